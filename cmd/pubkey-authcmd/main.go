@@ -0,0 +1,316 @@
+// The pubkey-authcmd tool is an sshd AuthorizedKeysCommand that prints the collected keys of the
+// GitHub login mapped to a local user. It only reads: either a compact export
+// (pubkey-db -export FILE -format compact), which is replaced atomically and so is safe to read while
+// it is being refreshed, or a database that no collector currently has open.
+//
+// With a database it prints every authentication key of the login:
+//
+//	AuthorizedKeysCommand /usr/local/bin/pubkey-authcmd -db /var/lib/pubkey-collector/keys.db -map /etc/ssh/github-users %u
+//
+// A compact export stores fingerprints rather than keys, so sshd must also pass the offered key, which
+// is printed back if the login owns it:
+//
+//	AuthorizedKeysCommand /usr/local/bin/pubkey-authcmd -compact /var/lib/pubkey-collector/keys.idx -map /etc/ssh/github-users %u %t %k
+//
+// Local users are mapped to GitHub logins by a -map file, or by -login, such as -login %u for the
+// login of the same name (written -login %%u in sshd_config, which expands %u itself). Anyone can
+// register any free GitHub login, so -login never maps uid 0 or a system account below -min-uid;
+// list those in -map to allow them.
+//
+// Keys go to stdout in authorized_keys format. An unmapped user or a key the login does not own prints
+// nothing and exits 0. If the source cannot be read, -fail closed prints nothing and exits 1, while
+// -fail open accepts the offered key (%t %k) of any user listed in the -map file. A database locked by
+// a collector and a source that doesn't answer within -timeout always fail closed: both happen in
+// normal operation, so failing open on them would accept any key whenever the collector runs or the
+// disk is slow. Nothing is written to stderr unless -debug is set.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	osuser "os/user"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/compactdb"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// config is the parsed command line, with the functions run calls to read the system
+type config struct {
+	dbPath      string
+	compactPath string
+	loginFormat string
+	mapFile     string
+	minUID      int
+	maxAge      time.Duration
+	timeout     time.Duration
+	failOpen    bool
+
+	// readKeys returns the keys to print for a login; readSource if nil
+	readKeys func(cfg config, login, offered string) ([]string, error)
+	// lookupUID returns the uid of a local user; localUID if nil
+	lookupUID func(user string) (int, error)
+}
+
+func main() {
+	cfg := config{}
+	flag.StringVar(&cfg.dbPath, "db", "", "BadgerDB database location, opened read-only")
+	flag.StringVar(&cfg.compactPath, "compact", "", "Compact export to read instead of a database; needs the offered key (%t %k)")
+	flag.StringVar(&cfg.loginFormat, "login", "", "GitHub login for a local user, with %u replaced by the user name, such as %u; never applied to uid 0 or below -min-uid")
+	flag.StringVar(&cfg.mapFile, "map", "", "File of 'localuser githublogin' lines, used instead of -login; users not listed are denied")
+	flag.IntVar(&cfg.minUID, "min-uid", 1000, "Lowest uid -login maps; system accounts below it, and root, must be listed in -map")
+	flag.DurationVar(&cfg.maxAge, "max-age", 0, "Ignore keys last seen longer ago than this (0 means no limit)")
+	flag.DurationVar(&cfg.timeout, "timeout", 2*time.Second, "Give up and apply -fail after this long")
+	fail := flag.String("fail", "closed", "When the keys cannot be read: closed (deny) or open (accept the offered key)")
+	debug := flag.Bool("debug", false, "Log diagnostics to stderr")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -db DIR|-compact FILE [flags] USER [KEYTYPE KEY]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if !*debug {
+		log.SetOutput(io.Discard)
+	}
+	switch *fail {
+	case "closed":
+	case "open":
+		cfg.failOpen = true
+	default:
+		log.Printf("Unknown -fail mode %q", *fail)
+		os.Exit(2)
+	}
+	if err := cfg.check(flag.NArg()); err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+
+	user := flag.Arg(0)
+	offered := ""
+	if flag.NArg() == 3 {
+		offered = flag.Arg(1) + " " + flag.Arg(2)
+	}
+	os.Exit(run(cfg, user, offered, os.Stdout))
+}
+
+// check validates the flags given nargs positional arguments
+func (cfg config) check(nargs int) error {
+	if (cfg.dbPath == "") == (cfg.compactPath == "") || (nargs != 1 && nargs != 3) {
+		return errors.New("need exactly one of -db or -compact, a user, and optionally the offered key type and key")
+	}
+	if cfg.compactPath != "" && nargs != 3 {
+		return errors.New("-compact needs the offered key type and key (%t %k)")
+	}
+	if cfg.mapFile == "" && cfg.loginFormat == "" {
+		return errors.New("need -map or -login to map local users to GitHub logins")
+	}
+	if cfg.failOpen && cfg.mapFile == "" {
+		// Otherwise every local account, root included, would accept any key while the source is unreadable
+		return errors.New("-fail open needs a -map file listing the users it applies to")
+	}
+	return nil
+}
+
+// readSource returns the keys to print for login from the configured database or compact export
+func readSource(cfg config, login, offered string) ([]string, error) {
+	if cfg.compactPath != "" {
+		return compactKeys(cfg, login, offered)
+	}
+	return dbKeys(cfg, login, offered)
+}
+
+// run answers sshd for a local user and the offered key, if any, writing keys to w, and returns the
+// exit code
+func run(cfg config, user, offered string, w io.Writer) int {
+	login, err := mapLogin(cfg, user)
+	if err != nil {
+		log.Printf("Mapping %s failed: %v", user, err)
+		return 1
+	}
+	if login == "" {
+		log.Printf("%s is not mapped to a GitHub login", user)
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+	read := cfg.readKeys
+	if read == nil {
+		read = readSource
+	}
+	keys, err := withDeadline(ctx, func() ([]string, error) {
+		return read(cfg, login, offered)
+	})
+	if err != nil {
+		log.Printf("Reading keys for %s (%s) failed: %v", user, login, err)
+		if !cfg.failOpen || errors.Is(err, keydb.ErrLocked) || errors.Is(err, context.DeadlineExceeded) {
+			return 1
+		}
+		if offered != "" {
+			log.Printf("Failing open: accepting the offered key for %s", user)
+			keys = []string{offered}
+		}
+	} else {
+		log.Printf("%d keys for %s (%s)", len(keys), user, login)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, k := range keys {
+		fmt.Fprintln(bw, k)
+	}
+	if err := bw.Flush(); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// mapLogin returns the GitHub login for a local user, or "" if the user has none
+func mapLogin(cfg config, user string) (string, error) {
+	if cfg.mapFile == "" {
+		return formatLogin(cfg, user), nil
+	}
+	f, err := os.Open(cfg.mapFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == user {
+			return fields[1], nil
+		}
+	}
+	return "", s.Err()
+}
+
+// formatLogin returns the -login for a local user, or "" for root, a system account or a user
+// whose uid can't be found
+func formatLogin(cfg config, user string) string {
+	lookup := cfg.lookupUID
+	if lookup == nil {
+		lookup = localUID
+	}
+	uid, err := lookup(user)
+	if err != nil {
+		log.Printf("Looking up the uid of %s failed: %v", user, err)
+		return ""
+	}
+	if uid == 0 || uid < cfg.minUID {
+		log.Printf("%s has uid %d, below -min-uid %d; list it in -map to allow it", user, uid, cfg.minUID)
+		return ""
+	}
+	return strings.ReplaceAll(cfg.loginFormat, "%u", user)
+}
+
+// localUID returns the numeric uid of a local user
+func localUID(name string) (int, error) {
+	u, err := osuser.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// withDeadline runs fn, returning ctx's error if it has not finished by ctx's deadline. fn is left
+// running in that case; the process exits soon after.
+func withDeadline(ctx context.Context, fn func() ([]string, error)) ([]string, error) {
+	type result struct {
+		keys []string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		keys, err := fn()
+		done <- result{keys, err}
+	}()
+	select {
+	case r := <-done:
+		return r.keys, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// compactKeys returns the offered key if the compact export attributes it to login
+func compactKeys(cfg config, login, offered string) ([]string, error) {
+	db, err := compactdb.Open(cfg.compactPath)
+	if err != nil {
+		return nil, err
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(offered))
+	if err != nil {
+		// A key we cannot parse is not one we collected: deny rather than fail.
+		log.Printf("Offered key does not parse: %v", err)
+		return nil, nil
+	}
+	owner, lastSeen, ok := db.Lookup(ssh.FingerprintSHA256(pk))
+	if !ok || !strings.EqualFold(owner, login) || stale(cfg, lastSeen) {
+		return nil, nil
+	}
+	return []string{offered}, nil
+}
+
+// dbKeys returns login's usable authentication keys from the database, or just the offered key if
+// one was given
+func dbKeys(cfg config, login, offered string) ([]string, error) {
+	db, err := keydb.OpenReadOnly(cfg.dbPath)
+	if err != nil {
+		if errors.Is(err, keydb.ErrLocked) {
+			return nil, fmt.Errorf("%w (use a -compact export alongside a running collector)", err)
+		}
+		return nil, err
+	}
+	defer db.Close()
+
+	stored, err := db.UserKeys(login)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key, md := range stored {
+		if md.Purpose == keydb.PurposeSigning || stale(cfg, md.Timestamp) || unusable(md.Flags) {
+			continue
+		}
+		if offered != "" && !sameKey(key, offered) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// stale reports whether a key last seen at t is older than -max-age
+func stale(cfg config, t time.Time) bool {
+	return cfg.maxAge > 0 && time.Since(t) > cfg.maxAge
+}
+
+// unusable reports whether flags mark a key that must not be trusted for login: one on the
+// blocklist, or one that doesn't parse as what it claims to be
+func unusable(flags []string) bool {
+	return slices.Contains(flags, keydb.FlagBlocked) || slices.Contains(flags, keydb.FlagMalformed)
+}
+
+// sameKey reports whether two authorized_keys lines have the same type and blob
+func sameKey(a, b string) bool {
+	fa, fb := strings.Fields(a), strings.Fields(b)
+	return len(fa) >= 2 && len(fb) >= 2 && fa[0] == fb[0] && fa[1] == fb[1]
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/compactdb"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// testKey returns a distinct, valid ed25519 authorized_keys line for each n
+func testKey(t testing.TB, n int) string {
+	t.Helper()
+	seed := make([]byte, ed25519.SeedSize)
+	binary.BigEndian.PutUint64(seed, uint64(n)+1)
+	pub, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(seed).Public())
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
+
+// localUIDs is a lookupUID for a system with root, a system account and two people
+func localUIDs(user string) (int, error) {
+	uids := map[string]int{"root": 0, "daemon": 1, "ada": 1000, "grace": 1001}
+	uid, ok := uids[user]
+	if !ok {
+		return 0, osuser.UnknownUserError(user)
+	}
+	return uid, nil
+}
+
+// writeFile writes content to name in a temporary directory and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config
+		nargs   int
+		wantErr bool
+	}{
+		{name: "database", cfg: config{dbPath: "keys.db", loginFormat: "%u"}, nargs: 1},
+		{name: "database and offered key", cfg: config{dbPath: "keys.db", mapFile: "users"}, nargs: 3},
+		{name: "compact", cfg: config{compactPath: "keys.idx", loginFormat: "%u"}, nargs: 3},
+		{name: "no mapping", cfg: config{dbPath: "keys.db"}, nargs: 1, wantErr: true},
+		{name: "compact without the offered key", cfg: config{compactPath: "keys.idx"}, nargs: 1, wantErr: true},
+		{name: "no source", nargs: 1, wantErr: true},
+		{name: "two sources", cfg: config{dbPath: "keys.db", compactPath: "keys.idx"}, nargs: 3, wantErr: true},
+		{name: "half an offered key", cfg: config{dbPath: "keys.db"}, nargs: 2, wantErr: true},
+		{name: "fail open with a map", cfg: config{dbPath: "keys.db", mapFile: "users", failOpen: true}, nargs: 3},
+		{name: "fail open for every user", cfg: config{dbPath: "keys.db", failOpen: true}, nargs: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.check(tt.nargs); (err != nil) != tt.wantErr {
+				t.Errorf("check(%d) = %v, want error: %v", tt.nargs, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMapLogin(t *testing.T) {
+	users := writeFile(t, "users", "# local github\nroot  ada\n\nbob grace extra\n  carol   Linus  \n")
+	tests := []struct {
+		name    string
+		cfg     config
+		user    string
+		want    string
+		wantErr bool
+	}{
+		{name: "same name", cfg: config{loginFormat: "%u", minUID: 1000}, user: "ada", want: "ada"},
+		{name: "format", cfg: config{loginFormat: "%u-corp", minUID: 1000}, user: "ada", want: "ada-corp"},
+		{name: "root by name", cfg: config{loginFormat: "%u", minUID: 1000}, user: "root"},
+		{name: "root without a uid floor", cfg: config{loginFormat: "%u"}, user: "root"},
+		{name: "system account", cfg: config{loginFormat: "%u", minUID: 1000}, user: "daemon"},
+		{name: "system account above a lower floor", cfg: config{loginFormat: "%u", minUID: 1}, user: "daemon", want: "daemon"},
+		{name: "no such local user", cfg: config{loginFormat: "%u", minUID: 1000}, user: "linus"},
+		{name: "real root", cfg: config{loginFormat: "%u", minUID: 1000, lookupUID: localUID}, user: "root"},
+		{name: "listed", cfg: config{mapFile: users}, user: "root", want: "ada"},
+		{name: "surrounding space", cfg: config{mapFile: users}, user: "carol", want: "Linus"},
+		{name: "malformed line", cfg: config{mapFile: users}, user: "bob"},
+		{name: "not listed", cfg: config{mapFile: users, loginFormat: "%u"}, user: "ada"},
+		{name: "comment", cfg: config{mapFile: users}, user: "#"},
+		{name: "missing map", cfg: config{mapFile: filepath.Join(t.TempDir(), "users")}, user: "root", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.cfg.lookupUID == nil {
+				tt.cfg.lookupUID = localUIDs
+			}
+			got, err := mapLogin(tt.cfg, tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mapLogin error = %v, want error: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("mapLogin(%s) = %q, want %q", tt.user, got, tt.want)
+			}
+		})
+	}
+}
+
+// newKeyDB writes a database for ada with one key of each kind and returns its path and keys
+func newKeyDB(t *testing.T) (string, map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := keydb.New(dir)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	keys := map[string]string{
+		"usable":   testKey(t, 1),
+		"rejected": testKey(t, 2),
+		"signing":  testKey(t, 3),
+		"blocked":  testKey(t, 4),
+		"stale":    testKey(t, 5),
+		// An ed25519 blob declared as RSA
+		"malformed": "ssh-rsa " + strings.Fields(testKey(t, 6))[1],
+	}
+	store := func(info collect.UserInfo, at time.Time) {
+		t.Helper()
+		if err := db.Store(info, "ada", at); err != nil && !errors.Is(err, keydb.ErrKeyTooLarge) {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	store(collect.UserInfo{Username: "ada", PublicKeys: []string{keys["usable"], keys["blocked"], keys["malformed"]}, SigningKeys: []string{keys["signing"]}}, now)
+	// Stored alongside a key too large to keep, so it carries FlagKeyRejected
+	store(collect.UserInfo{Username: "ada", PublicKeys: []string{keys["rejected"], "ssh-rsa " + strings.Repeat("A", 20000)}}, now)
+	store(collect.UserInfo{Username: "ada", PublicKeys: []string{keys["stale"]}}, now.Add(-30*24*time.Hour))
+	fp, err := keydb.Fingerprint(keys["blocked"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Block(fp, "test", "leaked"); err != nil {
+		t.Fatalf("Block: %v", err)
+	}
+	return dir, keys
+}
+
+func TestRunDatabase(t *testing.T) {
+	dir, keys := newKeyDB(t)
+	users := writeFile(t, "users", "root ada\n")
+	usable := []string{keys["usable"], keys["rejected"]}
+	tests := []struct {
+		name     string
+		cfg      config
+		user     string
+		offered  string
+		wantCode int
+		want     []string
+	}{
+		{name: "all usable keys", cfg: config{loginFormat: "%u", maxAge: 7 * 24 * time.Hour}, user: "ada", want: usable},
+		{name: "no age limit", cfg: config{loginFormat: "%u"}, user: "ada", want: append(append([]string{}, usable...), keys["stale"])},
+		{name: "mapped user", cfg: config{mapFile: users}, user: "root", offered: keys["usable"], want: []string{keys["usable"]}},
+		{name: "unmapped user", cfg: config{mapFile: users}, user: "ada"},
+		// Whoever registers the GitHub login a format produces must not get into root or system accounts
+		{name: "root never mapped by -login", cfg: config{loginFormat: "ada", minUID: 1000}, user: "root", offered: keys["usable"]},
+		{name: "system account never mapped by -login", cfg: config{loginFormat: "ada", minUID: 1000}, user: "daemon", offered: keys["usable"]},
+		{name: "offered key of another kind", cfg: config{loginFormat: "%u"}, user: "ada", offered: keys["signing"]},
+		{name: "offered blocked key", cfg: config{loginFormat: "%u"}, user: "ada", offered: keys["blocked"]},
+		{name: "offered stale key", cfg: config{loginFormat: "%u", maxAge: time.Hour}, user: "ada", offered: keys["stale"]},
+		{name: "login without keys", cfg: config{loginFormat: "%u"}, user: "grace"},
+		{name: "missing database fails closed", cfg: config{loginFormat: "%u", dbPath: filepath.Join(t.TempDir(), "none")},
+			user: "ada", offered: keys["usable"], wantCode: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.timeout = 10 * time.Second
+			tt.cfg.lookupUID = localUIDs
+			if tt.cfg.dbPath == "" {
+				tt.cfg.dbPath = dir
+			}
+			var out bytes.Buffer
+			if code := run(tt.cfg, tt.user, tt.offered, &out); code != tt.wantCode {
+				t.Errorf("run() = %d, want %d", code, tt.wantCode)
+			}
+			want := slices.Sorted(slices.Values(tt.want))
+			if got := strings.TrimSpace(out.String()); got != strings.Join(want, "\n") {
+				t.Errorf("printed %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRunFailOpen(t *testing.T) {
+	users := writeFile(t, "users", "root ada\n")
+	offered := testKey(t, 1)
+	corrupt := writeFile(t, "keys.idx", "not a compact export")
+
+	// A database a collector has open, as it is mid-update
+	locked := t.TempDir()
+	db, err := keydb.New(locked)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		name     string
+		cfg      config
+		user     string
+		slow     bool
+		wantCode int
+		wantKey  bool
+	}{
+		{name: "unreadable source, closed", cfg: config{compactPath: corrupt, mapFile: users}, user: "root", wantCode: 1},
+		{name: "unreadable source, open", cfg: config{compactPath: corrupt, mapFile: users, failOpen: true}, user: "root", wantKey: true},
+		{name: "unreadable source, open, unmapped user", cfg: config{compactPath: corrupt, mapFile: users, failOpen: true}, user: "ada"},
+		{name: "locked database, closed", cfg: config{dbPath: locked, mapFile: users}, user: "root", wantCode: 1},
+		{name: "locked database, open", cfg: config{dbPath: locked, mapFile: users, failOpen: true}, user: "root", wantCode: 1},
+		{name: "timeout, closed", cfg: config{compactPath: corrupt, mapFile: users}, user: "root", slow: true, wantCode: 1},
+		{name: "timeout, open", cfg: config{compactPath: corrupt, mapFile: users, failOpen: true}, user: "root", slow: true, wantCode: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.timeout = 10 * time.Second
+			if tt.slow {
+				tt.cfg.timeout = 10 * time.Millisecond
+				release := make(chan struct{})
+				defer close(release)
+				tt.cfg.readKeys = func(config, string, string) ([]string, error) {
+					<-release
+					return nil, nil
+				}
+			}
+			var out bytes.Buffer
+			if code := run(tt.cfg, tt.user, offered, &out); code != tt.wantCode {
+				t.Errorf("run() = %d, want %d", code, tt.wantCode)
+			}
+			if got := strings.TrimSpace(out.String()) == offered; got != tt.wantKey {
+				t.Errorf("printed %q, want the offered key: %v", out.String(), tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestRunCompact(t *testing.T) {
+	now := time.Now()
+	var entries []compactdb.Entry
+	for i, e := range []struct {
+		login string
+		age   time.Duration
+	}{{"ada", time.Hour}, {"Grace", time.Hour}, {"ada", 30 * 24 * time.Hour}} {
+		fp, err := keydb.Fingerprint(testKey(t, i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, compactdb.Entry{Fingerprint: fp, Login: e.login, LastSeen: now.Add(-e.age)})
+	}
+	var buf bytes.Buffer
+	if err := compactdb.Write(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	path := writeFile(t, "keys.idx", buf.String())
+
+	tests := []struct {
+		name    string
+		user    string
+		offered string
+		want    bool
+	}{
+		{name: "owned key", user: "ada", offered: testKey(t, 1) + " ada@laptop", want: true},
+		{name: "login case is ignored", user: "grace", offered: testKey(t, 2), want: true},
+		{name: "another login's key", user: "ada", offered: testKey(t, 2)},
+		{name: "stale key", user: "ada", offered: testKey(t, 3)},
+		{name: "unknown key", user: "ada", offered: testKey(t, 4)},
+		{name: "unparsable key", user: "ada", offered: "ssh-ed25519 AAAA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config{compactPath: path, loginFormat: "%u", lookupUID: localUIDs, maxAge: 7 * 24 * time.Hour, timeout: 10 * time.Second}
+			var out bytes.Buffer
+			if code := run(cfg, tt.user, tt.offered, &out); code != 0 {
+				t.Errorf("run() = %d, want 0", code)
+			}
+			if got := strings.TrimSpace(out.String()) == tt.offered; got != tt.want {
+				t.Errorf("printed %q, want the offered key: %v", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/lists"
+)
+
+// backfillPolicy is how the stream recovers from a coverage gap before it starts polling
+type backfillPolicy struct {
+	// gapAfter is how old the stream cursor may be before the events since are considered lost.
+	gapAfter time.Duration
+	// watchlist, if set, lists users refreshed first.
+	watchlist *lists.List
+	// org, if set, has its members refreshed after the watchlist, stalest first.
+	org string
+	// budget is the most users the backfill fetches.
+	budget int
+}
+
+// recoverGap checks whether the stream was last polled so long ago that events were missed and, if
+// so, runs the backfill policy and records the gap and what was covered in the run record. It only
+// returns errors that should stop collection; a failed backfill is recorded and streaming goes on.
+func (c *collector) recoverGap(ctx context.Context) error {
+	cursor, err := c.db.StreamCursor()
+	if err != nil {
+		log.Printf("Unable to read the stream cursor; not checking for a coverage gap: %v", err)
+		return nil
+	}
+	now := c.clock.Now()
+	if cursor == nil || now.Sub(cursor.Polled) < c.backfill.gapAfter {
+		return nil
+	}
+
+	gap := &keydb.StreamGap{Since: cursor.Polled, Detected: now, Org: c.backfill.org}
+	log.Printf("COVERAGE GAP: the event stream was last polled %s ago (%s); events since then have expired", now.Sub(cursor.Polled).Round(time.Minute), cursor.Polled.Format(time.RFC3339))
+	c.run.count("stream_gaps")
+
+	src := &collect.BackfillSource{Collector: c.fetcher, Client: c.client, Org: c.backfill.org, Budget: c.backfill.budget}
+	if c.backfill.watchlist != nil {
+		src.Watchlist = c.backfill.watchlist.Entries()
+	}
+	if src.Org != "" {
+		if src.LastCollected, err = c.db.LastCollected(ctx); err != nil {
+			log.Printf("Unable to read when users were last collected; backfilling %s in listing order: %v", src.Org, err)
+		}
+	}
+	if len(src.Watchlist) == 0 && src.Org == "" {
+		log.Printf("No -watchlist or -backfill-org to backfill from; resuming the stream with the gap unfilled")
+	} else {
+		plan := fmt.Sprintf("%d on the watchlist", len(src.Watchlist))
+		if src.Org != "" {
+			plan += ", then " + src.Org + " members stalest first"
+		}
+		log.Printf("Backfilling up to %d users: %s", src.Budget, plan)
+		err = c.runSource(ctx, src)
+	}
+
+	gap.Watchlist, gap.Members, gap.Deferred = src.Coverage.Watchlist, src.Coverage.Members, src.Coverage.Deferred
+	if e := src.Coverage.Enumeration; e != nil {
+		gap.Enumeration = e.String()
+	}
+	c.run.add("backfill_watchlist", gap.Watchlist)
+	c.run.add("backfill_members", gap.Members)
+	c.run.add("backfill_deferred", gap.Deferred)
+	if err != nil {
+		gap.Error = err.Error()
+	}
+	c.run.setGap(gap)
+	log.Printf("Backfill covered %d watchlist users and %d org members; %d deferred by the budget", gap.Watchlist, gap.Members, gap.Deferred)
+
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case errors.Is(err, keydb.ErrNoSpace):
+		return err
+	}
+	c.run.fail(fmt.Errorf("backfill: %w", err))
+	log.Printf("Backfill failed: %v. Resuming the stream.", err)
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"log"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// cloneOnUSR1 is unsupported without SIGUSR1; use pubkey-db -clone-snapshot while the collector is stopped
+func cloneOnUSR1(db *keydb.KeyDB, dir string) {
+	log.Printf("-clone-dir needs SIGUSR1, which this platform lacks; ignoring it")
+}
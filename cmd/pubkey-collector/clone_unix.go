@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// cloneOnUSR1 copies the database to a new timestamped directory under dir whenever the process
+// receives SIGUSR1. Collection continues while the copy is written.
+func cloneOnUSR1(db *keydb.KeyDB, dir string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			dest := filepath.Join(dir, time.Now().UTC().Format("20060102T150405Z"))
+			info, err := db.CloneSnapshot(dest)
+			if err != nil {
+				log.Printf("Failed to clone database to %s: %v", dest, err)
+				continue
+			}
+			log.Printf("Cloned database to %s as of sequence %d", dest, info.Sequence)
+		}
+	}()
+}
@@ -3,117 +3,758 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/go-github/v45/github"
 	"golang.org/x/oauth2"
 
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
 	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/identity"
 	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/lists"
+	"github.com/tstromberg/pubkey-collector/pkg/ratebudget"
+	"github.com/tstromberg/pubkey-collector/pkg/traffic"
 )
 
 func main() {
-	githubToken := os.Getenv("GITHUB_TOKEN")
-	if githubToken == "" {
-		log.Fatal("GITHUB_TOKEN environment variable must be set")
+	// Mask tokens in everything logged from here on
+	redact := &redactor{w: os.Stderr}
+	log.SetOutput(redact)
+
+	if len(os.Args) > 1 && os.Args[1] == "quickstart" {
+		if err := quickstart(os.Args[2:], redact, nil); err != nil {
+			log.Fatalf("Quickstart failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		if err := simulateRun(os.Args[2:]); err != nil {
+			log.Fatalf("Simulation failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "trace" {
+		if err := trace(os.Args[2:], redact); err != nil {
+			log.Fatalf("Trace failed: %v", err)
+		}
+		return
 	}
 
 	// Define and parse flags
 	streamFlag := flag.Bool("stream", false, "Gather active users from GitHub events steam (loops infinitely)")
 	orgFlag := flag.String("org", "", "GitHub organization to gather keys from")
+	exposureFlag := flag.String("exposure", "", "Collect everyone who could push to this owner/repo (collaborators, recent committers, org admins) and record their roles for pubkey-report -exposure")
+	exposureSince := flag.Duration("exposure-since", 90*24*time.Hour, "With -exposure, how far back to take committers from")
+	usersFlag := flag.String("users", "", "Comma-separated GitHub users to collect keys for")
+	publicMode := flag.Bool("public-mode", false, "Run without a token: only fetch .keys for -users, at most one request every 2s")
+	keysInterval := flag.Duration("keys-interval", 0, "Minimum time between .keys requests (at least 2s in -public-mode)")
+	sourceFlag := flag.String("source", "", "Comma-separated registered sources to run. Available: "+strings.Join(collect.RegisteredNames(), ", "))
 	dbPath := flag.String("db", "", "BadgerDB database location")
+	fingerprintsFlag := flag.String("fingerprints", "", "Comma-separated fingerprint algorithms to index in addition to SHA256 and MD5. Available: "+strings.Join(keydb.FingerprintAlgorithms(), ", "))
+	dbProfile := flag.String("db-profile", "balanced", "Database tuning profile: balanced, bulk-load, read-heavy or low-memory")
+	captureDir := flag.String("capture-dir", "", "Save a gzipped copy of each events page here for replay with pubkey-db -replay")
+	captureKeep := flag.Int("capture-keep", 10000, "Maximum number of captured events pages to retain")
+	jsonDir := flag.String("json-dir", "", "Also write each collected user to a JSON file in this directory")
+	recordSkips := flag.Bool("record-skips", false, "Record why users were skipped so pubkey-db -why can explain them")
+	signingFlag := flag.Bool("signing-keys", false, "Also collect SSH signing keys via the GitHub API (one API request per user)")
+	tokenFile := flag.String("token-file", "", "Read the GitHub token from this file (re-read on SIGHUP); overrides GITHUB_TOKEN_FILE and GITHUB_TOKEN")
+	useGH := flag.Bool("use-gh-cli", false, "Use the token from 'gh auth token'; overrides all other token settings")
+	instanceFlag := flag.String("instance", "", "Collector instance ID recorded with every write (default: hostname)")
+	minFreeMB := flag.Uint64("min-free-mb", 256, "Refuse to start with less than this much free disk space (MB)")
+	pauseFreeMB := flag.Uint64("pause-free-mb", 512, "Pause collection while free disk space is below this (MB)")
+	keyUsage := flag.Bool("key-usage", false, "With -org, record when each member's SSH keys were last used (needs an org owner token and SAML SSO)")
+	storeRetry := flag.Duration("store-retry", 2*time.Minute, "How long to keep retrying writes while the database is temporarily unwritable")
+	storeBuffer := flag.Int("store-buffer", 10000, "Maximum observations held in memory for write retries; the oldest are dropped beyond this, and 0 disables retries")
+	keysVia := flag.String("keys-via", collect.KeysViaScrape, "How to fetch keys: scrape (github.com/USER.keys), api (users/USER/keys, counts against the rate limit), or auto (switch to the API if a proxy blocks github.com)")
+	workers := flag.Int("workers", 1, "Number of users whose keys are fetched concurrently (.keys pacing still applies)")
+	estimate := flag.Bool("estimate", false, "Print the API requests and time the requested collection would take, then exit without collecting")
+	rateBudgetFile := flag.String("rate-budget", "", "Lease file shared with other collectors using the same token, to split its API quota between them")
+	blocklistFile := flag.String("blocklist", "", "File or https:// URL of blocked key fingerprints, one per line (re-read on SIGHUP and every -list-refresh); matching keys are flagged and alerted on")
+	listRefresh := flag.Duration("list-refresh", 15*time.Minute, "How often to re-read -blocklist (0 to only re-read on SIGHUP)")
+	listCache := flag.String("list-cache", defaultListCache(), "Directory caching the last good copy of remote lists, used when a fetch fails")
+	listPubKey := flag.String("list-pubkey", "", "Base64 Ed25519 public key that must have signed remote lists (signature at URL.sig)")
+	streamGap := flag.Duration("stream-gap", 30*time.Minute, "With -stream, treat a stream last polled longer ago than this as a coverage gap and backfill before streaming")
+	watchlistFile := flag.String("watchlist", "", "File or https:// URL of GitHub users, one per line, refreshed first when backfilling a stream coverage gap")
+	backfillOrg := flag.String("backfill-org", "", "Organization whose members, stalest first, are refreshed after the watchlist when backfilling a stream coverage gap")
+	identityMap := flag.String("identity-map", "", "File or https:// URL of login,employee_id,email lines linking collected users to corporate identities (refreshed every -list-refresh)")
+	identityCmd := flag.String("identity-cmd", "", "Command run with a login as its last argument, printing {\"employee_id\":...,\"email\":...} or nothing, to link collected users to corporate identities")
+	identityTTL := flag.Duration("identity-ttl", 24*time.Hour, "How long a user's identity link is reused before -identity-map or -identity-cmd is asked again")
+	cloneDir := flag.String("clone-dir", "", "On SIGUSR1, write a consistent copy of the database to a new directory here, for reports that must not slow collection")
+	sharedKeysThreshold := flag.Int("shared-keys-threshold", collect.DefaultSharedKeysThreshold, "Quarantine users served identical keys with this many other users within -shared-keys-window, as a misbehaving cache would (0 to disable)")
+	sharedKeysWindow := flag.Duration("shared-keys-window", collect.DefaultSharedKeysWindow, "Window in which identical keys served for -shared-keys-threshold users are quarantined")
+	backfillBudget := flag.Int("backfill-budget", 1000, "Most users fetched when backfilling a stream coverage gap (one keys request each)")
+	maxPerHour := flag.Int(traffic.CeilingFlag, traffic.DefaultCeiling, "Most HTTP requests of any kind this process makes in any hour, whatever the other pacing flags allow")
+	trafficRetention := flag.Duration("traffic-retention", defaultTrafficRetention, "How long the log of outbound requests behind pubkey-db -traffic-report is kept")
 	flag.Parse()
 
 	// Validate flags - must specify dbPath
-	if *dbPath == "" {
+	if *dbPath == "" && !*estimate {
 		log.Fatal("--db flag must be specified")
 	}
+	if *jsonDir != "" {
+		if err := os.MkdirAll(*jsonDir, 0o700); err != nil {
+			log.Fatalf("Failed to create JSON directory: %v", err)
+		}
+	}
+
+	if *storeBuffer < 0 {
+		log.Fatal("-store-buffer must not be negative")
+	}
+	if *maxPerHour <= 0 {
+		log.Fatalf("-%s must be positive", traffic.CeilingFlag)
+	}
+	// The ring buffer holds up to an hour of requests, far more than are made between saves
+	rec := traffic.NewRecorder(*maxPerHour, *maxPerHour)
+	fetchOpts := collect.Options{
+		Workers:             *workers,
+		KeysInterval:        *keysInterval,
+		PublicMode:          *publicMode,
+		KeysVia:             *keysVia,
+		RoundTripper:        rec.Transport(nil),
+		SharedKeysThreshold: *sharedKeysThreshold,
+		SharedKeysWindow:    *sharedKeysWindow,
+	}
+	var ts oauth2.TokenSource
+	if *publicMode {
+		if *streamFlag || *orgFlag != "" || *exposureFlag != "" || *signingFlag || *keysVia == collect.KeysViaAPI {
+			log.Fatal("-public-mode only supports -users; -stream, -org, -exposure, -signing-keys and -keys-via api need the GitHub API")
+		}
+	} else {
+		var err error
+		ts, err = tokenSource(*useGH, *tokenFile, redact)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *estimate {
+		users := 0
+		if *usersFlag != "" {
+			users = len(strings.Split(*usersFlag, ","))
+		}
+		client := newClient(ts, nil, nil, rec)
+		fetchOpts.Client = client
+		fetcher, err := collect.New(fetchOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := printEstimate(context.Background(), client, fetcher, *orgFlag, users, *streamFlag, *signingFlag, *keyUsage, *keysVia == collect.KeysViaAPI); err != nil {
+			log.Fatalf("Estimate failed: %v", err)
+		}
+		return
+	}
+
+	if err := os.MkdirAll(*dbPath, 0o700); err != nil {
+		log.Fatalf("Failed to create database directory: %v", err)
+	}
+	if free, err := keydb.FreeSpace(*dbPath); err != nil {
+		log.Printf("Unable to check free disk space: %v", err)
+	} else if free < *minFreeMB<<20 {
+		log.Fatalf("Only %d MB free for %s; refusing to start below %d MB", free>>20, *dbPath, *minFreeMB)
+	}
 
 	// Initialize database
-	db, err := keydb.New(*dbPath)
+	profile, err := keydb.ParseProfile(*dbProfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := keydb.NewWithProfile(*dbPath, profile)
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
 	defer db.Close()
 
+	prov := keydb.Provenance{Instance: instanceID(*instanceFlag), RunID: keydb.NewRunID()}
+	db.SetProvenance(prov)
+	if *fingerprintsFlag != "" {
+		if err := db.SetFingerprints(strings.Split(*fingerprintsFlag, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("Collector instance %s, run %s", prov.Instance, prov.RunID)
+
+	config := keydb.RunConfig(flag.CommandLine)
+	listOpts := lists.Options{CacheDir: *listCache, Client: &http.Client{Timeout: 30 * time.Second, Transport: rec.Transport(nil)}}
+	if *listPubKey != "" {
+		key, err := base64.StdEncoding.DecodeString(*listPubKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			log.Fatalf("-list-pubkey is not a base64 Ed25519 public key")
+		}
+		listOpts.PublicKey = key
+	}
+	if *blocklistFile != "" {
+		bl, err := keydb.OpenBlocklist(*blocklistFile, listOpts)
+		if err != nil {
+			log.Fatalf("Failed to load blocklist: %v", err)
+		}
+		log.Printf("Loaded %d blocked fingerprints from %s (version %s)", bl.Len(), *blocklistFile, bl.List().Version())
+		config["blocklist_version"] = bl.List().Version()
+		db.SetBlocklist(bl)
+		reloadBlocklistOnHUP(bl, *blocklistFile)
+		if *listRefresh > 0 {
+			go bl.List().Watch(context.Background(), *listRefresh)
+		}
+	}
+
+	backfill := backfillPolicy{gapAfter: *streamGap, org: *backfillOrg, budget: *backfillBudget}
+	if *watchlistFile != "" {
+		backfill.watchlist, err = lists.Open(*watchlistFile, listOpts)
+		if err != nil {
+			log.Fatalf("Failed to load watchlist: %v", err)
+		}
+		config["watchlist_version"] = backfill.watchlist.Version()
+	}
+
+	if *cloneDir != "" {
+		cloneOnUSR1(db, *cloneDir)
+	}
+	migrateOnUSR2(db)
+
+	var resolver identity.Resolver
+	switch {
+	case *identityMap != "" && *identityCmd != "":
+		log.Fatal("Use at most one of -identity-map and -identity-cmd")
+	case *identityMap != "":
+		m, err := identity.OpenMap(*identityMap, listOpts)
+		if err != nil {
+			log.Fatalf("Failed to load identity map: %v", err)
+		}
+		config["identity_map_version"] = m.List().Version()
+		if *listRefresh > 0 {
+			go m.List().Watch(context.Background(), *listRefresh)
+		}
+		resolver = m
+	case *identityCmd != "":
+		resolver = identity.NewCommand(*identityCmd)
+	}
+
 	// GitHub client setup
-	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: githubToken})
-	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
+	// Interrupts cancel in-flight fetches and sleeps; the run is then recorded and the database closed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var budget *ratebudget.Budget
+	if *rateBudgetFile != "" && ts != nil {
+		budget, err = ratebudget.Open(*rateBudgetFile, prov.Instance+"/"+prov.RunID)
+		if err != nil {
+			log.Printf("Rate budget %s unavailable, continuing without coordination: %v", *rateBudgetFile, err)
+		} else {
+			defer budget.Close()
+		}
+	}
+	client := newClient(ts, nil, budget, rec)
+	var apiClient *github.Client
+	if ts != nil {
+		apiClient = client
+	}
+	fetchOpts.Client = apiClient
+	fetcher, err := collect.New(fetchOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *publicMode {
+		log.Printf("PUBLIC MODE: unauthenticated, limited to one .keys request every %s.", fetcher.KeysInterval())
+		log.Printf("Respect GitHub's Acceptable Use Policies: https://docs.github.com/site-policy/acceptable-use-policies")
+	}
+
+	c := &collector{
+		clock:       clock.Real,
+		client:      client,
+		fetcher:     fetcher,
+		db:          db,
+		jsonDir:     *jsonDir,
+		captureDir:  *captureDir,
+		captureKeep: *captureKeep,
+		pauseFree:   *pauseFreeMB << 20,
+		signingKeys: *signingFlag,
+		recordSkips: *recordSkips,
+		spill:       keydb.NewSpill(db, *storeBuffer, *storeRetry),
+		backfill:    backfill,
+		identities:  resolver,
+		identityTTL: *identityTTL,
+		traffic:     rec,
+		retention:   *trafficRetention,
+	}
+	go c.saveTrafficEvery(ctx, trafficSaveInterval)
+	c.run = newRunTracker(ctx, db, fetcher, client, prov, runMode(*streamFlag, *orgFlag, *exposureFlag, *usersFlag, *sourceFlag), os.Args[1:], config, c.clock.Now())
+
+	if *usersFlag != "" {
+		if err := c.runSource(ctx, &collect.UsersSource{Collector: fetcher, Usernames: strings.Split(*usersFlag, ",")}); err != nil {
+			c.shutdown(err)
+		}
+	}
 
 	if *orgFlag != "" {
-		processOrgMembers(ctx, client, *orgFlag, db)
+		if err := c.processOrgMembers(ctx, *orgFlag); err != nil {
+			c.shutdown(err)
+		}
+		if *keyUsage {
+			if err := c.recordKeyUsage(ctx, *orgFlag); err != nil {
+				c.shutdown(err)
+			}
+		}
+	}
+
+	if *exposureFlag != "" {
+		if err := c.processExposure(ctx, *exposureFlag, c.clock.Now().Add(-*exposureSince)); err != nil {
+			c.shutdown(err)
+		}
+	}
+
+	if *sourceFlag != "" {
+		for _, name := range strings.Split(*sourceFlag, ",") {
+			src := collect.Registered(strings.TrimSpace(name))
+			if src == nil {
+				c.shutdown(fmt.Errorf("unknown source %q", name))
+			}
+			log.Printf("Collecting from source %s...", src.Name())
+			if err := c.runSource(ctx, src); err != nil {
+				c.shutdown(fmt.Errorf("source %s: %w", src.Name(), err))
+			}
+		}
 	}
 
 	if *streamFlag {
-		processStream(ctx, client, db)
+		if err := c.processStream(ctx); err != nil {
+			c.shutdown(err)
+		}
+	}
+	c.saveTraffic()
+	c.run.finish(ctx, client, c.clock.Now())
+}
+
+// defaultListCache returns the directory caching remote lists under the user's cache directory.
+func defaultListCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "pubkey-collector", "lists")
+}
+
+// newClient returns a GitHub client authenticated by ts, or an unauthenticated one if ts is nil.
+// ts is asked for a token on every request, so a token reloaded by a fileTokenSource is used at once.
+// Authenticated requests take their share of the token's quota from budget, if it is not nil.
+// Every request is recorded and held to the ceiling by rec, if it is not nil. Requests are sent over
+// base, or http.DefaultTransport if it is nil.
+func newClient(ts oauth2.TokenSource, base http.RoundTripper, budget *ratebudget.Budget, rec *traffic.Recorder) *github.Client {
+	hc := &http.Client{Transport: base}
+	if ts != nil {
+		// Not oauth2.NewClient: its ReuseTokenSource would cache a token with no expiry forever
+		hc.Transport = &oauth2.Transport{Source: ts, Base: base}
+	}
+	if rec != nil {
+		hc.Transport = rec.Transport(hc.Transport)
 	}
+	if budget != nil && ts != nil {
+		hc.Transport = budget.Transport(hc.Transport)
+	}
+	return github.NewClient(hc)
 }
 
-// processStream continuously collects user data from the GitHub event stream.
-func processStream(ctx context.Context, client *github.Client, db *keydb.KeyDB) {
+// printEstimate prints the predicted cost of collecting the given org, users and events page under the current quota.
+func printEstimate(ctx context.Context, client *github.Client, fetcher *collect.Collector, org string, users int, stream, signingKeys, keyUsage, keysViaAPI bool) error {
+	if org != "" {
+		n, err := collect.OrgMemberCount(ctx, client, org)
+		if err != nil {
+			return err
+		}
+		users += n
+	}
+	if stream {
+		// An events page of 100 yields at most 100 actors
+		users += 100
+	}
+
+	e := collect.EstimateCost(collect.CostOptions{
+		Users:        users,
+		Org:          org != "",
+		Events:       stream,
+		SigningKeys:  signingKeys,
+		KeyUsage:     keyUsage && org != "",
+		KeysViaAPI:   keysViaAPI,
+		KeysInterval: fetcher.KeysInterval(),
+		Workers:      fetcher.Workers(),
+	})
+	if limits, _, err := client.RateLimits(ctx); err == nil && limits.GetCore() != nil {
+		core := limits.GetCore()
+		e.ApplyQuota(core.Remaining, core.Limit, core.Reset.Time, time.Now())
+	} else {
+		log.Printf("Unable to check rate limit: %v", err)
+	}
+
+	fmt.Println(e)
+	if stream {
+		fmt.Println("The stream runs until stopped; this is the cost of one events page.")
+	}
+	return nil
+}
+
+// runMode names the collection modes enabled for this run, for its run record.
+func runMode(stream bool, org, exposure, users, sources string) string {
+	var modes []string
+	if users != "" {
+		modes = append(modes, "users")
+	}
+	if org != "" {
+		modes = append(modes, "org")
+	}
+	if exposure != "" {
+		modes = append(modes, "exposure")
+	}
+	if sources != "" {
+		modes = append(modes, "source:"+sources)
+	}
+	if stream {
+		modes = append(modes, "stream")
+	}
+	return strings.Join(modes, ",")
+}
+
+// instanceID returns the configured instance ID, falling back to the hostname.
+func instanceID(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// drainSpill waits for writes held for retry to land or be given up on, recording any given up on.
+func (c *collector) drainSpill() {
+	for {
+		pending, err := c.spill.Flush()
+		if err != nil {
+			log.Printf("Abandoning %d held writes: %v", pending, err)
+			break
+		}
+		if pending == 0 {
+			break
+		}
+		log.Printf("Waiting for %d held writes to be stored...", pending)
+		time.Sleep(5 * time.Second)
+	}
+	if n := c.spill.Dropped(); n > 0 {
+		c.run.fail(fmt.Errorf("dropped %d observations that could not be stored", n))
+	}
+}
+
+// shutdown records the failed run, then closes the database and exits. An interrupt is not a failure.
+func (c *collector) shutdown(err error) {
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Interrupted; stopping")
+		c.drainSpill()
+		c.saveTraffic()
+		c.run.finish(context.Background(), c.client, c.clock.Now())
+		if cerr := c.db.Close(); cerr != nil {
+			log.Printf("Failed to close database: %v", cerr)
+		}
+		os.Exit(130)
+	}
+	c.drainSpill()
+	c.saveTraffic()
+	c.run.fail(err)
+	c.run.finish(context.Background(), c.client, c.clock.Now())
+	shutdown(c.db, err)
+}
+
+// shutdown closes the database cleanly before exiting on a fatal error.
+func shutdown(db *keydb.KeyDB, err error) {
+	log.Printf("Stopping: %v", err)
+	if cerr := db.Close(); cerr != nil {
+		log.Printf("Failed to close database: %v", cerr)
+	}
+	os.Exit(1)
+}
+
+// collector holds the state shared by the collection modes.
+type collector struct {
+	clock       clock.Clock
+	client      *github.Client
+	fetcher     *collect.Collector
+	db          *keydb.KeyDB
+	jsonDir     string
+	captureDir  string
+	captureKeep int
+	pauseFree   uint64
+	// freeSpace and spacePoll default to keydb.FreeSpace and a minute; see waitForSpace
+	freeSpace   func(path string) (uint64, error)
+	spacePoll   time.Duration
+	signingKeys bool
+	recordSkips bool
+	spill       *keydb.Spill
+	run         *runTracker
+	backfill    backfillPolicy
+	identities  identity.Resolver
+	identityTTL time.Duration
+	// traffic, if set, records outbound requests, saved for retention; see saveTraffic
+	traffic   *traffic.Recorder
+	retention time.Duration
+	trafficMu sync.Mutex
+}
+
+// processStream continuously collects user data from the GitHub event stream, first backfilling
+// any coverage gap since the stream was last polled. It only returns once the database can no
+// longer be written to.
+func (c *collector) processStream(ctx context.Context) error {
+	if err := c.recoverGap(ctx); err != nil {
+		return err
+	}
+	it := &collect.EventUserIterator{
+		Collector:   c.fetcher,
+		Client:      c.client,
+		Cursor:      c.db,
+		CaptureDir:  c.captureDir,
+		CaptureKeep: c.captureKeep,
+		OnSkip:      c.recordSkip,
+	}
 	for {
-		if err := processStreamEvents(ctx, client, db); err != nil {
-			if strings.Contains(err.Error(), "rate limit") {
-				log.Println("Rate limit hit. Sleeping for 20 minutes.")
-				time.Sleep(20 * time.Minute)
-			} else {
-				log.Printf("Error processing events: %v. Retrying...", err)
-				time.Sleep(5 * time.Second)
+		if err := c.waitForSpace(ctx); err != nil {
+			return err
+		}
+		user, err := it.Next(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if errors.Is(err, keydb.ErrNoSpace) {
+				return err
 			}
+			c.run.fail(err)
+			log.Printf("Error processing events: %v. Retrying...", err)
 			continue
 		}
-		log.Printf("Resting before next events fetch...")
-		time.Sleep(1 * time.Second)
+		if err := c.storeInDB(ctx, user); err != nil {
+			return err
+		}
+		if it.Buffered() == 0 {
+			c.run.save()
+		}
 	}
 }
 
 // processOrgMembers collects and saves public keys for all members of an organization.
-func processOrgMembers(ctx context.Context, client *github.Client, org string, db *keydb.KeyDB) {
+func (c *collector) processOrgMembers(ctx context.Context, org string) error {
 	log.Printf("Listing members of %s...", org)
 
-	users, err := collect.OrgMembers(ctx, client, org)
-	if err != nil {
-		log.Fatalf("Failed to list org members: %v", err)
+	src := &collect.OrgSource{Collector: c.fetcher, Client: c.client, Org: org}
+	err := c.runSource(ctx, src)
+	if src.Enumeration != nil {
+		log.Printf("Summary for %s: %s", org, src.Enumeration)
 	}
+	return err
+}
+
+// processExposure collects everyone who could push to repo and records their roles.
+func (c *collector) processExposure(ctx context.Context, repo string, since time.Time) error {
+	log.Printf("Listing users who could push to %s...", repo)
 
-	for _, user := range users {
-		storeInDB(user, db)
+	src := &collect.ExposureSource{Collector: c.fetcher, Client: c.client, Repo: repo, Since: since}
+	if err := c.runSource(ctx, src); err != nil {
+		return err
+	}
+	for _, l := range src.Limitations {
+		log.Printf("Exposure of %s is partial: %s", repo, l)
 	}
+	log.Printf("Recording %d users who could push to %s", len(src.Roles), repo)
+	return c.db.PutExposure(&keydb.ExposureRecord{Repo: repo, Roles: src.Roles, Limitations: src.Limitations})
 }
 
-// processStreamEvents collects and saves public keys for users from the GitHub event stream.
-func processStreamEvents(ctx context.Context, client *github.Client, db *keydb.KeyDB) error {
-	users, err := collect.RecentEvents(ctx, client)
+// recordKeyUsage stores when each of an organization's SSO-authorized SSH keys was last used.
+func (c *collector) recordKeyUsage(ctx context.Context, org string) error {
+	usage, err := collect.KeyLastUsed(ctx, c.client, org)
+	if err != nil {
+		return err
+	}
+	n, err := c.db.RecordKeyUsage(usage, "credential-authorizations:"+org)
 	if err != nil {
 		return err
 	}
+	log.Printf("Recorded last use for %d of %d SSO-authorized keys in %s", n, len(usage), org)
+	return nil
+}
+
+// runSource collects from src, storing each user it produces.
+func (c *collector) runSource(ctx context.Context, src collect.Source) error {
+	return src.Collect(ctx, &sourceSink{c: c, source: src.Name()})
+}
+
+// sourceSink feeds the users produced by one source into the collector.
+type sourceSink struct {
+	c      *collector
+	source string
+}
 
-	log.Printf("Processing %d users from events...", len(users))
-	for _, user := range users {
-		storeInDB(user, db)
+// Add stores a collected user, tagging it with the source that produced it.
+func (s *sourceSink) Add(ctx context.Context, user *collect.UserInfo) error {
+	if user.Source == "" {
+		user.Source = s.source
 	}
+	if err := s.c.waitForSpace(ctx); err != nil {
+		return err
+	}
+	return s.c.storeInDB(ctx, user)
+}
 
-	return nil
+// Skip records a user the source decided not to collect.
+func (s *sourceSink) Skip(_ context.Context, skip collect.Skip) error {
+	return s.c.recordSkip(skip)
+}
+
+// waitForSpace blocks while free disk space is below the pause threshold, returning ctx's error if
+// ctx is done first.
+func (c *collector) waitForSpace(ctx context.Context) error {
+	freeSpace, poll := c.freeSpace, c.spacePoll
+	if freeSpace == nil {
+		freeSpace = keydb.FreeSpace
+	}
+	if poll == 0 {
+		poll = time.Minute
+	}
+	for {
+		// The database may have moved since startup; see migrateOnUSR2
+		path := c.db.Path()
+		free, err := freeSpace(path)
+		if err != nil || free >= c.pauseFree {
+			return nil
+		}
+		log.Printf("ALERT: only %d MB free for %s, below %d MB. Collection paused.", free>>20, path, c.pauseFree>>20)
+		t := time.NewTimer(poll)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
 }
 
 // storeInDB stores a user's public key information in the BadgerDB.
-func storeInDB(userInfo *collect.UserInfo, db *keydb.KeyDB) {
+// Only errors that should stop collection, such as a full disk, are returned.
+func (c *collector) storeInDB(ctx context.Context, userInfo *collect.UserInfo) error {
 	username := userInfo.Username
 	if username == "" {
 		log.Printf("Cannot determine username, skipping")
-		return
+		return nil
+	}
+
+	// Signing keys are only meaningful for users that came from GitHub
+	if c.signingKeys && strings.HasPrefix(userInfo.Source, "github") {
+		if err := collect.AddSigningKeys(ctx, c.client, userInfo); err != nil {
+			c.run.fail(err)
+			log.Printf("Failed to fetch signing keys for %s: %v", username, err)
+		}
 	}
 
-	log.Printf("Storing %s from %s (%d keys) to database...", username, userInfo.Repo, len(userInfo.PublicKeys))
+	// Repeated keys would inflate counts; sorting keeps JSON output stable
+	_, removed := collect.DedupeKeys(userInfo)
+	c.run.add("keys_deduped", removed)
+
+	if c.jsonDir != "" {
+		if err := collect.WriteJSON(c.jsonDir, userInfo); err != nil {
+			log.Printf("Failed to write JSON for %s: %v", username, err)
+		}
+	}
+
+	if skip := collect.SkipFor(userInfo); skip != nil {
+		log.Printf("Skipping %s: %s (%s)", username, skip.Reason, skip.Detail)
+		return c.recordSkip(*skip)
+	}
+
+	if userInfo.Quarantine != nil {
+		if err := c.db.Quarantine(*userInfo); err != nil {
+			if errors.Is(err, keydb.ErrNoSpace) {
+				return err
+			}
+			c.run.fail(err)
+			log.Printf("Failed to quarantine %s: %v", username, err)
+		}
+		return nil
+	}
+
+	log.Printf("Storing %s from %s (%d keys, %d signing keys) to database...", username, userInfo.Repo, len(userInfo.PublicKeys), len(userInfo.SigningKeys))
 
 	// Store the user info in the database
-	if err := db.Store(*userInfo, username, time.Now()); err != nil {
-		log.Printf("Failed to store user info for %s: %v", username, err)
+	fetched := userInfo.FetchedAt
+	if fetched.IsZero() {
+		fetched = c.clock.Now()
+	}
+	if err := c.spill.Store(*userInfo, username, fetched); err != nil {
+		if errors.Is(err, keydb.ErrNoSpace) {
+			return err
+		}
+		c.run.fail(err)
+		// An oversized key is rejected on its own; the user's other keys were stored
+		if !errors.Is(err, keydb.ErrKeyTooLarge) {
+			log.Printf("Failed to store user info for %s: %v", username, err)
+			return nil
+		}
+		log.Printf("Stored %s without a rejected key: %v", username, err)
+	}
+	c.run.count("users_stored")
+	c.linkIdentity(ctx, username)
+	return nil
+}
+
+// linkIdentity links a stored user to their corporate identity, if a resolver is configured and
+// the user's link is older than the identity TTL.
+func (c *collector) linkIdentity(ctx context.Context, username string) {
+	if c.identities == nil {
+		return
 	}
+	stats, err := identity.Link(ctx, c.db, c.identities, []string{username}, c.identityTTL)
+	if err != nil && ctx.Err() == nil {
+		c.run.fail(err)
+		log.Printf("Failed to record identity of %s: %v", username, err)
+	}
+	c.run.add("identities_linked", stats.Linked)
+	c.run.add("identities_unlinked", stats.Unlinked)
+	c.run.add("identity_errors", stats.Failed)
+}
+
+// recordSkip stores the reason a user was skipped, if skip recording is enabled.
+func (c *collector) recordSkip(skip collect.Skip) error {
+	c.run.count("skipped_" + string(skip.Reason))
+	if !c.recordSkips {
+		return nil
+	}
+	if err := c.db.StoreSkip(skip, c.clock.Now()); err != nil {
+		if errors.Is(err, keydb.ErrNoSpace) {
+			return err
+		}
+		c.run.fail(err)
+		log.Printf("Failed to record skip for %s: %v", skip.Username, err)
+	}
+	return nil
+}
+
+// reloadBlocklistOnHUP re-reads the blocklist file whenever the process receives SIGHUP.
+func reloadBlocklistOnHUP(bl *keydb.Blocklist, path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := bl.Reload(); err != nil {
+				log.Printf("Keeping previous blocklist; reload failed: %v", err)
+				continue
+			}
+			log.Printf("Reloaded %d blocked fingerprints from %s (version %s)", bl.Len(), path, bl.List().Version())
+		}
+	}()
 }
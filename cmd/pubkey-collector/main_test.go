@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// newTestDB opens a database in a temporary directory, closed when the test ends
+func newTestDB(t *testing.T) *keydb.KeyDB {
+	t.Helper()
+	db, err := keydb.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestWaitForSpace(t *testing.T) {
+	const floor = 100 << 20
+	tests := []struct {
+		name string
+		// free is what each check reports, the last repeating
+		free []uint64
+		err  error
+		// cancelAfter, if set, cancels the context this long into an hour-long pause
+		cancelAfter time.Duration
+		wantCalls   int
+		wantErr     error
+	}{
+		{name: "enough space", free: []uint64{floor}, wantCalls: 1},
+		{name: "paused until space is freed", free: []uint64{1 << 20, floor - 1, 50 << 20, floor + 1}, wantCalls: 4},
+		{name: "unknown free space does not pause", free: []uint64{0}, err: errors.New("statfs failed"), wantCalls: 1},
+		{name: "cancelled while paused", free: []uint64{1 << 20}, cancelAfter: 20 * time.Millisecond, wantCalls: 1, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var calls atomic.Int32
+			c := &collector{db: db, pauseFree: floor, spacePoll: time.Millisecond,
+				freeSpace: func(path string) (uint64, error) {
+					if path != db.Path() {
+						t.Errorf("checked %s, want the database path %s", path, db.Path())
+					}
+					n := int(calls.Add(1))
+					return tt.free[min(n-1, len(tt.free)-1)], tt.err
+				}}
+			if tt.cancelAfter > 0 {
+				c.spacePoll = time.Hour
+				time.AfterFunc(tt.cancelAfter, cancel)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- c.waitForSpace(ctx)
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("waitForSpace() = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("still paused after %d checks", calls.Load())
+			}
+			if n := int(calls.Load()); n != tt.wantCalls {
+				t.Errorf("checked free space %d times, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestStoreInDBOversizedKey(t *testing.T) {
+	db := newTestDB(t)
+	c := &collector{clock: clock.Real, db: db, spill: keydb.NewSpill(db, 10, time.Minute), run: &runTracker{db: db}}
+	pub, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	huge := "ssh-rsa " + strings.Repeat("A", 100<<10)
+
+	user := &collect.UserInfo{Username: "ada", Source: "github-org", PublicKeys: []string{good, huge}}
+	if err := c.storeInDB(context.Background(), user); err != nil {
+		t.Fatalf("storeInDB: %v", err)
+	}
+	keys, err := db.UserKeys("ada")
+	if err != nil || len(keys) != 1 {
+		t.Errorf("UserKeys(ada) = %d keys, %v; want the 1 that fit", len(keys), err)
+	}
+	counts := c.run.counts.Snapshot()
+	if counts["users_stored"] != 1 || counts["errors"] != 1 {
+		t.Errorf("counts = %v, want 1 user stored and 1 error", counts)
+	}
+}
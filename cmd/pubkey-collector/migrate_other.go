@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "github.com/tstromberg/pubkey-collector/pkg/keydb"
+
+// migrateOnUSR2 is unsupported without SIGUSR2; use pubkey-db -migrate-path while the collector is stopped
+func migrateOnUSR2(db *keydb.KeyDB) {}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// migrateOnUSR2 moves the database wherever pubkey-db -migrate-path asks, whenever the process
+// receives SIGUSR2. Collection continues during the copy and pauses briefly for the switch.
+func migrateOnUSR2(db *keydb.KeyDB) {
+	if err := db.AcceptMigrations(); err != nil {
+		log.Printf("Failed to accept migration requests: %v", err)
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	go func() {
+		for range ch {
+			req, err := db.ServeMigration()
+			if err != nil && req != nil && req.Info != nil {
+				log.Printf("Migrated database to %s, but: %v", req.Info.To, err)
+				continue
+			}
+			if err != nil {
+				log.Printf("Failed to migrate database: %v", err)
+				continue
+			}
+			if req == nil {
+				continue
+			}
+			log.Printf("Migrated database from %s to %s (%s paused); restart with -db %s", req.Info.From, req.Info.To, req.Info.Paused, req.Info.To)
+		}
+	}()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/traffic"
+)
+
+const (
+	// demoOrg is a small organization with public members, collected by quickstart -demo.
+	demoOrg = "octokit"
+	// quickstartInterval paces .keys requests conservatively for first-time users.
+	quickstartInterval = time.Second
+	// quickstartExamples is how many example lookups quickstart prints.
+	quickstartExamples = 3
+)
+
+// quickstart collects one organization into a database at a default location with conservative
+// settings, then shows example lookups and the commands to run next. Re-running it refreshes the
+// same database. Requests are sent over base, or http.DefaultTransport if it is nil.
+func quickstart(args []string, redact *redactor, base http.RoundTripper) error {
+	fs := flag.NewFlagSet("quickstart", flag.ExitOnError)
+	org := fs.String("org", "", "GitHub organization to collect")
+	demo := fs.Bool("demo", false, "Collect the small public "+demoOrg+" organization")
+	dbPath := fs.String("db", defaultDBPath(), "BadgerDB database location")
+	tokenFile := fs.String("token-file", "", "Read the GitHub token from this file instead of GITHUB_TOKEN")
+	useGH := fs.Bool("use-gh-cli", false, "Use the token from 'gh auth token'")
+	fs.Parse(args)
+
+	if *demo && *org == "" {
+		*org = demoOrg
+	}
+	if *org == "" {
+		return fmt.Errorf("quickstart needs -org ORG or -demo")
+	}
+	ts, err := tokenSource(*useGH, *tokenFile, redact)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*dbPath, 0o700); err != nil {
+		return fmt.Errorf("create database directory: %w", err)
+	}
+	db, err := keydb.New(*dbPath)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer db.Close()
+
+	prov := keydb.Provenance{Instance: instanceID(""), RunID: keydb.NewRunID()}
+	db.SetProvenance(prov)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// quickstart paces itself far below the ceiling, but its requests are logged like any run's
+	rec := traffic.NewRecorder(traffic.DefaultCeiling, traffic.DefaultCeiling)
+	client := newClient(ts, base, nil, rec)
+	fetcher, err := collect.New(collect.Options{
+		KeysInterval:        quickstartInterval,
+		RoundTripper:        rec.Transport(base),
+		Progress:            progressBar,
+		SharedKeysThreshold: collect.DefaultSharedKeysThreshold,
+		SharedKeysWindow:    collect.DefaultSharedKeysWindow,
+	})
+	if err != nil {
+		return err
+	}
+
+	c := &collector{
+		clock:     clock.Real,
+		client:    client,
+		fetcher:   fetcher,
+		db:        db,
+		pauseFree: 512 << 20,
+		spill:     keydb.NewSpill(db, 10000, 2*time.Minute),
+		traffic:   rec,
+		retention: defaultTrafficRetention,
+	}
+	c.run = newRunTracker(ctx, db, fetcher, client, prov, "quickstart,org", append([]string{"quickstart"}, args...), keydb.RunConfig(fs), c.clock.Now())
+
+	fmt.Printf("Collecting the members of %s into %s, one request per second...\n", *org, *dbPath)
+	err = c.processOrgMembers(ctx, *org)
+	fmt.Println()
+	c.drainSpill()
+	c.saveTraffic()
+	if err != nil {
+		c.run.fail(err)
+	}
+	c.run.finish(context.Background(), client, c.clock.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := printExamples(db, *dbPath, *org); err != nil {
+		return err
+	}
+	fmt.Printf(`
+Next steps:
+  pubkey-collector -db %[1]s -org %[2]s -signing-keys   # Refresh, adding SSH signing keys
+  pubkey-db -db %[1]s -export ./%[2]s-keys -org %[2]s     # Export one JSON file per user for Git
+  pubkey-report -db %[1]s -coverage -org %[2]s          # Share of recent committers with keys
+  pubkey-db -db %[1]s -why LOGIN                          # Explain what is known about a user
+`, *dbPath, *org)
+	return nil
+}
+
+// defaultDBPath returns the quickstart database location under the user's data directory.
+func defaultDBPath() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "pubkey-collector.db"
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "pubkey-collector", "keys.db")
+}
+
+// progressBar redraws a one-line progress bar on stdout.
+func progressBar(done, total int) {
+	const width = 40
+	filled := width * done / max(total, 1)
+	fmt.Printf("\r[%s%s] %d/%d users", strings.Repeat("#", filled), strings.Repeat(" ", width-filled), done, total)
+}
+
+// printExamples looks up a few of the org's collected keys by fingerprint, as pubkey-lookup would.
+func printExamples(db *keydb.KeyDB, dbPath, org string) error {
+	var fps []string
+	errEnough := fmt.Errorf("enough examples")
+	err := db.ForEachKey(context.Background(), func(rec keydb.KeyRecord) error {
+		if strings.EqualFold(rec.Repo, org) && rec.Fingerprint != "" {
+			fps = append(fps, rec.Fingerprint)
+		}
+		if len(fps) == quickstartExamples {
+			return errEnough
+		}
+		return nil
+	})
+	if err != nil && err != errEnough {
+		return err
+	}
+	if len(fps) == 0 {
+		log.Printf("No keys collected for %s: its members may be private or have no SSH keys", org)
+		return nil
+	}
+
+	fmt.Println("Example lookups:")
+	for _, fp := range fps {
+		md, err := db.Lookup(fp)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  $ pubkey-lookup -db %s %s\n    %s (%s, last seen %s)\n", dbPath, fp, md.User, md.KeyType, md.Timestamp.Format("2006-01-02"))
+	}
+	return nil
+}
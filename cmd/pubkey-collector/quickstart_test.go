@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/simulate"
+)
+
+func TestQuickstart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("paces requests a second apart")
+	}
+	t.Setenv("GITHUB_TOKEN", "test-token")
+	t.Setenv("GITHUB_TOKEN_FILE", "")
+	p := simulate.Profile{Name: "quickstart", Org: "sim-quickstart", Members: 3, MaxKeys: 3, Seed: 7}
+	server := simulate.NewServer(p)
+	dir := t.TempDir()
+	redact := &redactor{w: &bytes.Buffer{}}
+
+	if err := quickstart([]string{"-db", dir}, redact, server); err == nil {
+		t.Fatal("quickstart without -org or -demo succeeded")
+	}
+
+	// Re-running refreshes the same database, changing nothing
+	for run := 1; run <= 2; run++ {
+		if err := quickstart([]string{"-org", p.Org, "-db", dir}, redact, server); err != nil {
+			t.Fatalf("run %d: quickstart: %v", run, err)
+		}
+		if got, want := server.Stats()["requests_keys_scrape"], run*p.Members; got != want {
+			t.Errorf("run %d: %d .keys requests in all, want %d", run, got, want)
+		}
+	}
+
+	db, err := keydb.New(dir)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+	stored := map[string][]string{}
+	err = db.ForEachUser(context.Background(), func(u keydb.UserRecord) error {
+		for _, k := range u.Keys {
+			stored[u.Login] = append(stored[u.Login], k.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != p.Members {
+		t.Errorf("stored %d users, want %d", len(stored), p.Members)
+	}
+	for i := 0; i < p.Members; i++ {
+		login := server.Login(i)
+		got, want := stored[strings.ToLower(login)], server.Keys(login)
+		slices.Sort(got)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: stored %q, served %q", login, got, want)
+		}
+	}
+
+	runs, err := db.Runs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("%d runs recorded, want 2", len(runs))
+	}
+	for _, r := range runs {
+		if r.Mode != "quickstart,org" || r.End == nil || len(r.Errors) != 0 {
+			t.Errorf("run %s: mode %q, ended %v, errors %q", r.ID, r.Mode, r.End != nil, r.Errors)
+		}
+		if r.Counts["users_stored"] != p.Members {
+			t.Errorf("run %s stored %d users, want %d", r.ID, r.Counts["users_stored"], p.Members)
+		}
+	}
+	newKeys := []int{runs[0].Counts["keys_new"], runs[1].Counts["keys_new"]}
+	slices.Sort(newKeys)
+	if newKeys[0] != 0 || newKeys[1] == 0 {
+		t.Errorf("keys_new by run = %v, want some in the first and none in the second", newKeys)
+	}
+
+	// Every request went through the traffic recorder and was saved to the log
+	logs, err := db.TrafficLogs(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrapes := 0
+	for _, l := range logs {
+		for _, r := range l.Requests {
+			if r.Class == ":user.keys" {
+				scrapes++
+			}
+		}
+	}
+	if got, want := scrapes, server.Stats()["requests_keys_scrape"]; got != want {
+		t.Errorf("traffic log holds %d .keys requests, want the %d served", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/stats"
+)
+
+// runTracker accumulates the record of this invocation and persists it to the database.
+// Its counts are merged with the fetch and keydb counters each time it is saved.
+type runTracker struct {
+	db      *keydb.KeyDB
+	fetcher *collect.Collector
+	counts  stats.Counters
+
+	mu  sync.Mutex
+	rec keydb.RunRecord
+}
+
+// newRunTracker starts the record for a run and writes it, so that runs that never finish are still listed.
+func newRunTracker(ctx context.Context, db *keydb.KeyDB, fetcher *collect.Collector, client *github.Client, prov keydb.Provenance, mode string, args []string, config map[string]string, start time.Time) *runTracker {
+	r := &runTracker{db: db, fetcher: fetcher, rec: keydb.RunRecord{
+		ID:                prov.RunID,
+		Instance:          prov.Instance,
+		Mode:              mode,
+		ArgsHash:          keydb.HashArgs(args),
+		Start:             start,
+		APIRemainingStart: apiRemaining(ctx, client),
+		Config:            config,
+	}}
+	r.save()
+	return r
+}
+
+// count increments a named tally.
+func (r *runTracker) count(name string) {
+	r.counts.Inc(name)
+}
+
+// add adds n to a named tally.
+func (r *runTracker) add(name string, n int) {
+	r.counts.Add(name, int64(n))
+}
+
+// setGap records a stream coverage gap and its backfill.
+func (r *runTracker) setGap(gap *keydb.StreamGap) {
+	r.mu.Lock()
+	r.rec.Gap = gap
+	r.mu.Unlock()
+	r.save()
+}
+
+// fail records an error that didn't stop the run.
+func (r *runTracker) fail(err error) {
+	r.counts.Inc("errors")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.rec.Errors) < keydb.MaxRunErrors {
+		r.rec.Errors = append(r.rec.Errors, err.Error())
+	}
+}
+
+// finish stamps the end of the run and writes the final record.
+func (r *runTracker) finish(ctx context.Context, client *github.Client, end time.Time) {
+	r.mu.Lock()
+	r.rec.End = &end
+	r.rec.APIRemainingEnd = apiRemaining(ctx, client)
+	r.mu.Unlock()
+	r.save()
+}
+
+// save writes the current record to the database.
+func (r *runTracker) save() {
+	r.mu.Lock()
+	rec := r.rec
+	rec.Errors = append([]string(nil), r.rec.Errors...)
+	r.mu.Unlock()
+
+	rec.Counts = r.counts.Snapshot()
+	for _, counts := range []map[string]int{r.fetcher.Counts(), r.db.Counts()} {
+		for k, v := range counts {
+			rec.Counts[k] = v
+		}
+	}
+
+	if err := r.db.PutRun(&rec); err != nil {
+		log.Printf("Failed to save run record: %v", err)
+	}
+}
+
+// apiRemaining returns the remaining GitHub core API requests, or 0 if unknown. Checking is free.
+func apiRemaining(ctx context.Context, client *github.Client) int {
+	limits, _, err := client.RateLimits(ctx)
+	if err != nil || limits.GetCore() == nil {
+		return 0
+	}
+	return limits.GetCore().Remaining
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/simulate"
+)
+
+// simulateRun collects a simulated organization through the normal pipeline, against a fake GitHub
+// instead of the real one, then checks the database against what the fake served. It writes the same
+// run record and database a real org run would, and fails if any stored key is wrong.
+func simulateRun(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	profileName := fs.String("profile", "ci", "Simulation profile: "+strings.Join(simulate.ProfileNames(), ", "))
+	dbPath := fs.String("db", "", "BadgerDB database location; must be new or empty")
+	members := fs.Int("members", 0, "Override the profile's number of org members")
+	seed := fs.Int64("seed", 0, "Override the profile's seed; the same seed simulates the same GitHub")
+	errorRate := fs.Float64("error-rate", 0, "Override the profile's share of per-user requests failing with a 502")
+	listErrorRate := fs.Float64("list-error-rate", 0, "Share of org listing requests failing with a 502 (any failure ends the run)")
+	notFoundRate := fs.Float64("not-found-rate", 0, "Override the profile's share of members deleted before their keys are fetched")
+	latency := fs.Duration("latency", 0, "Override the profile's median request latency")
+	latencyP99 := fs.Duration("latency-p99", 0, "Override the profile's 99th percentile request latency")
+	rateLimit := fs.Int("rate-limit", 0, "Override the profile's API requests allowed per hour (0 for unlimited)")
+	workers := fs.Int("workers", 8, "Number of users whose keys are fetched concurrently")
+	keysVia := fs.String("keys-via", collect.KeysViaScrape, "How to fetch keys: scrape, api or auto")
+	signing := fs.Bool("signing-keys", false, "Also collect SSH signing keys via the API")
+	fs.Parse(args)
+
+	p, ok := simulate.Profiles[*profileName]
+	if !ok {
+		return fmt.Errorf("unknown profile %q: want one of %s", *profileName, strings.Join(simulate.ProfileNames(), ", "))
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "members":
+			p.Members = *members
+		case "seed":
+			p.Seed = *seed
+		case "error-rate":
+			p.ErrorRate = *errorRate
+		case "list-error-rate":
+			p.ListErrorRate = *listErrorRate
+		case "not-found-rate":
+			p.NotFoundRate = *notFoundRate
+		case "latency":
+			p.LatencyMedian = *latency
+		case "latency-p99":
+			p.LatencyP99 = *latencyP99
+		case "rate-limit":
+			p.RateLimit, p.RateWindow = *rateLimit, time.Hour
+		}
+	})
+	if *dbPath == "" {
+		return fmt.Errorf("simulate needs -db DIR")
+	}
+	if entries, err := os.ReadDir(*dbPath); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty; simulations need a database of their own", *dbPath)
+	}
+
+	db, err := keydb.New(*dbPath)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer db.Close()
+
+	prov := keydb.Provenance{Instance: "simulate-" + p.Name, RunID: keydb.NewRunID()}
+	db.SetProvenance(prov)
+	server := simulate.NewServer(p)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	client := github.NewClient(&http.Client{Transport: server})
+	fetcher, err := collect.New(collect.Options{
+		Workers:             *workers,
+		KeysVia:             *keysVia,
+		Client:              client,
+		RoundTripper:        server,
+		SharedKeysThreshold: collect.DefaultSharedKeysThreshold,
+		SharedKeysWindow:    collect.DefaultSharedKeysWindow,
+	})
+	if err != nil {
+		return err
+	}
+
+	c := &collector{
+		clock:       clock.Real,
+		client:      client,
+		fetcher:     fetcher,
+		db:          db,
+		signingKeys: *signing,
+		recordSkips: true,
+		spill:       keydb.NewSpill(db, 10000, 2*time.Minute),
+	}
+	c.run = newRunTracker(ctx, db, fetcher, client, prov, "simulate,org", append([]string{"simulate"}, args...), keydb.RunConfig(fs), c.clock.Now())
+
+	fmt.Printf("Simulating %s: %d members of %s, seed %d, %d workers, keys via %s\n", p.Name, p.Members, p.Org, p.Seed, fetcher.Workers(), *keysVia)
+	start := time.Now()
+	err = c.processOrgMembers(ctx, p.Org)
+	c.drainSpill()
+	if err != nil {
+		c.run.fail(err)
+	}
+	c.run.finish(context.Background(), client, c.clock.Now())
+	elapsed := time.Since(start)
+	if err != nil {
+		return err
+	}
+
+	rec, err := db.Run(prov.RunID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Elapsed %s (%.1f users/s), run %s\n", elapsed.Round(time.Millisecond), float64(p.Members)/elapsed.Seconds(), prov.RunID)
+	fmt.Printf("Run counts:   %s\n", formatCounts(rec.Counts))
+	fmt.Printf("Server stats: %s\n", formatCounts(server.Stats()))
+
+	checked, wrong, err := checkSimulation(ctx, db, server, p.Members)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Checked %d stored users against the simulated GitHub: %d wrong\n", checked, len(wrong))
+	for _, w := range wrong {
+		fmt.Printf("  %s\n", w)
+	}
+	if len(wrong) > 0 {
+		return fmt.Errorf("%d users were stored with the wrong keys", len(wrong))
+	}
+	return nil
+}
+
+// checkSimulation compares every stored user's keys with the keys the server serves for them. Members
+// whose fetch failed may be missing, but nothing stored may differ from what the server served.
+// It returns how many members were checked and a description of each wrong one.
+func checkSimulation(ctx context.Context, db *keydb.KeyDB, server *simulate.Server, members int) (int, []string, error) {
+	stored := map[string][]string{}
+	err := db.ForEachUser(ctx, func(u keydb.UserRecord) error {
+		for _, k := range u.Keys {
+			stored[u.Login] = append(stored[u.Login], k.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	checked := 0
+	var wrong []string
+	for i := 0; i < members; i++ {
+		login := server.Login(i)
+		got := stored[strings.ToLower(login)]
+		delete(stored, strings.ToLower(login))
+		if got == nil {
+			continue
+		}
+		checked++
+		want := server.Keys(login)
+		sort.Strings(got)
+		sort.Strings(want)
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			wrong = append(wrong, fmt.Sprintf("%s: stored %d keys, served %d", login, len(got), len(want)))
+		}
+	}
+	for login := range stored {
+		wrong = append(wrong, login+": stored but not a member")
+	}
+	return checked, wrong, nil
+}
+
+// formatCounts returns counts as "name=n" pairs sorted by name
+func formatCounts(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	for n := range counts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = fmt.Sprintf("%s=%d", n, counts[n])
+	}
+	return strings.Join(pairs, " ")
+}
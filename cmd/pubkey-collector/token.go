@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenSource returns the GitHub token source to use. In order of precedence:
+//
+//  1. -use-gh-cli: the output of `gh auth token`
+//  2. -token-file: the contents of the file, re-read on SIGHUP
+//  3. GITHUB_TOKEN_FILE: same as -token-file
+//  4. GITHUB_TOKEN: the environment variable
+//
+// Every token handed out is registered with the log redactor.
+func tokenSource(useGH bool, tokenFile string, r *redactor) (oauth2.TokenSource, error) {
+	if useGH {
+		out, err := exec.Command("gh", "auth", "token").Output()
+		if err != nil {
+			return nil, fmt.Errorf("gh auth token failed: %w", err)
+		}
+		token := strings.TrimSpace(string(out))
+		if token == "" {
+			return nil, errors.New("gh auth token returned an empty token; run gh auth login")
+		}
+		r.add(token)
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}), nil
+	}
+
+	if tokenFile == "" {
+		tokenFile = os.Getenv("GITHUB_TOKEN_FILE")
+	}
+	if tokenFile != "" {
+		fs := &fileTokenSource{path: tokenFile, redact: r}
+		if err := fs.load(); err != nil {
+			return nil, err
+		}
+		fs.reloadOnHUP()
+		return fs, nil
+	}
+
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		return nil, errors.New("no GitHub token: set GITHUB_TOKEN or GITHUB_TOKEN_FILE, or use -token-file or -use-gh-cli")
+	}
+	r.add(token)
+	return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}), nil
+}
+
+// fileTokenSource serves a token read from a file, allowing rotation without a restart.
+type fileTokenSource struct {
+	path   string
+	redact *redactor
+
+	mu    sync.Mutex
+	token string
+}
+
+// Token returns the most recently loaded token.
+func (s *fileTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &oauth2.Token{AccessToken: s.token}, nil
+}
+
+// load reads the token file. The error never includes the file contents.
+func (s *fileTokenSource) load() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("read token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("token file %s is empty", s.path)
+	}
+
+	s.redact.add(token)
+	s.mu.Lock()
+	s.token = token
+	s.mu.Unlock()
+	return nil
+}
+
+// reloadOnHUP re-reads the token file whenever the process receives SIGHUP.
+func (s *fileTokenSource) reloadOnHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := s.load(); err != nil {
+				log.Printf("Keeping previous token; reload failed: %v", err)
+				continue
+			}
+			log.Printf("Reloaded GitHub token from %s", s.path)
+		}
+	}()
+}
+
+// redactor is a log writer that masks known secrets before they reach the output.
+type redactor struct {
+	w io.Writer
+
+	mu      sync.Mutex
+	secrets [][]byte
+}
+
+// add registers a secret to be masked.
+func (r *redactor) add(secret string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets = append(r.secrets, []byte(secret))
+}
+
+// Write masks any registered secrets in p before passing it on.
+func (r *redactor) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	out := p
+	for _, s := range r.secrets {
+		out = bytes.ReplaceAll(out, s, []byte("[REDACTED]"))
+	}
+	r.mu.Unlock()
+
+	if _, err := r.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
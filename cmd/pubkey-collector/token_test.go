@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestTokenSourcePrecedence(t *testing.T) {
+	dir := t.TempDir()
+	flagFile := filepath.Join(dir, "flag-token")
+	envFile := filepath.Join(dir, "env-token")
+	os.WriteFile(flagFile, []byte("from-flag-file\n"), 0o600)
+	os.WriteFile(envFile, []byte("from-env-file\n"), 0o600)
+
+	tests := []struct {
+		name      string
+		useGH     bool
+		tokenFile string
+		env       map[string]string
+		want      string
+		wantErr   bool
+	}{
+		{name: "environment", env: map[string]string{"GITHUB_TOKEN": "from-env"}, want: "from-env"},
+		{name: "GITHUB_TOKEN_FILE over GITHUB_TOKEN", env: map[string]string{"GITHUB_TOKEN": "from-env", "GITHUB_TOKEN_FILE": envFile}, want: "from-env-file"},
+		{name: "-token-file over GITHUB_TOKEN_FILE", tokenFile: flagFile, env: map[string]string{"GITHUB_TOKEN": "from-env", "GITHUB_TOKEN_FILE": envFile}, want: "from-flag-file"},
+		{name: "-use-gh-cli over everything", useGH: true, tokenFile: flagFile, env: map[string]string{"GITHUB_TOKEN": "from-env", "GITHUB_TOKEN_FILE": envFile}, want: "from-gh"},
+		{name: "no token", wantErr: true},
+		{name: "missing token file", tokenFile: filepath.Join(dir, "missing"), env: map[string]string{"GITHUB_TOKEN": "from-env"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.useGH {
+				fakeGH(t, "from-gh")
+			}
+			t.Setenv("GITHUB_TOKEN", "")
+			t.Setenv("GITHUB_TOKEN_FILE", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			r := &redactor{w: &bytes.Buffer{}}
+			ts, err := tokenSource(tt.useGH, tt.tokenFile, r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("tokenSource succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tokenSource: %v", err)
+			}
+			tok, err := ts.Token()
+			if err != nil || tok.AccessToken != tt.want {
+				t.Fatalf("Token() = %v, %v; want %s", tok, err, tt.want)
+			}
+			if len(r.secrets) != 1 || string(r.secrets[0]) != tt.want {
+				t.Errorf("redacted %q, want the token", r.secrets)
+			}
+		})
+	}
+}
+
+// fakeGH puts a gh command printing token first on PATH
+func fakeGH(t *testing.T, token string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake gh is a shell script")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho " + token + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "gh"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestReloadedTokenIsUsed(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(path, []byte("old-token"), 0o600)
+	ts := &fileTokenSource{path: path, redact: &redactor{w: &bytes.Buffer{}}}
+	if err := ts.load(); err != nil {
+		t.Fatal(err)
+	}
+	client := newClient(ts, nil, nil, nil)
+	get := func() {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL, nil)
+		resp, err := client.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	// What SIGHUP does
+	os.WriteFile(path, []byte("new-token"), 0o600)
+	if err := ts.load(); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	want := []string{"Bearer old-token", "Bearer new-token"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("requests were authorized with %q, want %q", got, want)
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	var out bytes.Buffer
+	r := &redactor{w: &out}
+	r.add("ghp_secret")
+	l := log.New(r, "", 0)
+	l.Printf("request failed: Authorization: token ghp_secret (ghp_secret)")
+	if strings.Contains(out.String(), "ghp_secret") {
+		t.Errorf("token logged: %q", out.String())
+	}
+	if !strings.Contains(out.String(), "[REDACTED]") {
+		t.Errorf("no redaction marker in %q", out.String())
+	}
+}
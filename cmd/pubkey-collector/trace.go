@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/traffic"
+)
+
+// traceReport is everything observed while collecting one user
+type traceReport struct {
+	User    string `json:"user"`
+	Applied bool   `json:"applied"`
+	// Events are HTTP exchanges and log lines, including every skip and flag decision, in order.
+	Events []traceEvent `json:"events"`
+	// Collected is the user as it reached the database, after signing keys and deduplication.
+	Collected *collect.UserInfo `json:"collected,omitempty"`
+	Keys      []traceKey        `json:"keys"`
+	// NotReturned are keys stored for the user that this collection did not return.
+	NotReturned []string `json:"not_returned,omitempty"`
+}
+
+// traceEvent is an HTTP exchange or a log line
+type traceEvent struct {
+	Time time.Time  `json:"time"`
+	HTTP *traceHTTP `json:"http,omitempty"`
+	Log  string     `json:"log,omitempty"`
+}
+
+// traceHTTP summarizes one HTTP request and its response
+type traceHTTP struct {
+	Method             string        `json:"method"`
+	URL                string        `json:"url"`
+	Status             int           `json:"status,omitempty"`
+	Server             string        `json:"server,omitempty"`
+	RateLimitRemaining string        `json:"rate_limit_remaining,omitempty"`
+	Duration           time.Duration `json:"duration"`
+	Error              string        `json:"error,omitempty"`
+}
+
+// traceKey is one key the database considered and the record it wrote or would write
+type traceKey struct {
+	Key         string          `json:"key"`
+	KeyType     string          `json:"key_type,omitempty"`
+	Fingerprint string          `json:"fingerprint,omitempty"`
+	Status      string          `json:"status"`
+	Existing    *keydb.Metadata `json:"existing,omitempty"`
+	Written     *keydb.Metadata `json:"written,omitempty"`
+	// Changes lists the fields that differ between Existing and Written.
+	Changes []string `json:"changes,omitempty"`
+}
+
+// tracer records a traceReport from the hooks of the normal collection pipeline
+type tracer struct {
+	mu     sync.Mutex
+	report traceReport
+}
+
+// Write records log output, one event per line.
+func (t *tracer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		t.report.Events = append(t.report.Events, traceEvent{Time: time.Now(), Log: line})
+	}
+	return len(p), nil
+}
+
+// roundTripper returns base wrapped to record each request; base defaults to http.DefaultTransport.
+func (t *tracer) roundTripper(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := base.RoundTrip(req)
+		h := &traceHTTP{Method: req.Method, URL: req.URL.Redacted(), Duration: time.Since(start)}
+		if err != nil {
+			h.Error = err.Error()
+		} else {
+			h.Status = resp.StatusCode
+			h.Server = resp.Header.Get("Server")
+			h.RateLimitRemaining = resp.Header.Get("X-RateLimit-Remaining")
+		}
+		t.mu.Lock()
+		t.report.Events = append(t.report.Events, traceEvent{Time: start, HTTP: h})
+		t.mu.Unlock()
+		return resp, err
+	})
+}
+
+// storeHook records a key considered by KeyDB.Store.
+func (t *tracer) storeHook(ev keydb.StoreEvent) {
+	k := traceKey{Key: ev.Key, Existing: ev.Existing, Written: ev.Written}
+	switch {
+	case ev.Written == nil:
+		k.Status = "unchanged"
+	case ev.Existing == nil:
+		k.Status = "new"
+	default:
+		k.Status = "changed"
+		k.Changes = metadataChanges(ev.Existing, ev.Written)
+	}
+	if md := k.Written; md != nil {
+		k.KeyType, k.Fingerprint = md.KeyType, md.Fingerprint
+	} else if md := k.Existing; md != nil {
+		k.KeyType, k.Fingerprint = md.KeyType, md.Fingerprint
+	}
+	t.mu.Lock()
+	t.report.Keys = append(t.report.Keys, k)
+	t.mu.Unlock()
+}
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// traceSink passes users to the collector's sink, remembering the last one
+type traceSink struct {
+	collect.Sink
+	t *tracer
+}
+
+// Add stores user as the collector would, then records it as stored.
+func (s *traceSink) Add(ctx context.Context, user *collect.UserInfo) error {
+	err := s.Sink.Add(ctx, user)
+	s.t.mu.Lock()
+	s.t.report.Collected = user
+	s.t.mu.Unlock()
+	return err
+}
+
+// trace collects one user through the normal pipeline, recording every request, decision and record
+// written, and prints the result. Nothing is written to the database unless -apply is set.
+func trace(args []string, redact *redactor) error {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	user := fs.String("user", "", "GitHub user to collect")
+	dbPath := fs.String("db", "", "BadgerDB database location")
+	apply := fs.Bool("apply", false, "Write the traced records to the database instead of discarding them")
+	jsonOut := fs.Bool("json", false, "Print the trace as JSON")
+	signing := fs.Bool("signing-keys", false, "Also collect SSH signing keys via the GitHub API")
+	keysVia := fs.String("keys-via", collect.KeysViaScrape, "How to fetch keys: scrape, api or auto")
+	tokenFile := fs.String("token-file", "", "Read the GitHub token from this file instead of GITHUB_TOKEN")
+	useGH := fs.Bool("use-gh-cli", false, "Use the token from 'gh auth token'")
+	fs.Parse(args)
+
+	if *user == "" || *dbPath == "" {
+		return fmt.Errorf("trace needs -user USER and -db DIR")
+	}
+	ts, err := tokenSource(*useGH, *tokenFile, redact)
+	if err != nil {
+		return err
+	}
+
+	db, err := keydb.New(*dbPath)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer db.Close()
+
+	t := &tracer{report: traceReport{User: *user, Applied: *apply}}
+	// Log lines become trace events; the redactor still masks the token in them
+	redact.w = t
+	defer func() { redact.w = os.Stderr }()
+
+	prov := keydb.Provenance{Instance: instanceID(""), RunID: keydb.NewRunID()}
+	db.SetProvenance(prov)
+	db.SetDryRun(!*apply)
+	db.SetStoreHook(t.storeHook)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// The recorder holds requests to the ceiling before the tracer times them
+	rec := traffic.NewRecorder(traffic.DefaultCeiling, traffic.DefaultCeiling)
+	client := newClient(ts, t.roundTripper(nil), nil, rec)
+	fetcher, err := collect.New(collect.Options{
+		KeysVia:             *keysVia,
+		Client:              client,
+		RoundTripper:        rec.Transport(t.roundTripper(nil)),
+		SharedKeysThreshold: collect.DefaultSharedKeysThreshold,
+		SharedKeysWindow:    collect.DefaultSharedKeysWindow,
+	})
+	if err != nil {
+		return err
+	}
+
+	c := &collector{
+		clock:       clock.Real,
+		client:      client,
+		fetcher:     fetcher,
+		db:          db,
+		signingKeys: *signing,
+		recordSkips: true,
+		spill:       keydb.NewSpill(db, 1, 0),
+		traffic:     rec,
+		retention:   defaultTrafficRetention,
+	}
+	c.run = newRunTracker(ctx, db, fetcher, client, prov, "trace", append([]string{"trace"}, args...), keydb.RunConfig(fs), c.clock.Now())
+	src := &collect.UsersSource{Collector: fetcher, Usernames: []string{*user}}
+	err = src.Collect(ctx, &traceSink{Sink: &sourceSink{c: c, source: src.Name()}, t: t})
+	c.saveTraffic()
+	if err != nil {
+		c.run.fail(err)
+	}
+	c.run.finish(context.Background(), client, c.clock.Now())
+	if err != nil {
+		return err
+	}
+
+	stored, err := db.UserKeys(*user)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seen := map[string]bool{}
+	for _, k := range t.report.Keys {
+		seen[k.Key] = true
+	}
+	for key := range stored {
+		if !seen[key] {
+			t.report.NotReturned = append(t.report.NotReturned, key)
+		}
+	}
+	sort.Strings(t.report.NotReturned)
+	sort.Slice(t.report.Keys, func(i, j int) bool { return t.report.Keys[i].Key < t.report.Keys[j].Key })
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t.report)
+	}
+	printTrace(os.Stdout, &t.report)
+	return nil
+}
+
+// metadataChanges lists the fields that differ between two records as "field: old -> new"
+func metadataChanges(before, after *keydb.Metadata) []string {
+	b, a := fieldMap(before), fieldMap(after)
+	var changes []string
+	for name := range mergedKeys(b, a) {
+		if !bytes.Equal(b[name], a[name]) {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, orNone(b[name]), orNone(a[name])))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// fieldMap returns the JSON encoding of each of md's fields
+func fieldMap(md *keydb.Metadata) map[string]json.RawMessage {
+	m := map[string]json.RawMessage{}
+	data, err := json.Marshal(md)
+	if err == nil {
+		json.Unmarshal(data, &m)
+	}
+	return m
+}
+
+// mergedKeys returns the union of the keys of a and b
+func mergedKeys(a, b map[string]json.RawMessage) map[string]bool {
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
+
+// orNone returns a JSON value as text, or "(none)" if it is absent
+func orNone(v json.RawMessage) string {
+	if v == nil {
+		return "(none)"
+	}
+	return string(v)
+}
+
+// printTrace writes a trace report as readable text
+func printTrace(w io.Writer, r *traceReport) {
+	mode := "dry run: nothing was written"
+	if r.Applied {
+		mode = "applied to the database"
+	}
+	fmt.Fprintf(w, "Trace of %s (%s)\n\nEvents:\n", r.User, mode)
+	for _, ev := range r.Events {
+		ts := ev.Time.Format("15:04:05.000")
+		if h := ev.HTTP; h != nil {
+			result := fmt.Sprintf("%d", h.Status)
+			if h.Error != "" {
+				result = "error: " + h.Error
+			}
+			extra := ""
+			if h.RateLimitRemaining != "" {
+				extra = ", rate limit remaining " + h.RateLimitRemaining
+			}
+			fmt.Fprintf(w, "  %s  %s %s -> %s in %s (server %q%s)\n", ts, h.Method, h.URL, result, h.Duration.Round(time.Millisecond), h.Server, extra)
+			continue
+		}
+		// Log lines carry their own timestamp prefix
+		fmt.Fprintf(w, "  %s\n", ev.Log)
+	}
+
+	if u := r.Collected; u != nil {
+		fmt.Fprintf(w, "\nCollected: %d keys, %d signing keys via %s", len(u.PublicKeys), len(u.SigningKeys), u.KeysVia)
+		if u.FetchError != "" {
+			fmt.Fprintf(w, ", fetch error: %s", u.FetchError)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "\nRecords:\n")
+	if len(r.Keys) == 0 {
+		fmt.Fprintf(w, "  (none)\n")
+	}
+	for _, k := range r.Keys {
+		fmt.Fprintf(w, "  %s %s %s\n    %.80s\n", k.Status, k.KeyType, k.Fingerprint, k.Key)
+		if k.Written != nil {
+			if data, err := json.Marshal(k.Written); err == nil {
+				fmt.Fprintf(w, "    record: %s\n", data)
+			}
+		}
+		for _, c := range k.Changes {
+			fmt.Fprintf(w, "    %s\n", c)
+		}
+	}
+
+	if len(r.NotReturned) > 0 {
+		fmt.Fprintf(w, "\nStored but not returned by GitHub:\n")
+		for _, key := range r.NotReturned {
+			fmt.Fprintf(w, "  %.80s\n", key)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	// trafficSaveInterval is how often the outbound request log is saved to the database
+	trafficSaveInterval = time.Minute
+	// defaultTrafficRetention is how long the outbound request log is kept unless -traffic-retention says otherwise
+	defaultTrafficRetention = 30 * 24 * time.Hour
+)
+
+// saveTrafficEvery saves the outbound request log every interval until ctx is done
+func (c *collector) saveTrafficEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c.saveTraffic()
+		}
+	}
+}
+
+// saveTraffic appends the requests made since the last save to the database's traffic log,
+// forgetting those older than the retention period. Failures are logged; the requests are lost.
+func (c *collector) saveTraffic() {
+	if c.traffic == nil {
+		return
+	}
+	c.trafficMu.Lock()
+	defer c.trafficMu.Unlock()
+
+	reqs, dropped := c.traffic.Unsaved()
+	if len(reqs) == 0 && dropped == 0 {
+		return
+	}
+	if dropped > 0 {
+		log.Printf("%d outbound requests were made but not logged", dropped)
+	}
+	if err := c.db.AppendTraffic(reqs, dropped, c.clock.Now().Add(-c.retention)); err != nil {
+		log.Printf("Failed to save %d outbound requests to the traffic log: %v", len(reqs), err)
+	}
+}
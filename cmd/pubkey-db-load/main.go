@@ -2,15 +2,15 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
 	"github.com/tstromberg/pubkey-collector/pkg/collect"
 	"github.com/tstromberg/pubkey-collector/pkg/keydb"
 )
@@ -19,6 +19,10 @@ func main() {
 	// Define command-line flags
 	dirPath := flag.String("dir", "", "Directory to search for JSON files")
 	dbPath := flag.String("db", "", "BadgerDB database location")
+	fingerprintsFlag := flag.String("fingerprints", "", "Comma-separated fingerprint algorithms to index in addition to SHA256 and MD5. Available: "+strings.Join(keydb.FingerprintAlgorithms(), ", "))
+	dbProfile := flag.String("db-profile", "bulk-load", "Database tuning profile: balanced, bulk-load, read-heavy or low-memory")
+	observedAt := flag.String("observed-at", "", "RFC3339 time to record for files without fetched_at, instead of their modification time")
+	instance := flag.String("instance", "", "Instance ID recorded with every write (default: hostname)")
 	flag.Parse()
 
 	// Validate flags
@@ -29,58 +33,41 @@ func main() {
 	}
 
 	// Open KeyDB
-	db, err := keydb.New(*dbPath)
+	profile, err := keydb.ParseProfile(*dbProfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := keydb.NewWithProfile(*dbPath, profile)
 	if err != nil {
 		fmt.Printf("Failed to open database: %v\n", err)
 		os.Exit(1)
 	}
 	defer db.Close()
-
-	// Process JSON files
-	err = filepath.Walk(*dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Skip directories and non-JSON files
-		if info.IsDir() || !strings.HasSuffix(strings.ToLower(info.Name()), ".json") {
-			return nil
-		}
-
-		log.Printf("Processing %s", path)
-		// Read and parse JSON file
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			fmt.Printf("Error reading file %s: %v\n", path, err)
-			return nil // Continue with next file
-		}
-
-		var userInfo collect.UserInfo
-		if err := json.Unmarshal(data, &userInfo); err != nil {
-			fmt.Printf("Error parsing JSON in file %s: %v\n", path, err)
-			return nil // Continue with next file
+	if *fingerprintsFlag != "" {
+		if err := db.SetFingerprints(strings.Split(*fingerprintsFlag, ",")); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		// Extract the base filename without extension (user)
-		baseName := filepath.Base(path)
-		baseName = strings.TrimSuffix(baseName, filepath.Ext(baseName))
+	if *instance == "" {
+		*instance, _ = os.Hostname()
+	}
+	runID := keydb.NewRunID()
+	db.SetProvenance(keydb.Provenance{Instance: *instance, RunID: runID})
+	log.Printf("Loading as instance %s, run %s", *instance, runID)
+	run := &keydb.RunRecord{ID: runID, Instance: *instance, Mode: "load", ArgsHash: keydb.HashArgs(os.Args[1:]), Start: time.Now(), Counts: map[string]int{}, Config: keydb.RunConfig(flag.CommandLine)}
 
-		// Get file modification time
-		fileInfo, err := os.Stat(path)
+	// Process JSON files
+	src := &collect.DirSource{Path: *dirPath}
+	if *observedAt != "" {
+		t, err := time.Parse(time.RFC3339, *observedAt)
 		if err != nil {
-			fmt.Printf("Error getting file info for %s: %v\n", path, err)
-			return nil
-		}
-		modTime := fileInfo.ModTime()
-
-		// Store user info in database
-		if err := db.Store(userInfo, baseName, modTime); err != nil {
-			log.Printf("Error storing data from file %s: %v\n", path, err)
+			log.Fatalf("Invalid -observed-at: %v", err)
 		}
-
-		return nil
-	})
-	if err != nil {
+		src.Clock = clock.Fixed(t)
+		db.SetClock(src.Clock)
+	}
+	if err := src.Collect(context.Background(), &dbSink{db: db, run: run}); err != nil {
 		log.Printf("Error walking directory: %v\n", err)
 		os.Exit(1)
 	}
@@ -91,5 +78,64 @@ func main() {
 		log.Printf("Error counting keys: %v\n", err)
 	}
 
+	end := time.Now()
+	run.End = &end
+	for k, v := range db.Counts() {
+		run.Counts[k] = v
+	}
+	if err := db.PutRun(run); err != nil {
+		log.Printf("Error saving run record: %v\n", err)
+	}
+
 	log.Printf("Processing completed successfully. Total keys in database: %d", keyCount)
 }
+
+// dbSink stores users read from JSON files.
+type dbSink struct {
+	db  *keydb.KeyDB
+	run *keydb.RunRecord
+}
+
+// Add stores a user info record, timestamped with when it was fetched, or records why it has no keys.
+// Duplicate keys in the file are dropped, and records an earlier load stored for them are removed.
+func (s *dbSink) Add(_ context.Context, user *collect.UserInfo) error {
+	dropped, removed := collect.DedupeKeys(user)
+	s.run.Counts["keys_deduped"] += removed
+	if skip := collect.SkipFor(user); skip != nil {
+		// Recorded like the collector's -record-skips, so failed fetches aren't mistaken for users without keys
+		s.run.Counts["skipped_"+string(skip.Reason)]++
+		if err := s.db.StoreSkip(*skip, user.FetchedAt); err != nil {
+			log.Printf("Error recording skip for %s: %v\n", user.Username, err)
+			s.run.AddError(err)
+		}
+		return nil
+	}
+	if user.Quarantine != nil {
+		// Marked when the JSON was collected; the batch is reviewed with pubkey-db -quarantine
+		if err := s.db.Quarantine(*user); err != nil {
+			log.Printf("Error quarantining %s: %v\n", user.Username, err)
+			s.run.AddError(err)
+		}
+		return nil
+	}
+	if err := s.db.Store(*user, user.Username, user.FetchedAt); err != nil {
+		log.Printf("Error storing data for %s: %v\n", user.Username, err)
+		s.run.AddError(err)
+		return nil
+	}
+	s.run.Counts["users_stored"]++
+	if len(dropped) > 0 {
+		n, err := s.db.RemoveDuplicates(user.Username, dropped)
+		if err != nil {
+			log.Printf("Error removing duplicate keys for %s: %v\n", user.Username, err)
+			s.run.AddError(err)
+		}
+		s.run.Counts["duplicates_removed"] += n
+	}
+	return nil
+}
+
+// Skip is a no-op: JSON files have no skip decisions.
+func (s *dbSink) Skip(_ context.Context, _ collect.Skip) error {
+	return nil
+}
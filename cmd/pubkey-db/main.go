@@ -0,0 +1,834 @@
+// The pubkey-db tool inspects a pubkey-collector database.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/export"
+	"github.com/tstromberg/pubkey-collector/pkg/identity"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/lists"
+	"github.com/tstromberg/pubkey-collector/pkg/report"
+)
+
+func main() {
+	dbPath := flag.String("db", "", "BadgerDB database location")
+	dbProfile := flag.String("db-profile", "read-heavy", "Database tuning profile: balanced, bulk-load, read-heavy or low-memory")
+	whyFlag := flag.String("why", "", "Explain whether and why a GitHub user is in the database")
+	staleDays := flag.Int("stale-days", int(keydb.DefaultStaleAfter.Hours()/24), "With -why, caveat keys not seen on GitHub for more than this many days as stale")
+	byRun := flag.String("by-run", "", "List keys last written by the given collector run ID")
+	byInstance := flag.String("by-instance", "", "List keys last written by the given collector instance")
+	replayDir := flag.String("replay", "", "Re-derive event actors from pages captured with pubkey-collector -capture-dir and compare with the database")
+	refreshIdentities := flag.Bool("refresh-identities", false, "Re-resolve the corporate identity of every user in the database with -identity-map or -identity-cmd, without re-collecting keys")
+	identityMap := flag.String("identity-map", "", "File or https:// URL of login,employee_id,email lines, for -refresh-identities")
+	identityCmd := flag.String("identity-cmd", "", "Command printing a login's identity as JSON, for -refresh-identities (see pubkey-collector -identity-cmd)")
+	cloneDir := flag.String("clone-snapshot", "", "Copy the database to this new directory as of one consistent point, for running reports off the primary")
+	migratePath := flag.String("migrate-path", "", "Move the database to this new directory; a running pubkey-collector is asked to move it without stopping")
+	exportDir := flag.String("export", "", "Export the database to this directory (or file, with -format compact)")
+	importDir := flag.String("import", "", "Import a gitdir export from this directory into the database")
+	datasetFile := flag.String("import-dataset", "", "Backfill first-seen times from a historical login,key,observed_at,source dataset (.csv or .jsonl)")
+	datasetName := flag.String("dataset", "", "Name recorded with -import-dataset records (default: the file name)")
+	confidence := flag.Float64("confidence", 0.5, "Confidence from 0 to 1 recorded with -import-dataset records")
+	fleetDir := flag.String("import-fleet", "", "Import the authorized_keys files in this directory, one subdirectory per host, for pubkey-report -migration")
+	exportFormat := flag.String("format", "gitdir", "Export/import format: gitdir (one sorted JSON file per user, for committing to Git) or compact (export only: a fingerprint index file for pkg/compactdb)")
+	fingerprintsFlag := flag.String("fingerprints", "", "Comma-separated extra fingerprint algorithms to index and, with -export, include. Available: "+strings.Join(keydb.FingerprintAlgorithms(), ", "))
+	userFlag := flag.String("user", "", "Comma-separated users to limit -export/-import to")
+	usersFile := flag.String("users-file", "", "File of users, one per line, to limit -export/-import to")
+	orgFlag := flag.String("org", "", "Limit -export/-import to keys collected from this org or seen in its repositories")
+	timeseries := flag.Bool("timeseries", false, "Print daily totals of distinct keys and users with keys")
+	fsck := flag.Bool("fsck", false, "Re-validate every stored key and flag the malformed ones")
+	backfill := flag.Bool("backfill-rollups", false, "Recompute the daily rollups behind -timeseries from first-seen times")
+	runsFlag := flag.Bool("runs", false, "List recent collector and loader runs")
+	trafficReport := flag.Bool("traffic-report", false, "Summarize the collectors' outbound requests per host per hour over the retained log, with the ceilings they ran under")
+	runFlag := flag.String("run", "", "Show the run record with this ID")
+	configHistory := flag.Bool("config-history", false, "List how the collection configuration changed from run to run")
+	blockFlag := flag.String("block", "", "Block a key fingerprint (SHA256:...): flag existing keys and any later sightings")
+	reasonFlag := flag.String("reason", "", "Why the key is being blocked, recorded with -block")
+	resolveFlag := flag.String("resolve-conflict", "", "Resolve the ownership conflict for a key fingerprint (SHA256:...) with -accept or -keep-both")
+	acceptFlag := flag.String("accept", "", "User whose attribution -resolve-conflict accepts; the key's record is restored to their evidence")
+	keepBoth := flag.Bool("keep-both", false, "Resolve the conflict by keeping both attributions, explained with -note")
+	noteFlag := flag.String("note", "", "Analyst note recorded with -resolve-conflict")
+	quarantineFlag := flag.Bool("quarantine", false, "List batches of keys GitHub served identically to several users, held back for review")
+	applyBatch := flag.String("quarantine-apply", "", "Store a quarantined batch's keys for its users after all, as genuine observations")
+	discardBatch := flag.String("quarantine-discard", "", "Discard a quarantined batch, leaving its keys unattributed")
+	archiveFile := flag.String("archive", "", "Write the whole database to this tar file for cold storage: zstd NDJSON chunks under a manifest of counts and digests")
+	archiveKey := flag.String("archive-key", "", "File holding a base64 Ed25519 private key that signs the -archive manifest")
+	verifyFile := flag.String("verify-archive", "", "Check an archive's digests and counts and print its manifest (no -db needed)")
+	restoreFile := flag.String("restore-archive", "", "Rebuild a database at -db, which must not exist yet, from an archive")
+	archivePubKey := flag.String("archive-pubkey", "", "Base64 Ed25519 public key that must have signed the archive, for -verify-archive and -restore-archive")
+	flag.Parse()
+
+	var pub ed25519.PublicKey
+	if *archivePubKey != "" {
+		key, err := base64.StdEncoding.DecodeString(*archivePubKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			log.Fatalf("-archive-pubkey is not a base64 Ed25519 public key")
+		}
+		pub = key
+	}
+	if *verifyFile != "" {
+		check, err := export.VerifyArchive(*verifyFile, pub)
+		if err != nil {
+			log.Fatalf("Archive verification failed: %v", err)
+		}
+		printArchiveCheck(check)
+		return
+	}
+
+	if *dbPath == "" {
+		log.Fatal("--db flag must be specified")
+	}
+
+	if *restoreFile != "" {
+		check, err := export.RestoreArchive(*restoreFile, *dbPath, pub)
+		if err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+		printArchiveCheck(check)
+		log.Printf("Restored %d records to %s", check.Manifest.Records, *dbPath)
+		return
+	}
+
+	profile, err := keydb.ParseProfile(*dbProfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *migratePath != "" {
+		info, err := migrateDB(*dbPath, *migratePath, profile)
+		if err != nil && info == nil {
+			log.Fatalf("Migration failed, %s is unchanged: %v", *dbPath, err)
+		}
+		if err != nil {
+			log.Printf("Migration to %s finished with an error: %v", info.To, err)
+		}
+		n := 0
+		for _, c := range info.Records {
+			n += c
+		}
+		log.Printf("Moved %s to %s: %d records checked in %d passes, writes paused for %s", info.From, info.To, n, info.Passes, info.Paused.Round(time.Millisecond))
+		log.Printf("%s is no longer used and can be removed", info.From)
+		return
+	}
+
+	db, err := keydb.NewWithProfile(*dbPath, profile)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if *fingerprintsFlag != "" {
+		if err := db.SetFingerprints(strings.Split(*fingerprintsFlag, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *whyFlag != "" {
+		if err := explainUser(db, *whyFlag, time.Duration(*staleDays)*24*time.Hour); err != nil {
+			log.Fatalf("Failed to explain %s: %v", *whyFlag, err)
+		}
+		return
+	}
+
+	if *fsck {
+		n, err := db.FlagMalformedKeys(context.Background())
+		if err != nil {
+			log.Fatalf("Check failed: %v", err)
+		}
+		log.Printf("Flagged %d malformed key(s)", n)
+		return
+	}
+
+	if *backfill {
+		days, err := db.BackfillRollups(context.Background())
+		if err != nil {
+			log.Fatalf("Backfill failed: %v", err)
+		}
+		log.Printf("Rebuilt rollups for %d days", days)
+		return
+	}
+
+	if *timeseries {
+		points, err := db.Timeseries()
+		if err != nil {
+			log.Fatalf("Failed to read rollups: %v", err)
+		}
+		for _, p := range points {
+			fmt.Printf("%s\t%d\t%d\n", p.Date, p.Keys, p.Users)
+		}
+		return
+	}
+
+	if *trafficReport {
+		if err := printTraffic(db); err != nil {
+			log.Fatalf("Failed to report traffic: %v", err)
+		}
+		return
+	}
+
+	if *runsFlag {
+		if err := listRuns(db); err != nil {
+			log.Fatalf("Failed to list runs: %v", err)
+		}
+		return
+	}
+
+	if *configHistory {
+		if err := listConfigHistory(db); err != nil {
+			log.Fatalf("Failed to list configuration history: %v", err)
+		}
+		return
+	}
+
+	if *runFlag != "" {
+		if err := showRun(db, *runFlag); err != nil {
+			log.Fatalf("Failed to show run: %v", err)
+		}
+		return
+	}
+
+	if *blockFlag != "" {
+		n, err := db.Block(*blockFlag, os.Getenv("USER"), *reasonFlag)
+		if err != nil {
+			log.Fatalf("Failed to block key: %v", err)
+		}
+		log.Printf("Blocked %s; flagged %d stored key(s)", *blockFlag, n)
+		return
+	}
+
+	if *refreshIdentities {
+		if err := refreshIdentityLinks(db, *identityMap, *identityCmd); err != nil {
+			log.Fatalf("Identity refresh failed: %v", err)
+		}
+		return
+	}
+
+	if *archiveFile != "" {
+		var opts export.ArchiveOptions
+		if *archiveKey != "" {
+			key, err := readPrivateKey(*archiveKey)
+			if err != nil {
+				log.Fatalf("Failed to read -archive-key: %v", err)
+			}
+			opts.PrivateKey = key
+		}
+		m, err := export.Archive(db, *archiveFile, opts)
+		if err != nil {
+			log.Fatalf("Archive failed: %v", err)
+		}
+		log.Printf("Archived %d records in %d chunks to %s", m.Records, len(m.Chunks), *archiveFile)
+		return
+	}
+
+	if *cloneDir != "" {
+		info, err := db.CloneSnapshot(*cloneDir)
+		if err != nil {
+			log.Fatalf("Clone failed: %v", err)
+		}
+		log.Printf("Cloned %s to %s as of sequence %d", *dbPath, *cloneDir, info.Sequence)
+		return
+	}
+
+	if *resolveFlag != "" {
+		r := keydb.Resolution{Login: *acceptFlag, Note: *noteFlag, By: os.Getenv("USER")}
+		switch {
+		case *keepBoth && *acceptFlag == "" && *noteFlag == "":
+			log.Fatal("--keep-both requires a --note explaining why both users hold the key")
+		case *keepBoth && *acceptFlag == "":
+			r.Decision = keydb.ResolutionKeepBoth
+		case !*keepBoth && *acceptFlag != "":
+			r.Decision = keydb.ResolutionAccept
+		default:
+			log.Fatal("--resolve-conflict requires exactly one of --accept USER or --keep-both")
+		}
+		if err := db.ResolveConflict(*resolveFlag, r); err != nil {
+			log.Fatalf("Failed to resolve conflict: %v", err)
+		}
+		log.Printf("Resolved conflict for %s: %s %s", *resolveFlag, r.Decision, r.Login)
+		return
+	}
+
+	if *quarantineFlag {
+		if err := listQuarantine(db); err != nil {
+			log.Fatalf("Failed to list quarantine: %v", err)
+		}
+		return
+	}
+
+	if *applyBatch != "" || *discardBatch != "" {
+		batch, decision := *applyBatch, keydb.QuarantineApplied
+		if *discardBatch != "" {
+			batch, decision = *discardBatch, keydb.QuarantineDiscarded
+		}
+		if *applyBatch != "" && *discardBatch != "" {
+			log.Fatal("--quarantine-apply and --quarantine-discard are mutually exclusive")
+		}
+		if err := db.ReviewQuarantine(batch, decision, os.Getenv("USER")); err != nil {
+			log.Fatalf("Failed to review quarantine: %v", err)
+		}
+		log.Printf("Quarantined batch %s %s", batch, decision)
+		return
+	}
+
+	if *byRun != "" || *byInstance != "" {
+		if err := listByProvenance(db, *byInstance, *byRun); err != nil {
+			log.Fatalf("Failed to list keys: %v", err)
+		}
+		return
+	}
+
+	if *datasetFile != "" {
+		name := *datasetName
+		if name == "" {
+			name = strings.TrimSuffix(filepath.Base(*datasetFile), filepath.Ext(*datasetFile))
+		}
+		if *confidence < 0 || *confidence > 1 {
+			log.Fatalf("-confidence must be between 0 and 1")
+		}
+		if err := importDataset(db, *datasetFile, name, *confidence); err != nil {
+			log.Fatalf("Dataset import failed: %v", err)
+		}
+		return
+	}
+
+	if *fleetDir != "" {
+		if err := importFleet(db, *fleetDir); err != nil {
+			log.Fatalf("Fleet import failed: %v", err)
+		}
+		return
+	}
+
+	if *exportDir != "" || *importDir != "" {
+		switch {
+		case *exportFormat == "compact" && *importDir != "":
+			log.Fatalf("The compact format cannot be imported")
+		case *exportFormat != "gitdir" && *exportFormat != "compact":
+			log.Fatalf("Unknown export format %q", *exportFormat)
+		}
+		users, err := userList(*userFlag, *usersFile)
+		if err != nil {
+			log.Fatalf("Failed to read users: %v", err)
+		}
+		filter := export.UsersAndOrg(users, *orgFlag)
+
+		if *importDir != "" {
+			stats, err := export.ImportGitDir(db, *importDir, filter)
+			if err != nil {
+				log.Fatalf("Import failed: %v", err)
+			}
+			log.Printf("Imported %d keys for %d users", stats.Keys, stats.Users)
+			if stats.Conflicts > 0 {
+				log.Printf("%d keys are attributed to a different user than this database had; see pubkey-report -conflicts", stats.Conflicts)
+			}
+			return
+		}
+
+		if *exportFormat == "compact" {
+			n, err := export.Compact(db, *exportDir, filter)
+			if err != nil {
+				log.Fatalf("Export failed: %v", err)
+			}
+			log.Printf("Exported %d keys to %s", n, *exportDir)
+			return
+		}
+
+		stats, err := export.GitDir(db, *exportDir, filter, *fingerprintsFlag != "")
+		if err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		log.Printf("Exported %d users: %d written, %d unchanged, %d removed", stats.Users, stats.Written, stats.Unchanged, stats.Removed)
+		return
+	}
+
+	if *replayDir != "" {
+		if err := replay(db, *replayDir); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
+
+	flag.Usage()
+	os.Exit(1)
+}
+
+// listRuns prints one line per retained run, newest first.
+func listRuns(db *keydb.KeyDB) error {
+	runs, err := db.Runs()
+	if err != nil {
+		return err
+	}
+	for _, r := range runs {
+		end := "running"
+		if r.End != nil {
+			end = r.End.Sub(r.Start).Round(time.Second).String()
+		}
+		gap := ""
+		if r.Gap != nil {
+			gap = fmt.Sprintf("\tgap since %s, backfilled %d", r.Gap.Since.Format("2006-01-02 15:04"), r.Gap.Watchlist+r.Gap.Members)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%d errors%s\n", r.ID, r.Instance, r.Start.Format("2006-01-02 15:04:05"), end, r.Mode, r.Counts["errors"], gap)
+	}
+	log.Printf("%d runs", len(runs))
+	return nil
+}
+
+// printTraffic prints the outbound requests recorded in the traffic log: totals and peaks per host,
+// requests per endpoint class, requests per host per hour and the ceiling each run was held to.
+func printTraffic(db *keydb.KeyDB) error {
+	r, err := report.Traffic(db, time.Time{})
+	if err != nil {
+		return err
+	}
+	if len(r.Hosts) == 0 {
+		log.Printf("No outbound requests recorded")
+		return nil
+	}
+
+	const hourFormat = "2006-01-02 15:04"
+	span := int(r.To.Sub(r.From)/time.Hour) + 1
+	fmt.Printf("Outbound requests from %s to %s UTC (%d hours)\n", r.From.Format(hourFormat), r.To.Add(time.Hour).Format(hourFormat), span)
+	if r.Dropped > 0 {
+		fmt.Printf("%d further requests were made but not logged\n", r.Dropped)
+	}
+
+	fmt.Println("\nhost\trequests\tper hour\tpeak hour\tpeak minute\tresponses")
+	for _, h := range r.Hosts {
+		fmt.Printf("%s\t%d\t%.1f\t%d at %s\t%d\t%s\n", h.Host, h.Requests, float64(h.Requests)/float64(span), h.PeakHourRequests, h.PeakHour.Format(hourFormat), h.PeakMinute, formatCounts(h.Statuses))
+	}
+
+	fmt.Println("\nhost\tendpoint\trequests")
+	for _, h := range r.Hosts {
+		classes := make([]string, 0, len(h.Classes))
+		for c := range h.Classes {
+			classes = append(classes, c)
+		}
+		sort.Slice(classes, func(i, j int) bool {
+			if h.Classes[classes[i]] != h.Classes[classes[j]] {
+				return h.Classes[classes[i]] > h.Classes[classes[j]]
+			}
+			return classes[i] < classes[j]
+		})
+		for _, c := range classes {
+			fmt.Printf("%s\t%s\t%d\n", h.Host, c, h.Classes[c])
+		}
+	}
+
+	fmt.Println("\nhour\thost\trequests\tresponses")
+	for _, h := range r.Hours {
+		fmt.Printf("%s\t%s\t%d\t%s\n", h.Hour.Format(hourFormat), h.Host, h.Requests, formatCounts(h.Statuses))
+	}
+
+	if len(r.Runs) > 0 {
+		fmt.Println("\nrun\tinstance\tstarted\tceiling per hour")
+		for _, run := range r.Runs {
+			fmt.Printf("%s\t%s\t%s\t%d\n", run.ID, run.Instance, run.Start.UTC().Format(hourFormat), run.Ceiling)
+		}
+	}
+	return nil
+}
+
+// formatCounts formats named counts as sorted name=count pairs
+func formatCounts(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%d", name, counts[name])
+	}
+	return strings.Join(parts, " ")
+}
+
+// listConfigHistory prints each run whose configuration differs from the previous run of the same
+// mode, oldest first, with the settings that changed. The first run of each mode shows them all.
+// readPrivateKey reads a base64 Ed25519 private key, either the 32-byte seed or the full 64-byte key.
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%d bytes is not an Ed25519 private key", len(key))
+}
+
+// printArchiveCheck prints a verified archive's manifest.
+func printArchiveCheck(check *export.ArchiveCheck) {
+	m := check.Manifest
+	sig := "unsigned"
+	switch {
+	case check.SignatureVerified:
+		sig = "signature verified"
+	case check.Signed:
+		sig = "signed (not checked: no -archive-pubkey)"
+	}
+	fmt.Printf("Archive created %s by %s, schema %d, %s\n", m.Created.Format(time.RFC3339), m.Collector, m.Schema, sig)
+	types := make([]string, 0, len(m.Counts))
+	for t := range m.Counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Printf("  %-12s %d\n", t, m.Counts[t])
+	}
+	fmt.Printf("  %-12s %d\n", "total", m.Records)
+	for _, c := range m.Chunks {
+		fmt.Printf("  %s\t%d records\t%d bytes\tsha256:%s\n", c.Name, c.Records, c.Size, c.SHA256)
+	}
+}
+
+// listQuarantine prints each quarantined batch with the users it was served for and its keys.
+func listQuarantine(db *keydb.KeyDB) error {
+	batches, err := db.QuarantineBatches()
+	if err != nil {
+		return err
+	}
+	for _, b := range batches {
+		status := b.Status
+		if b.Reviewed != nil {
+			status = fmt.Sprintf("%s at %s by %q", b.Status, b.Reviewed.Format(time.RFC3339), b.ReviewedBy)
+		}
+		fmt.Printf("%s\tdetected %s\t%d users\t%s\n", b.Batch, b.Detected.Format(time.RFC3339), len(b.Users), status)
+		for _, u := range b.Users {
+			note := ""
+			if u.Withdrawn {
+				note = "\t(withdrawn)"
+			}
+			fmt.Printf("  user %s\t%s\t%s%s\n", u.Login, u.FetchedAt.Format(time.RFC3339), u.Source, note)
+		}
+		for _, key := range b.Keys {
+			fmt.Printf("  key  %s\n", key)
+		}
+	}
+	return nil
+}
+
+func listConfigHistory(db *keydb.KeyDB) error {
+	runs, err := db.Runs()
+	if err != nil {
+		return err
+	}
+
+	last := map[string]map[string]string{}
+	for i := len(runs) - 1; i >= 0; i-- {
+		r := runs[i]
+		if r.Config == nil {
+			continue
+		}
+		prev := last[r.Mode]
+		last[r.Mode] = r.Config
+
+		var changes []string
+		for name, v := range r.Config {
+			if old, ok := prev[name]; !ok || old != v {
+				changes = append(changes, fmt.Sprintf("  -%s=%s", name, v))
+			}
+		}
+		for name := range prev {
+			if _, ok := r.Config[name]; !ok {
+				changes = append(changes, fmt.Sprintf("  -%s removed", name))
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		sort.Strings(changes)
+		fmt.Printf("%s\t%s\t%s\t%s\n", r.Start.Format("2006-01-02 15:04:05"), r.ID, r.Instance, r.Mode)
+		fmt.Println(strings.Join(changes, "\n"))
+	}
+	return nil
+}
+
+// showRun prints a run record in full.
+func showRun(db *keydb.KeyDB, id string) error {
+	r, err := db.Run(id)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return fmt.Errorf("no run %q in the database", id)
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// importDataset backfills db from a historical dataset, reporting each malformed row, and records the import as a run.
+func importDataset(db *keydb.KeyDB, path, name string, confidence float64) error {
+	sightings, bad, err := export.ReadDataset(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range bad {
+		log.Printf("%s: skipping %v", path, e)
+	}
+
+	prov := keydb.Provenance{Instance: os.Getenv("USER"), RunID: keydb.NewRunID()}
+	db.SetProvenance(prov)
+	run := &keydb.RunRecord{ID: prov.RunID, Instance: prov.Instance, Mode: "dataset", ArgsHash: keydb.HashArgs(os.Args[1:]), Start: time.Now(), Counts: map[string]int{}, Config: keydb.RunConfig(flag.CommandLine)}
+	stats, err := db.Backfill(sightings, name, confidence)
+	if err != nil {
+		run.AddError(err)
+	}
+	if stats != nil {
+		run.Counts["keys_added"], run.Counts["keys_backdated"], run.Counts["rows_malformed"] = stats.Added, stats.Backdated, len(bad)+stats.Rejected
+		log.Printf("Dataset %s: %d keys added, %d backdated, %d unchanged, %d malformed rows", name, stats.Added, stats.Backdated, stats.Unchanged, len(bad)+stats.Rejected)
+	}
+	end := time.Now()
+	run.End = &end
+	if perr := db.PutRun(run); perr != nil {
+		log.Printf("Failed to save run record: %v", perr)
+	}
+	return err
+}
+
+// importFleet replaces the fleet records of each host in dir with the keys in its authorized_keys files.
+func importFleet(db *keydb.KeyDB, dir string) error {
+	hosts, bad, err := export.ReadFleet(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range bad {
+		log.Printf("Skipping %v", e)
+	}
+
+	prov := keydb.Provenance{Instance: os.Getenv("USER"), RunID: keydb.NewRunID()}
+	db.SetProvenance(prov)
+	run := &keydb.RunRecord{ID: prov.RunID, Instance: prov.Instance, Mode: "fleet", ArgsHash: keydb.HashArgs(os.Args[1:]), Start: time.Now(), Counts: map[string]int{}, Config: keydb.RunConfig(flag.CommandLine)}
+	run.Counts["lines_malformed"] = len(bad)
+	for host, keys := range hosts {
+		if err = db.PutFleetHost(host, keys); err != nil {
+			run.AddError(err)
+			break
+		}
+		run.Counts["hosts_imported"]++
+		run.Counts["keys_imported"] += len(keys)
+	}
+	log.Printf("Fleet %s: %d keys from %d hosts, %d lines skipped", dir, run.Counts["keys_imported"], run.Counts["hosts_imported"], len(bad))
+	end := time.Now()
+	run.End = &end
+	if perr := db.PutRun(run); perr != nil {
+		log.Printf("Failed to save run record: %v", perr)
+	}
+	return err
+}
+
+// userList combines a comma-separated list of users with the users in file, one per line.
+func userList(list, file string) ([]string, error) {
+	var users []string
+	if list != "" {
+		users = strings.Split(list, ",")
+	}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, strings.Split(string(b), "\n")...)
+	}
+
+	var out []string
+	for _, u := range users {
+		if u = strings.TrimSpace(u); u != "" && !strings.HasPrefix(u, "#") {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
+
+// replay re-runs actor selection over captured events pages and reports how each actor is represented in the database.
+func replay(db *keydb.KeyDB, dir string) error {
+	actors, skipped, err := collect.ReplayCaptured(dir)
+	if err != nil {
+		return err
+	}
+
+	keys, err := db.Matching(func(*keydb.Metadata) bool { return true })
+	if err != nil {
+		return err
+	}
+	stored := map[string]bool{}
+	for _, md := range keys {
+		stored[strings.ToLower(md.User)] = true
+	}
+
+	counts := map[string]int{}
+	for _, a := range actors {
+		status := "absent"
+		if stored[strings.ToLower(a.Username)] {
+			status = "stored"
+		} else if skip, err := db.Skip(a.Username); err != nil {
+			return err
+		} else if skip != nil {
+			status = "skipped:" + string(skip.Reason)
+		}
+		counts[status]++
+		fmt.Printf("%s\t%s\t%s\n", a.Username, a.Repo, status)
+	}
+	for _, s := range skipped {
+		counts["filtered:"+string(s.Reason)]++
+		fmt.Printf("%s\t%s\tfiltered:%s\n", s.Username, s.Repo, s.Reason)
+	}
+
+	log.Printf("Replayed %d actors: %v", len(actors)+len(skipped), counts)
+	return nil
+}
+
+// listByProvenance prints the keys written by a collector instance and/or run.
+func listByProvenance(db *keydb.KeyDB, instance, runID string) error {
+	keys, err := db.Matching(func(md *keydb.Metadata) bool {
+		return (instance == "" || md.Instance == instance) && (runID == "" || md.RunID == runID)
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, md := range keys {
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", md.User, md.Instance, md.RunID, md.Timestamp.Format("2006-01-02 15:04:05"), key)
+	}
+	log.Printf("%d matching keys", len(keys))
+	return nil
+}
+
+// refreshIdentityLinks re-resolves the identity of every user with keys or a skip record.
+func refreshIdentityLinks(db *keydb.KeyDB, mapSrc, cmdline string) error {
+	var r identity.Resolver
+	switch {
+	case (mapSrc == "") == (cmdline == ""):
+		return fmt.Errorf("-refresh-identities needs exactly one of -identity-map and -identity-cmd")
+	case mapSrc != "":
+		m, err := identity.OpenMap(mapSrc, lists.Options{})
+		if err != nil {
+			return err
+		}
+		r = m
+	default:
+		r = identity.NewCommand(cmdline)
+	}
+
+	ctx := context.Background()
+	last, err := db.LastCollected(ctx)
+	if err != nil {
+		return err
+	}
+	logins := make([]string, 0, len(last))
+	for login := range last {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+
+	stats, err := identity.Link(ctx, db, r, logins, 0)
+	if stats != nil {
+		log.Printf("Resolved %d users via %s: %d linked, %d unlinked, %d lookups failed", len(logins), r.Name(), stats.Linked, stats.Unlinked, stats.Failed)
+	}
+	return err
+}
+
+// explainUser prints a human explanation of what the database knows about a user.
+func explainUser(db *keydb.KeyDB, user string, staleAfter time.Duration) error {
+	keys, err := db.UserKeys(user)
+	if err != nil {
+		return err
+	}
+
+	skip, err := db.Skip(user)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) > 0 {
+		fmt.Printf("%s has %d key(s) in the database:\n", user, len(keys))
+		for key, md := range keys {
+			fmt.Printf("  %s (from %q, stored %s", key, md.Repo, md.Timestamp.Format("2006-01-02 15:04:05"))
+			if md.LastUsed != nil {
+				fmt.Printf(", last used %s per %s", md.LastUsed.At.Format("2006-01-02"), md.LastUsed.Source)
+			}
+			fmt.Println(")")
+			caveats, err := db.Caveats(md, staleAfter)
+			if err != nil {
+				return err
+			}
+			for _, c := range caveats {
+				fmt.Printf("    caveat: %s\n", c)
+			}
+		}
+	}
+
+	if id, err := db.Identity(user); err != nil {
+		return err
+	} else if id != nil {
+		fmt.Printf("%s is %s per %s as of %s\n", user, id, id.Source, id.Resolved.Format("2006-01-02 15:04:05"))
+	}
+
+	switch {
+	case skip != nil:
+		fmt.Printf("%s was last skipped at %s: %s", user, skip.Timestamp.Format("2006-01-02 15:04:05"), skip.Reason)
+		if skip.Detail != "" {
+			fmt.Printf(" (%s)", skip.Detail)
+		}
+		if skip.Repo != "" {
+			fmt.Printf(" while seen in %s", skip.Repo)
+		}
+		fmt.Println()
+	case len(keys) == 0:
+		fmt.Printf("%s is not in the database: the collector has not seen this user, or ran without -record-skips\n", user)
+		caveats, err := report.Caveats(db)
+		if err != nil {
+			return err
+		}
+		for _, c := range caveats {
+			fmt.Printf("  caveat: %s\n", c)
+		}
+	}
+	return nil
+}
+
+// migrateDB moves the database at path to dest. If a collector has it open, the collector is asked
+// to move it, so collection carries on; otherwise it is moved here.
+func migrateDB(path, dest string, profile keydb.Profile) (*keydb.MigrationInfo, error) {
+	db, err := keydb.NewWithProfile(path, profile)
+	if errors.Is(err, keydb.ErrLocked) {
+		pid, err := keydb.RequestMigration(path, dest)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Asked pid %d to move %s to %s; waiting...", pid, path, dest)
+		req, err := keydb.AwaitMigration(context.Background(), path, pid)
+		if req == nil {
+			return nil, err
+		}
+		return req.Info, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := db.MigratePath(dest)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return info, err
+}
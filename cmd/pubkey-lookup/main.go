@@ -0,0 +1,86 @@
+// The pubkey-lookup tool finds the GitHub user a public key or key fingerprint belongs to.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+func main() {
+	dbPath := flag.String("db", "", "BadgerDB database location")
+	dbProfile := flag.String("db-profile", "read-heavy", "Database tuning profile: balanced, bulk-load, read-heavy or low-memory")
+	staleDays := flag.Int("stale-days", int(keydb.DefaultStaleAfter.Hours()/24), "Caveat keys not seen on GitHub for more than this many days as stale")
+	minQuality := flag.Float64("min-quality", 0, "Suppress attributions whose caveats put their quality, from 0 to 1, below this")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -db DIR FINGERPRINT|KEY...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *dbPath == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	profile, err := keydb.ParseProfile(*dbProfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := keydb.NewWithProfile(*dbPath, profile)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	missing := 0
+	for _, query := range flag.Args() {
+		md, err := db.Lookup(query)
+		if errors.Is(err, keydb.ErrNotFound) {
+			fmt.Printf("%s\tnot found\n", query)
+			missing++
+			continue
+		}
+		if err != nil {
+			log.Fatalf("Lookup failed: %v", err)
+		}
+
+		caveats, err := db.Caveats(md, time.Duration(*staleDays)*24*time.Hour)
+		if err != nil {
+			log.Fatalf("Lookup failed: %v", err)
+		}
+		if q := keydb.Quality(caveats); q < *minQuality {
+			fmt.Printf("%s\tsuppressed\tquality:%.2f\tcaveats:%s\n", query, q, strings.Join(keydb.CaveatCodes(caveats), ","))
+			missing++
+			continue
+		}
+
+		status := ""
+		if len(md.Flags) > 0 {
+			status = "\t" + strings.Join(md.Flags, ",")
+		}
+		if md.Purpose != "" {
+			status += "\tpurpose:" + string(md.Purpose)
+		}
+		if id, err := db.Identity(md.User); err != nil {
+			log.Fatalf("Lookup failed: %v", err)
+		} else if id != nil {
+			status += "\tidentity:" + id.String()
+		}
+		if len(caveats) > 0 {
+			status += "\tcaveats:" + strings.Join(keydb.CaveatCodes(caveats), ",")
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s%s\n", query, md.User, md.Repo, md.Timestamp.Format("2006-01-02 15:04:05"), md.KeyType, md.Fingerprint, status)
+	}
+
+	if missing > 0 {
+		db.Close()
+		os.Exit(1)
+	}
+}
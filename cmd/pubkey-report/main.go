@@ -0,0 +1,385 @@
+// The pubkey-report tool produces reports from a pubkey-collector database.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+	"golang.org/x/oauth2"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/lists"
+	"github.com/tstromberg/pubkey-collector/pkg/report"
+	"github.com/tstromberg/pubkey-collector/pkg/traffic"
+)
+
+func main() {
+	dbPath := flag.String("db", "", "BadgerDB database location")
+	coverageFlag := flag.Bool("coverage", false, "Report the share of an org's recent committers with keys in the database")
+	exposureFlag := flag.String("exposure", "", "List who could push to this owner/repo, as recorded by pubkey-collector -exposure, with their keys")
+	conflictsFlag := flag.Bool("conflicts", false, "List keys that merged databases attributed to different users, with each side's evidence")
+	attentionFlag := flag.Bool("attention", false, "List every open item needing an operator, most severe first, with the command to remedy it; no output and exit status 0 means all clear, 2 means items are open")
+	migrationFlag := flag.Bool("migration", false, "Map the local accounts imported with pubkey-db -import-fleet to GitHub users, listing unknown and risky keys")
+	blocklistFile := flag.String("blocklist", "", "With -migration, also treat the fingerprints in this file or https:// URL as blocked")
+	aggregatesFlag := flag.Bool("aggregates", false, "Print population statistics safe to share with outside researchers, as JSON")
+	minPopulation := flag.Int("min-population", report.DefaultMinPopulation, "With -aggregates, the fewest users any reported number may describe")
+	keyTypeFlag := flag.String("key-type", "", "With -aggregates, only describe keys of this type, such as ssh-ed25519")
+	orgFlag := flag.String("org", "", "GitHub organization to report on")
+	sinceFlag := flag.String("since", "90d", "How far back to look, as a Go duration or a number of days (e.g. 90d)")
+	staleFlag := flag.String("stale-after", "365d", "Caveat keys not seen on GitHub for longer than this as stale, as a Go duration or a number of days")
+	minQuality := flag.Float64("min-quality", 0, "Leave out keys whose caveats put their quality, from 0 to 1, below this")
+	flag.Parse()
+
+	if *dbPath == "" {
+		log.Fatal("--db flag must be specified")
+	}
+	if *exposureFlag != "" {
+		staleAfter, err := parseSince(*staleFlag)
+		if err != nil {
+			log.Fatalf("Invalid --stale-after: %v", err)
+		}
+		if err := printExposure(*dbPath, *exposureFlag, staleAfter, *minQuality); err != nil {
+			log.Fatalf("Exposure failed: %v", err)
+		}
+		return
+	}
+	if *attentionFlag {
+		open, err := printAttention(os.Stdout, *dbPath)
+		if err != nil {
+			log.Fatalf("Attention failed: %v", err)
+		}
+		if open {
+			os.Exit(2)
+		}
+		return
+	}
+	if *migrationFlag {
+		if err := printMigration(*dbPath, *blocklistFile); err != nil {
+			log.Fatalf("Migration report failed: %v", err)
+		}
+		return
+	}
+	if *aggregatesFlag {
+		f := report.AggregateFilter{KeyType: *keyTypeFlag}
+		if flagSet("since") {
+			since, err := parseSince(*sinceFlag)
+			if err != nil {
+				log.Fatalf("Invalid --since: %v", err)
+			}
+			after := time.Now().Add(-since)
+			f.SeenAfter = &after
+		}
+		if err := printAggregates(os.Stdout, *dbPath, f, *minPopulation); err != nil {
+			log.Fatalf("Aggregates failed: %v", err)
+		}
+		return
+	}
+	if *conflictsFlag {
+		if err := printConflicts(*dbPath); err != nil {
+			log.Fatalf("Conflicts failed: %v", err)
+		}
+		return
+	}
+	if !*coverageFlag {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *orgFlag == "" {
+		log.Fatal("--coverage requires --org")
+	}
+
+	since, err := parseSince(*sinceFlag)
+	if err != nil {
+		log.Fatalf("Invalid --since: %v", err)
+	}
+
+	githubToken := os.Getenv("GITHUB_TOKEN")
+	if githubToken == "" {
+		log.Fatal("GITHUB_TOKEN environment variable must be set")
+	}
+
+	db, err := keydb.New(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: githubToken})
+	// Coverage requests are held to the collector's default ceiling and added to its traffic log
+	rec := traffic.NewRecorder(traffic.DefaultCeiling, traffic.DefaultCeiling)
+	client := github.NewClient(&http.Client{Transport: rec.Transport(&oauth2.Transport{Source: ts})})
+
+	r, err := report.Coverage(ctx, client, db, *orgFlag, time.Now().Add(-since))
+	saveTraffic(db, rec)
+	if err != nil {
+		log.Fatalf("Coverage failed: %v", err)
+	}
+
+	fmt.Printf("%s: %.1f%% of %d committers since %s have keys\n", r.Org, r.Percent, len(r.Committers)-len(r.Unknown), r.Since.Format("2006-01-02"))
+	if len(r.Unknown) > 0 {
+		fmt.Printf("caveat: %d committers are excluded because their last key fetch failed\n", len(r.Unknown))
+	}
+	printCaveats(db)
+	for _, login := range r.Uncovered {
+		fmt.Printf("uncovered: %s\n", login)
+	}
+	for _, login := range r.Unknown {
+		fmt.Printf("unknown: %s\n", login)
+	}
+	for _, login := range r.Unlinked {
+		fmt.Printf("unlinked account: %s\n", login)
+	}
+	if len(r.Runs) > 0 {
+		fmt.Printf("from runs: %s\n", strings.Join(r.Runs, ", "))
+	}
+}
+
+// printExposure prints the users who could push to repo and their keys, noting up front any populations that could not be listed.
+// Keys whose caveats put them below minQuality are counted but not listed.
+func printExposure(dbPath, repo string, staleAfter time.Duration, minQuality float64) error {
+	db, err := keydb.New(dbPath)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	r, err := report.Exposure(context.Background(), db, repo, now, staleAfter)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d users could push as of %s\n", r.Repo, len(r.Users), r.Collected.Format("2006-01-02 15:04"))
+	for _, l := range r.Limitations {
+		fmt.Printf("limitation: %s\n", l)
+	}
+	printCaveats(db)
+	suppressed := 0
+	for _, u := range r.Users {
+		for _, k := range u.Keys {
+			if keydb.Quality(k.Caveats) < minQuality {
+				suppressed++
+			}
+		}
+	}
+	if suppressed > 0 {
+		fmt.Printf("caveat: %d keys below -min-quality %.2f are not listed\n", suppressed, minQuality)
+	}
+	for _, u := range r.Users {
+		login := u.Login
+		if u.Identity != nil {
+			login += " [" + u.Identity.String() + "]"
+		}
+		if len(u.Keys) == 0 {
+			fmt.Printf("%s\t%s\t(no keys)\n", login, strings.Join(u.Roles, ","))
+			continue
+		}
+		for _, k := range u.Keys {
+			if keydb.Quality(k.Caveats) < minQuality {
+				continue
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%dd\t%s\t%s\n", login, strings.Join(u.Roles, ","), k.KeyType, orDash(string(k.Purpose)), k.Fingerprint, int(k.Age.Hours()/24), strings.Join(k.Flags, ","), strings.Join(keydb.CaveatCodes(k.Caveats), ","))
+		}
+	}
+	return nil
+}
+
+// printConflicts prints each recorded ownership conflict, its evidence and any resolution.
+func printConflicts(dbPath string) error {
+	db, err := keydb.New(dbPath)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer db.Close()
+
+	conflicts, err := db.Conflicts()
+	if err != nil {
+		return err
+	}
+	open := 0
+	for _, c := range conflicts {
+		if c.Resolution == nil {
+			open++
+		}
+	}
+	fmt.Printf("%d conflicts, %d unresolved\n", len(conflicts), open)
+	for _, c := range conflicts {
+		fmt.Printf("\n%s detected %s\n  %.80s\n", c.Fingerprint, c.Detected.Format("2006-01-02 15:04"), c.Key)
+		for _, s := range c.Sides {
+			fmt.Printf("  %s\tfirst %s\tlast %s\trepo %s\tsource %s\tinstance %s\trun %s\n", s.User,
+				s.FirstSeen.Format("2006-01-02"), s.LastSeen.Format("2006-01-02"), orDash(s.Repo), orDash(s.Source), orDash(s.Instance), orDash(s.RunID))
+		}
+		if r := c.Resolution; r != nil {
+			decision := r.Decision
+			if r.Login != "" {
+				decision += " " + r.Login
+			}
+			fmt.Printf("  resolved: %s by %s at %s", decision, r.By, r.At.Format("2006-01-02 15:04"))
+			if r.Note != "" {
+				fmt.Printf(": %s", r.Note)
+			}
+			fmt.Println()
+		} else {
+			fmt.Printf("  unresolved\n")
+		}
+	}
+	return nil
+}
+
+// saveTraffic appends the requests rec recorded to the database's traffic log, under this host's
+// name as collector instances are, leaving pruning to the collector. Failures are logged.
+func saveTraffic(db *keydb.KeyDB, rec *traffic.Recorder) {
+	reqs, dropped := rec.Unsaved()
+	if len(reqs) == 0 && dropped == 0 {
+		return
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	db.SetProvenance(keydb.Provenance{Instance: host})
+	if err := db.AppendTraffic(reqs, dropped, time.Time{}); err != nil {
+		log.Printf("Failed to save %d outbound requests to the traffic log: %v", len(reqs), err)
+	}
+}
+
+// printAttention prints one line per open item to w: severity, age, kind, subject, detail and
+// remedy. It reports whether any items are open.
+func printAttention(w io.Writer, dbPath string) (bool, error) {
+	db, err := keydb.New(dbPath)
+	if err != nil {
+		return false, fmt.Errorf("open database: %w", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	items := report.Attention(context.Background(), report.AttentionEnv{DB: db, DBPath: dbPath, Now: now})
+	for _, it := range items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", it.Severity, formatAge(now.Sub(it.Since)), it.Kind, it.Subject, it.Detail, it.Remedy)
+	}
+	return len(items) > 0, nil
+}
+
+// formatAge returns d in the largest whole unit of days, hours or minutes, such as "3d"
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(max(d, 0).Minutes()))
+	}
+}
+
+// printMigration prints how each imported fleet account maps to GitHub users, then the keys no
+// GitHub user is known to hold and the keys that should stop authorizing access.
+func printMigration(dbPath, blocklist string) error {
+	db, err := keydb.New(dbPath)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer db.Close()
+	if blocklist != "" {
+		bl, err := keydb.OpenBlocklist(blocklist, lists.Options{})
+		if err != nil {
+			return fmt.Errorf("load blocklist: %w", err)
+		}
+		db.SetBlocklist(bl)
+	}
+
+	r, err := report.Migration(db)
+	if err != nil {
+		return err
+	}
+	if len(r.Accounts) == 0 {
+		return fmt.Errorf("no fleet keys imported; see pubkey-db -import-fleet")
+	}
+	fmt.Printf("%d accounts on %d hosts: %d clean, %d partial, %d shared, %d unknown; %d unknown keys, %d risky\n", len(r.Accounts), r.Hosts,
+		r.Statuses[report.MappingClean], r.Statuses[report.MappingPartial], r.Statuses[report.MappingShared], r.Statuses[report.MappingUnknown], len(r.Unknown), len(r.Risky))
+	printCaveats(db)
+	for _, a := range r.Accounts {
+		fmt.Printf("account: %s\t%s\t%s\t%s\t%d keys, %d unknown\n", a.Host, a.Account, a.Status, orDash(strings.Join(a.GitHubUsers, ",")), a.Keys, a.UnknownKeys)
+	}
+	for _, k := range r.Unknown {
+		fmt.Printf("unknown key: %s\t%s\t%s\t%s\t%s\n", k.Host, k.Account, k.Fingerprint, orDash(k.Comment), k.Path)
+	}
+	for _, k := range r.Risky {
+		fmt.Printf("risky key: %s\t%s\t%s\t%s\t%s\t%s\n", k.Host, k.Account, k.Fingerprint, strings.Join(k.Reasons, ","), orDash(k.GitHubUser), k.Path)
+	}
+	return nil
+}
+
+// printAggregates writes the aggregate statistics of the keys matching f to w as indented JSON.
+func printAggregates(w io.Writer, dbPath string, f report.AggregateFilter, minPopulation int) error {
+	db, err := keydb.New(dbPath)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer db.Close()
+
+	r, err := report.Aggregates(context.Background(), db, f, minPopulation, time.Now())
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// flagSet reports whether the named flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// orDash returns s, or "-" if it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// printCaveats prints the header lines describing how the database's collection settings limit a report.
+func printCaveats(db *keydb.KeyDB) {
+	caveats, err := report.Caveats(db)
+	if err != nil {
+		log.Printf("Unable to describe collection settings: %v", err)
+		return
+	}
+	for _, c := range caveats {
+		fmt.Printf("caveat: %s\n", c)
+	}
+}
+
+// parseSince parses a duration, also accepting a whole number of days such as "90d".
+func parseSince(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
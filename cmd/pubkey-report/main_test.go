@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/report"
+)
+
+func TestParseSince(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "90d", want: 90 * 24 * time.Hour},
+		{in: "0d"},
+		{in: "36h", want: 36 * time.Hour},
+		{in: "1.5d", wantErr: true},
+		{in: "d", wantErr: true},
+		{in: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSince(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSince(%q) error = %v, want error: %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSince(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintAggregates(t *testing.T) {
+	dir := t.TempDir()
+	db, err := keydb.New(dir)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for i := range 4 {
+		seed := make([]byte, ed25519.SeedSize)
+		binary.BigEndian.PutUint64(seed, uint64(i)+1)
+		pub, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(seed).Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		login := fmt.Sprintf("user%d", i)
+		key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+		if err := db.Store(collect.UserInfo{Username: login, PublicKeys: []string{key}}, login, time.Time{}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		min          int
+		wantWithheld bool
+		wantUsers    int
+	}{
+		{name: "reported", min: 4, wantUsers: 4},
+		{name: "withheld", min: 5, wantWithheld: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := printAggregates(&out, dir, report.AggregateFilter{}, tt.min); err != nil {
+				t.Fatalf("printAggregates: %v", err)
+			}
+			var rep report.AggregateReport
+			if err := json.Unmarshal(out.Bytes(), &rep); err != nil {
+				t.Fatalf("output is not a report: %v\n%s", err, out.String())
+			}
+			if rep.Withheld != tt.wantWithheld || rep.Users != tt.wantUsers || rep.MinPopulation != tt.min {
+				t.Errorf("report = %+v, want withheld %v, %d users, minimum %d", rep, tt.wantWithheld, tt.wantUsers, tt.min)
+			}
+			if tt.wantWithheld && strings.Contains(out.String(), "key_age_days") {
+				t.Errorf("withheld report includes statistics:\n%s", out.String())
+			}
+		})
+	}
+}
+
+// fakeAttention is an attention provider reporting whatever items a test gives it
+type fakeAttention struct {
+	mu    sync.Mutex
+	items []report.AttentionItem
+}
+
+func (f *fakeAttention) Name() string { return "pubkey_report_test" }
+
+func (f *fakeAttention) Attention(context.Context, report.AttentionEnv) ([]report.AttentionItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.items, nil
+}
+
+var fakeProvider = &fakeAttention{}
+
+func init() {
+	report.RegisterAttention(fakeProvider)
+}
+
+func TestPrintAttention(t *testing.T) {
+	dir := t.TempDir()
+	db, err := keydb.New(dir)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		items    []report.AttentionItem
+		wantOpen bool
+		want     string
+	}{
+		{name: "all clear"},
+		{name: "open item", items: []report.AttentionItem{{Severity: report.SeverityWarning, Subject: "batch-1", Detail: "3 keys",
+			Since: time.Now().Add(-50 * time.Hour), Remedy: "pubkey-db -quarantine-apply batch-1"}},
+			wantOpen: true, want: "warning\t2d\tpubkey_report_test\tbatch-1\t3 keys\tpubkey-db -quarantine-apply batch-1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeProvider.mu.Lock()
+			fakeProvider.items = tt.items
+			fakeProvider.mu.Unlock()
+
+			var out bytes.Buffer
+			open, err := printAttention(&out, dir)
+			if err != nil {
+				t.Fatalf("printAttention: %v", err)
+			}
+			if open != tt.wantOpen || out.String() != tt.want {
+				t.Errorf("printAttention() = %v, output %q; want %v, %q", open, out.String(), tt.wantOpen, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: -time.Minute, want: "0m"},
+		{d: 59 * time.Minute, want: "59m"},
+		{d: 90 * time.Minute, want: "1h"},
+		{d: 71 * time.Hour, want: "2d"},
+	}
+	for _, tt := range tests {
+		if got := formatAge(tt.d); got != tt.want {
+			t.Errorf("formatAge(%s) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
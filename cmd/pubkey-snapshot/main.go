@@ -0,0 +1,228 @@
+// The pubkey-snapshot tool creates, verifies, and compares organization snapshots.
+//
+// Usage:
+//
+//	pubkey-snapshot create -org ORG [-db PATH -max-age 24h] [-o FILE]
+//	pubkey-snapshot verify FILE
+//	pubkey-snapshot diff OLD NEW
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+	"golang.org/x/oauth2"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/snapshot"
+	"github.com/tstromberg/pubkey-collector/pkg/traffic"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "create":
+		err = create(os.Args[2:])
+	case "verify":
+		err = verify(os.Args[2:])
+	case "diff":
+		err = diff(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// usage prints the command summary and exits.
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pubkey-snapshot create -org ORG [-db PATH -max-age DURATION] [-o FILE]")
+	fmt.Fprintln(os.Stderr, "       pubkey-snapshot verify FILE")
+	fmt.Fprintln(os.Stderr, "       pubkey-snapshot diff OLD NEW")
+	os.Exit(2)
+}
+
+// create collects an org (or reads it from a database) and writes a snapshot.
+func create(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	org := fs.String("org", "", "GitHub organization to snapshot")
+	dbPath := fs.String("db", "", "Read members from this database instead of collecting live")
+	maxAge := fs.Duration("max-age", 24*time.Hour, "With -db, refuse to snapshot if any member's record is older than this")
+	out := fs.String("o", "", "Output file (default: stdout)")
+	fs.Parse(args)
+
+	if *org == "" {
+		return fmt.Errorf("-org must be specified")
+	}
+
+	host, _ := os.Hostname()
+	prov := keydb.Provenance{Instance: host, RunID: keydb.NewRunID()}
+
+	var s *snapshot.Snapshot
+	var err error
+	if *dbPath != "" {
+		s, err = fromDB(*dbPath, *org, *maxAge, prov)
+	} else {
+		s, err = live(*org, prov)
+	}
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := s.Write(w); err != nil {
+		return err
+	}
+
+	hash, err := s.Hash()
+	if err != nil {
+		return err
+	}
+	log.Printf("Snapshot of %s: %d members, sha256 %s", *org, len(s.Members), hash)
+	return nil
+}
+
+// live collects the organization's members from GitHub.
+func live(org string, prov keydb.Provenance) (*snapshot.Snapshot, error) {
+	githubToken := os.Getenv("GITHUB_TOKEN")
+	if githubToken == "" {
+		return nil, fmt.Errorf("GITHUB_TOKEN environment variable must be set")
+	}
+	ctx := context.Background()
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: githubToken})
+	// Live snapshots are held to the collector's default ceiling, like every other client
+	rec := traffic.NewRecorder(traffic.DefaultCeiling, traffic.DefaultCeiling)
+	client := github.NewClient(&http.Client{Transport: rec.Transport(&oauth2.Transport{Source: ts})})
+
+	fetcher, err := collect.New(collect.Options{RoundTripper: rec.Transport(nil)})
+	if err != nil {
+		return nil, err
+	}
+	users, e, err := fetcher.OrgMembers(ctx, client, org)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]map[string][]string{}
+	for _, u := range users {
+		userKeys := map[string][]string{}
+		for _, k := range u.PublicKeys {
+			userKeys[k] = nil
+		}
+		keys[u.Username] = userKeys
+	}
+	return snapshot.New(org, time.Now(), prov, e, keys), nil
+}
+
+// fromDB builds a snapshot from records stored by org collection, requiring them to be fresh.
+func fromDB(path, org string, maxAge time.Duration, prov keydb.Provenance) (*snapshot.Snapshot, error) {
+	db, err := keydb.New(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	records, err := db.Matching(func(md *keydb.Metadata) bool {
+		return md.Source == "github-org" && md.Repo == org
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	keys := map[string]map[string][]string{}
+	runs := map[string]bool{}
+	for key, md := range records {
+		if md.Timestamp.Before(cutoff) {
+			return nil, fmt.Errorf("record for %s is from %s, older than -max-age %s; recollect the org", md.User, md.Timestamp.Format(time.RFC3339), maxAge)
+		}
+		if keys[md.User] == nil {
+			keys[md.User] = map[string][]string{}
+		}
+		keys[md.User][key] = md.Flags
+		if md.RunID != "" {
+			runs[md.RunID] = true
+		}
+	}
+	// Members without keys are not stored, so enumeration completeness is unknown here
+	s := snapshot.New(org, time.Now(), prov, nil, keys)
+	for id := range runs {
+		s.SourceRuns = append(s.SourceRuns, id)
+	}
+	sort.Strings(s.SourceRuns)
+	return s, nil
+}
+
+// verify checks a snapshot file's content hash and prints a summary.
+func verify(args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	s, err := readFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("OK: %s snapshot of %s taken %s with %d members (run %s)\n",
+		args[0], s.Org, s.TakenAt.Format(time.RFC3339), len(s.Members), s.Provenance.RunID)
+	if s.Enumeration != nil {
+		fmt.Printf("enumeration: %s\n", s.Enumeration)
+	}
+	return nil
+}
+
+// diff prints the member and key changes between two snapshot files.
+func diff(args []string) error {
+	if len(args) != 2 {
+		usage()
+	}
+	a, err := readFile(args[0])
+	if err != nil {
+		return err
+	}
+	b, err := readFile(args[1])
+	if err != nil {
+		return err
+	}
+
+	for _, c := range snapshot.Diff(a, b) {
+		fmt.Printf("%s\t%s\t%s\n", c.Kind, c.Login, c.Key)
+	}
+	return nil
+}
+
+// readFile reads and verifies a snapshot file.
+func readFile(path string) (*snapshot.Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s, err := snapshot.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
@@ -5,6 +5,8 @@ go 1.23.4
 require (
 	github.com/dgraph-io/badger/v3 v3.2103.5
 	github.com/google/go-github/v45 v45.2.0
+	github.com/klauspost/compress v1.12.3
+	golang.org/x/crypto v0.36.0
 	golang.org/x/oauth2 v0.27.0
 )
 
@@ -20,10 +22,8 @@ require (
 	github.com/golang/snappy v0.0.3 // indirect
 	github.com/google/flatbuffers v1.12.1 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
-	github.com/klauspost/compress v1.12.3 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	go.opencensus.io v0.22.5 // indirect
-	golang.org/x/crypto v0.36.0 // indirect
 	golang.org/x/net v0.38.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 )
@@ -0,0 +1,28 @@
+// Package clock abstracts the current time so that collection, storage, and replays can run against a fixed or historical clock.
+package clock
+
+import "time"
+
+// Clock reports the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+// Now returns the system time.
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Real is the system clock, and the default everywhere a Clock is accepted.
+var Real Clock = realClock{}
+
+// Fixed is a clock that always reports the same time, such as the original observation time of backfilled data.
+type Fixed time.Time
+
+// Now returns the fixed time.
+func (f Fixed) Now() time.Time {
+	return time.Time(f)
+}
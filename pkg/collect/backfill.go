@@ -0,0 +1,105 @@
+package collect
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+)
+
+// BackfillSource refreshes users missed while the event stream was not being watched: first a
+// watchlist, then an organization's members, least recently collected first, until a budget of
+// users is spent. Members beyond the budget are left to later runs.
+type BackfillSource struct {
+	Collector *Collector
+	Client    *github.Client
+	Watchlist []string
+	Org       string
+	// LastCollected maps lower-cased logins to when they were last collected. Members missing from
+	// it are taken first.
+	LastCollected map[string]time.Time
+	// Budget is the most users to fetch, watchlist included; each costs one keys request.
+	Budget int
+
+	// Coverage is set by Collect to what the backfill reached.
+	Coverage BackfillCoverage
+}
+
+// BackfillCoverage is how much of a backfill's plan was carried out
+type BackfillCoverage struct {
+	Watchlist int
+	Members   int
+	// Deferred are the watchlist users and members left out by the budget.
+	Deferred    int
+	Enumeration *Enumeration
+}
+
+// Name returns the source identifier.
+func (s *BackfillSource) Name() string {
+	return "github-backfill"
+}
+
+// Collect fetches the watchlist, then the stalest org members, adding each user to sink.
+func (s *BackfillSource) Collect(ctx context.Context, sink Sink) error {
+	budget := s.Budget
+	seen := map[string]bool{}
+	var watch []Actor
+	for _, login := range s.Watchlist {
+		if login = strings.TrimSpace(login); login != "" && !seen[strings.ToLower(login)] {
+			seen[strings.ToLower(login)] = true
+			watch = append(watch, Actor{Username: login})
+		}
+	}
+	if len(watch) > budget {
+		s.Coverage.Deferred += len(watch) - budget
+		watch = watch[:budget]
+	}
+	if err := s.fetch(ctx, sink, watch, &s.Coverage.Watchlist); err != nil {
+		return err
+	}
+	budget -= len(watch)
+
+	if s.Org == "" {
+		return nil
+	}
+	logins, e, err := orgMemberLogins(ctx, s.Client, s.Org)
+	if err != nil {
+		return err
+	}
+	s.Coverage.Enumeration = e
+	var members []Actor
+	for _, login := range logins {
+		if !seen[strings.ToLower(login)] {
+			members = append(members, Actor{Username: login, Repo: s.Org})
+		}
+	}
+	// Stalest first; never-collected members have the zero time
+	sort.SliceStable(members, func(i, j int) bool {
+		return s.LastCollected[strings.ToLower(members[i].Username)].Before(s.LastCollected[strings.ToLower(members[j].Username)])
+	})
+	if len(members) > budget {
+		s.Coverage.Deferred += len(members) - budget
+		members = members[:budget]
+	}
+	return s.fetch(ctx, sink, members, &s.Coverage.Members)
+}
+
+// fetch fetches actors and adds them to sink, counting each one added in n
+func (s *BackfillSource) fetch(ctx context.Context, sink Sink, actors []Actor, n *int) error {
+	if len(actors) == 0 {
+		return nil
+	}
+	users, err := s.Collector.fetchUsers(ctx, actors, 0)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := sink.Add(ctx, user); err != nil {
+			return err
+		}
+		*n++
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package collect
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+)
+
+// capturePattern matches the files written by CaptureEvents. Names sort in capture order.
+const capturePattern = "events-*.json.gz"
+
+// CaptureEvents writes a page of events to dir as gzipped JSON, then deletes the oldest
+// captured pages so that at most keep remain (0 keeps everything).
+func CaptureEvents(dir string, events []*github.Event, keep int) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("events-%020d.json.gz", time.Now().UnixNano()))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(f)
+	if err := json.NewEncoder(zw).Encode(events); err != nil {
+		f.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if keep <= 0 {
+		return nil
+	}
+	pages, err := capturedPages(dir)
+	if err != nil {
+		return err
+	}
+	for len(pages) > keep {
+		if err := os.Remove(pages[0]); err != nil {
+			return err
+		}
+		pages = pages[1:]
+	}
+	return nil
+}
+
+// ReplayCaptured re-runs actor selection over every page captured in dir, oldest first, using
+// the current filtering logic. Actors are deduplicated across pages. No API calls are made.
+func ReplayCaptured(dir string) ([]Actor, []Skip, error) {
+	pages, err := capturedPages(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var events []*github.Event
+	for _, path := range pages {
+		page, err := readCapture(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		events = append(events, page...)
+	}
+
+	actors, skipped := EventActors(events)
+	return actors, skipped, nil
+}
+
+// capturedPages returns the captured page files in dir, oldest first.
+func capturedPages(dir string) ([]string, error) {
+	pages, err := filepath.Glob(filepath.Join(dir, capturePattern))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(pages)
+	return pages, nil
+}
+
+// readCapture decodes one captured events page.
+func readCapture(path string) ([]*github.Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var events []*github.Event
+	if err := json.NewDecoder(zr).Decode(&events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
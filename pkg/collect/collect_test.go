@@ -0,0 +1,27 @@
+package collect
+
+import (
+	"context"
+	"sync"
+)
+
+// recordSink is a Sink that keeps what it is given
+type recordSink struct {
+	mu    sync.Mutex
+	users []*UserInfo
+	skips []Skip
+}
+
+func (s *recordSink) Add(_ context.Context, user *UserInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, user)
+	return nil
+}
+
+func (s *recordSink) Skip(_ context.Context, skip Skip) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skips = append(s.skips, skip)
+	return nil
+}
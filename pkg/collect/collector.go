@@ -0,0 +1,111 @@
+package collect
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
+	"github.com/tstromberg/pubkey-collector/pkg/stats"
+)
+
+// Defaults for the shared keys guard: a body served to this many users within the window is quarantined.
+const (
+	DefaultSharedKeysThreshold = 3
+	DefaultSharedKeysWindow    = 10 * time.Minute
+)
+
+// Options configures a Collector. The zero value scrapes .keys one user at a time, unpaced, with
+// the shared keys guard disabled.
+type Options struct {
+	// Workers is how many users' keys are fetched at once. Values below 1 mean 1. The .keys pacing
+	// interval still applies across all of them.
+	Workers int
+	// KeysInterval is the minimum time between .keys requests.
+	KeysInterval time.Duration
+	// PublicMode restricts .keys requests to one every two seconds, whatever KeysInterval says, and
+	// sets an identifying User-Agent. It is meant for unauthenticated use.
+	PublicMode bool
+	// KeysVia is how authentication keys are fetched: KeysViaScrape (the default), KeysViaAPI or KeysViaAuto.
+	KeysVia string
+	// Client is used by KeysViaAPI, and by KeysViaAuto once it switches. With a nil Client, auto mode only scrapes.
+	Client *github.Client
+	// RoundTripper carries .keys requests, such as one that records them for a trace. nil means
+	// http.DefaultTransport.
+	RoundTripper http.RoundTripper
+	// Clock timestamps collected users; nil means clock.Real. Request pacing always uses real time.
+	Clock clock.Clock
+	// Progress, if set, is called after each user in a batch is fetched, with the number fetched so
+	// far and the batch size. It is called from the fetch workers, one call at a time.
+	Progress func(done, total int)
+	// SharedKeysThreshold is how many distinct users must be served the same keys within
+	// SharedKeysWindow for them to be quarantined. A threshold below 2 disables the check.
+	SharedKeysThreshold int
+	SharedKeysWindow    time.Duration
+}
+
+// Collector fetches users' keys from GitHub: it paces .keys requests, shares concurrent fetches of
+// the same login, and counts what it did. The sources that fetch keys take one. A Collector is
+// safe for concurrent use.
+type Collector struct {
+	workers   int
+	progress  func(done, total int)
+	clock     clock.Clock
+	keys      *keysClient
+	transport *keysTransport
+	fetches   *inflight
+	guard     *sharedBodyGuard
+	counters  stats.Counters
+}
+
+// New returns a Collector configured by o.
+func New(o Options) (*Collector, error) {
+	via := o.KeysVia
+	switch via {
+	case "":
+		via = KeysViaScrape
+	case KeysViaScrape, KeysViaAuto:
+	case KeysViaAPI:
+		if o.Client == nil {
+			return nil, errors.New("fetching keys via the API needs a GitHub client")
+		}
+	default:
+		return nil, fmt.Errorf("unknown keys transport %q: want scrape, api or auto", via)
+	}
+
+	c := &Collector{
+		workers:  max(o.Workers, 1),
+		progress: o.Progress,
+		clock:    o.Clock,
+		keys:     &keysClient{interval: o.KeysInterval, roundTripper: o.RoundTripper},
+		guard:    &sharedBodyGuard{threshold: o.SharedKeysThreshold, window: o.SharedKeysWindow},
+	}
+	if c.clock == nil {
+		c.clock = clock.Real
+	}
+	if o.PublicMode {
+		c.keys.interval = max(c.keys.interval, publicModeInterval)
+		c.keys.userAgent = publicModeUserAgent
+	}
+	c.transport = &keysTransport{mode: via, client: o.Client, keys: c.keys}
+	c.fetches = &inflight{calls: map[string]*fetchCall{}, counters: &c.counters}
+	return c, nil
+}
+
+// Counts returns a snapshot of the fetch counters: users_fetched, fetch_errors and fetches_deduped.
+func (c *Collector) Counts() map[string]int {
+	return c.counters.Snapshot()
+}
+
+// Workers returns how many users' keys are fetched concurrently.
+func (c *Collector) Workers() int {
+	return c.workers
+}
+
+// KeysInterval returns the effective minimum time between .keys requests.
+func (c *Collector) KeysInterval() time.Duration {
+	return c.keys.interval
+}
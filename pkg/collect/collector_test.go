@@ -0,0 +1,354 @@
+package collect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
+)
+
+// redirectTransport sends every request to a test server, keeping its path
+type redirectTransport struct {
+	host string
+}
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = "http", rt.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestCollector returns a Collector whose .keys requests go to a server running h, and a
+// GitHub client for the same server.
+func newTestCollector(t *testing.T, h http.Handler, o Options) (*Collector, *github.Client) {
+	t.Helper()
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := github.NewClient(ts.Client())
+	client.BaseURL, _ = url.Parse(ts.URL + "/api/")
+
+	o.RoundTripper = redirectTransport{host: u.Host}
+	if o.Client == nil {
+		o.Client = client
+	}
+	c, err := New(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, client
+}
+
+// keyFor is the single key the test servers serve for login
+func keyFor(login string) string {
+	return fmt.Sprintf("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAA%s %s@example.com", strings.ToLower(login), login)
+}
+
+func TestNewOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		o            Options
+		wantErr      bool
+		wantWorkers  int
+		wantInterval time.Duration
+	}{
+		{name: "zero", wantWorkers: 1},
+		{name: "workers", o: Options{Workers: 8, KeysInterval: time.Second}, wantWorkers: 8, wantInterval: time.Second},
+		{name: "negative workers", o: Options{Workers: -3}, wantWorkers: 1},
+		{name: "public mode floor", o: Options{PublicMode: true, KeysInterval: time.Millisecond}, wantWorkers: 1, wantInterval: publicModeInterval},
+		{name: "public mode slower", o: Options{PublicMode: true, KeysInterval: time.Minute}, wantWorkers: 1, wantInterval: time.Minute},
+		{name: "api without client", o: Options{KeysVia: KeysViaAPI}, wantErr: true},
+		{name: "api", o: Options{KeysVia: KeysViaAPI, Client: github.NewClient(nil)}, wantWorkers: 1},
+		{name: "auto without client", o: Options{KeysVia: KeysViaAuto}, wantWorkers: 1},
+		{name: "unknown transport", o: Options{KeysVia: "carrier-pigeon"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(tt.o)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if c.Workers() != tt.wantWorkers || c.KeysInterval() != tt.wantInterval {
+				t.Errorf("Workers() = %d, KeysInterval() = %s; want %d, %s", c.Workers(), c.KeysInterval(), tt.wantWorkers, tt.wantInterval)
+			}
+		})
+	}
+}
+
+func TestFetchUsersKeepsActorOrder(t *testing.T) {
+	logins := []string{"ada", "grace", "missing", "linus", "ken", "barbara", "edsger", "donald"}
+	var requests atomic.Int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		login := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".keys")
+		// Earlier users answer last, so workers finish in reverse order
+		for i, l := range logins {
+			if l == login {
+				time.Sleep(time.Duration(len(logins)-i) * 5 * time.Millisecond)
+			}
+		}
+		if login == "missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, keyFor(login))
+	})
+
+	var mu sync.Mutex
+	var progress []int
+	c, _ := newTestCollector(t, h, Options{Workers: 4, Progress: func(done, total int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if total != len(logins) {
+			t.Errorf("progress total = %d, want %d", total, len(logins))
+		}
+		progress = append(progress, done)
+	}})
+	actors := make([]Actor, len(logins))
+	for i, l := range logins {
+		actors[i] = Actor{Username: l, Repo: "org"}
+	}
+
+	users, err := c.fetchUsers(context.Background(), actors, 0)
+	if err != nil {
+		t.Fatalf("fetchUsers: %v", err)
+	}
+	if len(users) != len(logins) {
+		t.Fatalf("got %d users, want %d", len(users), len(logins))
+	}
+	for i, u := range users {
+		if u.Username != logins[i] || u.Repo != "org" {
+			t.Errorf("users[%d] = %s in %q, want %s in org", i, u.Username, u.Repo, logins[i])
+		}
+		if u.Username == "missing" {
+			if u.Status != StatusNotFound || u.FetchError == "" || len(u.PublicKeys) != 0 {
+				t.Errorf("missing user: status %q, error %q, keys %q", u.Status, u.FetchError, u.PublicKeys)
+			}
+			continue
+		}
+		if u.FetchError != "" || len(u.PublicKeys) != 1 || u.PublicKeys[0] != keyFor(u.Username) {
+			t.Errorf("%s: error %q, keys %q", u.Username, u.FetchError, u.PublicKeys)
+		}
+	}
+	for i, done := range progress {
+		if done != i+1 {
+			t.Fatalf("progress calls = %v, want 1 to %d", progress, len(logins))
+		}
+	}
+	if len(progress) != len(logins) {
+		t.Errorf("%d progress calls, want %d", len(progress), len(logins))
+	}
+	counts := c.Counts()
+	if counts["users_fetched"] != len(logins) || counts["fetch_errors"] != 1 || int(requests.Load()) != len(logins) {
+		t.Errorf("counts = %v after %d requests", counts, requests.Load())
+	}
+}
+
+func TestRecentEventsDedupesActors(t *testing.T) {
+	// The same actor in two events, plus a bot
+	events := []map[string]any{
+		{"id": "3", "actor": map[string]any{"login": "ada"}, "repo": map[string]any{"name": "ada/engine"}},
+		{"id": "2", "actor": map[string]any{"login": "dependabot"}, "repo": map[string]any{"name": "ada/engine"}},
+		{"id": "1", "actor": map[string]any{"login": "grace"}, "repo": map[string]any{"name": "navy/cobol"}},
+		{"id": "0", "actor": map[string]any{"login": "ada"}, "repo": map[string]any{"name": "ada/notes"}},
+	}
+	var mu sync.Mutex
+	fetched := map[string]int{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(events)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		login := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".keys")
+		mu.Lock()
+		fetched[login]++
+		mu.Unlock()
+		fmt.Fprintln(w, keyFor(login))
+	})
+	c, client := newTestCollector(t, mux, Options{Workers: 4})
+
+	users, skipped, err := c.RecentEvents(context.Background(), client)
+	if err != nil {
+		t.Fatalf("RecentEvents: %v", err)
+	}
+	var got []string
+	for _, u := range users {
+		got = append(got, u.Username+" "+u.Repo)
+	}
+	if want := []string{"ada ada/engine", "grace navy/cobol"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("users = %q, want %q", got, want)
+	}
+	if len(skipped) != 1 || skipped[0].Username != "dependabot" || skipped[0].Reason != SkipBot {
+		t.Errorf("skipped = %+v, want dependabot as a bot", skipped)
+	}
+	if fetched["ada"] != 1 || fetched["grace"] != 1 || len(fetched) != 2 {
+		t.Errorf(".keys requests = %v, want one each for ada and grace", fetched)
+	}
+}
+
+func TestFetchUsersCancel(t *testing.T) {
+	const workers = 3
+	started := make(chan struct{}, 100)
+	var cancelled atomic.Int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			cancelled.Add(1)
+		case <-time.After(10 * time.Second):
+			fmt.Fprintln(w, keyFor("late"))
+		}
+	})
+	c, _ := newTestCollector(t, h, Options{Workers: workers})
+	var actors []Actor
+	for i := 0; i < 20; i++ {
+		actors = append(actors, Actor{Username: fmt.Sprintf("user%d", i)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	type result struct {
+		users []*UserInfo
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		users, err := c.fetchUsers(ctx, actors, 0)
+		done <- result{users, err}
+	}()
+	for i := 0; i < workers; i++ {
+		<-started
+	}
+	cancel()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetchUsers still running 5s after cancellation")
+	}
+	if !errors.Is(res.err, context.Canceled) {
+		t.Errorf("fetchUsers error = %v, want context.Canceled", res.err)
+	}
+	if len(res.users) != 0 {
+		t.Errorf("got %d users from cancelled fetches, want none", len(res.users))
+	}
+	// The server may see the disconnects a moment after the client gives up
+	deadline := time.Now().Add(5 * time.Second)
+	for cancelled.Load() < workers && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := cancelled.Load(); n != workers {
+		t.Errorf("%d in-flight requests were cancelled, want %d", n, workers)
+	}
+	if n := len(started); n != 0 {
+		t.Errorf("%d requests started after cancellation", n)
+	}
+}
+
+func TestCollectorClock(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, keyFor("ada"))
+	})
+	for _, now := range []time.Time{
+		time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC),
+		time.Date(2024, 6, 30, 23, 59, 59, 0, time.UTC),
+	} {
+		c, _ := newTestCollector(t, h, Options{Clock: clock.Fixed(now)})
+		users, err := c.fetchUsers(context.Background(), []Actor{{Username: "ada"}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 1 || !users[0].FetchedAt.Equal(now) {
+			t.Errorf("fetched %+v, want ada fetched at %s", users, now)
+		}
+	}
+}
+
+func TestCountsReconcileWithServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		users   int
+		// repeats is how many times each login appears in the batch
+		repeats int
+	}{
+		{name: "one worker", workers: 1, users: 50, repeats: 1},
+		{name: "many workers", workers: 32, users: 300, repeats: 1},
+		{name: "many workers, repeated logins", workers: 32, users: 100, repeats: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests, failed atomic.Int32
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				login := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".keys")
+				time.Sleep(time.Millisecond)
+				if strings.HasSuffix(login, "7") {
+					failed.Add(1)
+					http.NotFound(w, r)
+					return
+				}
+				fmt.Fprintln(w, keyFor(login))
+			})
+			c, _ := newTestCollector(t, h, Options{Workers: tt.workers})
+
+			var actors []Actor
+			for r := 0; r < tt.repeats; r++ {
+				for i := 0; i < tt.users; i++ {
+					// Repeats differ in case, which must still share a fetch
+					login := fmt.Sprintf("user%d", i)
+					if r%2 == 1 {
+						login = strings.ToUpper(login)
+					}
+					actors = append(actors, Actor{Username: login})
+				}
+			}
+			users, err := c.fetchUsers(context.Background(), actors, 0)
+			if err != nil {
+				t.Fatalf("fetchUsers: %v", err)
+			}
+
+			errs := 0
+			for _, u := range users {
+				if u.FetchError != "" {
+					errs++
+				}
+			}
+			counts := c.Counts()
+			if counts["users_fetched"] != len(actors) {
+				t.Errorf("users_fetched = %d, want %d", counts["users_fetched"], len(actors))
+			}
+			if counts["fetch_errors"] != errs {
+				t.Errorf("fetch_errors = %d, but %d users have fetch errors", counts["fetch_errors"], errs)
+			}
+			// Every fetch either made a request or shared one
+			if got := int(requests.Load()) + counts["fetches_deduped"]; got != len(actors) {
+				t.Errorf("%d requests + %d deduped = %d, want %d fetches", requests.Load(), counts["fetches_deduped"], got, len(actors))
+			}
+			if int64(counts["fetches_deduped"]) != c.DedupedFetches() {
+				t.Errorf("DedupedFetches() = %d, Counts has %d", c.DedupedFetches(), counts["fetches_deduped"])
+			}
+			if tt.repeats == 1 && int(failed.Load()) != errs {
+				t.Errorf("server failed %d requests, %d users have fetch errors", failed.Load(), errs)
+			}
+		})
+	}
+}
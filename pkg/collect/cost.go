@@ -0,0 +1,146 @@
+package collect
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+)
+
+// The cost model: how many requests collecting each user takes with each option. Update it alongside
+// any change to the requests a source, enrichment or option makes per user.
+const (
+	// keysRequestsPerUser is the .keys fetch every user gets; it is not counted against the API rate limit.
+	keysRequestsPerUser = 1
+	// signingRequestsPerUser is the signing keys API call made with -signing-keys (users with over 100 signing keys need more).
+	signingRequestsPerUser = 1
+	// pageSize is the page size of the member list and credential authorization APIs.
+	pageSize = 100
+	// eventsRequestsPerCycle is the events page fetched per stream cycle.
+	eventsRequestsPerCycle = 1
+	// eventsUserDelay is the pause before each user in an events page.
+	eventsUserDelay = 50 * time.Millisecond
+	// requestLatency is the assumed duration of one request, for wall time estimates.
+	requestLatency = 250 * time.Millisecond
+)
+
+// CostOptions describes a planned collection.
+type CostOptions struct {
+	// Users is how many users will be collected.
+	Users int
+	// Org is set when users come from org member enumeration.
+	Org bool
+	// Events is set when users come from one page of the events stream.
+	Events      bool
+	SigningKeys bool
+	KeyUsage    bool
+	// KeysInterval is the minimum time between .keys requests.
+	KeysInterval time.Duration
+	// KeysViaAPI is set when keys are fetched through the REST API rather than .keys (see Options.KeysVia).
+	KeysViaAPI bool
+	// Workers is how many users are fetched concurrently (see Options.Workers).
+	Workers int
+}
+
+// CostLine is one part of an estimate.
+type CostLine struct {
+	What string
+	API  int
+	Keys int
+}
+
+// Estimate is the predicted request count and wall time of a collection.
+type Estimate struct {
+	Users     int
+	Breakdown []CostLine
+	API       int
+	Keys      int
+	// APIRemaining, APILimit and APIReset are the token's quota when the estimate was made, if known.
+	APIRemaining int
+	APILimit     int
+	APIReset     time.Time
+	// RateLimitWait is time spent waiting for the quota to reset.
+	RateLimitWait time.Duration
+	Duration      time.Duration
+}
+
+// EstimateCost applies the cost model to a planned collection, ignoring quota.
+func EstimateCost(o CostOptions) *Estimate {
+	e := &Estimate{Users: o.Users}
+	add := func(what string, api, keys int) {
+		e.Breakdown = append(e.Breakdown, CostLine{What: what, API: api, Keys: keys})
+		e.API += api
+		e.Keys += keys
+	}
+
+	pages := (o.Users + pageSize - 1) / pageSize
+	if o.Org {
+		// One request for the seat count; a GraphQL retry would double the pages
+		add("list org members", pages+1, 0)
+	}
+	if o.Events {
+		add("list events", eventsRequestsPerCycle, 0)
+	}
+	if o.KeysViaAPI {
+		add("fetch keys via API", o.Users*keysRequestsPerUser, 0)
+	} else {
+		add("fetch .keys", 0, o.Users*keysRequestsPerUser)
+	}
+	if o.SigningKeys {
+		add("fetch signing keys", o.Users*signingRequestsPerUser, 0)
+	}
+	if o.KeyUsage {
+		add("list credential authorizations", max(pages, 1), 0)
+	}
+
+	// Workers overlap request latency and delays, but never beat the pacing interval
+	perKeys := requestLatency
+	if o.Events {
+		perKeys += eventsUserDelay
+	}
+	perKeys = max(o.KeysInterval, perKeys/time.Duration(max(o.Workers, 1)))
+	e.Duration = time.Duration(e.Keys)*perKeys + time.Duration(e.API)*requestLatency
+	return e
+}
+
+// ApplyQuota adds the time spent waiting for rate limit resets, given the quota at now.
+func (e *Estimate) ApplyQuota(remaining, limit int, reset, now time.Time) {
+	e.APIRemaining, e.APILimit, e.APIReset = remaining, limit, reset
+	over := e.API - remaining
+	if over <= 0 || limit <= 0 {
+		return
+	}
+	// Wait for the first reset, then an hour for each further full quota
+	e.RateLimitWait = max(reset.Sub(now), 0) + time.Duration((over-1)/limit)*time.Hour
+	e.Duration += e.RateLimitWait
+}
+
+// String formats the estimate as a human-readable breakdown.
+func (e *Estimate) String() string {
+	s := fmt.Sprintf("Estimate for %d users:\n", e.Users)
+	for _, l := range e.Breakdown {
+		s += fmt.Sprintf("  %-32s %7d API requests %7d .keys requests\n", l.What, l.API, l.Keys)
+	}
+	s += fmt.Sprintf("  %-32s %7d API requests %7d .keys requests\n", "total", e.API, e.Keys)
+	if e.APILimit > 0 {
+		s += fmt.Sprintf("API quota: %d of %d remaining, resets %s\n", e.APIRemaining, e.APILimit, e.APIReset.Format(time.RFC3339))
+	}
+	if e.RateLimitWait > 0 {
+		s += fmt.Sprintf("Rate limit waits: %s\n", e.RateLimitWait.Round(time.Second))
+	}
+	s += fmt.Sprintf("ETA: %s", e.Duration.Round(time.Second))
+	return s
+}
+
+// OrgMemberCount returns how many members of org the token can list, using a single request.
+func OrgMemberCount(ctx context.Context, client *github.Client, org string) (int, error) {
+	members, resp, err := client.Organizations.ListMembers(ctx, org, &github.ListMembersOptions{ListOptions: github.ListOptions{PerPage: 1}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count org members: %w", err)
+	}
+	if resp.LastPage == 0 {
+		return len(members), nil
+	}
+	return resp.LastPage, nil
+}
@@ -0,0 +1,65 @@
+package collect
+
+import (
+	"sort"
+	"strings"
+)
+
+// DedupeKeys removes keys repeated within user's PublicKeys, and within its SigningKeys, and sorts
+// each list by key type then blob so output is stable. Keys are compared by type and blob, ignoring
+// comments; of several lines with the same blob, the lexically smallest is kept, taking the dropped
+// lines' KeyCreatedAt entries when it has none. It returns the dropped lines that differ from the
+// kept ones (exact repeats are removed but not returned) and how many lines were removed in all.
+func DedupeKeys(user *UserInfo) ([]string, int) {
+	var dropped []string
+	before := len(user.PublicKeys) + len(user.SigningKeys)
+	user.PublicKeys, dropped = dedupe(user, user.PublicKeys, dropped)
+	user.SigningKeys, dropped = dedupe(user, user.SigningKeys, dropped)
+	return dropped, before - len(user.PublicKeys) - len(user.SigningKeys)
+}
+
+// dedupe returns keys without repeated blobs, sorted, appending the lines it drops to dropped.
+func dedupe(user *UserInfo, keys, dropped []string) ([]string, []string) {
+	if len(keys) == 0 {
+		return keys, dropped
+	}
+	sorted := append([]string(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool {
+		bi, bj := keyBlob(sorted[i]), keyBlob(sorted[j])
+		if bi != bj {
+			return bi < bj
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	out := sorted[:1]
+	for i, key := range sorted[1:] {
+		kept := out[len(out)-1]
+		if keyBlob(key) != keyBlob(kept) {
+			out = append(out, key)
+			continue
+		}
+		// Sorting puts repeats of a dropped line next to it, so each is reported once
+		if key != kept && key != sorted[i] {
+			dropped = append(dropped, key)
+		}
+		if created, ok := user.KeyCreatedAt[key]; ok {
+			if _, has := user.KeyCreatedAt[kept]; !has {
+				user.KeyCreatedAt[kept] = created
+			}
+			if key != kept {
+				delete(user.KeyCreatedAt, key)
+			}
+		}
+	}
+	return out, dropped
+}
+
+// keyBlob returns the type and blob of an authorized_keys line without its comment.
+func keyBlob(key string) string {
+	f := strings.Fields(key)
+	if len(f) < 2 {
+		return key
+	}
+	return f[0] + " " + f[1]
+}
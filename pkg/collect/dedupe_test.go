@@ -0,0 +1,66 @@
+package collect
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDedupeKeys(t *testing.T) {
+	const (
+		ed1 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAaaaa"
+		ed2 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAbbbb"
+		rsa = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCz"
+	)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name        string
+		user        UserInfo
+		wantKeys    []string
+		wantSigning []string
+		wantDropped []string
+		wantRemoved int
+		wantCreated map[string]time.Time
+	}{
+		{name: "empty", user: UserInfo{PublicKeys: []string{}}, wantKeys: []string{}},
+		{name: "sorted by type then blob", user: UserInfo{PublicKeys: []string{rsa, ed2, ed1}},
+			wantKeys: []string{ed1, ed2, rsa}},
+		{name: "exact repeats are removed, not reported", user: UserInfo{PublicKeys: []string{ed1, ed2, ed1, ed1}},
+			wantKeys: []string{ed1, ed2}, wantRemoved: 2},
+		{name: "comments are ignored, keeping the smallest line", user: UserInfo{PublicKeys: []string{ed1 + " laptop", ed1 + " desktop", ed1 + " laptop"}},
+			wantKeys: []string{ed1 + " desktop"}, wantDropped: []string{ed1 + " laptop"}, wantRemoved: 2},
+		{name: "a bare line sorts before a commented one", user: UserInfo{PublicKeys: []string{ed1 + " laptop", ed1}},
+			wantKeys: []string{ed1}, wantDropped: []string{ed1 + " laptop"}, wantRemoved: 1},
+		{name: "signing keys are deduped separately", user: UserInfo{PublicKeys: []string{ed1}, SigningKeys: []string{ed1, ed2, ed1}},
+			wantKeys: []string{ed1}, wantSigning: []string{ed1, ed2}, wantRemoved: 1},
+		{name: "created time moves to the kept line", user: UserInfo{PublicKeys: []string{ed1 + " old", ed1}, KeyCreatedAt: map[string]time.Time{ed1 + " old": created}},
+			wantKeys: []string{ed1}, wantDropped: []string{ed1 + " old"}, wantRemoved: 1, wantCreated: map[string]time.Time{ed1: created}},
+		{name: "kept line's created time wins", user: UserInfo{PublicKeys: []string{ed1 + " old", ed1}, KeyCreatedAt: map[string]time.Time{ed1: created, ed1 + " old": created.Add(time.Hour)}},
+			wantKeys: []string{ed1}, wantDropped: []string{ed1 + " old"}, wantRemoved: 1, wantCreated: map[string]time.Time{ed1: created}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := tt.user
+			dropped, removed := DedupeKeys(&user)
+			if !slices.Equal(user.PublicKeys, tt.wantKeys) {
+				t.Errorf("PublicKeys = %q, want %q", user.PublicKeys, tt.wantKeys)
+			}
+			if !slices.Equal(user.SigningKeys, tt.wantSigning) {
+				t.Errorf("SigningKeys = %q, want %q", user.SigningKeys, tt.wantSigning)
+			}
+			if !slices.Equal(dropped, tt.wantDropped) || removed != tt.wantRemoved {
+				t.Errorf("DedupeKeys() = %q, %d; want %q, %d", dropped, removed, tt.wantDropped, tt.wantRemoved)
+			}
+			if tt.wantCreated != nil && !maps.Equal(user.KeyCreatedAt, tt.wantCreated) {
+				t.Errorf("KeyCreatedAt = %v, want %v", user.KeyCreatedAt, tt.wantCreated)
+			}
+
+			// Deduping again changes nothing
+			again := slices.Clone(user.PublicKeys)
+			if dropped, removed := DedupeKeys(&user); len(dropped) != 0 || removed != 0 || !slices.Equal(user.PublicKeys, again) {
+				t.Errorf("second DedupeKeys() = %q, %d, keys %q", dropped, removed, user.PublicKeys)
+			}
+		})
+	}
+}
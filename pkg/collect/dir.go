@@ -0,0 +1,156 @@
+package collect
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
+)
+
+// maxFileNameLen bounds the encoded part of a user's JSON file name, leaving room for a hash and extension.
+const maxFileNameLen = 180
+
+// reservedNames are device names Windows refuses to use as file names, with or without an extension.
+var reservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// FileName returns a file name for a user's JSON file that is safe on common filesystems.
+//
+// Characters outside [A-Za-z0-9_-] are percent-encoded, as is the first character of a Windows
+// reserved device name, so short names decode back to the login with url.PathUnescape.
+// Over-long names are truncated and suffixed with a hash of the login; the true login is always
+// stored inside the file, and readers should prefer it to the file name.
+func FileName(login string) string {
+	var b strings.Builder
+	for i := 0; i < len(login); i++ {
+		c := login[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	name := b.String()
+
+	if reservedNames[strings.ToLower(name)] {
+		name = fmt.Sprintf("%%%02X", name[0]) + name[1:]
+	}
+	if len(name) > maxFileNameLen {
+		name = fmt.Sprintf("%s~%x", name[:maxFileNameLen], sha256.Sum256([]byte(login)))[:maxFileNameLen+17]
+	}
+	if name == "" {
+		name = "%00"
+	}
+	return name + ".json"
+}
+
+// FileSchema is the version of the JSON file format written by WriteJSON. Version 1 added status.
+const FileSchema = 1
+
+// WriteJSON writes a user's info to dir, named with FileName, stamping it with FileSchema. Users from
+// sources that don't set Status get one implied by their keys and FetchError.
+func WriteJSON(dir string, user *UserInfo) error {
+	user.Schema = FileSchema
+	if user.Status == "" {
+		user.Status = fetchStatus(user.PublicKeys, fetchErr(user.FetchError))
+	}
+	data, err := json.MarshalIndent(user, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, FileName(user.Username)), data, 0o600)
+}
+
+// DirSource reads users from a directory tree of UserInfo JSON files, as written by earlier collector versions.
+type DirSource struct {
+	// Path is the directory to search for JSON files.
+	Path string
+	// Clock, if set, timestamps files that lack fetched_at instead of their modification time.
+	// Use a historical clock when the files' modification times were lost in copying.
+	Clock clock.Clock
+}
+
+// Name returns the source identifier.
+func (s *DirSource) Name() string {
+	return "dir"
+}
+
+// Collect walks the directory and adds a user for each parseable JSON file.
+// Unreadable or malformed files are logged and skipped.
+func (s *DirSource) Collect(ctx context.Context, sink Sink) error {
+	return filepath.Walk(s.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Skip directories and non-JSON files
+		if info.IsDir() || !strings.HasSuffix(strings.ToLower(info.Name()), ".json") {
+			return nil
+		}
+
+		log.Printf("Processing %s", path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Error reading file %s: %v", path, err)
+			return nil // Continue with next file
+		}
+
+		var user UserInfo
+		if err := json.Unmarshal(data, &user); err != nil {
+			log.Printf("Error parsing JSON in file %s: %v", path, err)
+			return nil // Continue with next file
+		}
+
+		// Older files are named after the user and may lack the username or fetch time.
+		// The file name may be sanitized, so only fall back to it when the JSON has no login.
+		if user.Username == "" {
+			base := filepath.Base(path)
+			user.Username = strings.TrimSuffix(base, filepath.Ext(base))
+			if decoded, err := url.PathUnescape(user.Username); err == nil {
+				user.Username = decoded
+			}
+		}
+		if user.Schema == 0 {
+			user.Status = legacyStatus(&user)
+		}
+		if user.FetchedAt.IsZero() {
+			user.FetchedAt = info.ModTime()
+			if s.Clock != nil {
+				user.FetchedAt = s.Clock.Now()
+			}
+		}
+
+		return sink.Add(ctx, &user)
+	})
+}
+
+// legacyStatus returns the status of a user read from a file without one. Failed runs also wrote
+// empty key lists, so a file with no keys is assumed to be a failed fetch rather than a user without keys.
+func legacyStatus(user *UserInfo) UserStatus {
+	if len(user.PublicKeys) > 0 {
+		return StatusOK
+	}
+	return StatusFetchFailed
+}
+
+// fetchErr returns a FetchError message as an error, or nil if it is empty.
+func fetchErr(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,91 @@
+package collect
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// nastyNames are logins, real or not, that have broken file-based tools
+var nastyNames = []string{
+	"alice",
+	"Alice-Smith",
+	"con", "NUL", "Com1", "lpt9", "aux.json",
+	"a.b", "..", "../etc/passwd", `c:\windows`, "a/b",
+	"аlice", // Cyrillic а, confusable with alice
+	"名前",
+	"tab\there", "new\nline", "nul\x00byte",
+	"%41", "~", " ", "",
+	strings.Repeat("x", 300),
+	strings.Repeat("y", 300),
+}
+
+// safeFileName matches the characters FileName may emit
+var safeFileName = regexp.MustCompile(`^[A-Za-z0-9_%~-]+\.json$`)
+
+func TestFileName(t *testing.T) {
+	seen := map[string]string{}
+	for _, login := range nastyNames {
+		name := FileName(login)
+		if !safeFileName.MatchString(name) {
+			t.Errorf("FileName(%q) = %q has unsafe characters", login, name)
+		}
+		base := strings.TrimSuffix(name, ".json")
+		if reservedNames[strings.ToLower(base)] || reservedNames[strings.ToLower(strings.SplitN(base, ".", 2)[0])] {
+			t.Errorf("FileName(%q) = %q is a Windows device name", login, name)
+		}
+		if len(name) > 255 {
+			t.Errorf("FileName(%q) is %d bytes, over the common 255 byte limit", login, len(name))
+		}
+		if prev, dup := seen[name]; dup {
+			t.Errorf("FileName(%q) = FileName(%q) = %q", login, prev, name)
+		}
+		seen[name] = login
+
+		if len(base) <= maxFileNameLen && login != "" {
+			if got, err := url.PathUnescape(base); err != nil || got != login {
+				t.Errorf("FileName(%q) = %q decodes to %q, %v", login, name, got, err)
+			}
+		}
+	}
+}
+
+func TestDirSourceUsesLoginFromFile(t *testing.T) {
+	dir := t.TempDir()
+	var want []string
+	for _, login := range nastyNames {
+		if login == "" {
+			continue
+		}
+		if err := WriteJSON(dir, &UserInfo{Username: login, PublicKeys: []string{"ssh-ed25519 AAAA"}}); err != nil {
+			t.Fatalf("WriteJSON(%q): %v", login, err)
+		}
+		want = append(want, login)
+	}
+	// A file from before logins were stored, named after its user
+	legacy, _ := json.Marshal(UserInfo{PublicKeys: []string{"ssh-ed25519 BBBB"}})
+	if err := os.WriteFile(filepath.Join(dir, FileName("old name")), legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "old name")
+
+	sink := &recordSink{}
+	if err := (&DirSource{Path: dir}).Collect(context.Background(), sink); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	var got []string
+	for _, u := range sink.users {
+		got = append(got, u.Username)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, "\x01") != strings.Join(want, "\x01") {
+		t.Errorf("read logins %q, want %q", got, want)
+	}
+}
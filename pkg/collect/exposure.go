@@ -0,0 +1,171 @@
+package collect
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+)
+
+// Exposure roles: how a user could push to a repository.
+const (
+	RoleAdmin      = "collaborator:admin"
+	RoleMaintain   = "collaborator:maintain"
+	RoleWrite      = "collaborator:write"
+	RoleCommitter  = "committer"
+	RoleOrgAdmin   = "org-admin"
+	maxCommitPages = 10
+)
+
+// ExposureSource collects everyone who could push to a repository: collaborators with write access,
+// recent committers, and admins of the owning organization. Populations the token can't see are
+// skipped and described in Limitations, leaving the public subsets.
+type ExposureSource struct {
+	Collector *Collector
+	Client    *github.Client
+	// Repo is "owner/repo".
+	Repo string
+	// Since bounds how far back committers are taken from.
+	Since time.Time
+
+	// Roles is set by Collect to each user's roles, keyed by login.
+	Roles map[string][]string
+	// Limitations is set by Collect to the populations that could not be listed, and why.
+	Limitations []string
+}
+
+// Name returns the source identifier.
+func (s *ExposureSource) Name() string {
+	return "github-exposure"
+}
+
+// Collect gathers the repository's exposed users and adds each one to sink.
+func (s *ExposureSource) Collect(ctx context.Context, sink Sink) error {
+	owner, repo, ok := strings.Cut(s.Repo, "/")
+	if !ok || owner == "" || repo == "" {
+		return fmt.Errorf("exposure repository %q is not owner/repo", s.Repo)
+	}
+	s.Roles = map[string][]string{}
+	s.Limitations = nil
+	addRole := func(login, role string) {
+		for _, r := range s.Roles[login] {
+			if r == role {
+				return
+			}
+		}
+		s.Roles[login] = append(s.Roles[login], role)
+	}
+
+	if err := s.collaborators(ctx, owner, repo, addRole); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.Limitations = append(s.Limitations, fmt.Sprintf("collaborators not listed (needs push access to %s): %v", s.Repo, err))
+	}
+	if err := s.committers(ctx, owner, repo, addRole); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.Limitations = append(s.Limitations, fmt.Sprintf("committers not listed: %v", err))
+	}
+	if err := s.orgAdmins(ctx, owner, addRole); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.Limitations = append(s.Limitations, fmt.Sprintf("org admins not listed (needs %s membership, or owner is a user): %v", owner, err))
+	}
+
+	logins := make([]string, 0, len(s.Roles))
+	for login, roles := range s.Roles {
+		sort.Strings(roles)
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	actors := make([]Actor, len(logins))
+	for i, login := range logins {
+		actors[i] = Actor{Username: login, Repo: s.Repo}
+	}
+
+	users, err := s.Collector.fetchUsers(ctx, actors, 0)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := sink.Add(ctx, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collaborators adds the repository's collaborators who can push.
+func (s *ExposureSource) collaborators(ctx context.Context, owner, repo string, addRole func(login, role string)) error {
+	opts := &github.ListCollaboratorsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		users, resp, err := s.Client.Repositories.ListCollaborators(ctx, owner, repo, opts)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			perms := u.GetPermissions()
+			switch {
+			case perms["admin"]:
+				addRole(u.GetLogin(), RoleAdmin)
+			case perms["maintain"]:
+				addRole(u.GetLogin(), RoleMaintain)
+			case perms["push"]:
+				addRole(u.GetLogin(), RoleWrite)
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// committers adds the authors and committers of the repository's commits since s.Since.
+func (s *ExposureSource) committers(ctx context.Context, owner, repo string, addRole func(login, role string)) error {
+	opts := &github.CommitsListOptions{Since: s.Since, ListOptions: github.ListOptions{PerPage: 100}}
+	for page := 0; page < maxCommitPages; page++ {
+		commits, resp, err := s.Client.Repositories.ListCommits(ctx, owner, repo, opts)
+		if err != nil {
+			return err
+		}
+		for _, c := range commits {
+			for _, login := range []string{c.GetAuthor().GetLogin(), c.GetCommitter().GetLogin()} {
+				// "web-flow" commits merges made in the GitHub UI
+				if login != "" && login != "web-flow" {
+					addRole(login, RoleCommitter)
+				}
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil
+		}
+		opts.Page = resp.NextPage
+	}
+	s.Limitations = append(s.Limitations, fmt.Sprintf("committers limited to the newest %d commits", maxCommitPages*100))
+	return nil
+}
+
+// orgAdmins adds the admins of the owning organization.
+func (s *ExposureSource) orgAdmins(ctx context.Context, org string, addRole func(login, role string)) error {
+	opts := &github.ListMembersOptions{Role: "admin", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		members, resp, err := s.Client.Organizations.ListMembers(ctx, org, opts)
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			addRole(m.GetLogin(), RoleOrgAdmin)
+		}
+		if resp.NextPage == 0 {
+			return nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
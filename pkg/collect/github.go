@@ -3,63 +3,223 @@ package collect
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/google/go-github/v45/github"
 )
 
+// maxKeysBodySize bounds how much of a .keys response is read.
+const maxKeysBodySize = 1 << 20
+
 // UserInfo represents a GitHub user and their SSH public keys.
 type UserInfo struct {
 	// PublicKeys contains the user's public SSH keys.
 	PublicKeys []string `json:"public_keys"`
+	// SigningKeys contains the user's public SSH signing keys (when collected).
+	SigningKeys []string `json:"signing_keys,omitempty"`
+	// KeyCreatedAt maps public keys to the time they were added to GitHub, when known.
+	KeyCreatedAt map[string]time.Time `json:"key_created_at,omitempty"`
 	// Repo is the repository the user was active in (for event-based collection).
 	Repo string `json:"repo,omitempty"`
 	// Username is the GitHub username.
 	Username string `json:"username"`
+	// FetchError is set when the user's public keys could not be fetched.
+	FetchError string `json:"fetch_error,omitempty"`
+	// Status is the outcome of fetching PublicKeys. Files from before FileSchema 1 lack it.
+	Status UserStatus `json:"status,omitempty"`
+	// Schema is the JSON file format version; 0 means a file written before versioning.
+	Schema int `json:"schema,omitempty"`
+	// FetchedAt is when the keys were fetched.
+	FetchedAt time.Time `json:"fetched_at,omitempty"`
+	// Source is the name of the Source that produced this user.
+	Source string `json:"source,omitempty"`
+	// KeysVia is the transport PublicKeys were fetched over: KeysViaScrape or KeysViaAPI.
+	KeysVia string `json:"keys_via,omitempty"`
+	// Quarantine is set when the same keys were served for several other users at about the same
+	// time; such users are held for review rather than stored.
+	Quarantine *Quarantine `json:"quarantine,omitempty"`
 }
 
-// OrgMembers retrieves all members of a GitHub organization and their public keys.
-func OrgMembers(ctx context.Context, client *github.Client, org string) ([]*UserInfo, error) {
-	var allUsers []*UserInfo
-	opts := &github.ListMembersOptions{}
+// UserStatus is the outcome of fetching a user's public keys
+type UserStatus string
 
-	for {
-		members, resp, err := client.Organizations.ListMembers(ctx, org, opts)
-		if err != nil {
-			return nil, fmt.Errorf("failed to list org members: %w", err)
+const (
+	// StatusOK means the user was fetched and has public keys.
+	StatusOK UserStatus = "ok"
+	// StatusEmpty means the user was fetched and has no public keys.
+	StatusEmpty UserStatus = "empty"
+	// StatusFetchFailed means the keys could not be fetched; the user should be retried.
+	StatusFetchFailed UserStatus = "fetch_failed"
+	// StatusNotFound means GitHub has no such user.
+	StatusNotFound UserStatus = "not_found"
+)
+
+// ErrUserNotFound is returned (wrapped) when GitHub reports that a user does not exist.
+var ErrUserNotFound = errors.New("user not found")
+
+// fetchStatus returns the status implied by a fetch's outcome.
+func fetchStatus(keys []string, err error) UserStatus {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return StatusNotFound
+	case err != nil:
+		return StatusFetchFailed
+	case len(keys) == 0:
+		return StatusEmpty
+	default:
+		return StatusOK
+	}
+}
+
+// OrgSource collects all members of a GitHub organization.
+type OrgSource struct {
+	Collector *Collector
+	Client    *github.Client
+	Org       string
+
+	// Enumeration is set by Collect to describe how complete the member list was.
+	Enumeration *Enumeration
+}
+
+// Name returns the source identifier.
+func (s *OrgSource) Name() string {
+	return "github-org"
+}
+
+// Collect lists the organization's members and adds each one to sink.
+func (s *OrgSource) Collect(ctx context.Context, sink Sink) error {
+	users, e, err := s.Collector.OrgMembers(ctx, s.Client, s.Org)
+	if err != nil {
+		return err
+	}
+	s.Enumeration = e
+	for _, user := range users {
+		if err := sink.Add(ctx, user); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		for _, member := range members {
-			username := member.GetLogin()
-			if username == "" {
-				continue
-			}
+// EventsSource collects active users from one poll of the GitHub public events stream.
+// Callers wanting a continuous stream run Collect repeatedly.
+type EventsSource struct {
+	Collector *Collector
+	Client    *github.Client
 
-			user, err := processUser(username, org)
-			if err == nil && user != nil {
-				allUsers = append(allUsers, user)
-			}
+	// CaptureDir, if set, receives a gzipped JSON copy of each events page for later replay.
+	CaptureDir string
+	// CaptureKeep is the maximum number of captured pages retained in CaptureDir (0 for unlimited).
+	CaptureKeep int
+}
+
+// Name returns the source identifier.
+func (s *EventsSource) Name() string {
+	return "github-events"
+}
+
+// Collect fetches recent events and passes their actors to sink.
+func (s *EventsSource) Collect(ctx context.Context, sink Sink) error {
+	events, err := listEvents(ctx, s.Client)
+	if err != nil {
+		return err
+	}
+	if s.CaptureDir != "" {
+		if err := CaptureEvents(s.CaptureDir, events, s.CaptureKeep); err != nil {
+			log.Printf("failed to capture events page: %v", err)
 		}
+	}
 
-		if resp.NextPage == 0 {
-			break
+	users, skipped, err := s.Collector.usersFromEvents(ctx, events)
+	if err != nil {
+		return err
+	}
+	for _, skip := range skipped {
+		if err := sink.Skip(ctx, skip); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Processing %d users from events...", len(users))
+	for _, user := range users {
+		if err := sink.Add(ctx, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UsersSource collects a fixed list of GitHub users using only the .keys endpoint.
+type UsersSource struct {
+	Collector *Collector
+	Usernames []string
+}
+
+// Name returns the source identifier.
+func (s *UsersSource) Name() string {
+	return "github-users"
+}
+
+// Collect fetches each listed user's keys and adds them to sink.
+func (s *UsersSource) Collect(ctx context.Context, sink Sink) error {
+	var actors []Actor
+	for _, username := range s.Usernames {
+		if username = strings.TrimSpace(username); username != "" {
+			actors = append(actors, Actor{Username: username})
+		}
+	}
+
+	users, err := s.Collector.fetchUsers(ctx, actors, 0)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := sink.Add(ctx, user); err != nil {
+			return err
 		}
-		opts.Page = resp.NextPage
+	}
+	return nil
+}
+
+// OrgMembers retrieves all members of a GitHub organization and their public keys,
+// along with a summary of whether the member list is believed complete.
+func (c *Collector) OrgMembers(ctx context.Context, client *github.Client, org string) ([]*UserInfo, *Enumeration, error) {
+	logins, e, err := orgMemberLogins(ctx, client, org)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return allUsers, nil
+	actors := make([]Actor, len(logins))
+	for i, username := range logins {
+		actors[i] = Actor{Username: username, Repo: org}
+	}
+	users, err := c.fetchUsers(ctx, actors, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return users, e, nil
 }
 
-// RecentEvents retrieves active users from the GitHub events stream.
-func RecentEvents(ctx context.Context, client *github.Client) ([]*UserInfo, error) {
+// RecentEvents retrieves active users from the GitHub events stream, along with the actors it skipped.
+func (c *Collector) RecentEvents(ctx context.Context, client *github.Client) ([]*UserInfo, []Skip, error) {
+	events, err := listEvents(ctx, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.usersFromEvents(ctx, events)
+}
+
+// listEvents fetches the latest page of public events.
+func listEvents(ctx context.Context, client *github.Client) ([]*github.Event, error) {
 	opts := &github.ListOptions{PerPage: 100}
-	seen := map[string]bool{}
-	var allUsers []*UserInfo
 
 	events, _, err := client.Activity.ListEvents(ctx, opts)
 	if err != nil {
@@ -68,6 +228,31 @@ func RecentEvents(ctx context.Context, client *github.Client) ([]*UserInfo, erro
 		}
 		return nil, fmt.Errorf("failed to list events: %w", err)
 	}
+	return events, nil
+}
+
+// usersFromEvents fetches public keys for the actors selected from a page of events.
+func (c *Collector) usersFromEvents(ctx context.Context, events []*github.Event) ([]*UserInfo, []Skip, error) {
+	actors, skipped := EventActors(events)
+	// Small delay to avoid hammering GitHub
+	users, err := c.fetchUsers(ctx, actors, eventsUserDelay)
+	return users, skipped, err
+}
+
+// Actor is an event actor selected for key collection.
+type Actor struct {
+	// Username is the actor's GitHub login.
+	Username string `json:"username"`
+	// Repo is the repository of the first event the actor appeared in.
+	Repo string `json:"repo,omitempty"`
+}
+
+// EventActors selects the distinct actors to collect from events, in order of first appearance,
+// along with the actors it decided to skip. It makes no network requests.
+func EventActors(events []*github.Event) ([]Actor, []Skip) {
+	seen := map[string]bool{}
+	var actors []Actor
+	var skipped []Skip
 
 	for _, event := range events {
 		if event.GetActor() == nil {
@@ -78,73 +263,173 @@ func RecentEvents(ctx context.Context, client *github.Client) ([]*UserInfo, erro
 		if login == "" || seen[login] {
 			continue
 		}
-
-		// Skip likely bots
-		if strings.HasSuffix(login, "bot") || strings.HasSuffix(login, "bot]") {
-			continue
-		}
-
-		// Small delay to avoid hammering the API
-		time.Sleep(50 * time.Millisecond)
+		seen[login] = true
 
 		repoName := ""
 		if event.GetRepo() != nil {
 			repoName = event.GetRepo().GetName()
 		}
 
-		user, err := processUser(login, repoName)
-		if err == nil && user != nil {
-			allUsers = append(allUsers, user)
+		// Skip likely bots
+		if strings.HasSuffix(login, "bot") || strings.HasSuffix(login, "bot]") {
+			log.Printf("skipping %q: login looks like a bot", login)
+			skipped = append(skipped, Skip{Username: login, Reason: SkipBot, Detail: "login ends in \"bot\"", Repo: repoName})
+			continue
 		}
-		seen[login] = true
+
+		actors = append(actors, Actor{Username: login, Repo: repoName})
 	}
 
-	return allUsers, nil
+	return actors, skipped
 }
 
+// errFetchShared is returned by processUser to callers whose fetch was shared with a concurrent
+// caller for the same login; only that caller's user is returned, so it is stored once.
+var errFetchShared = errors.New("fetched by a concurrent caller")
+
 // processUser fetches public keys for a GitHub user.
-func processUser(username, repo string) (*UserInfo, error) {
+func (c *Collector) processUser(ctx context.Context, username, repo string) (*UserInfo, error) {
 	if username == "" {
 		return nil, fmt.Errorf("empty username")
 	}
 
-	// Fetch public keys
-	publicKeys, err := fetchPublicKeys(username)
+	user := &UserInfo{
+		Repo:      repo,
+		Username:  username,
+		FetchedAt: c.clock.Now(),
+	}
+
+	// Fetch public keys, leaving the result of any concurrent fetch for the same user to its caller
+	publicKeys, via, shared, err := c.fetches.do(ctx, username, func() ([]string, string, error) {
+		return c.transport.fetch(ctx, username)
+	})
+	if shared {
+		return nil, errFetchShared
+	}
+	user.KeysVia = via
+	user.Status = fetchStatus(publicKeys, err)
+	c.counters.Inc("users_fetched")
 	if err != nil {
 		// Return empty keys array rather than failing
+		c.counters.Inc("fetch_errors")
 		publicKeys = []string{}
+		user.FetchError = err.Error()
+	}
+	user.PublicKeys = publicKeys
+	user.Quarantine = c.guard.observe(username, publicKeys, user.FetchedAt)
+
+	return user, nil
+}
+
+// SkipFor returns the reason a collected user would not be stored, or nil if it has keys to store.
+func SkipFor(user *UserInfo) *Skip {
+	if len(user.PublicKeys) > 0 || len(user.SigningKeys) > 0 {
+		return nil
+	}
+	if user.Status == StatusNotFound {
+		return &Skip{Username: user.Username, Reason: SkipNotFound, Detail: user.FetchError, Repo: user.Repo}
+	}
+	if user.FetchError != "" || user.Status == StatusFetchFailed {
+		return &Skip{Username: user.Username, Reason: SkipFetchFailed, Detail: user.FetchError, Repo: user.Repo}
+	}
+	return &Skip{Username: user.Username, Reason: SkipNoKeys, Detail: "GitHub returned no public keys", Repo: user.Repo}
+}
+
+// signingKey is an entry from the GitHub SSH signing keys API.
+type signingKey struct {
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddSigningKeys fetches the SSH signing keys for a user via the GitHub API and records them in user.
+func AddSigningKeys(ctx context.Context, client *github.Client, user *UserInfo) error {
+	var keys []*signingKey
+	page := 1
+
+	for {
+		u := fmt.Sprintf("users/%s/ssh_signing_keys?per_page=100&page=%d", user.Username, page)
+		req, err := client.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+
+		var batch []*signingKey
+		resp, err := client.Do(ctx, req, &batch)
+		if err != nil {
+			return fmt.Errorf("failed to list signing keys: %w", err)
+		}
+		keys = append(keys, batch...)
+
+		if resp.NextPage == 0 {
+			break
+		}
+		page = resp.NextPage
 	}
 
-	return &UserInfo{
-		PublicKeys: publicKeys,
-		Repo:       repo,
-		Username:   username,
-	}, nil
+	for _, k := range keys {
+		key := strings.TrimSpace(k.Key)
+		if key == "" {
+			continue
+		}
+		user.SigningKeys = append(user.SigningKeys, key)
+		if !k.CreatedAt.IsZero() {
+			if user.KeyCreatedAt == nil {
+				user.KeyCreatedAt = map[string]time.Time{}
+			}
+			user.KeyCreatedAt[key] = k.CreatedAt
+		}
+	}
+	return nil
 }
 
-// fetchPublicKeys retrieves the public SSH keys for a GitHub user.
-func fetchPublicKeys(username string) ([]string, error) {
+// fetchPublicKeys retrieves the public SSH keys for a GitHub user through keys.
+func fetchPublicKeys(ctx context.Context, keys *keysClient, username string) ([]string, error) {
 	log.Printf("fetching public keys: %q", username)
-	resp, err := http.Get(fmt.Sprintf("https://github.com/%s.keys", username))
+	resp, err := keys.get(ctx, fmt.Sprintf("https://github.com/%s.keys", username))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if err := checkServer(resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("failed to fetch keys: %w", ErrUserNotFound)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("failed to fetch keys, status: %d", resp.StatusCode)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxKeysBodySize+1))
 	if err != nil {
 		return nil, err
 	}
+	if len(body) > maxKeysBodySize {
+		return nil, fmt.Errorf("keys response exceeds %d bytes", maxKeysBodySize)
+	}
+
+	return splitKeys(body), nil
+}
 
+// splitKeys splits a .keys response body into key lines, dropping blank lines and lines that cannot be keys.
+func splitKeys(body []byte) []string {
 	var keys []string
-	if len(body) == 0 {
-		return keys, nil
+	for _, line := range strings.Split(string(body), "\n") {
+		// TrimSpace also removes the CR of CRLF line endings
+		line = strings.TrimSpace(line)
+		if line == "" || !utf8.ValidString(line) || hasControl(line) {
+			continue
+		}
+		keys = append(keys, line)
 	}
+	return keys
+}
 
-	keys = strings.Split(strings.TrimSpace(string(body)), "\n")
-	return keys, nil
+// hasControl reports whether s contains control characters other than tab.
+// A bare CR or escape sequence inside a comment could otherwise smuggle a second key onto the line.
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return r != '\t' && unicode.IsControl(r)
+	}) >= 0
 }
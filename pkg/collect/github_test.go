@@ -0,0 +1,68 @@
+package collect
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FuzzSplitKeys checks that every line splitKeys returns could be stored as one key line, and that
+// splitting its own output gives it back. Seeds are in testdata/fuzz/FuzzSplitKeys.
+func FuzzSplitKeys(f *testing.F) {
+	f.Add(strings.Repeat("A", maxKeysBodySize))
+	f.Add(strings.Repeat("\n", 1<<20))
+	f.Fuzz(func(t *testing.T, body string) {
+		keys := splitKeys([]byte(body))
+		size := 0
+		for _, k := range keys {
+			size += len(k)
+			switch {
+			case k == "" || k != strings.TrimSpace(k):
+				t.Fatalf("line %q is blank or untrimmed", k)
+			case !utf8.ValidString(k):
+				t.Fatalf("line %q is not UTF-8", k)
+			case strings.IndexFunc(k, func(r rune) bool { return r != '\t' && unicode.IsControl(r) }) >= 0:
+				t.Fatalf("line %q has control characters", k)
+			}
+		}
+		if size > len(body) {
+			t.Fatalf("%d bytes of lines from a %d byte body", size, len(body))
+		}
+
+		again := splitKeys([]byte(strings.Join(keys, "\n")))
+		if strings.Join(again, "\n") != strings.Join(keys, "\n") || len(again) != len(keys) {
+			t.Fatalf("splitting the output again gave %q, want %q", again, keys)
+		}
+	})
+}
+
+func TestSplitKeys(t *testing.T) {
+	const ed = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	const rsa = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQ"
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{name: "empty", body: "", want: nil},
+		{name: "LF", body: ed + "\n" + rsa + "\n", want: []string{ed, rsa}},
+		{name: "CRLF", body: ed + "\r\n" + rsa + "\r\n", want: []string{ed, rsa}},
+		{name: "no trailing newline", body: ed, want: []string{ed}},
+		{name: "blank and whitespace lines", body: "\n \n\t\n" + ed + "\n\n", want: []string{ed}},
+		{name: "comment with tab", body: ed + " me\tlaptop", want: []string{ed + " me\tlaptop"}},
+		{name: "bare CR smuggling a second key", body: ed + " x\r" + rsa + "\n" + rsa, want: []string{rsa}},
+		{name: "terminal escape in comment", body: ed + " \x1b[2Kroot\n" + rsa, want: []string{rsa}},
+		{name: "NUL in comment", body: ed + " a\x00b\n" + rsa, want: []string{rsa}},
+		{name: "invalid UTF-8", body: ed + " \xff\n" + rsa, want: []string{rsa}},
+		{name: "UTF-8 comment", body: ed + " José 🔑", want: []string{ed + " José 🔑"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitKeys([]byte(tt.body))
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("splitKeys(%q) = %q, want %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package collect
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quarantine marks a user whose keys GitHub served identically to other users in a short window,
+// as a misbehaving cache or proxy would. Such keys must not be attributed until reviewed.
+type Quarantine struct {
+	// Batch identifies the shared keys body: "sha256:" and the start of its hash.
+	Batch string `json:"batch"`
+	// Users are every login served the body within the window, this one included.
+	Users []string `json:"users"`
+	// Since is the start of the window the users were seen in.
+	Since time.Time `json:"since"`
+}
+
+// sharedBodyGuard notices the same non-empty keys body served for many distinct users within a
+// window. Distinct users sharing one key happens (shared deploy keys), but sharing every key is rare.
+type sharedBodyGuard struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	seen      map[string]map[string]time.Time
+	pruned    time.Time
+}
+
+// observe records that user was served keys at now, returning a Quarantine if enough other users
+// were served the same keys within the window.
+func (g *sharedBodyGuard) observe(user string, keys []string, now time.Time) *Quarantine {
+	if len(keys) == 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.threshold < 2 {
+		return nil
+	}
+	if g.seen == nil {
+		g.seen = map[string]map[string]time.Time{}
+	}
+
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	batch := fmt.Sprintf("sha256:%x", sum[:6])
+
+	since := now.Add(-g.window)
+	if now.Sub(g.pruned) > g.window {
+		g.prune(since)
+		g.pruned = now
+	}
+	users := g.seen[batch]
+	if users == nil {
+		users = map[string]time.Time{}
+		g.seen[batch] = users
+	}
+	users[strings.ToLower(user)] = now
+	for u, at := range users {
+		if at.Before(since) {
+			delete(users, u)
+		}
+	}
+
+	if len(users) < g.threshold {
+		return nil
+	}
+	q := &Quarantine{Batch: batch, Since: since}
+	for u := range users {
+		q.Users = append(q.Users, u)
+	}
+	sort.Strings(q.Users)
+	return q
+}
+
+// prune forgets sightings from before since; g.mu must be held
+func (g *sharedBodyGuard) prune(since time.Time) {
+	for batch, users := range g.seen {
+		for u, at := range users {
+			if at.Before(since) {
+				delete(users, u)
+			}
+		}
+		if len(users) == 0 {
+			delete(g.seen, batch)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package collect
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/tstromberg/pubkey-collector/pkg/stats"
+)
+
+// fetchCall is an in-progress .keys fetch that other callers can wait on.
+type fetchCall struct {
+	done chan struct{}
+	keys []string
+	via  string
+	err  error
+}
+
+// inflight deduplicates concurrent .keys fetches for the same login.
+type inflight struct {
+	mu    sync.Mutex
+	calls map[string]*fetchCall
+	// counters tallies fetches_deduped
+	counters *stats.Counters
+}
+
+// do runs fetch for login unless a fetch for the same (case-insensitive) login is already
+// running, in which case it waits for and shares that result, or gives up when ctx is done.
+// shared reports that the result came from another caller's fetch, which that caller stores.
+func (f *inflight) do(ctx context.Context, login string, fetch func() ([]string, string, error)) (keys []string, via string, shared bool, err error) {
+	key := strings.ToLower(login)
+
+	f.mu.Lock()
+	if c, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+		f.counters.Inc("fetches_deduped")
+		select {
+		case <-c.done:
+			return append([]string(nil), c.keys...), c.via, true, c.err
+		case <-ctx.Done():
+			return nil, "", true, ctx.Err()
+		}
+	}
+	c := &fetchCall{done: make(chan struct{})}
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	c.keys, c.via, c.err = fetch()
+
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+	close(c.done)
+
+	return c.keys, c.via, false, c.err
+}
+
+// DedupedFetches returns how many .keys fetches were avoided by sharing an in-flight request.
+func (c *Collector) DedupedFetches() int64 {
+	return c.counters.Get("fetches_deduped")
+}
@@ -0,0 +1,91 @@
+package collect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/stats"
+)
+
+func TestConcurrentFetchesShareOneRequest(t *testing.T) {
+	const callers = 50
+	var requests atomic.Int32
+	var c *Collector
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		// Hold the request open until every other caller is waiting on it
+		deadline := time.Now().Add(5 * time.Second)
+		for c.DedupedFetches() < callers-1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		fmt.Fprintln(w, keyFor("ada"))
+	})
+	c, _ = newTestCollector(t, h, Options{})
+
+	// Each caller is a source listing the user, as an org listing and the event stream may
+	// at once, all adding to one sink that stands in for the database
+	sink := &recordSink{}
+	var wg sync.WaitGroup
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Logins differ only in case, as those sources may report them
+			login := "ada"
+			if i%2 == 1 {
+				login = "Ada"
+			}
+			src := &UsersSource{Collector: c, Usernames: []string{login}}
+			if err := src.Collect(context.Background(), sink); err != nil {
+				t.Errorf("Collect(%s): %v", login, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d requests for %d concurrent fetches, want 1", n, callers)
+	}
+	if n := c.DedupedFetches(); n != callers-1 {
+		t.Errorf("DedupedFetches() = %d, want %d", n, callers-1)
+	}
+	// Only the caller that made the request passes the user on to be stored
+	if len(sink.users) != 1 {
+		t.Fatalf("%d users added for %d concurrent fetches, want 1", len(sink.users), callers)
+	}
+	if u := sink.users[0]; len(u.PublicKeys) != 1 || u.PublicKeys[0] != keyFor("ada") || u.FetchError != "" {
+		t.Errorf("added keys %q, error %q", u.PublicKeys, u.FetchError)
+	}
+}
+
+func TestInflightWaiterCancel(t *testing.T) {
+	var counters stats.Counters
+	f := &inflight{calls: map[string]*fetchCall{}, counters: &counters}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go f.do(context.Background(), "ada", func() ([]string, string, error) {
+		close(started)
+		<-release
+		return []string{keyFor("ada")}, KeysViaScrape, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, shared, err := f.do(ctx, "ADA", func() ([]string, string, error) {
+		t.Error("a second fetch ran while one was in flight")
+		return nil, "", nil
+	}); !shared || !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled waiter got shared %v, %v; want a shared context.Canceled", shared, err)
+	}
+	close(release)
+	if n := counters.Get("fetches_deduped"); n != 1 {
+		t.Errorf("fetches_deduped = %d, want 1", n)
+	}
+}
@@ -0,0 +1,285 @@
+package collect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+)
+
+const (
+	// defaultPollInterval is the least time between polls of the events stream unless configured.
+	defaultPollInterval = time.Second
+	// defaultRemember is how long a returned user is skipped if they reappear, unless configured.
+	defaultRemember = 10 * time.Minute
+	// maxRemembered bounds how many recently returned logins are remembered, whatever the window.
+	maxRemembered = 10000
+	// pollErrorBackoff is the wait before retrying a failed poll.
+	pollErrorBackoff = 5 * time.Second
+)
+
+// CursorStore records the last poll of the events stream whose users were all handed out.
+// keydb.KeyDB implements it.
+type CursorStore interface {
+	PutStreamCursor(polled time.Time) error
+}
+
+// EventUserIterator yields the users active in the GitHub public events stream one at a time, for
+// as long as Next is called. It paces its polls, sends the previous page's ETag so unchanged pages
+// cost nothing, skips events it has already seen and users it returned recently, and waits out
+// rate limits without returning them.
+//
+// Polling is driven by Next: a page is only requested once every user from the previous one has
+// been returned, so however slowly the caller consumes users, the iterator holds at most one page
+// of them (100 events) plus a bounded set of recent logins. A slow caller will miss events rather
+// than accumulate them; the stream cursor shows the gap.
+//
+// The zero value is not usable; set Collector and Client. An EventUserIterator is not safe for concurrent use.
+type EventUserIterator struct {
+	Collector *Collector
+	Client    *github.Client
+
+	// Cursor, if set, records each poll once all of its users have been returned, so a later run
+	// can tell how long the stream went unread.
+	Cursor CursorStore
+	// CaptureDir, if set, receives a gzipped JSON copy of each new events page for later replay.
+	CaptureDir string
+	// CaptureKeep is the maximum number of captured pages retained in CaptureDir (0 for unlimited).
+	CaptureKeep int
+	// Interval is the least time between polls; zero means one second.
+	Interval time.Duration
+	// Remember is how long a returned user is skipped if they appear in the stream again; zero
+	// means ten minutes. At most 10,000 logins are remembered.
+	Remember time.Duration
+	// OnSkip, if set, is called with each actor the iterator decides not to collect, such as bots.
+	// An error from it is returned by Next.
+	OnSkip func(Skip) error
+
+	etag     string
+	lastID   int64
+	queue    []*UserInfo
+	polled   time.Time
+	nextPoll time.Time
+	recent   recentLogins
+}
+
+// Next returns the next active user, with their keys fetched, waiting for new events as needed.
+// It returns ctx's error once ctx is done. Other errors, from a failed poll or from OnSkip or
+// Cursor, leave the iterator usable: calling Next again carries on, retrying a failed poll after
+// a short backoff.
+func (it *EventUserIterator) Next(ctx context.Context) (*UserInfo, error) {
+	for len(it.queue) == 0 {
+		if !it.polled.IsZero() && it.Cursor != nil {
+			polled := it.polled
+			it.polled = time.Time{}
+			if err := it.Cursor.PutStreamCursor(polled); err != nil {
+				return nil, fmt.Errorf("record stream cursor: %w", err)
+			}
+		}
+		if err := sleepCtx(ctx, time.Until(it.nextPoll)); err != nil {
+			return nil, err
+		}
+		if err := it.poll(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	user := it.queue[0]
+	it.queue[0] = nil
+	it.queue = it.queue[1:]
+	return user, nil
+}
+
+// Buffered returns how many users from the last poll have yet to be returned by Next. It is zero
+// when the next call to Next will poll.
+func (it *EventUserIterator) Buffered() int {
+	return len(it.queue)
+}
+
+// poll requests the events page, fetching the keys of the new users in it into the queue
+func (it *EventUserIterator) poll(ctx context.Context) error {
+	interval := it.Interval
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	remember := it.Remember
+	if remember == 0 {
+		remember = defaultRemember
+	}
+	it.nextPoll = time.Now().Add(interval)
+
+	events, etag, err := listEventsSince(ctx, it.Client, it.etag)
+	if wait, ok := rateLimitWait(err, time.Now()); ok {
+		log.Printf("Rate limit hit. Sleeping for %s.", wait.Round(time.Second))
+		it.nextPoll = time.Now().Add(wait)
+		return nil
+	}
+	if err != nil {
+		it.nextPoll = time.Now().Add(pollErrorBackoff)
+		return err
+	}
+	now := it.Collector.clock.Now()
+	if etag == it.etag && etag != "" {
+		// Unchanged since the last poll, which counts as reading the stream up to now
+		it.polled = now
+		return nil
+	}
+	it.etag = etag
+
+	if it.CaptureDir != "" {
+		if err := CaptureEvents(it.CaptureDir, events, it.CaptureKeep); err != nil {
+			log.Printf("failed to capture events page: %v", err)
+		}
+	}
+
+	actors, skipped := EventActors(it.unseen(events))
+	for _, skip := range skipped {
+		if it.OnSkip == nil {
+			continue
+		}
+		if err := it.OnSkip(skip); err != nil {
+			return err
+		}
+	}
+	it.recent.prune(now, remember)
+	fresh := actors[:0]
+	for _, a := range actors {
+		if !it.recent.has(a.Username) {
+			fresh = append(fresh, a)
+		}
+	}
+
+	log.Printf("Processing %d users from events...", len(fresh))
+	users, err := it.Collector.fetchUsers(ctx, fresh, eventsUserDelay)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		user.Source = "github-events"
+		it.recent.add(user.Username, now)
+		it.queue = append(it.queue, user)
+	}
+	it.polled = now
+	return nil
+}
+
+// unseen returns the events newer than any seen in earlier polls, remembering the newest. Event
+// IDs increase over time; events whose ID doesn't parse are always returned.
+func (it *EventUserIterator) unseen(events []*github.Event) []*github.Event {
+	var out []*github.Event
+	newest := it.lastID
+	for _, e := range events {
+		id, err := strconv.ParseInt(e.GetID(), 10, 64)
+		if err != nil {
+			out = append(out, e)
+			continue
+		}
+		if id <= it.lastID {
+			continue
+		}
+		out = append(out, e)
+		newest = max(newest, id)
+	}
+	it.lastID = newest
+	return out
+}
+
+// listEventsSince fetches the latest page of public events unless it is unchanged since the page
+// with the given ETag, in which case it returns no events and the same ETag. Unchanged pages don't
+// count against the rate limit.
+func listEventsSince(ctx context.Context, client *github.Client, etag string) ([]*github.Event, string, error) {
+	req, err := client.NewRequest(http.MethodGet, "events?per_page=100", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	var events []*github.Event
+	resp, err := client.Do(ctx, req, &events)
+	if resp != nil && resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	if err != nil {
+		var rle *github.RateLimitError
+		if errors.As(err, &rle) {
+			return nil, "", fmt.Errorf("rate limit hit: %w", err)
+		}
+		return nil, "", fmt.Errorf("failed to list events: %w", err)
+	}
+	return events, resp.Header.Get("ETag"), nil
+}
+
+// rateLimitWait returns how long to wait before retrying after a GitHub rate limit error, using the
+// reset time or Retry-After from the response.
+func rateLimitWait(err error, now time.Time) (time.Duration, bool) {
+	var rle *github.RateLimitError
+	if errors.As(err, &rle) {
+		// Allow a little slack for clock skew
+		return max(rle.Rate.Reset.Time.Sub(now), 0) + 5*time.Second, true
+	}
+	var abuse *github.AbuseRateLimitError
+	if errors.As(err, &abuse) {
+		if abuse.RetryAfter != nil {
+			return *abuse.RetryAfter, true
+		}
+		return time.Minute, true
+	}
+	return 0, false
+}
+
+// recentLogins remembers when logins were last returned, oldest first, up to maxRemembered
+type recentLogins struct {
+	at    map[string]time.Time
+	order []recentLogin
+}
+
+// recentLogin is one entry of recentLogins' eviction order
+type recentLogin struct {
+	login string
+	at    time.Time
+}
+
+// add remembers login as returned at t
+func (r *recentLogins) add(login string, t time.Time) {
+	if r.at == nil {
+		r.at = map[string]time.Time{}
+	}
+	r.at[login] = t
+	r.order = append(r.order, recentLogin{login: login, at: t})
+	for len(r.order) > maxRemembered {
+		r.evict()
+	}
+}
+
+// has reports whether login is remembered
+func (r *recentLogins) has(login string) bool {
+	_, ok := r.at[login]
+	return ok
+}
+
+// prune forgets logins returned longer than window before now
+func (r *recentLogins) prune(now time.Time, window time.Duration) {
+	for len(r.order) > 0 && now.Sub(r.order[0].at) > window {
+		r.evict()
+	}
+}
+
+// evict forgets the oldest entry, unless its login was added again since
+func (r *recentLogins) evict() {
+	e := r.order[0]
+	r.order[0] = recentLogin{}
+	r.order = r.order[1:]
+	if r.at[e.login].Equal(e.at) {
+		delete(r.at, e.login)
+	}
+}
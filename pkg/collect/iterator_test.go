@@ -0,0 +1,233 @@
+package collect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+)
+
+// eventsPage is one response of eventsServer: a page of events with an ETag, or an error status
+type eventsPage struct {
+	etag   string
+	events []map[string]any
+	status int
+	header map[string]string
+	body   string
+}
+
+// eventsServer serves pages of the events stream in turn, then 304s for the last ETag, along with
+// .keys for any login. It records the If-None-Match of each events request.
+type eventsServer struct {
+	mu          sync.Mutex
+	pages       []eventsPage
+	ifNoneMatch []string
+	lastETag    string
+}
+
+func (s *eventsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/events" {
+		login := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".keys")
+		fmt.Fprintln(w, keyFor(login))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ifNoneMatch = append(s.ifNoneMatch, r.Header.Get("If-None-Match"))
+	if len(s.pages) == 0 {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	p := s.pages[0]
+	s.pages = s.pages[1:]
+	for k, v := range p.header {
+		w.Header().Set(k, v)
+	}
+	if p.status != 0 {
+		w.WriteHeader(p.status)
+		fmt.Fprint(w, p.body)
+		return
+	}
+	if p.etag == s.lastETag && r.Header.Get("If-None-Match") == p.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.lastETag = p.etag
+	w.Header().Set("ETag", p.etag)
+	json.NewEncoder(w).Encode(p.events)
+}
+
+// event returns an events stream entry with the given ID and actor
+func event(id, login string) map[string]any {
+	return map[string]any{"id": id, "actor": map[string]any{"login": login}, "repo": map[string]any{"name": login + "/repo"}}
+}
+
+// cursorLog is a CursorStore recording each cursor it is given
+type cursorLog struct {
+	polls []time.Time
+}
+
+func (c *cursorLog) PutStreamCursor(polled time.Time) error {
+	c.polls = append(c.polls, polled)
+	return nil
+}
+
+// nextUsers calls Next n times, returning the logins
+func nextUsers(t *testing.T, it *EventUserIterator, n int) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var logins []string
+	for range n {
+		u, err := it.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next after %q: %v", logins, err)
+		}
+		logins = append(logins, u.Username)
+	}
+	return logins
+}
+
+func TestEventUserIterator(t *testing.T) {
+	tests := []struct {
+		name  string
+		pages []eventsPage
+		// want are the users returned, in order
+		want        []string
+		wantSkipped []string
+		// wantIfNoneMatch are the If-None-Match headers of the events requests made for want
+		wantIfNoneMatch []string
+		// wantWait is the least time Next must take to return want
+		wantWait time.Duration
+	}{
+		{name: "one page", pages: []eventsPage{{etag: `"a"`, events: []map[string]any{event("3", "ada"), event("2", "dependabot"), event("1", "grace")}}},
+			want: []string{"ada", "grace"}, wantSkipped: []string{"dependabot"}, wantIfNoneMatch: []string{""}},
+		{name: "unchanged page costs a 304", pages: []eventsPage{
+			{etag: `"a"`, events: []map[string]any{event("1", "ada")}},
+			{etag: `"a"`, events: []map[string]any{event("1", "ada")}},
+			{etag: `"b"`, events: []map[string]any{event("2", "grace"), event("1", "ada")}},
+		}, want: []string{"ada", "grace"}, wantIfNoneMatch: []string{"", `"a"`, `"a"`}},
+		{name: "events already seen by ID are skipped", pages: []eventsPage{
+			{etag: `"a"`, events: []map[string]any{event("5", "ada"), event("4", "grace")}},
+			// Event 4 reappears with a different actor, as when a page boundary shifts
+			{etag: `"b"`, events: []map[string]any{event("6", "linus"), event("4", "ken"), event("3", "dmr")}},
+		}, want: []string{"ada", "grace", "linus"}},
+		{name: "recently returned users are skipped", pages: []eventsPage{
+			{etag: `"a"`, events: []map[string]any{event("1", "ada")}},
+			{etag: `"b"`, events: []map[string]any{event("3", "grace"), event("2", "ada")}},
+		}, want: []string{"ada", "grace"}},
+		{name: "secondary rate limit is waited out", pages: []eventsPage{
+			{status: http.StatusForbidden, header: map[string]string{"Retry-After": "1"},
+				body: `{"message": "You have exceeded a secondary rate limit", "documentation_url": "https://docs.github.com/rest/overview/resources-in-the-rest-api#secondary-rate-limits"}`},
+			{etag: `"a"`, events: []map[string]any{event("1", "ada")}},
+		}, want: []string{"ada"}, wantIfNoneMatch: []string{"", ""}, wantWait: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &eventsServer{pages: tt.pages}
+			c, client := newTestCollector(t, s, Options{Workers: 2})
+			var skipped []string
+			cursor := &cursorLog{}
+			it := &EventUserIterator{Collector: c, Client: client, Cursor: cursor, Interval: time.Millisecond,
+				OnSkip: func(s Skip) error {
+					skipped = append(skipped, s.Username)
+					return nil
+				}}
+
+			start := time.Now()
+			if got := nextUsers(t, it, len(tt.want)); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("Next returned %q, want %q", got, tt.want)
+			}
+			if strings.Join(skipped, " ") != strings.Join(tt.wantSkipped, " ") {
+				t.Errorf("skipped %q, want %q", skipped, tt.wantSkipped)
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if tt.wantIfNoneMatch != nil && strings.Join(s.ifNoneMatch, " ") != strings.Join(tt.wantIfNoneMatch, " ") {
+				t.Errorf("events requests sent If-None-Match %q, want %q", s.ifNoneMatch, tt.wantIfNoneMatch)
+			}
+			if len(s.pages) != 0 {
+				t.Errorf("%d pages were never requested", len(s.pages))
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantWait {
+				t.Errorf("Next returned after %s, want at least %s", elapsed, tt.wantWait)
+			}
+			if it.Buffered() != 0 {
+				t.Errorf("Buffered() = %d after every user was returned", it.Buffered())
+			}
+		})
+	}
+}
+
+func TestEventUserIteratorCursor(t *testing.T) {
+	s := &eventsServer{pages: []eventsPage{
+		{etag: `"a"`, events: []map[string]any{event("2", "ada"), event("1", "grace")}},
+		{etag: `"b"`, events: []map[string]any{event("3", "linus")}},
+	}}
+	c, client := newTestCollector(t, s, Options{})
+	cursor := &cursorLog{}
+	it := &EventUserIterator{Collector: c, Client: client, Cursor: cursor, Interval: time.Millisecond}
+
+	nextUsers(t, it, 1)
+	if it.Buffered() != 1 || len(cursor.polls) != 0 {
+		t.Errorf("with grace still buffered: Buffered() = %d, %d cursors recorded; want 1, none", it.Buffered(), len(cursor.polls))
+	}
+	// Handing out grace empties the first page; the next call records it before polling again
+	nextUsers(t, it, 2)
+	if len(cursor.polls) != 1 {
+		t.Errorf("recorded %d cursors after the first page was consumed, want 1", len(cursor.polls))
+	}
+}
+
+func TestEventUserIteratorErrors(t *testing.T) {
+	s := &eventsServer{pages: []eventsPage{
+		{status: http.StatusBadGateway, body: `{"message": "upstream failure"}`},
+	}}
+	c, client := newTestCollector(t, s, Options{})
+	it := &EventUserIterator{Collector: c, Client: client, Interval: time.Millisecond}
+	if _, err := it.Next(context.Background()); err == nil {
+		t.Fatal("Next succeeded despite the failed poll")
+	}
+
+	// The iterator stays usable, backing off before the next poll until ctx gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := it.Next(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Next during the backoff = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	retry := 30 * time.Second
+	tests := []struct {
+		name   string
+		err    error
+		want   time.Duration
+		wantOK bool
+	}{
+		{name: "primary", err: fmt.Errorf("rate limit hit: %w", &github.RateLimitError{Rate: github.Rate{Reset: github.Timestamp{Time: now.Add(time.Minute)}}}),
+			want: time.Minute + 5*time.Second, wantOK: true},
+		{name: "primary, reset passed", err: &github.RateLimitError{Rate: github.Rate{Reset: github.Timestamp{Time: now.Add(-time.Minute)}}},
+			want: 5 * time.Second, wantOK: true},
+		{name: "secondary with Retry-After", err: &github.AbuseRateLimitError{RetryAfter: &retry}, want: retry, wantOK: true},
+		{name: "secondary without Retry-After", err: &github.AbuseRateLimitError{}, want: time.Minute, wantOK: true},
+		{name: "other error", err: errors.New("connection reset")},
+		{name: "no error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rateLimitWait(tt.err, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("rateLimitWait() = %s, %v; want %s, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
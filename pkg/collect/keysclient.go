@@ -0,0 +1,46 @@
+package collect
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// publicModeInterval is the minimum time between .keys requests in public mode. It cannot be lowered.
+	publicModeInterval = 2 * time.Second
+	// publicModeUserAgent identifies unauthenticated public-mode traffic to GitHub.
+	publicModeUserAgent = "pubkey-collector (public mode; +https://github.com/tstromberg/pubkey-collector)"
+)
+
+// keysClient paces and identifies requests to the .keys endpoint.
+type keysClient struct {
+	interval  time.Duration
+	userAgent string
+	// roundTripper is used instead of http.DefaultTransport when set
+	roundTripper http.RoundTripper
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// get waits for the pacing interval and then issues a GET request, giving up when ctx is done.
+func (c *keysClient) get(ctx context.Context, url string) (*http.Response, error) {
+	c.mu.Lock()
+	if err := sleepCtx(ctx, time.Until(c.last.Add(c.interval))); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.last = time.Now()
+	c.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	return (&http.Client{Transport: c.roundTripper}).Do(req)
+}
@@ -0,0 +1,69 @@
+package collect
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublicModeFloor(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		want     time.Duration
+	}{
+		{interval: 0, want: publicModeInterval},
+		{interval: -time.Second, want: publicModeInterval},
+		{interval: time.Millisecond, want: publicModeInterval},
+		{interval: publicModeInterval - 1, want: publicModeInterval},
+		{interval: publicModeInterval, want: publicModeInterval},
+		{interval: time.Minute, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.interval.String(), func(t *testing.T) {
+			c, err := New(Options{PublicMode: true, KeysInterval: tt.interval, Workers: 16})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.KeysInterval(); got != tt.want {
+				t.Errorf("KeysInterval() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublicModeRequests(t *testing.T) {
+	var mu sync.Mutex
+	var agents []string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents = append(agents, r.UserAgent())
+		mu.Unlock()
+	})
+	c, _ := newTestCollector(t, h, Options{PublicMode: true, KeysInterval: time.Nanosecond, Workers: 8})
+
+	resp, err := c.keys.get(context.Background(), "https://github.com/ada.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The next request must wait out the floor, whatever workers and interval were asked for
+	ctx, cancel := context.WithTimeout(context.Background(), publicModeInterval/4)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.keys.get(ctx, "https://github.com/grace.keys"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("second request within %s: error %v, want it to wait past the deadline", publicModeInterval, err)
+	}
+	if elapsed := time.Since(start); elapsed > publicModeInterval/2 {
+		t.Errorf("waiting request gave up after %s, not at its deadline", elapsed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(agents) != 1 || agents[0] != publicModeUserAgent {
+		t.Errorf("requests had User-Agents %q, want one with %q", agents, publicModeUserAgent)
+	}
+}
@@ -0,0 +1,76 @@
+package collect
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+)
+
+// credentialAuthorization is an entry from the GitHub org credential authorizations API, available
+// to org owners of organizations that enforce SAML single sign-on.
+type credentialAuthorization struct {
+	Login          string    `json:"login"`
+	CredentialType string    `json:"credential_type"`
+	Fingerprint    string    `json:"fingerprint"`
+	AccessedAt     time.Time `json:"credential_accessed_at"`
+}
+
+// KeyUsage is when GitHub last saw a user authenticate with an SSH key.
+type KeyUsage struct {
+	Login string
+	At    time.Time
+}
+
+// KeyLastUsed returns when each SSH key authorized for an organization's SSO was last used, keyed by
+// normalized fingerprint (see NormalizeFingerprint). Keys GitHub has no access time for are omitted.
+func KeyLastUsed(ctx context.Context, client *github.Client, org string) (map[string]KeyUsage, error) {
+	usage := map[string]KeyUsage{}
+	page := 1
+
+	for {
+		u := fmt.Sprintf("orgs/%s/credential-authorizations?per_page=100&page=%d", org, page)
+		req, err := client.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var batch []*credentialAuthorization
+		resp, err := client.Do(ctx, req, &batch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list credential authorizations: %w", err)
+		}
+		for _, ca := range batch {
+			if ca.CredentialType != "SSH key" || ca.Fingerprint == "" || ca.AccessedAt.IsZero() {
+				continue
+			}
+			fp := NormalizeFingerprint(ca.Fingerprint)
+			if prev, ok := usage[fp]; !ok || ca.AccessedAt.After(prev.At) {
+				usage[fp] = KeyUsage{Login: ca.Login, At: ca.AccessedAt}
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		page = resp.NextPage
+	}
+	return usage, nil
+}
+
+// NormalizeFingerprint returns a fingerprint as "SHA256:<base64>" or "MD5:<lower-case hex>", accepting
+// either with or without its prefix, and MD5 with or without colons.
+func NormalizeFingerprint(fp string) string {
+	fp = strings.TrimSpace(fp)
+	if rest, ok := strings.CutPrefix(fp, "SHA256:"); ok {
+		return "SHA256:" + strings.TrimRight(rest, "=")
+	}
+	hex := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(fp, "MD5:"), ":", ""))
+	if len(hex) == 32 && strings.Trim(hex, "0123456789abcdef") == "" {
+		return "MD5:" + hex
+	}
+	return "SHA256:" + strings.TrimRight(fp, "=")
+}
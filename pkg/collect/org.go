@@ -0,0 +1,177 @@
+package collect
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/go-github/v45/github"
+)
+
+// Enumeration summarizes how completely an organization's members were listed.
+type Enumeration struct {
+	// Listed is the number of member logins enumerated.
+	Listed int `json:"listed"`
+	// Expected is the member count reported by the organization's plan, or 0 when unavailable.
+	Expected int `json:"expected,omitempty"`
+	// Method is how the final member list was obtained: "rest" or "graphql".
+	Method string `json:"method"`
+	// Complete is false when fewer members were listed than the organization reports.
+	Complete bool `json:"complete"`
+}
+
+// String describes the enumeration for run summaries.
+func (e *Enumeration) String() string {
+	switch {
+	case !e.Complete:
+		return fmt.Sprintf("INCOMPLETE: listed %d of %d members via %s", e.Listed, e.Expected, e.Method)
+	case e.Expected == 0:
+		return fmt.Sprintf("listed %d members via %s (believed complete; member count unavailable to verify)", e.Listed, e.Method)
+	default:
+		return fmt.Sprintf("complete: listed %d of %d members via %s", e.Listed, e.Expected, e.Method)
+	}
+}
+
+// orgMemberLogins lists an organization's member logins, falling back to GraphQL when the REST listing is truncated.
+func orgMemberLogins(ctx context.Context, client *github.Client, org string) ([]string, *Enumeration, error) {
+	logins, err := restMemberLogins(ctx, client, org)
+	if err != nil {
+		return nil, nil, err
+	}
+	e := &Enumeration{Listed: len(logins), Method: "rest", Complete: true}
+
+	// Seat counts are only visible to tokens with org admin access
+	o, _, err := client.Organizations.Get(ctx, org)
+	if err != nil {
+		log.Printf("unable to get member count for %s: %v", org, err)
+		return logins, e, nil
+	}
+	if o.GetPlan() != nil {
+		e.Expected = o.GetPlan().GetFilledSeats()
+	}
+	if e.Expected <= len(logins) {
+		return logins, e, nil
+	}
+
+	log.Printf("member list for %s looks truncated: REST listed %d, org reports %d; retrying via GraphQL", org, len(logins), e.Expected)
+	gqlLogins, err := graphQLMemberLogins(ctx, client, org)
+	if err != nil {
+		log.Printf("GraphQL member listing for %s failed: %v", org, err)
+		e.Complete = false
+		return logins, e, nil
+	}
+
+	seen := map[string]bool{}
+	for _, l := range logins {
+		seen[l] = true
+	}
+	for _, l := range gqlLogins {
+		if !seen[l] {
+			seen[l] = true
+			logins = append(logins, l)
+		}
+	}
+
+	e.Listed = len(logins)
+	e.Method = "graphql"
+	e.Complete = e.Listed >= e.Expected
+	if !e.Complete {
+		log.Printf("member list for %s is still short after GraphQL: %d of %d", org, e.Listed, e.Expected)
+	}
+	return logins, e, nil
+}
+
+// restMemberLogins lists member logins via the paginated REST API.
+func restMemberLogins(ctx context.Context, client *github.Client, org string) ([]string, error) {
+	var logins []string
+	opts := &github.ListMembersOptions{ListOptions: github.ListOptions{PerPage: 100}}
+
+	for {
+		members, resp, err := client.Organizations.ListMembers(ctx, org, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list org members: %w", err)
+		}
+
+		for _, member := range members {
+			if login := member.GetLogin(); login != "" {
+				logins = append(logins, login)
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return logins, nil
+}
+
+// membersQuery lists organization members using cursor pagination, which is not subject to REST page limits.
+const membersQuery = `query($org: String!, $cursor: String) {
+  organization(login: $org) {
+    membersWithRole(first: 100, after: $cursor) {
+      pageInfo { hasNextPage endCursor }
+      nodes { login }
+    }
+  }
+}`
+
+// membersResponse is the GraphQL response shape for membersQuery.
+type membersResponse struct {
+	Data struct {
+		Organization struct {
+			MembersWithRole struct {
+				PageInfo struct {
+					HasNextPage bool   `json:"hasNextPage"`
+					EndCursor   string `json:"endCursor"`
+				} `json:"pageInfo"`
+				Nodes []struct {
+					Login string `json:"login"`
+				} `json:"nodes"`
+			} `json:"membersWithRole"`
+		} `json:"organization"`
+	} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// graphQLMemberLogins lists member logins via the GraphQL membersWithRole connection.
+func graphQLMemberLogins(ctx context.Context, client *github.Client, org string) ([]string, error) {
+	var logins []string
+	var cursor *string
+
+	for {
+		body := map[string]interface{}{
+			"query":     membersQuery,
+			"variables": map[string]interface{}{"org": org, "cursor": cursor},
+		}
+		req, err := client.NewRequest(http.MethodPost, "graphql", body)
+		if err != nil {
+			return nil, err
+		}
+
+		var resp membersResponse
+		if _, err := client.Do(ctx, req, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Errors) > 0 {
+			return nil, fmt.Errorf("graphql: %s", resp.Errors[0].Message)
+		}
+
+		conn := resp.Data.Organization.MembersWithRole
+		for _, n := range conn.Nodes {
+			if n.Login != "" {
+				logins = append(logins, n.Login)
+			}
+		}
+
+		if !conn.PageInfo.HasNextPage {
+			break
+		}
+		end := conn.PageInfo.EndCursor
+		cursor = &end
+	}
+	return logins, nil
+}
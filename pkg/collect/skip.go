@@ -0,0 +1,27 @@
+package collect
+
+// SkipReason describes why a user was not added to the database.
+type SkipReason string
+
+const (
+	// SkipBot means the login looked like an automation account.
+	SkipBot SkipReason = "bot"
+	// SkipFetchFailed means the user's keys could not be fetched.
+	SkipFetchFailed SkipReason = "fetch_failed"
+	// SkipNoKeys means the user has no public keys to store.
+	SkipNoKeys SkipReason = "no_keys"
+	// SkipNotFound means GitHub has no such user, for example after a rename or deletion.
+	SkipNotFound SkipReason = "not_found"
+)
+
+// Skip records a decision not to store a user.
+type Skip struct {
+	// Username is the GitHub username that was skipped.
+	Username string `json:"username"`
+	// Reason is the category of the skip decision.
+	Reason SkipReason `json:"reason"`
+	// Detail is a human-readable explanation, such as an error message.
+	Detail string `json:"detail,omitempty"`
+	// Repo is the repository the user was seen in, if any.
+	Repo string `json:"repo,omitempty"`
+}
@@ -0,0 +1,82 @@
+package collect
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Source produces users and their keys from some key provider.
+//
+// Sources only gather data: deduplication, storage and skip recording are handled by the Sink
+// they are given. A minimal custom source looks like:
+//
+//	type ldapSource struct{ conn *ldap.Conn }
+//
+//	func (s *ldapSource) Name() string { return "ldap" }
+//
+//	func (s *ldapSource) Collect(ctx context.Context, sink collect.Sink) error {
+//		for _, entry := range s.search(ctx) {
+//			user := &collect.UserInfo{Username: entry.UID, PublicKeys: entry.SSHKeys}
+//			if err := sink.Add(ctx, user); err != nil {
+//				return err
+//			}
+//		}
+//		return nil
+//	}
+//
+//	func init() { collect.Register(&ldapSource{}) }
+//
+// Registered sources can then be run by a build of pubkey-collector that imports the package
+// defining them, using -source ldap.
+type Source interface {
+	// Name returns a short identifier for the source, recorded with each user it produces.
+	Name() string
+	// Collect gathers users and hands each one to sink. It returns when the source is exhausted.
+	Collect(ctx context.Context, sink Sink) error
+}
+
+// Sink receives the users produced by a Source.
+type Sink interface {
+	// Add is called for each collected user. Returning an error stops the source.
+	Add(ctx context.Context, user *UserInfo) error
+	// Skip is called for each user the source decided not to collect.
+	Skip(ctx context.Context, skip Skip) error
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]Source{}
+)
+
+// Register makes a source available by name. It panics if a source with the same name is already registered.
+func Register(s Source) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, dup := registry[s.Name()]; dup {
+		panic(fmt.Sprintf("collect: source %q registered twice", s.Name()))
+	}
+	registry[s.Name()] = s
+}
+
+// Registered returns the source registered under name, or nil if there is none.
+func Registered(name string) Source {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return registry[name]
+}
+
+// RegisteredNames returns the names of all registered sources in sorted order.
+func RegisteredNames() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
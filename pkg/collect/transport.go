@@ -0,0 +1,142 @@
+package collect
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v45/github"
+)
+
+// Transports for fetching a user's authentication keys, recorded in UserInfo.KeysVia.
+const (
+	// KeysViaScrape fetches https://github.com/USER.keys, which is not rate limited by the API.
+	KeysViaScrape = "scrape"
+	// KeysViaAPI fetches users/USER/keys through the authenticated REST API.
+	KeysViaAPI = "api"
+	// KeysViaAuto scrapes until requests consistently fail the way intercepting proxies fail them, then uses the API.
+	KeysViaAuto = "auto"
+)
+
+// proxyFailuresToSwitch is how many proxy-style .keys failures in a row make auto mode switch to the API.
+const proxyFailuresToSwitch = 3
+
+// keysTransport chooses how authentication keys are fetched.
+type keysTransport struct {
+	mu       sync.Mutex
+	mode     string
+	client   *github.Client
+	keys     *keysClient
+	failures int
+	switched bool
+}
+
+// useAPI reports whether fetches should use the API, by choice or after an auto switch. t.mu must be held.
+func (t *keysTransport) useAPI() bool {
+	return t.mode == KeysViaAPI || (t.mode == KeysViaAuto && t.switched)
+}
+
+// fetch retrieves a user's authentication keys over the current transport and returns which one was used.
+func (t *keysTransport) fetch(ctx context.Context, username string) ([]string, string, error) {
+	t.mu.Lock()
+	api, client := t.useAPI(), t.client
+	t.mu.Unlock()
+
+	if api {
+		keys, err := fetchAPIKeys(ctx, client, username)
+		return keys, KeysViaAPI, err
+	}
+	keys, err := fetchPublicKeys(ctx, t.keys, username)
+	t.observe(err)
+	return keys, KeysViaScrape, err
+}
+
+// observe tracks consecutive proxy-style scrape failures, switching auto mode to the API once they persist.
+func (t *keysTransport) observe(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.mode != KeysViaAuto || t.client == nil || t.switched {
+		return
+	}
+	reason := proxyFailure(err)
+	if reason == "" {
+		t.failures = 0
+		return
+	}
+	t.failures++
+	if t.failures >= proxyFailuresToSwitch {
+		t.switched = true
+		log.Printf("%d .keys requests in a row failed like an intercepting proxy (%s); fetching keys via the API for the rest of the run", t.failures, reason)
+	}
+}
+
+// proxyError is a .keys response that did not come from GitHub.
+type proxyError struct {
+	status int
+	server string
+}
+
+// Error describes the response.
+func (e *proxyError) Error() string {
+	return fmt.Sprintf("failed to fetch keys, status: %d from server %q", e.status, e.server)
+}
+
+// proxyFailure describes why err looks like an egress proxy blocking github.com, or returns "" if it doesn't.
+func proxyFailure(err error) string {
+	if err == nil {
+		return ""
+	}
+	var pe *proxyError
+	if errors.As(err, &pe) {
+		return fmt.Sprintf("status %d from %q", pe.status, pe.server)
+	}
+	var unknownCA x509.UnknownAuthorityError
+	var certErr *tls.CertificateVerificationError
+	var hostErr x509.HostnameError
+	if errors.As(err, &unknownCA) || errors.As(err, &certErr) || errors.As(err, &hostErr) {
+		return "TLS interception: " + err.Error()
+	}
+	return ""
+}
+
+// checkServer returns a proxyError for responses to .keys that GitHub didn't serve: a 403 from
+// another server, or a proxy asking for authentication.
+func checkServer(resp *http.Response) error {
+	server := resp.Header.Get("Server")
+	if resp.StatusCode == http.StatusProxyAuthRequired ||
+		(resp.StatusCode == http.StatusForbidden && !strings.EqualFold(server, "GitHub.com")) {
+		return &proxyError{status: resp.StatusCode, server: server}
+	}
+	return nil
+}
+
+// fetchAPIKeys retrieves a user's authentication keys from the REST API.
+func fetchAPIKeys(ctx context.Context, client *github.Client, username string) ([]string, error) {
+	log.Printf("fetching public keys via API: %q", username)
+	var keys []string
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		batch, resp, err := client.Users.ListKeys(ctx, username, opts)
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("failed to list keys: %w", ErrUserNotFound)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list keys: %w", err)
+		}
+		for _, k := range batch {
+			if key := strings.TrimSpace(k.GetKey()); key != "" && !hasControl(key) {
+				keys = append(keys, key)
+			}
+		}
+		if resp.NextPage == 0 {
+			return keys, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
@@ -0,0 +1,76 @@
+package collect
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// fetchUsers fetches the keys of each actor across the worker pool, pausing delay before each
+// fetch. Results are in the order of actors whatever order the fetches finish in; a failed fetch
+// is recorded in that user's FetchError and doesn't affect the others. A login already being fetched
+// by another caller is left out, as that caller returns it. Once ctx is done no new
+// fetches start, in-flight ones are cancelled, and the users fetched so far are returned with ctx's error.
+func (c *Collector) fetchUsers(ctx context.Context, actors []Actor, delay time.Duration) ([]*UserInfo, error) {
+	results := make([]*UserInfo, len(actors))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	var progressMu sync.Mutex
+	done := 0
+
+	for w := 0; w < min(c.workers, max(len(actors), 1)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := sleepCtx(ctx, delay); err != nil {
+					return
+				}
+				user, err := c.processUser(ctx, actors[i].Username, actors[i].Repo)
+				if err == nil && ctx.Err() == nil {
+					results[i] = user
+				}
+				if c.progress != nil {
+					progressMu.Lock()
+					done++
+					c.progress(done, len(actors))
+					progressMu.Unlock()
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range actors {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	var users []*UserInfo
+	for _, u := range results {
+		if u != nil {
+			users = append(users, u)
+		}
+	}
+	return users, ctx.Err()
+}
+
+// sleepCtx sleeps for d, returning early with ctx's error if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,186 @@
+// Package compactdb reads and writes a compact, read-only index from SSH key fingerprints to GitHub
+// logins. It has no dependencies beyond the standard library, so other tools can embed lookups
+// without Badger.
+//
+// A file is a header, then fixed-width records sorted by fingerprint, then a string table of logins.
+// All integers are little-endian:
+//
+//	header  magic "PKCDB\x00\x00\x01", record count (uint32), string table length (uint32)
+//	record  SHA256 digest (32 bytes), login offset (uint32), login length (uint16),
+//	        reserved (2 bytes), last seen (int64 Unix seconds)
+//	strings logins, each stored once
+//
+// Records are 48 bytes, and the whole file can be memory-mapped and passed to New.
+package compactdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	headerSize = 16
+	recordSize = 48
+	digestSize = 32
+)
+
+// magic identifies a compactdb file and its format version.
+var magic = []byte("PKCDB\x00\x00\x01")
+
+// ErrCorrupt is returned (wrapped) by New for data that is not a well-formed compactdb file.
+var ErrCorrupt = errors.New("compactdb: corrupt file")
+
+// Entry is one key's owner, as written to and read from a file.
+type Entry struct {
+	// Fingerprint is the key's SHA256 fingerprint, such as "SHA256:aK3y...".
+	Fingerprint string
+	Login       string
+	LastSeen    time.Time
+}
+
+// DB is an opened compactdb file. It is safe for concurrent use.
+type DB struct {
+	records []byte
+	strings []byte
+	n       int
+}
+
+// Open reads a compactdb file into memory.
+func Open(path string) (*DB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(data)
+}
+
+// New validates data, such as a memory-mapped file, and returns a DB reading from it. data must not
+// change while the DB is in use. Records pointing outside the string table are detected at lookup.
+func New(data []byte) (*DB, error) {
+	if len(data) < headerSize || !bytes.Equal(data[:len(magic)], magic) {
+		return nil, fmt.Errorf("%w: bad header", ErrCorrupt)
+	}
+	n := uint64(binary.LittleEndian.Uint32(data[8:]))
+	strLen := uint64(binary.LittleEndian.Uint32(data[12:]))
+	if uint64(len(data)) != headerSize+n*recordSize+strLen {
+		return nil, fmt.Errorf("%w: size %d does not match %d records and %d string bytes", ErrCorrupt, len(data), n, strLen)
+	}
+	end := headerSize + int(n)*recordSize
+	return &DB{records: data[headerSize:end], strings: data[end:], n: int(n)}, nil
+}
+
+// Len returns the number of keys in the file.
+func (db *DB) Len() int {
+	return db.n
+}
+
+// Lookup returns the owner and last-seen time of the key with the given SHA256 fingerprint
+// ("SHA256:..." with or without base64 padding). ok is false if the key is not in the file, the
+// fingerprint is not SHA256, or the record is corrupt.
+func (db *DB) Lookup(fingerprint string) (login string, lastSeen time.Time, ok bool) {
+	digest, err := decodeFingerprint(fingerprint)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	i := sort.Search(db.n, func(i int) bool {
+		return bytes.Compare(db.record(i)[:digestSize], digest) >= 0
+	})
+	if i == db.n {
+		return "", time.Time{}, false
+	}
+	rec := db.record(i)
+	if !bytes.Equal(rec[:digestSize], digest) {
+		return "", time.Time{}, false
+	}
+
+	off := uint64(binary.LittleEndian.Uint32(rec[32:]))
+	length := uint64(binary.LittleEndian.Uint16(rec[36:]))
+	if off+length > uint64(len(db.strings)) {
+		return "", time.Time{}, false
+	}
+	seen := int64(binary.LittleEndian.Uint64(rec[40:]))
+	return string(db.strings[off : off+length]), time.Unix(seen, 0).UTC(), true
+}
+
+// record returns the bytes of record i.
+func (db *DB) record(i int) []byte {
+	return db.records[i*recordSize : (i+1)*recordSize]
+}
+
+// Write writes entries as a compactdb file. Entries with the same fingerprint keep the one seen most
+// recently. It fails on fingerprints that are not SHA256 and logins longer than 65535 bytes.
+func Write(w io.Writer, entries []Entry) error {
+	type record struct {
+		digest   []byte
+		login    string
+		lastSeen int64
+	}
+	byDigest := map[string]*record{}
+	for _, e := range entries {
+		digest, err := decodeFingerprint(e.Fingerprint)
+		if err != nil {
+			return err
+		}
+		if len(e.Login) > 0xffff {
+			return fmt.Errorf("compactdb: login of %d bytes is too long", len(e.Login))
+		}
+		r := &record{digest: digest, login: e.Login, lastSeen: e.LastSeen.Unix()}
+		if prev := byDigest[string(digest)]; prev == nil || r.lastSeen > prev.lastSeen {
+			byDigest[string(digest)] = r
+		}
+	}
+
+	records := make([]*record, 0, len(byDigest))
+	for _, r := range byDigest {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return bytes.Compare(records[i].digest, records[j].digest) < 0 })
+
+	var strtab bytes.Buffer
+	offsets := map[string]uint32{}
+	body := make([]byte, 0, len(records)*recordSize)
+	for _, r := range records {
+		off, ok := offsets[r.login]
+		if !ok {
+			off = uint32(strtab.Len())
+			offsets[r.login] = off
+			strtab.WriteString(r.login)
+		}
+		body = append(body, r.digest...)
+		body = binary.LittleEndian.AppendUint32(body, off)
+		body = binary.LittleEndian.AppendUint16(body, uint16(len(r.login)))
+		body = append(body, 0, 0)
+		body = binary.LittleEndian.AppendUint64(body, uint64(r.lastSeen))
+	}
+
+	header := append([]byte(nil), magic...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(records)))
+	header = binary.LittleEndian.AppendUint32(header, uint32(strtab.Len()))
+	for _, b := range [][]byte{header, body, strtab.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeFingerprint returns the digest of a SHA256 fingerprint.
+func decodeFingerprint(fp string) ([]byte, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(fp), "SHA256:")
+	if !ok {
+		return nil, fmt.Errorf("compactdb: %q is not a SHA256 fingerprint", fp)
+	}
+	digest, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(rest, "="))
+	if err != nil || len(digest) != digestSize {
+		return nil, fmt.Errorf("compactdb: %q is not a SHA256 fingerprint", fp)
+	}
+	return digest, nil
+}
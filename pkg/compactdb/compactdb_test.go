@@ -0,0 +1,204 @@
+package compactdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fp returns a distinct SHA256 fingerprint for each n
+func fp(n int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(n)))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// build writes entries and returns the file
+func build(t testing.TB, entries []Entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Write(&buf, entries); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 12, 30, 0, 0, time.UTC) }
+	entries := []Entry{
+		{Fingerprint: fp(1), Login: "ada", LastSeen: day(1)},
+		{Fingerprint: fp(2), Login: "ada", LastSeen: day(2)},
+		{Fingerprint: fp(3), Login: "grace", LastSeen: day(3)},
+		// The same key seen later under another owner wins, whatever the order
+		{Fingerprint: fp(4), Login: "linus", LastSeen: day(5)},
+		{Fingerprint: fp(4), Login: "ken", LastSeen: day(4)},
+		{Fingerprint: fp(5) + "=", Login: "", LastSeen: day(6)},
+	}
+	db, err := New(build(t, entries))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if db.Len() != 5 {
+		t.Errorf("Len() = %d, want 5", db.Len())
+	}
+
+	tests := []struct {
+		query     string
+		wantOK    bool
+		wantLogin string
+		wantSeen  time.Time
+	}{
+		{query: fp(1), wantOK: true, wantLogin: "ada", wantSeen: day(1)},
+		{query: fp(2) + "=", wantOK: true, wantLogin: "ada", wantSeen: day(2)},
+		{query: " " + fp(3) + "\n", wantOK: true, wantLogin: "grace", wantSeen: day(3)},
+		{query: fp(4), wantOK: true, wantLogin: "linus", wantSeen: day(5)},
+		{query: fp(5), wantOK: true, wantLogin: "", wantSeen: day(6)},
+		{query: fp(6)},
+		{query: strings.Replace(fp(1), "SHA256:", "MD5:", 1)},
+		{query: "SHA256:not-base64"},
+		{query: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			login, seen, ok := db.Lookup(tt.query)
+			if ok != tt.wantOK || login != tt.wantLogin || !seen.Equal(tt.wantSeen) {
+				t.Errorf("Lookup() = %q, %s, %v; want %q, %s, %v", login, seen, ok, tt.wantLogin, tt.wantSeen, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestWriteIsCompact(t *testing.T) {
+	var entries []Entry
+	for i := 0; i < 1000; i++ {
+		entries = append(entries, Entry{Fingerprint: fp(i), Login: fmt.Sprintf("user-%d", i/3), LastSeen: time.Unix(int64(i), 0)})
+	}
+	data := build(t, entries)
+	if perKey := len(data) / len(entries); perKey >= 100 {
+		t.Errorf("%d bytes per key, want under 100", perKey)
+	}
+	// Entries in another order produce the same file
+	reversed := make([]Entry, len(entries))
+	for i, e := range entries {
+		reversed[len(entries)-1-i] = e
+	}
+	if !bytes.Equal(data, build(t, reversed)) {
+		t.Error("file depends on the order of entries")
+	}
+}
+
+func TestWriteRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry Entry
+	}{
+		{name: "md5 fingerprint", entry: Entry{Fingerprint: "MD5:16:27:ac:a5:76:28:2d:36:63:1b:56:4d:eb:df:a6:48", Login: "ada"}},
+		{name: "short digest", entry: Entry{Fingerprint: "SHA256:AAAA", Login: "ada"}},
+		{name: "long login", entry: Entry{Fingerprint: fp(1), Login: strings.Repeat("a", 0x10000)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Write(&bytes.Buffer{}, []Entry{tt.entry}); err == nil {
+				t.Error("Write succeeded")
+			}
+		})
+	}
+}
+
+func TestNewCorrupt(t *testing.T) {
+	good := build(t, []Entry{{Fingerprint: fp(1), Login: "ada"}, {Fingerprint: fp(2), Login: "grace"}})
+	tests := []struct {
+		name    string
+		corrupt func([]byte) []byte
+	}{
+		{name: "empty", corrupt: func([]byte) []byte { return nil }},
+		{name: "short header", corrupt: func(b []byte) []byte { return b[:headerSize-1] }},
+		{name: "bad magic", corrupt: func(b []byte) []byte { b[0] = 'X'; return b }},
+		{name: "newer version", corrupt: func(b []byte) []byte { b[7] = 2; return b }},
+		{name: "truncated", corrupt: func(b []byte) []byte { return b[:len(b)-1] }},
+		{name: "trailing bytes", corrupt: func(b []byte) []byte { return append(b, 0) }},
+		{name: "huge record count", corrupt: func(b []byte) []byte { binary.LittleEndian.PutUint32(b[8:], 0xffffffff); return b }},
+		{name: "huge string table", corrupt: func(b []byte) []byte { binary.LittleEndian.PutUint32(b[12:], 0xffffffff); return b }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.corrupt(bytes.Clone(good))); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("New() error = %v, want ErrCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestLookupBadLoginOffset(t *testing.T) {
+	data := build(t, []Entry{{Fingerprint: fp(1), Login: "ada"}})
+	// Point the only record's login past the end of the string table
+	binary.LittleEndian.PutUint32(data[headerSize+digestSize:], 2)
+	db, err := New(data)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if login, _, ok := db.Lookup(fp(1)); ok {
+		t.Errorf("Lookup() = %q, true; want a corrupt record to be missing", login)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.cdb")
+	if err := os.WriteFile(path, build(t, []Entry{{Fingerprint: fp(1), Login: "ada"}}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if login, _, ok := db.Lookup(fp(1)); !ok || login != "ada" {
+		t.Errorf("Lookup() = %q, %v; want ada", login, ok)
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.cdb")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open of a missing file: %v, want ErrNotExist", err)
+	}
+}
+
+// FuzzNew checks that corrupted files are rejected or answer lookups without panicking.
+func FuzzNew(f *testing.F) {
+	f.Add(build(f, nil))
+	f.Add(build(f, []Entry{{Fingerprint: fp(1), Login: "ada"}, {Fingerprint: fp(2), Login: "grace"}, {Fingerprint: fp(3), Login: "ada"}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		db, err := New(data)
+		if err != nil {
+			if !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("New error %v does not wrap ErrCorrupt", err)
+			}
+			return
+		}
+		for i := 0; i < db.Len(); i++ {
+			rec := db.record(i)
+			db.Lookup("SHA256:" + base64.RawStdEncoding.EncodeToString(rec[:digestSize]))
+		}
+		db.Lookup(fp(1))
+	})
+}
+
+func BenchmarkLookup(b *testing.B) {
+	var entries []Entry
+	for i := 0; i < 100000; i++ {
+		entries = append(entries, Entry{Fingerprint: fp(i), Login: fmt.Sprintf("user-%d", i)})
+	}
+	db, err := New(build(b, entries))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, ok := db.Lookup(entries[i%len(entries)].Fingerprint); !ok {
+			b.Fatal("key not found")
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package export
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// archiveFormat identifies an archive's manifest
+const archiveFormat = "pubkey-collector-archive/1"
+
+// Archive entry names. The manifest comes first, then its signature if signed, then the chunks in order.
+const (
+	manifestName  = "MANIFEST.json"
+	signatureName = "MANIFEST.json.sig"
+)
+
+// defaultChunkRecords is how many records an archive chunk holds unless ArchiveOptions says otherwise
+const defaultChunkRecords = 100000
+
+// maxManifestSize bounds how much of an archive is read as its manifest
+const maxManifestSize = 16 << 20
+
+// ArchiveManifest describes an archive: what it holds and how to check each part of it.
+type ArchiveManifest struct {
+	Format  string    `json:"format"`
+	Created time.Time `json:"created"`
+	// Schema is the keydb.RecordSchema the records were written with.
+	Schema int `json:"schema"`
+	// Collector is the version of the program that wrote the archive.
+	Collector string `json:"collector"`
+	Records   int    `json:"records"`
+	// Counts are the number of records of each keydb.Record type, such as "key" or "run".
+	Counts map[string]int `json:"counts"`
+	Chunks []ArchiveChunk `json:"chunks"`
+}
+
+// ArchiveChunk is one zstd-compressed file of newline-delimited JSON keydb.Records in an archive.
+type ArchiveChunk struct {
+	Name    string `json:"name"`
+	Records int    `json:"records"`
+	Size    int64  `json:"size"`
+	// SHA256 is the hex digest of the compressed chunk, as stored in the archive.
+	SHA256 string `json:"sha256"`
+}
+
+// ArchiveOptions configures Archive.
+type ArchiveOptions struct {
+	// ChunkRecords is how many records each chunk holds; zero means 100000.
+	ChunkRecords int
+	// PrivateKey, if set, signs the manifest.
+	PrivateKey ed25519.PrivateKey
+}
+
+// ArchiveCheck is the outcome of verifying an archive.
+type ArchiveCheck struct {
+	Manifest *ArchiveManifest
+	// Signed reports whether the archive carries a manifest signature; SignatureVerified whether it
+	// was checked against a public key.
+	Signed            bool
+	SignatureVerified bool
+}
+
+// Archive writes the whole database, bookkeeping records and indexes included, to a tar file at path
+// for cold storage. The records are newline-delimited JSON in zstd-compressed chunks, so reading them
+// back needs neither Badger nor this version of it. The tar starts with a manifest of record counts,
+// chunk digests and versions, signed if opts has a private key. The file is replaced atomically.
+func Archive(db *keydb.KeyDB, path string, opts ArchiveOptions) (*ArchiveManifest, error) {
+	perChunk := opts.ChunkRecords
+	if perChunk <= 0 {
+		perChunk = defaultChunkRecords
+	}
+	// Chunks are spooled to disk so the manifest, which needs their digests, can lead the tar
+	spool, err := os.MkdirTemp(filepath.Dir(path), ".archive-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(spool)
+
+	m := &ArchiveManifest{Format: archiveFormat, Created: time.Now().UTC(), Schema: keydb.RecordSchema, Collector: collectorVersion(), Counts: map[string]int{}}
+	var cw *chunkWriter
+	err = db.DumpRecords(context.Background(), func(rec keydb.Record) error {
+		if cw == nil {
+			var err error
+			if cw, err = newChunkWriter(spool, fmt.Sprintf("records/%06d.ndjson.zst", len(m.Chunks))); err != nil {
+				return err
+			}
+		}
+		if err := cw.enc.Encode(rec); err != nil {
+			return err
+		}
+		cw.chunk.Records++
+		m.Records++
+		m.Counts[rec.Type]++
+		if cw.chunk.Records < perChunk {
+			return nil
+		}
+		chunk, err := cw.close()
+		m.Chunks = append(m.Chunks, chunk)
+		cw = nil
+		return err
+	})
+	if cw != nil {
+		chunk, cerr := cw.close()
+		m.Chunks = append(m.Chunks, chunk)
+		err = errors.Join(err, cerr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".archive-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	tw := tar.NewWriter(tmp)
+	err = addTarFile(tw, manifestName, m.Created, int64(len(manifest)), strings.NewReader(string(manifest)))
+	if err == nil && opts.PrivateKey != nil {
+		sig := base64.StdEncoding.EncodeToString(ed25519.Sign(opts.PrivateKey, manifest)) + "\n"
+		err = addTarFile(tw, signatureName, m.Created, int64(len(sig)), strings.NewReader(sig))
+	}
+	for _, c := range m.Chunks {
+		if err != nil {
+			break
+		}
+		err = addChunk(tw, spool, c, m.Created)
+	}
+	if err := errors.Join(err, tw.Close(), tmp.Chmod(0o644), tmp.Close()); err != nil {
+		return nil, err
+	}
+	return m, os.Rename(tmp.Name(), path)
+}
+
+// VerifyArchive checks an archive's manifest, the digest and record count of every chunk, and the
+// record counts by type, without writing anything. With a public key the manifest must be signed by
+// it; without one a signature is reported but not checked.
+func VerifyArchive(path string, pub ed25519.PublicKey) (*ArchiveCheck, error) {
+	return readArchive(path, pub, nil)
+}
+
+// RestoreArchive rebuilds a database at dest from an archive. The whole archive is verified, as by
+// VerifyArchive, before anything is written. dest must not exist or be empty; it is removed again if
+// restoring fails.
+func RestoreArchive(path, dest string, pub ed25519.PublicKey) (check *ArchiveCheck, err error) {
+	if _, err := readArchive(path, pub, nil); err != nil {
+		return nil, err
+	}
+	if entries, err := os.ReadDir(dest); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", dest)
+	}
+	db, err := keydb.NewWithProfile(dest, keydb.ProfileBulkLoad)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.RemoveAll(dest)
+		}
+	}()
+
+	var batch []keydb.Record
+	check, err = readArchive(path, pub, func(rec keydb.Record) error {
+		batch = append(batch, rec)
+		if len(batch) < 1000 {
+			return nil
+		}
+		err := db.LoadRecords(batch)
+		batch = batch[:0]
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return check, db.LoadRecords(batch)
+}
+
+// readArchive verifies an archive, calling fn, if set, with each record as it is read. Records come
+// before the chunk holding them is fully checked, so callers must discard them if an error is returned.
+func readArchive(path string, pub ed25519.PublicKey, fn func(keydb.Record) error) (*ArchiveCheck, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if hdr.Name != manifestName {
+		return nil, fmt.Errorf("%s is not an archive: first entry is %s, want %s", path, hdr.Name, manifestName)
+	}
+	manifest, err := io.ReadAll(io.LimitReader(tr, maxManifestSize))
+	if err != nil {
+		return nil, err
+	}
+	check := &ArchiveCheck{Manifest: &ArchiveManifest{}}
+	m := check.Manifest
+	if err := json.Unmarshal(manifest, m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	if m.Format != archiveFormat {
+		return nil, fmt.Errorf("unknown archive format %q", m.Format)
+	}
+	if m.Schema > keydb.RecordSchema {
+		return nil, fmt.Errorf("archive records are schema %d; this version reads up to %d", m.Schema, keydb.RecordSchema)
+	}
+
+	hdr, err = tr.Next()
+	if err == nil && hdr.Name == signatureName {
+		check.Signed = true
+		sig, rerr := io.ReadAll(io.LimitReader(tr, maxManifestSize))
+		if rerr != nil {
+			return nil, rerr
+		}
+		if pub != nil {
+			if err := verifySignature(pub, manifest, sig); err != nil {
+				return nil, err
+			}
+			check.SignatureVerified = true
+		}
+		hdr, err = tr.Next()
+	}
+	if pub != nil && !check.Signed {
+		return nil, errors.New("archive is not signed")
+	}
+
+	counts := map[string]int{}
+	for i := 0; ; i++ {
+		if errors.Is(err, io.EOF) {
+			if i < len(m.Chunks) {
+				return nil, fmt.Errorf("archive is missing chunk %s", m.Chunks[i].Name)
+			}
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+		if i >= len(m.Chunks) || hdr.Name != m.Chunks[i].Name {
+			return nil, fmt.Errorf("unexpected archive entry %s", hdr.Name)
+		}
+		if err := readChunk(tr, m.Chunks[i], counts, fn); err != nil {
+			return nil, fmt.Errorf("chunk %s: %w", hdr.Name, err)
+		}
+		hdr, err = tr.Next()
+	}
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total != m.Records || !maps.Equal(counts, m.Counts) {
+		return nil, fmt.Errorf("archive holds %d records %v; manifest says %d %v", total, counts, m.Records, m.Counts)
+	}
+	return check, nil
+}
+
+// readChunk decodes one chunk, tallying its records by type, and checks it against the manifest
+func readChunk(r io.Reader, want ArchiveChunk, counts map[string]int, fn func(keydb.Record) error) error {
+	h := sha256.New()
+	cr := &countingReader{r: io.TeeReader(r, h)}
+	zr, err := zstd.NewReader(cr, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	n := 0
+	dec := json.NewDecoder(zr)
+	for {
+		var rec keydb.Record
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		n++
+		counts[rec.Type]++
+		if fn != nil {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+	// Hash whatever the decoder left unread, so trailing bytes can't escape the digest
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != want.SHA256 || cr.n != want.Size {
+		return fmt.Errorf("digest %s (%d bytes) does not match manifest %s (%d bytes)", sum, cr.n, want.SHA256, want.Size)
+	}
+	if n != want.Records {
+		return fmt.Errorf("holds %d records; manifest says %d", n, want.Records)
+	}
+	return nil
+}
+
+// chunkWriter compresses one chunk to a spool file, hashing it as it goes
+type chunkWriter struct {
+	f     *os.File
+	h     hash.Hash
+	zw    *zstd.Encoder
+	enc   *json.Encoder
+	chunk ArchiveChunk
+}
+
+func newChunkWriter(spool, name string) (*chunkWriter, error) {
+	path := filepath.Join(spool, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	cw := &chunkWriter{f: f, h: sha256.New(), chunk: ArchiveChunk{Name: name}}
+	if cw.zw, err = zstd.NewWriter(io.MultiWriter(f, cw.h)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	cw.enc = json.NewEncoder(cw.zw)
+	return cw, nil
+}
+
+// close finishes the chunk and returns its manifest entry
+func (cw *chunkWriter) close() (ArchiveChunk, error) {
+	err := cw.zw.Close()
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = cw.f.Stat(); err == nil {
+			cw.chunk.Size = fi.Size()
+		}
+	}
+	cw.chunk.SHA256 = hex.EncodeToString(cw.h.Sum(nil))
+	return cw.chunk, errors.Join(err, cw.f.Close())
+}
+
+// addChunk copies a spooled chunk into the tar
+func addChunk(tw *tar.Writer, spool string, c ArchiveChunk, mod time.Time) error {
+	f, err := os.Open(filepath.Join(spool, filepath.FromSlash(c.Name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return addTarFile(tw, c.Name, mod, c.Size, f)
+}
+
+// addTarFile writes one regular file to the tar
+func addTarFile(tw *tar.Writer, name string, mod time.Time, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: size, ModTime: mod, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// verifySignature checks a base64 Ed25519 signature of the manifest
+func verifySignature(pub ed25519.PublicKey, manifest, sig []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	if !ed25519.Verify(pub, manifest, raw) {
+		return errors.New("manifest signature does not match the public key")
+	}
+	return nil
+}
+
+// collectorVersion returns the module version and VCS revision the running binary was built from
+func collectorVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v := bi.Main.Path + " " + bi.Main.Version
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			v += " " + s.Value
+		}
+	}
+	return v
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,247 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// dumpRecords returns every record in db, in key order
+func dumpRecords(t *testing.T, db *keydb.KeyDB) []string {
+	t.Helper()
+	var recs []string
+	err := db.DumpRecords(context.Background(), func(rec keydb.Record) error {
+		data, err := json.Marshal(rec)
+		recs = append(recs, string(data))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("DumpRecords: %v", err)
+	}
+	return recs
+}
+
+// tarEntry is one file of an archive, for tampering with
+type tarEntry struct {
+	name string
+	data []byte
+}
+
+// rewriteArchive replaces the archive at path with the entries edit returns
+func rewriteArchive(t *testing.T, path string, edit func([]tarEntry) []tarEntry) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []tarEntry
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{hdr.Name, data})
+	}
+	f.Close()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range edit(entries) {
+		if err := addTarFile(tw, e.name, time.Now(), int64(len(e.data)), bytes.NewReader(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// editManifest returns an edit that changes the manifest with fn
+func editManifest(t *testing.T, fn func(m *ArchiveManifest)) func([]tarEntry) []tarEntry {
+	return func(entries []tarEntry) []tarEntry {
+		m := &ArchiveManifest{}
+		if err := json.Unmarshal(entries[0].data, m); err != nil {
+			t.Fatal(err)
+		}
+		fn(m)
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[0].data = data
+		return entries
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	db := newFixtureDB(t)
+	want := dumpRecords(t, db)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		opts       ArchiveOptions
+		pub        ed25519.PublicKey
+		wantChunks int
+	}{
+		{name: "one chunk", wantChunks: 1},
+		{name: "a record per chunk", opts: ArchiveOptions{ChunkRecords: 1}, wantChunks: len(want)},
+		{name: "partial last chunk", opts: ArchiveOptions{ChunkRecords: 7}, wantChunks: (len(want) + 6) / 7},
+		{name: "signed", opts: ArchiveOptions{PrivateKey: priv}, pub: pub, wantChunks: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "keys.tar")
+			m, err := Archive(db, path, tt.opts)
+			if err != nil {
+				t.Fatalf("Archive: %v", err)
+			}
+			if m.Records != len(want) || len(m.Chunks) != tt.wantChunks || m.Counts[keydb.RecordKey] != 8 {
+				t.Errorf("manifest has %d records in %d chunks, %d keys; want %d in %d, 8 keys", m.Records, len(m.Chunks), m.Counts[keydb.RecordKey], len(want), tt.wantChunks)
+			}
+
+			check, err := VerifyArchive(path, tt.pub)
+			if err != nil {
+				t.Fatalf("VerifyArchive: %v", err)
+			}
+			if check.Signed != (tt.opts.PrivateKey != nil) || check.SignatureVerified != (tt.pub != nil) {
+				t.Errorf("signed %v, verified %v", check.Signed, check.SignatureVerified)
+			}
+
+			dest := filepath.Join(dir, "restored")
+			if _, err := RestoreArchive(path, dest, tt.pub); err != nil {
+				t.Fatalf("RestoreArchive: %v", err)
+			}
+			restored, err := keydb.New(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer restored.Close()
+			if got := dumpRecords(t, restored); !slices.Equal(got, want) {
+				t.Errorf("restored %d records, want the original %d:\n%s", len(got), len(want), strings.Join(got, "\n"))
+			}
+			if keys, err := restored.UserKeys("ken"); err != nil || len(keys) != 2 {
+				t.Errorf("restored UserKeys(ken) = %d keys, %v; want 2", len(keys), err)
+			}
+		})
+	}
+}
+
+func TestArchiveTampering(t *testing.T) {
+	db := newFixtureDB(t)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		signed  bool
+		pub     ed25519.PublicKey
+		edit    func([]tarEntry) []tarEntry
+		wantErr string
+	}{
+		{name: "chunk byte flipped", edit: func(e []tarEntry) []tarEntry {
+			e[1].data[len(e[1].data)/2] ^= 0xff
+			return e
+		}, wantErr: "chunk"},
+		{name: "trailing bytes after a chunk", edit: func(e []tarEntry) []tarEntry {
+			e[1].data = append(e[1].data, 0)
+			return e
+		}, wantErr: "does not match manifest"},
+		{name: "chunk missing", edit: func(e []tarEntry) []tarEntry { return e[:2] }, wantErr: "missing chunk"},
+		{name: "chunks reordered", edit: func(e []tarEntry) []tarEntry {
+			e[1], e[2] = e[2], e[1]
+			return e
+		}, wantErr: "unexpected archive entry"},
+		{name: "extra entry", edit: func(e []tarEntry) []tarEntry {
+			return append(e, tarEntry{"records/extra.ndjson.zst", []byte("x")})
+		}, wantErr: "unexpected archive entry"},
+		{name: "manifest first entry", edit: func(e []tarEntry) []tarEntry { return e[1:] }, wantErr: "not an archive"},
+		{name: "count changed", edit: editManifest(t, func(m *ArchiveManifest) { m.Counts[keydb.RecordKey]++ }), wantErr: "manifest says"},
+		{name: "future schema", edit: editManifest(t, func(m *ArchiveManifest) { m.Schema = keydb.RecordSchema + 1 }), wantErr: "schema"},
+		{name: "unknown format", edit: editManifest(t, func(m *ArchiveManifest) { m.Format = "tarball/9" }), wantErr: "unknown archive format"},
+		{name: "signed manifest changed", signed: true, pub: pub,
+			edit: editManifest(t, func(m *ArchiveManifest) { m.Collector = "forged" }), wantErr: "signature does not match"},
+		{name: "signature removed", signed: true, pub: pub, edit: func(e []tarEntry) []tarEntry {
+			return slices.Delete(e, 1, 2)
+		}, wantErr: "not signed"},
+		{name: "another key", signed: true, pub: otherPub, edit: func(e []tarEntry) []tarEntry { return e }, wantErr: "signature does not match"},
+		{name: "unsigned archive, key required", pub: pub, edit: func(e []tarEntry) []tarEntry { return e }, wantErr: "not signed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "keys.tar")
+			opts := ArchiveOptions{ChunkRecords: 10}
+			if tt.signed {
+				opts.PrivateKey = priv
+			}
+			if _, err := Archive(db, path, opts); err != nil {
+				t.Fatalf("Archive: %v", err)
+			}
+			rewriteArchive(t, path, tt.edit)
+
+			if _, err := VerifyArchive(path, tt.pub); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("VerifyArchive error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+			dest := filepath.Join(dir, "restored")
+			if _, err := RestoreArchive(path, dest, tt.pub); err == nil {
+				t.Error("RestoreArchive succeeded")
+			}
+			if _, err := os.Stat(dest); !os.IsNotExist(err) {
+				t.Errorf("failed restore left %s behind: %v", dest, err)
+			}
+		})
+	}
+}
+
+func TestRestoreArchiveNonEmpty(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys.tar")
+	if _, err := Archive(newFixtureDB(t), path, ArchiveOptions{}); err != nil {
+		t.Fatalf("Archive: %v", err)
+	}
+	dest := filepath.Join(dir, "existing")
+	if err := os.MkdirAll(dest, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "keep"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreArchive(path, dest, nil); err == nil {
+		t.Fatal("RestoreArchive into a non-empty directory succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "keep")); err != nil {
+		t.Errorf("existing file was removed: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/tstromberg/pubkey-collector/pkg/compactdb"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// Compact writes the keys selected by filter to path as a compactdb file mapping fingerprints to
+// owners and last-seen times, and returns the number of keys written. The file answers login
+// checks, so signing-only, blocked and malformed keys are left out. It is replaced atomically, so
+// readers never see it half written.
+func Compact(db *keydb.KeyDB, path string, filter Filter) (int, error) {
+	var entries []compactdb.Entry
+	err := db.ForEachKey(context.Background(), func(rec keydb.KeyRecord) error {
+		if filter != nil && !filter(rec.User, rec.Repo) {
+			return nil
+		}
+		if rec.Purpose == keydb.PurposeSigning || slices.Contains(rec.Flags, keydb.FlagBlocked) || slices.Contains(rec.Flags, keydb.FlagMalformed) {
+			return nil
+		}
+		fp := rec.Fingerprint
+		if fp == "" {
+			// Keys stored before fingerprints were recorded
+			var err error
+			if fp, err = keydb.Fingerprint(rec.Key); err != nil {
+				return nil
+			}
+		}
+		entries = append(entries, compactdb.Entry{Fingerprint: fp, Login: rec.User, LastSeen: rec.Timestamp})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".compact-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err := compactdb.Write(w, entries); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := errors.Join(w.Flush(), tmp.Chmod(0o644), tmp.Close()); err != nil {
+		return 0, err
+	}
+	return len(entries), os.Rename(tmp.Name(), path)
+}
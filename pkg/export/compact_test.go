@@ -0,0 +1,100 @@
+package export
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/compactdb"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	db := newFixtureDB(t)
+	tests := []struct {
+		name   string
+		filter Filter
+		want   int
+	}{
+		{name: "all", want: 8},
+		{name: "one org", filter: func(user, repo string) bool { return repo == "kernel" || repo == "kernel/unix" }, want: 3},
+		{name: "nobody", filter: func(string, string) bool { return false }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.cdb")
+			n, err := Compact(db, path, tt.filter)
+			if err != nil {
+				t.Fatalf("Compact: %v", err)
+			}
+			if n != tt.want {
+				t.Errorf("wrote %d keys, want %d", n, tt.want)
+			}
+			cdb, err := compactdb.Open(path)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if cdb.Len() != tt.want {
+				t.Errorf("file holds %d keys, want %d", cdb.Len(), tt.want)
+			}
+
+			err = db.ForEachKey(context.Background(), func(rec keydb.KeyRecord) error {
+				login, seen, ok := cdb.Lookup(rec.Fingerprint)
+				if tt.filter != nil && !tt.filter(rec.User, rec.Repo) {
+					if ok {
+						t.Errorf("%s's key %s was exported despite the filter", rec.User, rec.Fingerprint)
+					}
+					return nil
+				}
+				if !ok || login != rec.User || !seen.Equal(rec.Timestamp) {
+					t.Errorf("Lookup(%s) = %q, %s, %v; want %q, %s", rec.Fingerprint, login, seen, ok, rec.User, rec.Timestamp)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCompactSkipsUnusableKeys(t *testing.T) {
+	db := newFixtureDB(t)
+	at := time.Date(2026, 2, 2, 12, 0, 0, 0, time.UTC)
+	signing, malformed := testKey(t, 9), "ssh-rsa "+strings.Fields(testKey(t, 10))[1]
+	if err := db.Store(collect.UserInfo{Username: "Grace", SigningKeys: []string{signing}, PublicKeys: []string{malformed}}, "Grace", at); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	blocked, err := keydb.Fingerprint(testKey(t, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Block(blocked, "test", "leaked"); err != nil {
+		t.Fatalf("Block: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.cdb")
+	n, err := Compact(db, path, nil)
+	if err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if n != 7 {
+		t.Errorf("wrote %d keys, want the fixture's 8 less the blocked one", n)
+	}
+	cdb, err := compactdb.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for name, key := range map[string]string{"signing-only": signing, "blocked": testKey(t, 4)} {
+		fp, err := keydb.Fingerprint(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if login, _, ok := cdb.Lookup(fp); ok {
+			t.Errorf("%s key was exported for %s", name, login)
+		}
+	}
+}
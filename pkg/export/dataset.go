@@ -0,0 +1,152 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// DatasetRow is one user-key association in a historical dataset file. In CSV the columns are
+// login,key,observed_at,source with a header row; in JSON Lines each line is an object with these
+// field names. observed_at is RFC3339 or a date (2006-01-02); source is optional.
+type DatasetRow struct {
+	Login      string `json:"login"`
+	Key        string `json:"key"`
+	ObservedAt string `json:"observed_at"`
+	Source     string `json:"source,omitempty"`
+}
+
+// RowError describes a malformed dataset row.
+type RowError struct {
+	Line int
+	Err  error
+}
+
+// Error returns the line number and problem.
+func (e RowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// csvColumns is the expected CSV header.
+var csvColumns = []string{"login", "key", "observed_at", "source"}
+
+// ReadDataset reads a historical dataset from path, choosing CSV or JSON Lines by its extension
+// (.csv, or .json/.jsonl). Malformed rows are returned as RowErrors and do not stop the read; an
+// error is returned only when the file as a whole cannot be read.
+func ReadDataset(path string) ([]keydb.Sighting, []RowError, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return readDatasetCSV(f)
+	case ".json", ".jsonl":
+		return readDatasetJSON(f)
+	default:
+		return nil, nil, fmt.Errorf("unknown dataset format %q: want .csv, .json or .jsonl", filepath.Ext(path))
+	}
+}
+
+// readDatasetCSV reads CSV rows after checking the header.
+func readDatasetCSV(r io.Reader) ([]keydb.Sighting, []RowError, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("read header: %w", err)
+	}
+	for i, col := range csvColumns[:3] {
+		if i >= len(header) || strings.TrimSpace(strings.ToLower(header[i])) != col {
+			return nil, nil, fmt.Errorf("header must start with %s", strings.Join(csvColumns, ","))
+		}
+	}
+
+	var sightings []keydb.Sighting
+	var bad []RowError
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var pe *csv.ParseError
+			if errors.As(err, &pe) {
+				bad = append(bad, RowError{Line: pe.Line, Err: pe.Err})
+				continue
+			}
+			return sightings, bad, err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(rec) < 3 {
+			bad = append(bad, RowError{Line: line, Err: fmt.Errorf("want at least 3 columns, got %d", len(rec))})
+			continue
+		}
+		row := DatasetRow{Login: rec[0], Key: rec[1], ObservedAt: rec[2]}
+		if len(rec) > 3 {
+			row.Source = rec[3]
+		}
+		s, err := row.sighting()
+		if err != nil {
+			bad = append(bad, RowError{Line: line, Err: err})
+			continue
+		}
+		sightings = append(sightings, s)
+	}
+	return sightings, bad, nil
+}
+
+// readDatasetJSON reads one JSON object per line, ignoring blank lines.
+func readDatasetJSON(r io.Reader) ([]keydb.Sighting, []RowError, error) {
+	var sightings []keydb.Sighting
+	var bad []RowError
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var row DatasetRow
+		if err := json.Unmarshal([]byte(text), &row); err != nil {
+			bad = append(bad, RowError{Line: line, Err: err})
+			continue
+		}
+		s, err := row.sighting()
+		if err != nil {
+			bad = append(bad, RowError{Line: line, Err: err})
+			continue
+		}
+		sightings = append(sightings, s)
+	}
+	return sightings, bad, scanner.Err()
+}
+
+// sighting validates a row and converts it for keydb.Backfill.
+func (r DatasetRow) sighting() (keydb.Sighting, error) {
+	login, key := strings.TrimSpace(r.Login), strings.TrimSpace(r.Key)
+	if login == "" {
+		return keydb.Sighting{}, errors.New("empty login")
+	}
+	if _, err := keydb.Fingerprint(key); err != nil {
+		return keydb.Sighting{}, fmt.Errorf("unparseable key: %w", err)
+	}
+	at, err := time.Parse(time.RFC3339, strings.TrimSpace(r.ObservedAt))
+	if err != nil {
+		if at, err = time.Parse("2006-01-02", strings.TrimSpace(r.ObservedAt)); err != nil {
+			return keydb.Sighting{}, fmt.Errorf("observed_at %q is neither RFC3339 nor a date", r.ObservedAt)
+		}
+	}
+	return keydb.Sighting{Login: login, Key: key, ObservedAt: at, Source: strings.TrimSpace(r.Source)}, nil
+}
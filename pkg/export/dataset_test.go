@@ -0,0 +1,151 @@
+package export
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+func TestReadDataset(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		// content, if set, is written to path in a temporary directory instead of reading testdata
+		content     string
+		wantRows    int
+		wantBad     []int
+		wantErr     bool
+		wantSources []string
+	}{
+		{name: "csv", path: "testdata/historical.csv", wantRows: 6, wantBad: []int{8, 9, 10, 11},
+			wantSources: []string{"ghtorrent-2014", "ghtorrent-2015", "", "ghtorrent-2013", "ghtorrent-2012", "future"}},
+		{name: "json lines", path: "testdata/historical.jsonl", wantRows: 6, wantBad: []int{8, 9, 10, 11},
+			wantSources: []string{"ghtorrent-2014", "ghtorrent-2015", "", "ghtorrent-2013", "ghtorrent-2012", "future"}},
+		{name: "csv without a source column", path: "old.csv", content: "Login,Key,Observed_At\nada," + testKey(t, 1) + ",2014-03-01\n", wantRows: 1,
+			wantSources: []string{""}},
+		{name: "csv with the wrong header", path: "bad.csv", content: "user,key,date\n", wantErr: true},
+		{name: "unknown extension", path: "dump.tsv", content: "login\tkey\tobserved_at\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path
+			if tt.content != "" {
+				path = filepath.Join(t.TempDir(), tt.path)
+				if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sightings, bad, err := ReadDataset(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadDataset error = %v, want error: %v", err, tt.wantErr)
+			}
+			if len(sightings) != tt.wantRows {
+				t.Errorf("read %d sightings, want %d", len(sightings), tt.wantRows)
+			}
+			var lines []int
+			for _, e := range bad {
+				lines = append(lines, e.Line)
+			}
+			if !slices.Equal(lines, tt.wantBad) {
+				t.Errorf("malformed rows on lines %v (%v), want %v", lines, bad, tt.wantBad)
+			}
+			for i, s := range sightings {
+				if i < len(tt.wantSources) && s.Source != tt.wantSources[i] {
+					t.Errorf("sighting %d source = %q, want %q", i, s.Source, tt.wantSources[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBackfillDataset(t *testing.T) {
+	day := func(s string) time.Time {
+		at, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+	collected := time.Date(2026, 2, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		key            string
+		wantUser       string
+		wantSource     string
+		wantFirst      time.Time
+		wantLast       time.Time
+		wantHistorical *keydb.HistoricalSource
+	}{
+		{name: "older sighting backdates first seen", key: testKey(t, 1), wantUser: "ada", wantSource: "github-org",
+			wantFirst: day("2014-03-01T00:00:00Z"), wantLast: collected,
+			wantHistorical: &keydb.HistoricalSource{Dataset: "ghtorrent", Source: "ghtorrent-2014", Confidence: 0.8}},
+		{name: "login case is ignored", key: testKey(t, 3), wantUser: "Grace", wantSource: "github-events",
+			wantFirst: day("2016-05-05T10:00:00Z"), wantLast: collected.Add(time.Minute),
+			wantHistorical: &keydb.HistoricalSource{Dataset: "ghtorrent", Confidence: 0.8}},
+		{name: "another owner's key is left alone", key: testKey(t, 4), wantUser: "linus", wantSource: "github-org",
+			wantFirst: collected.Add(2 * time.Minute), wantLast: collected.Add(2 * time.Minute)},
+		{name: "unknown keys are added", key: testKey(t, 9), wantUser: "margaret", wantSource: "dataset:ghtorrent",
+			wantFirst: day("2012-07-01T00:00:00Z"), wantLast: day("2012-07-01T00:00:00Z"),
+			wantHistorical: &keydb.HistoricalSource{Dataset: "ghtorrent", Source: "ghtorrent-2012", Confidence: 0.8}},
+	}
+
+	for _, path := range []string{"testdata/historical.csv", "testdata/historical.jsonl"} {
+		t.Run(filepath.Ext(path), func(t *testing.T) {
+			db := newFixtureDB(t)
+			sightings, _, err := ReadDataset(path)
+			if err != nil {
+				t.Fatalf("ReadDataset: %v", err)
+			}
+			stats, err := db.Backfill(sightings, "ghtorrent", 0.8)
+			if err != nil {
+				t.Fatalf("Backfill: %v", err)
+			}
+			if want := (keydb.BackfillStats{Added: 1, Backdated: 2, Unchanged: 3}); *stats != want {
+				t.Errorf("Backfill stats = %+v, want %+v", *stats, want)
+			}
+
+			for _, tt := range tests {
+				md, err := db.Lookup(tt.key)
+				if err != nil {
+					t.Fatalf("%s: Lookup: %v", tt.name, err)
+				}
+				if md.User != tt.wantUser || md.Source != tt.wantSource {
+					t.Errorf("%s: owner %s from %s, want %s from %s", tt.name, md.User, md.Source, tt.wantUser, tt.wantSource)
+				}
+				if !md.FirstSeen.Equal(tt.wantFirst) || !md.Timestamp.Equal(tt.wantLast) {
+					t.Errorf("%s: first seen %s, last seen %s; want %s, %s", tt.name, md.FirstSeen, md.Timestamp, tt.wantFirst, tt.wantLast)
+				}
+				if (md.Historical == nil) != (tt.wantHistorical == nil) || (md.Historical != nil && *md.Historical != *tt.wantHistorical) {
+					t.Errorf("%s: historical source %+v, want %+v", tt.name, md.Historical, tt.wantHistorical)
+				}
+			}
+
+			// Importing again changes nothing
+			again, err := db.Backfill(sightings, "ghtorrent", 0.8)
+			if err != nil {
+				t.Fatalf("Backfill again: %v", err)
+			}
+			if want := (keydb.BackfillStats{Unchanged: 6}); *again != want {
+				t.Errorf("second Backfill stats = %+v, want %+v", *again, want)
+			}
+
+			// Later collection keeps the backdated first-seen time and its source
+			later := collected.Add(24 * time.Hour)
+			if err := db.Store(collect.UserInfo{Username: "ada", Source: "github-org", PublicKeys: []string{testKey(t, 1)}}, "ada", later); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			md, err := db.Lookup(testKey(t, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !md.FirstSeen.Equal(tests[0].wantFirst) || !md.Timestamp.Equal(later) || md.Historical == nil {
+				t.Errorf("after collection: first seen %s, last seen %s, historical %+v", md.FirstSeen, md.Timestamp, md.Historical)
+			}
+		})
+	}
+}
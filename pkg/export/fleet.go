@@ -0,0 +1,202 @@
+package export
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// FleetLineError describes an authorized_keys line or file that could not be imported.
+type FleetLineError struct {
+	Path string
+	// Line is 0 for problems with the whole file.
+	Line int
+	Err  error
+}
+
+// Error returns the file, line number and problem.
+func (e FleetLineError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: %v", e.Path, e.Line, e.Err)
+}
+
+// ReadFleet reads the authorized_keys files collected from a fleet of servers, returning their keys
+// by host. Each directory directly under dir is a host, holding copies of that host's files at their
+// usual paths. The local account a file authorizes is taken from where it lives:
+//
+//	HOST/home/alice/.ssh/authorized_keys    alice (any ACCOUNT/.ssh/authorized_keys or authorized_keys2)
+//	HOST/etc/ssh/authorized_keys/alice      alice (a per-account file, as with AuthorizedKeysFile %u)
+//	HOST/alice/authorized_keys              alice
+//
+// Other files are ignored. Options and comments are kept; a key listed twice for an account is
+// recorded once. Keys that fail keydb.ValidateKey are returned marked Malformed. Lines that aren't
+// keys are returned as FleetLineErrors and do not stop the read; an error is returned only when dir
+// as a whole cannot be read.
+func ReadFleet(dir string) (map[string][]keydb.FleetKey, []FleetLineError, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hosts := map[string][]keydb.FleetKey{}
+	var bad []FleetLineError
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		host := e.Name()
+		seen := map[string]bool{}
+		hosts[host] = []keydb.FleetKey{}
+		err := filepath.WalkDir(filepath.Join(dir, host), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			account, ok := fleetAccount(rel)
+			if !ok {
+				return nil
+			}
+			if account == "" {
+				bad = append(bad, FleetLineError{Path: rel, Err: errors.New("can't tell which account this file is for")})
+				return nil
+			}
+
+			keys, lineErrs, err := readAuthorizedKeys(path)
+			if err != nil {
+				bad = append(bad, FleetLineError{Path: rel, Err: err})
+				return nil
+			}
+			for _, le := range lineErrs {
+				le.Path = rel
+				bad = append(bad, le)
+			}
+			for _, fk := range keys {
+				if seen[account+"/"+fk.Fingerprint] {
+					continue
+				}
+				seen[account+"/"+fk.Fingerprint] = true
+				fk.Host, fk.Account, fk.Path = host, account, rel
+				hosts[host] = append(hosts[host], fk)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("read host %s: %w", host, err)
+		}
+	}
+	return hosts, bad, nil
+}
+
+// fleetAccount returns the local account an authorized_keys file at rel (HOST/...) is for, and
+// false if rel is not an authorized_keys file. The account is "" when the path doesn't say.
+func fleetAccount(rel string) (string, bool) {
+	parts := strings.Split(rel, "/")
+	n := len(parts)
+	name := parts[n-1]
+	if name != "authorized_keys" && name != "authorized_keys2" {
+		// A per-account file in an authorized_keys directory
+		if n >= 3 && parts[n-2] == "authorized_keys" {
+			return name, true
+		}
+		return "", false
+	}
+	if n >= 4 && parts[n-2] == ".ssh" {
+		return parts[n-3], true
+	}
+	if n >= 3 && parts[n-2] != ".ssh" {
+		return parts[n-2], true
+	}
+	return "", true
+}
+
+// readAuthorizedKeys parses an authorized_keys file, skipping blank lines and comments
+func readAuthorizedKeys(path string) ([]keydb.FleetKey, []FleetLineError, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var keys []keydb.FleetKey
+	var bad []FleetLineError
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fk, err := parseAuthorizedKey(text)
+		if err != nil {
+			bad = append(bad, FleetLineError{Line: line, Err: err})
+			continue
+		}
+		keys = append(keys, *fk)
+	}
+	return keys, bad, sc.Err()
+}
+
+// parseAuthorizedKey parses one authorized_keys line. A line whose key blob decodes but doesn't
+// parse is returned Malformed, with options and comment split on whitespace.
+func parseAuthorizedKey(text string) (*keydb.FleetKey, error) {
+	pub, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(text))
+	if err == nil {
+		fk := &keydb.FleetKey{
+			Key:         pub.Type() + " " + base64.StdEncoding.EncodeToString(pub.Marshal()),
+			KeyType:     pub.Type(),
+			Fingerprint: ssh.FingerprintSHA256(pub),
+			Comment:     comment,
+			Options:     options,
+		}
+		if _, err := keydb.ValidateKey(fk.Key); err != nil {
+			fk.Malformed = true
+		}
+		return fk, nil
+	}
+
+	fields := strings.Fields(text)
+	for i := 0; i+1 < len(fields); i++ {
+		blob, derr := base64.StdEncoding.DecodeString(fields[i+1])
+		if derr != nil || !looksLikeKeyType(fields[i]) {
+			continue
+		}
+		sum := sha256.Sum256(blob)
+		fk := &keydb.FleetKey{
+			Key:         fields[i] + " " + fields[i+1],
+			KeyType:     fields[i],
+			Fingerprint: "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]),
+			Comment:     strings.Join(fields[i+2:], " "),
+			Malformed:   true,
+		}
+		if i > 0 {
+			fk.Options = strings.Split(strings.Join(fields[:i], " "), ",")
+		}
+		return fk, nil
+	}
+	return nil, fmt.Errorf("not a key: %w", err)
+}
+
+// looksLikeKeyType reports whether s is shaped like an SSH key type, such as ssh-ed25519 or
+// sk-ecdsa-sha2-nistp256@openssh.com
+func looksLikeKeyType(s string) bool {
+	return strings.HasPrefix(s, "ssh-") || strings.HasPrefix(s, "ecdsa-") || strings.HasPrefix(s, "sk-")
+}
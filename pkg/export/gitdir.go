@@ -0,0 +1,266 @@
+// Package export writes the contents of a pubkey-collector database in portable formats.
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// GitDirUser is the content of one user's file in a gitdir export.
+type GitDirUser struct {
+	Login string `json:"login"`
+	// Keys are sorted by key.
+	Keys []GitDirKey `json:"keys"`
+}
+
+// GitDirKey is one key in a gitdir export. Last-seen times and run provenance are deliberately
+// omitted: they change on every collection and would turn each re-export into a full-tree diff.
+type GitDirKey struct {
+	Key       string           `json:"key"`
+	Repo      string           `json:"repo,omitempty"`
+	Purpose   keydb.KeyPurpose `json:"purpose,omitempty"`
+	Source    string           `json:"source,omitempty"`
+	FirstSeen time.Time        `json:"first_seen"`
+	Flags     []string         `json:"flags,omitempty"`
+	// Fingerprints are the key's fingerprints under each algorithm enabled on the database, when requested.
+	Fingerprints []string `json:"fingerprints,omitempty"`
+}
+
+// GitDirStats summarizes a gitdir export.
+type GitDirStats struct {
+	Users     int
+	Written   int
+	Unchanged int
+	Removed   int
+}
+
+// Filter selects the keys to export or import by login and repo. A nil Filter selects everything.
+type Filter func(login, repo string) bool
+
+// UsersAndOrg returns a Filter matching any of the given logins (case-insensitively) or keys
+// attributed to org: collected as an org member, or seen in one of the org's repositories.
+// With no users and no org it matches everything.
+func UsersAndOrg(users []string, org string) Filter {
+	if len(users) == 0 && org == "" {
+		return nil
+	}
+	want := map[string]bool{}
+	for _, u := range users {
+		want[strings.ToLower(u)] = true
+	}
+	org = strings.ToLower(org)
+	return func(login, repo string) bool {
+		if want[strings.ToLower(login)] {
+			return true
+		}
+		repo = strings.ToLower(repo)
+		return org != "" && (repo == org || strings.HasPrefix(repo, org+"/"))
+	}
+}
+
+// runsFile lists, one per line, the collector runs that wrote the exported keys.
+const runsFile = "RUNS"
+
+// GitDir writes one JSON file per user under dir, sharded by the first two characters of the
+// lower-cased login, plus a RUNS file naming the runs that wrote them. Output is deterministic: the same database always produces byte-identical
+// files. Files whose content is unchanged are not rewritten, and files for users no longer in
+// the database (or no longer selected by filter) are removed, so committing the tree to Git yields minimal diffs.
+// With fingerprints, each key also lists its fingerprints under the database's enabled algorithms.
+func GitDir(db *keydb.KeyDB, dir string, filter Filter, fingerprints bool) (*GitDirStats, error) {
+	users := map[string]*GitDirUser{}
+	runs := map[string]bool{}
+	err := db.ForEachUser(context.Background(), func(ur keydb.UserRecord) error {
+		u := &GitDirUser{Login: ur.Login}
+		for _, rec := range ur.Keys {
+			if filter != nil && !filter(rec.User, rec.Repo) {
+				continue
+			}
+			if rec.RunID != "" {
+				runs[rec.RunID] = true
+			}
+			// Records written before FirstSeen existed were first seen at their only timestamp
+			first := rec.FirstSeen
+			if first.IsZero() {
+				first = rec.Timestamp
+			}
+			k := GitDirKey{
+				Key:       rec.Key,
+				Repo:      rec.Repo,
+				Purpose:   rec.Purpose,
+				Source:    rec.Source,
+				FirstSeen: first.UTC(),
+				Flags:     rec.Flags,
+			}
+			if fingerprints {
+				// Malformed keys have no fingerprints
+				k.Fingerprints, _ = db.Fingerprints(rec.Key)
+			}
+			u.Keys = append(u.Keys, k)
+		}
+		if len(u.Keys) > 0 {
+			users[ur.Login] = u
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &GitDirStats{Users: len(users)}
+	want := map[string]bool{}
+	for login, u := range users {
+		data, err := json.MarshalIndent(u, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, '\n')
+
+		path := filepath.Join(dir, shard(login), collect.FileName(login))
+		want[path] = true
+		if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, data) {
+			stats.Unchanged++
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return nil, err
+		}
+		stats.Written++
+	}
+
+	if err := writeRuns(filepath.Join(dir, runsFile), runs); err != nil {
+		return nil, err
+	}
+
+	// Remove files for users that are no longer present
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json") || want[path] {
+			return nil
+		}
+		stats.Removed++
+		return os.Remove(path)
+	})
+	return stats, err
+}
+
+// writeRuns writes the sorted run IDs to path, leaving it untouched if unchanged.
+func writeRuns(path string, runs map[string]bool) error {
+	ids := make([]string, 0, len(runs))
+	for id := range runs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	data := []byte(strings.Join(ids, "\n") + "\n")
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// ImportStats summarizes a gitdir import.
+type ImportStats struct {
+	Users int
+	Keys  int
+	// Conflicts are keys the export attributes to a different login than db did; see keydb.Conflict.
+	Conflicts int
+}
+
+// ImportGitDir stores the keys from a gitdir export (optionally narrowed by filter) into db,
+// each observed at its first-seen time. Flags are not imported: Store derives them again.
+// Ownership conflicts are recorded in db and counted, and never stop the import.
+func ImportGitDir(db *keydb.KeyDB, dir string, filter Filter) (*ImportStats, error) {
+	stats := &ImportStats{}
+	db.SetConflictDetection(true)
+	defer db.SetConflictDetection(false)
+	before := db.Counts()["conflicts"]
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var u GitDirUser
+		if err := json.Unmarshal(data, &u); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		// Keys observed together share a repo, source and first-seen time
+		type observation struct {
+			repo, source string
+			at           time.Time
+		}
+		groups := map[observation]*collect.UserInfo{}
+		for _, k := range u.Keys {
+			if filter != nil && !filter(u.Login, k.Repo) {
+				continue
+			}
+			o := observation{k.Repo, k.Source, k.FirstSeen}
+			info := groups[o]
+			if info == nil {
+				info = &collect.UserInfo{Username: u.Login, Repo: k.Repo, Source: k.Source}
+				groups[o] = info
+			}
+			if k.Purpose != keydb.PurposeSigning {
+				info.PublicKeys = append(info.PublicKeys, k.Key)
+			}
+			if k.Purpose == keydb.PurposeSigning || k.Purpose == keydb.PurposeBoth {
+				info.SigningKeys = append(info.SigningKeys, k.Key)
+			}
+			stats.Keys++
+		}
+		if len(groups) == 0 {
+			return nil
+		}
+
+		stats.Users++
+		for o, info := range groups {
+			if err := db.Store(*info, u.Login, o.at); err != nil {
+				return fmt.Errorf("store %s: %w", u.Login, err)
+			}
+		}
+		return nil
+	})
+	stats.Conflicts = db.Counts()["conflicts"] - before
+	return stats, err
+}
+
+// shard returns the subdirectory for a login, keeping directories small in large exports.
+func shard(login string) string {
+	name := strings.TrimSuffix(collect.FileName(login), ".json")
+	if len(name) < 2 {
+		return name
+	}
+	return name[:2]
+}
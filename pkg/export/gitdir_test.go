@@ -0,0 +1,291 @@
+package export
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// testKey returns a distinct, valid ed25519 authorized_keys line for each n
+func testKey(t testing.TB, n int) string {
+	t.Helper()
+	seed := make([]byte, ed25519.SeedSize)
+	binary.BigEndian.PutUint64(seed, uint64(n)+1)
+	pub, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(seed).Public())
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
+
+// newFixtureDB returns a database holding users from two orgs, events and a plain user list
+func newFixtureDB(t *testing.T) *keydb.KeyDB {
+	t.Helper()
+	db, err := keydb.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetProvenance(keydb.Provenance{Instance: "test", RunID: "run-1"})
+
+	at := time.Date(2026, 2, 1, 12, 0, 0, 0, time.UTC)
+	users := []collect.UserInfo{
+		{Username: "ada", Repo: "acme", Source: "github-org", PublicKeys: []string{testKey(t, 1), testKey(t, 2)}, SigningKeys: []string{testKey(t, 2)}},
+		{Username: "Grace", Repo: "acme/compiler", Source: "github-events", PublicKeys: []string{testKey(t, 3)}},
+		{Username: "linus", Repo: "kernel", Source: "github-org", PublicKeys: []string{testKey(t, 4)}},
+		{Username: "ken", Repo: "kernel/unix", Source: "github-events", PublicKeys: []string{testKey(t, 5), testKey(t, 6)}},
+		{Username: "a", Source: "github-users", PublicKeys: []string{testKey(t, 7)}},
+		{Username: "con", Source: "github-users", PublicKeys: []string{testKey(t, 8)}},
+	}
+	for i, u := range users {
+		if err := db.Store(u, u.Username, at.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatalf("Store(%s): %v", u.Username, err)
+		}
+	}
+	return db
+}
+
+// readTree returns the contents of every file under dir, keyed by relative path
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestGitDirReproducible(t *testing.T) {
+	db := newFixtureDB(t)
+	first, second := t.TempDir(), t.TempDir()
+	for _, dir := range []string{first, second} {
+		stats, err := GitDir(db, dir, nil, true)
+		if err != nil {
+			t.Fatalf("GitDir: %v", err)
+		}
+		if stats.Users != 6 || stats.Written != 6 || stats.Unchanged != 0 || stats.Removed != 0 {
+			t.Errorf("fresh export stats = %+v", stats)
+		}
+	}
+	a, b := readTree(t, first), readTree(t, second)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("two exports of one database differ:\n%v\n%v", a, b)
+	}
+	if a["RUNS"] != "run-1\n" {
+		t.Errorf("RUNS = %q, want run-1", a["RUNS"])
+	}
+	grace, ok := a["gr/grace.json"]
+	if !ok {
+		t.Fatalf("no gr/grace.json in %v", a)
+	}
+	if !strings.HasSuffix(grace, "}\n") || !strings.Contains(grace, `"login": "grace"`) {
+		t.Errorf("grace.json = %s", grace)
+	}
+	for name, data := range a {
+		if name == "RUNS" {
+			continue
+		}
+		var u GitDirUser
+		if err := json.Unmarshal([]byte(data), &u); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !sort.SliceIsSorted(u.Keys, func(i, j int) bool { return u.Keys[i].Key < u.Keys[j].Key }) {
+			t.Errorf("%s: keys not sorted", name)
+		}
+	}
+
+	// Seeing the same keys again only moves last-seen times, which the export leaves out
+	if err := db.Store(collect.UserInfo{Username: "ada", Repo: "acme", Source: "github-org", PublicKeys: []string{testKey(t, 1), testKey(t, 2)}, SigningKeys: []string{testKey(t, 2)}}, "ada", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := GitDir(db, first, nil, true)
+	if err != nil {
+		t.Fatalf("GitDir: %v", err)
+	}
+	if stats.Written != 0 || stats.Unchanged != 6 {
+		t.Errorf("re-export after a repeat sighting: %+v, want nothing written", stats)
+	}
+	if got := readTree(t, first); !reflect.DeepEqual(got, b) {
+		t.Errorf("re-export changed the tree")
+	}
+
+	// Narrowing the export removes the files of users no longer selected, and nothing else
+	stats, err = GitDir(db, first, UsersAndOrg([]string{"KEN"}, "acme"), true)
+	if err != nil {
+		t.Fatalf("GitDir: %v", err)
+	}
+	if stats.Users != 3 || stats.Written != 0 || stats.Removed != 3 {
+		t.Errorf("narrowed export stats = %+v", stats)
+	}
+	var names []string
+	for name := range readTree(t, first) {
+		names = append(names, name)
+	}
+	if want := []string{"RUNS", "ad/ada.json", "gr/grace.json", "ke/ken.json"}; !sameSet(names, want) {
+		t.Errorf("narrowed export has %q, want %q", names, want)
+	}
+}
+
+// sameSet reports whether a and b hold the same strings in any order
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := map[string]int{}
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		seen[s]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestImportFilteredExport(t *testing.T) {
+	src := newFixtureDB(t)
+	tests := []struct {
+		name     string
+		users    []string
+		org      string
+		included []string
+	}{
+		{name: "org", org: "acme", included: []string{"ada", "grace"}},
+		{name: "org and user", users: []string{"Linus"}, org: "kernel", included: []string{"linus", "ken"}},
+		{name: "users", users: []string{"a", "CON", "nobody"}, included: []string{"a", "con"}},
+	}
+	all := []string{"ada", "grace", "linus", "ken", "a", "con"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if _, err := GitDir(src, dir, UsersAndOrg(tt.users, tt.org), false); err != nil {
+				t.Fatalf("GitDir: %v", err)
+			}
+			dst, err := keydb.New(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+			// The same filter on import must select everything the filtered export holds
+			stats, err := ImportGitDir(dst, dir, UsersAndOrg(tt.users, tt.org))
+			if err != nil {
+				t.Fatalf("ImportGitDir: %v", err)
+			}
+			if stats.Users != len(tt.included) || stats.Conflicts != 0 {
+				t.Errorf("import stats = %+v, want %d users", stats, len(tt.included))
+			}
+
+			for _, login := range all {
+				want, err := src.UserKeys(login)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := dst.UserKeys(login)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !contains(tt.included, login) {
+					if len(got) != 0 {
+						t.Errorf("%s was imported but not selected", login)
+					}
+					continue
+				}
+				if len(got) != len(want) {
+					t.Fatalf("%s: imported %d keys, want %d", login, len(got), len(want))
+				}
+				for key, w := range want {
+					g, ok := got[key]
+					if !ok {
+						t.Errorf("%s: key %.40s missing", login, key)
+						continue
+					}
+					if g.Repo != w.Repo || g.Source != w.Source || g.Purpose != w.Purpose || !g.FirstSeen.Equal(w.FirstSeen) {
+						t.Errorf("%s: imported %+v, want %+v", login, g, w)
+					}
+					if md, err := dst.Lookup(key); err != nil || md == nil || !strings.EqualFold(md.User, login) {
+						t.Errorf("Lookup(%.40s) = %+v, %v; want %s", key, md, err, login)
+					}
+				}
+			}
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGitDirFingerprints(t *testing.T) {
+	tests := []struct {
+		name         string
+		enabled      []string
+		fingerprints bool
+		wantPrefixes []string
+	}{
+		{name: "not requested", enabled: []string{"sha512"}},
+		{name: "defaults", fingerprints: true, wantPrefixes: []string{"SHA256:", "MD5:"}},
+		{name: "sha512 enabled", enabled: []string{"sha512"}, fingerprints: true, wantPrefixes: []string{"SHA256:", "MD5:", "SHA512:"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFixtureDB(t)
+			if err := db.SetFingerprints(tt.enabled); err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			if _, err := GitDir(db, dir, nil, tt.fingerprints); err != nil {
+				t.Fatalf("GitDir: %v", err)
+			}
+			var u GitDirUser
+			if err := json.Unmarshal([]byte(readTree(t, dir)["gr/grace.json"]), &u); err != nil {
+				t.Fatal(err)
+			}
+			if len(u.Keys) != 1 {
+				t.Fatalf("grace has %d keys, want 1", len(u.Keys))
+			}
+			fps := u.Keys[0].Fingerprints
+			if len(fps) != len(tt.wantPrefixes) {
+				t.Fatalf("fingerprints = %q, want prefixes %q", fps, tt.wantPrefixes)
+			}
+			for i, p := range tt.wantPrefixes {
+				if !strings.HasPrefix(fps[i], p) {
+					t.Errorf("fingerprints[%d] = %q, want prefix %q", i, fps[i], p)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+// Package identity links GitHub logins to corporate identities, such as employee IDs and email
+// addresses from LDAP or Okta, and stores the links as identity records in a KeyDB.
+//
+// Logins are resolved either from a mapping file of "login,employee_id,email" lines, or by running an
+// external command once per login. Either way the result is cached in the database, including logins
+// no directory knows, which reports list as unlinked accounts. Links can be refreshed at any time
+// without re-collecting keys.
+package identity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/lists"
+)
+
+// Identity is a corporate identity
+type Identity struct {
+	EmployeeID string `json:"employee_id"`
+	Email      string `json:"email"`
+}
+
+// Resolver finds the corporate identity for a GitHub login. It returns nil without an error for
+// logins it knows nothing about.
+type Resolver interface {
+	Resolve(ctx context.Context, login string) (*Identity, error)
+	// Name identifies the resolver in identity records.
+	Name() string
+}
+
+// Map resolves logins from a mapping file or URL of "login,employee_id,email" lines. It follows
+// changes to the list, so a list being watched keeps the mapping current.
+type Map struct {
+	list *lists.List
+
+	mu  sync.RWMutex
+	ids map[string]*Identity
+}
+
+// OpenMap loads a mapping from a file path or https:// URL; see lists.Open for the options.
+func OpenMap(src string, opts lists.Options) (*Map, error) {
+	m := &Map{}
+	opts.Validate = func(entries []string) error {
+		_, err := parseMap(entries)
+		return err
+	}
+	l, err := lists.Open(src, opts)
+	if err != nil {
+		return nil, err
+	}
+	m.list = l
+	l.OnChange(func(entries []string) {
+		ids, _ := parseMap(entries)
+		m.mu.Lock()
+		m.ids = ids
+		m.mu.Unlock()
+	})
+	return m, nil
+}
+
+// List returns the list the mapping is loaded from, to refresh or watch it.
+func (m *Map) List() *lists.List {
+	return m.list
+}
+
+// Name returns "map:" and the mapping's source.
+func (m *Map) Name() string {
+	return "map:" + m.list.Source()
+}
+
+// Resolve returns the mapped identity for login, matched case-insensitively.
+func (m *Map) Resolve(_ context.Context, login string) (*Identity, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ids[strings.ToLower(login)], nil
+}
+
+// parseMap parses "login,employee_id,email" lines; either identity field may be empty
+func parseMap(entries []string) (map[string]*Identity, error) {
+	ids := map[string]*Identity{}
+	for _, e := range entries {
+		fields := strings.Split(e, ",")
+		if len(fields) != 3 || strings.TrimSpace(fields[0]) == "" {
+			return nil, fmt.Errorf("malformed mapping %q: want login,employee_id,email", e)
+		}
+		ids[strings.ToLower(strings.TrimSpace(fields[0]))] = &Identity{EmployeeID: strings.TrimSpace(fields[1]), Email: strings.TrimSpace(fields[2])}
+	}
+	return ids, nil
+}
+
+// Command resolves each login by running an external command with the login as its last argument.
+// The command prints a JSON object with "employee_id" and "email", or nothing for an unknown login;
+// a non-zero exit is a failed lookup.
+type Command struct {
+	Path string
+	Args []string
+	// Timeout bounds each run; zero means 10 seconds.
+	Timeout time.Duration
+}
+
+// NewCommand returns a Command for a command line split on spaces.
+func NewCommand(cmdline string) *Command {
+	fields := strings.Fields(cmdline)
+	if len(fields) == 0 {
+		return &Command{}
+	}
+	return &Command{Path: fields[0], Args: fields[1:]}
+}
+
+// Name returns "command:" and the command's path.
+func (c *Command) Name() string {
+	return "command:" + c.Path
+}
+
+// Resolve runs the command for login.
+func (c *Command) Resolve(ctx context.Context, login string) (*Identity, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Path, append(append([]string{}, c.Args...), login)...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s %s: %w: %s", c.Path, login, err, strings.TrimSpace(stderr.String()))
+	}
+	out := bytes.TrimSpace(stdout.Bytes())
+	if len(out) == 0 {
+		return nil, nil
+	}
+	var id Identity
+	if err := json.Unmarshal(out, &id); err != nil {
+		return nil, fmt.Errorf("%s %s: parse output: %w", c.Path, login, err)
+	}
+	return &id, nil
+}
+
+// Stats counts the outcomes of Link
+type Stats struct {
+	Linked   int
+	Unlinked int
+	Cached   int
+	Failed   int
+}
+
+// Link resolves each login and stores the result as its identity record, skipping logins whose
+// record is younger than maxAge (zero re-resolves them all). Failed lookups are counted and leave the
+// previous record in place; only database errors stop Link.
+func Link(ctx context.Context, db *keydb.KeyDB, r Resolver, logins []string, maxAge time.Duration) (*Stats, error) {
+	stats := &Stats{}
+	for _, login := range logins {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if maxAge > 0 {
+			rec, err := db.Identity(login)
+			if err != nil {
+				return stats, err
+			}
+			if rec != nil && time.Since(rec.Resolved) < maxAge {
+				stats.Cached++
+				continue
+			}
+		}
+
+		id, err := r.Resolve(ctx, login)
+		if err != nil {
+			log.Printf("Identity lookup for %s failed: %v", login, err)
+			stats.Failed++
+			continue
+		}
+		rec := &keydb.IdentityRecord{Login: login, Source: r.Name()}
+		if id != nil {
+			rec.EmployeeID, rec.Email = id.EmployeeID, id.Email
+		}
+		if rec.Linked() {
+			stats.Linked++
+		} else {
+			stats.Unlinked++
+		}
+		if err := db.PutIdentity(rec); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
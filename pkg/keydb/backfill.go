@@ -0,0 +1,140 @@
+package keydb
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// backfillBatch is how many observations Backfill writes per transaction
+const backfillBatch = 1000
+
+// Sighting is one user-key association from a historical dataset
+type Sighting struct {
+	Login      string
+	Key        string
+	ObservedAt time.Time
+	// Source is where within the dataset the association came from, such as a dump name.
+	Source string
+}
+
+// HistoricalSource records that a key's first-seen time came from an imported dataset rather than collection
+type HistoricalSource struct {
+	Dataset    string  `json:"dataset"`
+	Source     string  `json:"source,omitempty"`
+	Confidence float64 `json:"confidence"`
+}
+
+// BackfillStats summarizes a Backfill
+type BackfillStats struct {
+	// Added are keys not previously in the database, stored as last seen at their observation.
+	Added int
+	// Backdated are stored keys whose first-seen time moved earlier.
+	Backdated int
+	// Unchanged are observations no earlier than what is stored, or of keys stored under another owner.
+	Unchanged int
+	// Rejected are observations of keys that could not be parsed.
+	Rejected int
+}
+
+// Backfill applies historical sightings from dataset without disturbing newer observations:
+//
+//   - Keys not in the database are stored with Source "dataset:<name>", first and last seen at the sighting.
+//   - Keys stored for the same owner have FirstSeen moved back if the sighting is earlier. Last-seen
+//     time and all other content are kept.
+//   - Keys stored for another owner are left alone, since the sighting is older than their current owner.
+//
+// Records it adds or backdates carry Historical with the dataset name and confidence, which later
+// collection keeps while the key stays with the same owner.
+func (k *KeyDB) Backfill(sightings []Sighting, dataset string, confidence float64) (*BackfillStats, error) {
+	stats := &BackfillStats{}
+	for start := 0; start < len(sightings); start += backfillBatch {
+		batch := sightings[start:min(start+backfillBatch, len(sightings))]
+		err := checkSpace(k.update(func(txn *badger.Txn) error {
+			for _, s := range batch {
+				if err := k.backfillOne(txn, s, dataset, confidence, stats); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// backfillOne applies a single sighting within txn
+func (k *KeyDB) backfillOne(txn *badger.Txn, s Sighting, dataset string, confidence float64, stats *BackfillStats) error {
+	key, _, err := limitKey(s.Key)
+	if err != nil {
+		stats.Rejected++
+		return nil
+	}
+	pk, err := k.parseKey(key)
+	if err != nil {
+		stats.Rejected++
+		return nil
+	}
+	hist := &HistoricalSource{Dataset: dataset, Source: s.Source, Confidence: confidence}
+
+	existing, err := getMetadata(txn, []byte(key))
+	if err != nil {
+		return err
+	}
+	var out *Metadata
+	switch {
+	case existing == nil:
+		out = &Metadata{
+			User:        s.Login,
+			Timestamp:   s.ObservedAt,
+			FirstSeen:   s.ObservedAt,
+			Purpose:     PurposeAuth,
+			Source:      "dataset:" + dataset,
+			KeyType:     pk.keyType,
+			Fingerprint: pk.sha256,
+			Historical:  hist,
+			Provenance:  k.provenance,
+		}
+		if err := updateRollup(txn, s.ObservedAt, func(r *Rollup) { r.add(key, out.Source) }); err != nil {
+			return err
+		}
+		if err := countUser(txn, s.Login, s.ObservedAt); err != nil {
+			return err
+		}
+		stats.Added++
+	case strings.EqualFold(existing.User, s.Login):
+		first := existing.FirstSeen
+		if first.IsZero() {
+			first = existing.Timestamp
+		}
+		if !s.ObservedAt.Before(first) {
+			stats.Unchanged++
+			return nil
+		}
+		out = existing
+		out.FirstSeen = s.ObservedAt
+		out.Historical = hist
+		stats.Backdated++
+	default:
+		log.Printf("Not backfilling %.40s for %s: now owned by %s", key, s.Login, existing.User)
+		stats.Unchanged++
+		return nil
+	}
+
+	if err := indexFingerprints(txn, key, pk); err != nil {
+		return err
+	}
+	if err := indexUser(txn, key, "", out.User); err != nil {
+		return err
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(key), data)
+}
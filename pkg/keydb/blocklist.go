@@ -0,0 +1,199 @@
+package keydb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"github.com/tstromberg/pubkey-collector/pkg/lists"
+)
+
+// FlagBlocked marks a key whose fingerprint is on the blocklist
+const FlagBlocked = "blocked"
+
+// blockPrefix is the key prefix for keys blocked with Block
+const blockPrefix = "block:"
+
+// BlockRecord records who blocked a key fingerprint, when, and why
+type BlockRecord struct {
+	Fingerprint string    `json:"fingerprint"`
+	By          string    `json:"by"`
+	Reason      string    `json:"reason,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// Blocklist is a reloadable set of SHA256 fingerprints of known-compromised keys
+type Blocklist struct {
+	list *lists.List
+
+	mu  sync.RWMutex
+	fps map[string]bool
+}
+
+// LoadBlocklist reads a blocklist file: one fingerprint per line, with blank lines and # comments ignored
+func LoadBlocklist(path string) (*Blocklist, error) {
+	return OpenBlocklist(path, lists.Options{})
+}
+
+// OpenBlocklist loads a blocklist from a file or https:// URL (see package lists). Each line starts
+// with a SHA256 fingerprint, optionally followed by a note; content with any other lines is rejected.
+func OpenBlocklist(src string, opts lists.Options) (*Blocklist, error) {
+	opts.Validate = validateFingerprints
+	l, err := lists.Open(src, opts)
+	if err != nil {
+		return nil, err
+	}
+	b := &Blocklist{list: l}
+	l.OnChange(func(entries []string) {
+		fps := map[string]bool{}
+		for _, e := range entries {
+			fps[strings.Fields(e)[0]] = true
+		}
+		b.mu.Lock()
+		b.fps = fps
+		b.mu.Unlock()
+	})
+	return b, nil
+}
+
+// validateFingerprints rejects blocklist entries that don't start with a SHA256 fingerprint
+func validateFingerprints(entries []string) error {
+	for _, e := range entries {
+		if fp := strings.Fields(e)[0]; !strings.HasPrefix(fp, "SHA256:") {
+			return fmt.Errorf("%q is not a SHA256 fingerprint", fp)
+		}
+	}
+	return nil
+}
+
+// Reload re-reads the blocklist, keeping the previous contents if it can't be read or is malformed
+func (b *Blocklist) Reload() error {
+	_, err := b.list.Refresh(context.Background())
+	return err
+}
+
+// List returns the list the blocklist is loaded from, for its version and periodic refresh
+func (b *Blocklist) List() *lists.List {
+	return b.list
+}
+
+// Contains reports whether fingerprint is on the blocklist
+func (b *Blocklist) Contains(fingerprint string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.fps[fingerprint]
+}
+
+// Len returns the number of fingerprints on the blocklist
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.fps)
+}
+
+// SetBlocklist sets the blocklist consulted by Store and Lookup, in addition to keys blocked with Block
+func (k *KeyDB) SetBlocklist(b *Blocklist) {
+	k.blocklist = b
+}
+
+// isBlocked reports whether a key is on the blocklist or was blocked in the database
+func (k *KeyDB) isBlocked(txn *badger.Txn, pubKey string) (bool, error) {
+	fp, err := Fingerprint(pubKey)
+	if err != nil {
+		// Unparseable keys have no fingerprint to block
+		return false, nil
+	}
+	return k.isBlockedFingerprint(txn, fp)
+}
+
+// isBlockedFingerprint reports whether a SHA256 fingerprint is on the blocklist or was blocked in the database
+func (k *KeyDB) isBlockedFingerprint(txn *badger.Txn, fp string) (bool, error) {
+	if k.blocklist != nil && k.blocklist.Contains(fp) {
+		return true, nil
+	}
+
+	_, err := txn.Get(blockKey(fp))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// IsBlocked reports whether a SHA256 fingerprint is on the blocklist or was blocked with Block,
+// whether or not a key with that fingerprint is stored
+func (k *KeyDB) IsBlocked(fingerprint string) (bool, error) {
+	var blocked bool
+	err := k.view(func(txn *badger.Txn) error {
+		var err error
+		blocked, err = k.isBlockedFingerprint(txn, fingerprint)
+		return err
+	})
+	return blocked, err
+}
+
+// Block records a fingerprint as blocked and flags every stored key with that fingerprint.
+// It returns the number of stored keys flagged.
+func (k *KeyDB) Block(fingerprint, by, reason string) (int, error) {
+	record := BlockRecord{Fingerprint: fingerprint, By: by, Reason: reason, Timestamp: k.clock.Now()}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+
+	matches, err := k.Matching(func(*Metadata) bool { return true })
+	if err != nil {
+		return 0, err
+	}
+
+	flagged := 0
+	err = checkSpace(k.update(func(txn *badger.Txn) error {
+		if err := txn.Set(blockKey(fingerprint), recordJSON); err != nil {
+			return err
+		}
+		for key, md := range matches {
+			if fp, err := Fingerprint(key); err != nil || fp != fingerprint {
+				continue
+			}
+			log.Printf("ALERT: blocked key %s is published by %s", fingerprint, describeAccount(txn, md.User))
+			flagged++
+			if hasFlag(md.Flags, FlagBlocked) {
+				continue
+			}
+			md.Flags = append(md.Flags, FlagBlocked)
+			mdJSON, err := json.Marshal(md)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set([]byte(key), mdJSON); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	if err != nil {
+		return 0, fmt.Errorf("block %s: %w", fingerprint, err)
+	}
+	return flagged, nil
+}
+
+// blockKey returns the database key for a blocked fingerprint
+func blockKey(fingerprint string) []byte {
+	return []byte(blockPrefix + fingerprint)
+}
+
+// hasFlag reports whether flags contains flag
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package keydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadBlocklist(t *testing.T) {
+	fp1, err := Fingerprint(testKey(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp2, err := Fingerprint(testKey(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		content  string
+		reload   string
+		want     []string
+		wantErr  bool
+		wantLen  int
+		notFound string
+	}{
+		{name: "fingerprints with notes", content: "# leaked\n" + fp1 + " laptop stolen\n\n" + fp2 + "\n", want: []string{fp1, fp2}, wantLen: 2},
+		{name: "not a fingerprint", content: fp1 + "\nssh-ed25519 AAAA\n", wantErr: true},
+		{name: "reload replaces", content: fp1 + "\n", reload: fp2 + "\n", want: []string{fp2}, wantLen: 1, notFound: fp1},
+		{name: "malformed reload is ignored", content: fp1 + "\n", reload: "MD5:00:11\n", want: []string{fp1}, wantLen: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "blocked.txt")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			b, err := LoadBlocklist(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadBlocklist error = %v, want error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.reload != "" {
+				if err := os.WriteFile(path, []byte(tt.reload), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				b.Reload()
+			}
+			for _, fp := range tt.want {
+				if !b.Contains(fp) {
+					t.Errorf("Contains(%s) = false, want true", fp)
+				}
+			}
+			if tt.notFound != "" && b.Contains(tt.notFound) {
+				t.Errorf("Contains(%s) = true after reload, want false", tt.notFound)
+			}
+			if b.Len() != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", b.Len(), tt.wantLen)
+			}
+		})
+	}
+}
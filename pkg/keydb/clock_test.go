@@ -0,0 +1,103 @@
+package keydb
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// loadSink stores users the way pubkey-db-load does
+type loadSink struct {
+	db *KeyDB
+}
+
+func (s *loadSink) Add(_ context.Context, user *collect.UserInfo) error {
+	if skip := collect.SkipFor(user); skip != nil {
+		return s.db.StoreSkip(*skip, user.FetchedAt)
+	}
+	return s.db.Store(*user, user.Username, user.FetchedAt)
+}
+
+func (s *loadSink) Skip(_ context.Context, skip collect.Skip) error {
+	return s.db.StoreSkip(skip, time.Time{})
+}
+
+func TestLoadWithClocks(t *testing.T) {
+	fetched := time.Date(2023, 5, 1, 9, 30, 0, 0, time.UTC)
+	dir := t.TempDir()
+	files := map[string]any{
+		// A legacy file: no login, schema or fetch time, so the clock dates it
+		"ada.json": map[string]any{"public_keys": []string{testKey(t, 1)}},
+		// A current file carries its own fetch time, whatever the clock says
+		"grace.json": collect.UserInfo{Username: "grace", PublicKeys: []string{testKey(t, 2)}, Schema: collect.FileSchema, Status: collect.StatusOK, FetchedAt: fetched},
+		// A user without keys is recorded as a skip, dated the same way
+		"linus.json": collect.UserInfo{Username: "linus", PublicKeys: []string{}, Schema: collect.FileSchema, Status: collect.StatusOK},
+	}
+	for name, v := range files {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, now := range []time.Time{
+		time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC),
+		time.Date(2024, 6, 30, 23, 59, 59, 0, time.UTC),
+	} {
+		t.Run(now.Format("2006-01-02"), func(t *testing.T) {
+			db := newTestDB(t)
+			db.SetClock(clock.Fixed(now))
+			src := &collect.DirSource{Path: dir, Clock: clock.Fixed(now)}
+			if err := src.Collect(context.Background(), &loadSink{db: db}); err != nil {
+				t.Fatalf("Collect: %v", err)
+			}
+
+			for user, want := range map[string]time.Time{"ada": now, "grace": fetched} {
+				keys, err := db.UserKeys(user)
+				if err != nil {
+					t.Fatalf("UserKeys(%s): %v", user, err)
+				}
+				if len(keys) != 1 {
+					t.Fatalf("%s has %d keys, want 1", user, len(keys))
+				}
+				for _, md := range keys {
+					if !md.Timestamp.Equal(want) || !md.FirstSeen.Equal(want) {
+						t.Errorf("%s: first seen %s, last seen %s; want both %s", user, md.FirstSeen, md.Timestamp, want)
+					}
+				}
+			}
+			skip, err := db.Skip("linus")
+			if err != nil || skip == nil {
+				t.Fatalf("Skip(linus) = %v, %v", skip, err)
+			}
+			if !skip.Timestamp.Equal(now) {
+				t.Errorf("linus skipped at %s, want %s", skip.Timestamp, now)
+			}
+
+			rollups, err := db.Rollups()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dates []string
+			for _, r := range rollups {
+				dates = append(dates, r.Date)
+			}
+			want := []string{fetched.Format(rollupDate), now.Format(rollupDate)}
+			if now.Before(fetched) {
+				want[0], want[1] = want[1], want[0]
+			}
+			if len(dates) != 2 || dates[0] != want[0] || dates[1] != want[1] {
+				t.Errorf("rollup dates = %q, want %q", dates, want)
+			}
+		})
+	}
+}
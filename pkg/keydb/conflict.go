@@ -0,0 +1,195 @@
+package keydb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// conflictPrefix is the key prefix for ownership conflict records, keyed by SHA256 fingerprint
+const conflictPrefix = "conflict:"
+
+// Resolutions of a Conflict
+const (
+	// ResolutionAccept keeps one side's owner, named in Resolution.Login.
+	ResolutionAccept = "accept"
+	// ResolutionKeepBoth leaves the stored record as it is, with a note that both attributions stand.
+	ResolutionKeepBoth = "keep-both"
+)
+
+// ConflictSide is one database's evidence for who owns a key
+type ConflictSide struct {
+	User      string    `json:"user"`
+	Repo      string    `json:"repo,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Provenance
+}
+
+// Resolution is an analyst's decision about a Conflict
+type Resolution struct {
+	Decision string `json:"decision"`
+	// Login is the accepted owner, for ResolutionAccept.
+	Login string    `json:"login,omitempty"`
+	Note  string    `json:"note,omitempty"`
+	By    string    `json:"by"`
+	At    time.Time `json:"at"`
+}
+
+// Conflict is a key that merged data attributed to different logins, both from GitHub directly
+type Conflict struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	Detected    time.Time `json:"detected"`
+	// Sides are the stored and the incoming attribution, in that order. Merging kept the newer one.
+	Sides      []ConflictSide `json:"sides"`
+	Resolution *Resolution    `json:"resolution,omitempty"`
+}
+
+// SetConflictDetection makes Store record a Conflict whenever an observation attributes a stored key
+// to another login and both came directly from GitHub, as happens when merging databases. The newer
+// observation still wins, so detection never blocks a merge; conflicts count as "conflicts" in Counts.
+func (k *KeyDB) SetConflictDetection(on bool) {
+	k.detectConflicts = on
+}
+
+// direct reports whether a record came from collecting GitHub rather than from an imported dataset
+func direct(md *Metadata) bool {
+	return md.Historical == nil && !strings.HasPrefix(md.Source, "dataset:")
+}
+
+// recordConflict writes a Conflict for key within txn if existing and incoming disagree on the owner,
+// reporting whether they did
+func (k *KeyDB) recordConflict(txn *badger.Txn, key string, existing, incoming *Metadata) (bool, error) {
+	if !k.detectConflicts || existing == nil || strings.EqualFold(existing.User, incoming.User) ||
+		!direct(existing) || !direct(incoming) || incoming.Fingerprint == "" {
+		return false, nil
+	}
+	c := &Conflict{Key: key, Fingerprint: incoming.Fingerprint, Detected: k.clock.Now()}
+	for _, md := range []*Metadata{existing, incoming} {
+		first := md.FirstSeen
+		if first.IsZero() {
+			first = md.Timestamp
+		}
+		c.Sides = append(c.Sides, ConflictSide{User: md.User, Repo: md.Repo, Source: md.Source, FirstSeen: first, LastSeen: md.Timestamp, Provenance: md.Provenance})
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return false, err
+	}
+	return true, txn.Set([]byte(conflictPrefix+c.Fingerprint), data)
+}
+
+// Conflicts returns the recorded ownership conflicts, most recently detected first
+func (k *KeyDB) Conflicts() ([]*Conflict, error) {
+	var conflicts []*Conflict
+	err := k.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(conflictPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var c Conflict
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &c)
+			}); err != nil {
+				return err
+			}
+			conflicts = append(conflicts, &c)
+		}
+		return nil
+	})
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Detected.After(conflicts[j].Detected) })
+	return conflicts, err
+}
+
+// ResolveConflict records an analyst's decision on the conflict for a fingerprint. Accepting a login
+// rewrites the key's record from that side's evidence if it currently names the other owner.
+func (k *KeyDB) ResolveConflict(fingerprint string, r Resolution) error {
+	if r.At.IsZero() {
+		r.At = k.clock.Now()
+	}
+	return checkSpace(k.update(func(txn *badger.Txn) error {
+		c, err := getConflict(txn, fingerprint)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			return fmt.Errorf("no conflict recorded for %s", fingerprint)
+		}
+
+		switch r.Decision {
+		case ResolutionKeepBoth:
+		case ResolutionAccept:
+			if err := acceptSide(txn, c, r.Login); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown resolution %q: want %s or %s", r.Decision, ResolutionAccept, ResolutionKeepBoth)
+		}
+
+		c.Resolution = &r
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(conflictPrefix+fingerprint), data)
+	}))
+}
+
+// acceptSide makes the conflict's side for login the owner of its key
+func acceptSide(txn *badger.Txn, c *Conflict, login string) error {
+	var side *ConflictSide
+	for i := range c.Sides {
+		if strings.EqualFold(c.Sides[i].User, login) {
+			side = &c.Sides[i]
+		}
+	}
+	if side == nil {
+		return fmt.Errorf("%s is not a side of the conflict for %s", login, c.Fingerprint)
+	}
+
+	md, err := getMetadata(txn, []byte(c.Key))
+	if err != nil {
+		return err
+	}
+	if md == nil {
+		return fmt.Errorf("key for %s is no longer stored", c.Fingerprint)
+	}
+	if strings.EqualFold(md.User, side.User) {
+		return nil
+	}
+	if err := indexUser(txn, c.Key, md.User, side.User); err != nil {
+		return err
+	}
+	md.User, md.Repo, md.Source = side.User, side.Repo, side.Source
+	md.FirstSeen, md.Timestamp, md.Provenance = side.FirstSeen, side.LastSeen, side.Provenance
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(c.Key), data)
+}
+
+// getConflict reads the conflict recorded for a fingerprint within txn, returning nil if there is none
+func getConflict(txn *badger.Txn, fingerprint string) (*Conflict, error) {
+	item, err := txn.Get([]byte(conflictPrefix + fingerprint))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c Conflict
+	if err := item.Value(func(val []byte) error { return json.Unmarshal(val, &c) }); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
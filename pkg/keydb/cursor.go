@@ -0,0 +1,97 @@
+package keydb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// cursorPrefix is the key prefix for records of how far a collection mode has got
+const cursorPrefix = "cursor:"
+
+// streamCursor is the key of the event stream's cursor
+const streamCursor = cursorPrefix + "stream"
+
+// StreamCursor records the last successful poll of the GitHub event stream. The stream only reaches a
+// few minutes back, so a cursor much older than that means events were missed.
+type StreamCursor struct {
+	Polled time.Time `json:"polled"`
+	Provenance
+}
+
+// PutStreamCursor records a successful poll of the event stream. A zero time means the KeyDB's clock.
+func (k *KeyDB) PutStreamCursor(polled time.Time) error {
+	if polled.IsZero() {
+		polled = k.clock.Now()
+	}
+	data, err := json.Marshal(StreamCursor{Polled: polled, Provenance: k.provenance})
+	if err != nil {
+		return err
+	}
+	return checkSpace(k.update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(streamCursor), data)
+	}))
+}
+
+// StreamCursor returns the event stream's cursor, or nil if the stream has never been polled
+func (k *KeyDB) StreamCursor() (*StreamCursor, error) {
+	var c StreamCursor
+	err := k.view(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(streamCursor))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &c)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// LastCollected returns when each user was last collected, by lower-cased login: the latest
+// last-seen time of their keys, or of their skip record if that is later. This scans the whole database.
+func (k *KeyDB) LastCollected(ctx context.Context) (map[string]time.Time, error) {
+	last := map[string]time.Time{}
+	see := func(login string, t time.Time) {
+		login = strings.ToLower(login)
+		if t.After(last[login]) {
+			last[login] = t
+		}
+	}
+	err := k.ForEachKey(ctx, func(rec KeyRecord) error {
+		see(rec.User, rec.Timestamp)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = k.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(skipPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var r SkipRecord
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &r)
+			}); err != nil {
+				return err
+			}
+			see(strings.TrimPrefix(string(it.Item().Key()), skipPrefix), r.Timestamp)
+		}
+		return nil
+	})
+	return last, err
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package keydb
+
+import "errors"
+
+// FreeSpace returns the number of bytes available on the filesystem holding path
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.New("free space check is not supported on this platform")
+}
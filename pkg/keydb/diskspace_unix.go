@@ -0,0 +1,14 @@
+//go:build unix
+
+package keydb
+
+import "syscall"
+
+// FreeSpace returns the number of bytes available to unprivileged users on the filesystem holding path
+func FreeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,59 @@
+package keydb
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// exposurePrefix is the key prefix for per-repository exposure records
+const exposurePrefix = "exposure:"
+
+// ExposureRecord is who could push to a repository as of its last exposure collection
+type ExposureRecord struct {
+	Repo      string    `json:"repo"`
+	Timestamp time.Time `json:"timestamp"`
+	// Roles maps each exposed login to how they could push, such as "collaborator:write" or "committer".
+	Roles map[string][]string `json:"roles"`
+	// Limitations are the populations that could not be listed, and why.
+	Limitations []string `json:"limitations,omitempty"`
+	Provenance
+}
+
+// PutExposure writes a repository's exposure record, replacing the previous one. A zero timestamp means the KeyDB's clock.
+func (k *KeyDB) PutExposure(r *ExposureRecord) error {
+	if r.Timestamp.IsZero() {
+		r.Timestamp = k.clock.Now()
+	}
+	r.Provenance = k.provenance
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return checkSpace(k.update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(exposurePrefix+r.Repo), data)
+	}))
+}
+
+// Exposure returns the exposure record for a repository ("owner/repo"), or nil if there is none
+func (k *KeyDB) Exposure(repo string) (*ExposureRecord, error) {
+	var r ExposureRecord
+	err := k.view(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(exposurePrefix + repo))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &r)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
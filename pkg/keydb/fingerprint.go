@@ -0,0 +1,250 @@
+package keydb
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+// fingerprintPrefix is the key prefix for the index from key fingerprints to stored keys
+const fingerprintPrefix = "fp:"
+
+// md5Colon matches a legacy MD5 fingerprint in colon form, such as "16:27:ac:..."
+var md5Colon = regexp.MustCompile(`^([0-9a-f]{2}:){15}[0-9a-f]{2}$`)
+
+// Fingerprint returns the SHA256 fingerprint of an authorized_keys line, such as "SHA256:aK3y..."
+func Fingerprint(pubKey string) (string, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(pk), nil
+}
+
+// FingerprintAlgorithm computes one kind of key fingerprint, identified by the prefix of its string form
+type FingerprintAlgorithm struct {
+	// Name selects the algorithm in SetFingerprints, such as "sha512".
+	Name string
+	// Prefix starts every fingerprint of this kind, such as "SHA512:". Prefixes must not overlap.
+	Prefix string
+	// Sum returns the fingerprint of a key, starting with Prefix.
+	Sum func(ssh.PublicKey) string
+	// Normalize returns the canonical form of a queried fingerprint, and false if s is not one of this
+	// kind. Lookup tries every registered algorithm, so it must reject other algorithms' fingerprints.
+	Normalize func(s string) (string, bool)
+}
+
+var (
+	fingerprintMu   sync.RWMutex
+	fingerprintAlgs = map[string]FingerprintAlgorithm{}
+	// defaultFingerprints are indexed by every KeyDB; others only once enabled with SetFingerprints
+	defaultFingerprints = []string{"sha256", "md5"}
+)
+
+func init() {
+	RegisterFingerprint(FingerprintAlgorithm{
+		Name:   "sha256",
+		Prefix: "SHA256:",
+		Sum:    ssh.FingerprintSHA256,
+		Normalize: func(s string) (string, bool) {
+			rest, ok := strings.CutPrefix(s, "SHA256:")
+			return "SHA256:" + strings.TrimRight(rest, "="), ok
+		},
+	})
+	RegisterFingerprint(FingerprintAlgorithm{
+		Name:   "md5",
+		Prefix: "MD5:",
+		Sum:    func(pk ssh.PublicKey) string { return "MD5:" + ssh.FingerprintLegacyMD5(pk) },
+		Normalize: func(s string) (string, bool) {
+			// The MD5: prefix is optional: bare colon form is how OpenSSH used to print them
+			md5 := strings.ToLower(strings.TrimPrefix(s, "MD5:"))
+			return "MD5:" + md5, md5Colon.MatchString(md5)
+		},
+	})
+	RegisterFingerprint(FingerprintAlgorithm{
+		Name:   "sha512",
+		Prefix: "SHA512:",
+		Sum: func(pk ssh.PublicKey) string {
+			sum := sha512.Sum512(pk.Marshal())
+			return "SHA512:" + base64.RawStdEncoding.EncodeToString(sum[:])
+		},
+		Normalize: func(s string) (string, bool) {
+			rest, ok := strings.CutPrefix(s, "SHA512:")
+			return "SHA512:" + strings.TrimRight(rest, "="), ok
+		},
+	})
+}
+
+// RegisterFingerprint makes a fingerprint algorithm available to SetFingerprints and Lookup.
+// It panics if an algorithm with the same name is already registered.
+func RegisterFingerprint(a FingerprintAlgorithm) {
+	fingerprintMu.Lock()
+	defer fingerprintMu.Unlock()
+	if _, dup := fingerprintAlgs[a.Name]; dup {
+		panic(fmt.Sprintf("keydb: fingerprint algorithm %q registered twice", a.Name))
+	}
+	fingerprintAlgs[a.Name] = a
+}
+
+// FingerprintAlgorithms returns the names of all registered fingerprint algorithms in sorted order
+func FingerprintAlgorithms() []string {
+	fingerprintMu.RLock()
+	defer fingerprintMu.RUnlock()
+	names := make([]string, 0, len(fingerprintAlgs))
+	for name := range fingerprintAlgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetFingerprints enables registered algorithms, by name, in addition to SHA256 and MD5. Store indexes
+// keys under every enabled fingerprint, so Lookup finds keys stored while an algorithm was enabled.
+func (k *KeyDB) SetFingerprints(names []string) error {
+	fingerprintMu.RLock()
+	defer fingerprintMu.RUnlock()
+	enabled := append([]string(nil), defaultFingerprints...)
+	for _, name := range names {
+		if _, ok := fingerprintAlgs[name]; !ok {
+			return fmt.Errorf("unknown fingerprint algorithm %q", name)
+		}
+		if !slices.Contains(enabled, name) {
+			enabled = append(enabled, name)
+		}
+	}
+	k.fingerprints = enabled
+	return nil
+}
+
+// Fingerprints returns every enabled fingerprint of an authorized_keys line, SHA256 first
+func (k *KeyDB) Fingerprints(pubKey string) ([]string, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return nil, err
+	}
+	return k.sums(pk), nil
+}
+
+// sums computes the enabled fingerprints of pk, SHA256 first
+func (k *KeyDB) sums(pk ssh.PublicKey) []string {
+	names := k.fingerprints
+	if names == nil {
+		names = defaultFingerprints
+	}
+	fingerprintMu.RLock()
+	defer fingerprintMu.RUnlock()
+	fps := make([]string, 0, len(names))
+	for _, name := range names {
+		fps = append(fps, fingerprintAlgs[name].Sum(pk))
+	}
+	return fps
+}
+
+// parsedKey is what Store derives from an authorized_keys line
+type parsedKey struct {
+	keyType string
+	sha256  string
+	// fps are the enabled fingerprints to index, including sha256
+	fps []string
+	// malformed keys have only keyType, taken from the line
+	malformed bool
+}
+
+// parseKey parses and validates an authorized_keys line (see ValidateKey)
+func (k *KeyDB) parseKey(pubKey string) (*parsedKey, error) {
+	pk, err := ValidateKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return &parsedKey{keyType: pk.Type(), sha256: ssh.FingerprintSHA256(pk), fps: k.sums(pk)}, nil
+}
+
+// normalizeFingerprint returns the index form of a fingerprint of any registered algorithm, chosen by
+// its prefix, and false if s is not a fingerprint
+func normalizeFingerprint(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	fingerprintMu.RLock()
+	defer fingerprintMu.RUnlock()
+	for _, name := range slices.Sorted(maps.Keys(fingerprintAlgs)) {
+		if fp, ok := fingerprintAlgs[name].Normalize(s); ok {
+			return fp, true
+		}
+	}
+	return "", false
+}
+
+// indexFingerprints points each enabled fingerprint of a key at its stored line, writing only if changed
+func indexFingerprints(txn *badger.Txn, key string, pk *parsedKey) error {
+	for _, fp := range pk.fps {
+		ik := []byte(fingerprintPrefix + fp)
+		item, err := txn.Get(ik)
+		if err == nil {
+			same := false
+			if err := item.Value(func(val []byte) error {
+				same = string(val) == key
+				return nil
+			}); err != nil {
+				return err
+			}
+			if same {
+				continue
+			}
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		if err := txn.Set(ik, []byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexFingerprints deletes the fingerprint entries that point at a removed key line, under every
+// registered algorithm since any may have been enabled when it was stored. Entries repointed at
+// another line of the same key are left alone.
+func unindexFingerprints(txn *badger.Txn, key string) error {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		// Malformed keys are not indexed
+		return nil
+	}
+	fingerprintMu.RLock()
+	defer fingerprintMu.RUnlock()
+	for _, a := range fingerprintAlgs {
+		fp := a.Sum(pk)
+		stored, err := resolveFingerprint(txn, fp)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if stored != key {
+			continue
+		}
+		if err := txn.Delete([]byte(fingerprintPrefix + fp)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveFingerprint returns the stored key line a fingerprint indexes
+func resolveFingerprint(txn *badger.Txn, fp string) (string, error) {
+	item, err := txn.Get([]byte(fingerprintPrefix + fp))
+	if err != nil {
+		return "", err
+	}
+	val, err := item.ValueCopy(nil)
+	return string(val), err
+}
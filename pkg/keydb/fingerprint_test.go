@@ -0,0 +1,214 @@
+package keydb
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// FuzzParseKey runs key lines through what Store does to them: limitKey, then parseKey. Seeds of
+// every key type, certificates and known-bad input are in testdata/fuzz/FuzzParseKey.
+func FuzzParseKey(f *testing.F) {
+	f.Add(strings.Repeat("A", 10<<20))
+	f.Add("ssh-ed25519 " + strings.Repeat("AAAA", 10<<18))
+	k := &KeyDB{}
+	f.Fuzz(func(t *testing.T, line string) {
+		limited, truncated, err := limitKey(line)
+		if err != nil {
+			if !errors.Is(err, ErrKeyTooLarge) {
+				t.Fatalf("limitKey: unexpected error %v", err)
+			}
+			return
+		}
+		if len(limited) > maxKeyLen {
+			t.Fatalf("limitKey kept %d bytes, over the %d limit", len(limited), maxKeyLen)
+		}
+		if !truncated && limited != line {
+			t.Fatalf("limitKey changed an untruncated line: %q", limited)
+		}
+		if truncated && utf8.ValidString(line) && !utf8.ValidString(limited) {
+			t.Fatalf("truncating the comment split a UTF-8 sequence: %q", limited)
+		}
+
+		pk, err := k.parseKey(limited)
+		if err != nil {
+			return
+		}
+		if pk.keyType != keyFields(limited)[0] {
+			t.Fatalf("key type %q, but the line declares %q", pk.keyType, keyFields(limited)[0])
+		}
+		// Lookup finds a key line by its fingerprint, so it must agree with the one Store indexed
+		fp, err := Fingerprint(limited)
+		if err != nil {
+			t.Fatalf("parseKey accepted a line Fingerprint rejects: %v", err)
+		}
+		if fp != pk.sha256 {
+			t.Fatalf("Fingerprint = %s, parseKey = %s", fp, pk.sha256)
+		}
+		if got, ok := normalizeFingerprint(pk.sha256); !ok || got != pk.sha256 {
+			t.Fatalf("normalizeFingerprint(%s) = %s, %v", pk.sha256, got, ok)
+		}
+
+		// Valid keys round-trip through their canonical form
+		parsed, err := ValidateKey(limited)
+		if err != nil {
+			t.Fatalf("ValidateKey: %v", err)
+		}
+		again, err := k.parseKey(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(parsed))))
+		if err != nil {
+			t.Fatalf("canonical form of a valid key rejected: %v", err)
+		}
+		if again.sha256 != pk.sha256 || again.keyType != pk.keyType {
+			t.Fatalf("round trip gave %s %s, want %s %s", again.keyType, again.sha256, pk.keyType, pk.sha256)
+		}
+	})
+}
+
+func TestLookupByFingerprint(t *testing.T) {
+	key := testKey(t, 1)
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256 := ssh.FingerprintSHA256(pk)
+	md5 := ssh.FingerprintLegacyMD5(pk)
+	sha512 := fingerprintAlgs["sha512"].Sum(pk)
+
+	tests := []struct {
+		name  string
+		query string
+		// extra are the algorithms enabled when the key is stored
+		extra []string
+		found bool
+	}{
+		{name: "sha256", query: sha256, found: true},
+		{name: "sha256 padded", query: sha256 + "=", found: true},
+		{name: "md5 with prefix", query: "MD5:" + md5, found: true},
+		{name: "bare md5", query: md5, found: true},
+		{name: "upper-case md5", query: strings.ToUpper(md5), found: true},
+		{name: "sha512 when enabled", query: sha512, extra: []string{"sha512"}, found: true},
+		{name: "sha512 padded", query: sha512 + "==", extra: []string{"sha512"}, found: true},
+		{name: "sha512 not enabled", query: sha512},
+		{name: "key line", query: key + " ada@laptop", found: true},
+		{name: "unknown prefix", query: "SHA1:" + strings.TrimPrefix(sha256, "SHA256:")},
+		{name: "other key", query: ssh.FingerprintSHA256(mustParse(t, testKey(t, 2)))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if err := db.SetFingerprints(tt.extra); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Store(collect.UserInfo{Username: "ada", PublicKeys: []string{key}}, "ada", time.Time{}); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			md, err := db.Lookup(tt.query)
+			if tt.found {
+				if err != nil || md.User != "ada" {
+					t.Errorf("Lookup(%s) = %+v, %v; want ada's key", tt.query, md, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("Lookup(%s) = %+v, %v; want ErrNotFound", tt.query, md, err)
+			}
+		})
+	}
+}
+
+// mustParse parses an authorized_keys line
+func mustParse(t *testing.T, line string) ssh.PublicKey {
+	t.Helper()
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+// registerTestFingerprint registers a SHA384 algorithm, as a partner's tooling might need, once per test binary
+var registerTestFingerprint = sync.OnceFunc(func() {
+	RegisterFingerprint(FingerprintAlgorithm{
+		Name:   "test-sha384",
+		Prefix: "SHA384:",
+		Sum: func(pk ssh.PublicKey) string {
+			sum := sha512.Sum384(pk.Marshal())
+			return "SHA384:" + base64.RawStdEncoding.EncodeToString(sum[:])
+		},
+		Normalize: func(s string) (string, bool) {
+			rest, ok := strings.CutPrefix(s, "SHA384:")
+			return "SHA384:" + strings.TrimRight(rest, "="), ok
+		},
+	})
+})
+
+// TestRegisteredFingerprint adds an algorithm through the registry alone and finds keys by it
+func TestRegisteredFingerprint(t *testing.T) {
+	registerTestFingerprint()
+	if !slices.Contains(FingerprintAlgorithms(), "test-sha384") {
+		t.Fatalf("FingerprintAlgorithms() = %v, missing test-sha384", FingerprintAlgorithms())
+	}
+
+	db := newTestDB(t)
+	if err := db.SetFingerprints([]string{"test-sha384"}); err != nil {
+		t.Fatal(err)
+	}
+	key := testKey(t, 1)
+	if err := db.Store(collect.UserInfo{Username: "ada", PublicKeys: []string{key}}, "ada", time.Time{}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	fps, err := db.Fingerprints(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fps) != 3 || !strings.HasPrefix(fps[0], "SHA256:") || !strings.HasPrefix(fps[2], "SHA384:") {
+		t.Fatalf("Fingerprints() = %q, want SHA256, MD5 and SHA384", fps)
+	}
+	if md, err := db.Lookup(fps[2]); err != nil || md.User != "ada" {
+		t.Errorf("Lookup(%s) = %+v, %v; want ada's key", fps[2], md, err)
+	}
+}
+
+func TestSetFingerprints(t *testing.T) {
+	tests := []struct {
+		names   []string
+		want    []string
+		wantErr bool
+	}{
+		{names: nil, want: []string{"sha256", "md5"}},
+		{names: []string{"sha512"}, want: []string{"sha256", "md5", "sha512"}},
+		{names: []string{"sha512", "sha256", "sha512"}, want: []string{"sha256", "md5", "sha512"}},
+		{names: []string{"gost"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.names, ","), func(t *testing.T) {
+			k := &KeyDB{}
+			err := k.SetFingerprints(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetFingerprints(%q) error = %v, want error: %v", tt.names, err, tt.wantErr)
+			}
+			if err == nil && !slices.Equal(k.fingerprints, tt.want) {
+				t.Errorf("enabled %q, want %q", k.fingerprints, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterFingerprintTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering sha256 again did not panic")
+		}
+	}()
+	RegisterFingerprint(FingerprintAlgorithm{Name: "sha256"})
+}
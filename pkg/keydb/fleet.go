@@ -0,0 +1,103 @@
+package keydb
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// fleetPrefix is the key prefix for keys found in servers' authorized_keys files
+const fleetPrefix = "fleet:"
+
+// FleetKey is a key that an authorized_keys file on a server lets into a local account, as imported
+// from an existing fleet rather than collected from GitHub
+type FleetKey struct {
+	Host    string `json:"host"`
+	Account string `json:"account"`
+	// Path is the file the key was read from, relative to the imported directory.
+	Path string `json:"path"`
+	// Key is the key type and base64 blob, without the file's options and comment.
+	Key         string   `json:"key"`
+	KeyType     string   `json:"key_type,omitempty"`
+	Fingerprint string   `json:"fingerprint"`
+	Comment     string   `json:"comment,omitempty"`
+	Options     []string `json:"options,omitempty"`
+	// Malformed is set for keys that fail ValidateKey; they are kept so migration reports list them.
+	Malformed bool      `json:"malformed,omitempty"`
+	Imported  time.Time `json:"imported"`
+	Provenance
+}
+
+// fleetKey returns the database key of a fleet record
+func fleetKey(host, account, fingerprint string) []byte {
+	return []byte(fleetPrefix + host + "/" + account + "/" + fingerprint)
+}
+
+// PutFleetHost replaces every fleet record for host with keys, so keys removed from the host since
+// its last import are forgotten. A zero Imported time means the KeyDB's clock.
+func (k *KeyDB) PutFleetHost(host string, keys []FleetKey) error {
+	now := k.clock.Now()
+	return checkSpace(k.update(func(txn *badger.Txn) error {
+		var stale [][]byte
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(fleetPrefix + host + "/")
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid(); it.Next() {
+			stale = append(stale, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+		for _, key := range stale {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		for _, fk := range keys {
+			fk.Host = host
+			if fk.Imported.IsZero() {
+				fk.Imported = now
+			}
+			fk.Provenance = k.provenance
+			data, err := json.Marshal(fk)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(fleetKey(host, fk.Account, fk.Fingerprint), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// FleetKeys returns every imported fleet key, sorted by host, account and fingerprint
+func (k *KeyDB) FleetKeys() ([]FleetKey, error) {
+	var keys []FleetKey
+	err := k.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(fleetPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var fk FleetKey
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &fk)
+			}); err != nil {
+				return err
+			}
+			keys = append(keys, fk)
+		}
+		return nil
+	})
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].Host != keys[j].Host {
+			return keys[i].Host < keys[j].Host
+		}
+		return keys[i].Account < keys[j].Account
+	})
+	return keys, err
+}
@@ -0,0 +1,121 @@
+package keydb
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// identityPrefix is the key prefix for identity records, keyed by lower-cased login
+const identityPrefix = "identity:"
+
+// IdentityRecord links a GitHub login to a corporate identity. A record with neither an employee ID
+// nor an email means the login was looked up and found in no directory: an unlinked account.
+type IdentityRecord struct {
+	Login      string `json:"login"`
+	EmployeeID string `json:"employee_id,omitempty"`
+	Email      string `json:"email,omitempty"`
+	// Source is the mapping that resolved the login, such as "map:/etc/logins.csv" or "command:ldap-lookup".
+	Source   string    `json:"source"`
+	Resolved time.Time `json:"resolved"`
+}
+
+// Linked reports whether the record names a corporate identity
+func (r *IdentityRecord) Linked() bool {
+	return r != nil && (r.EmployeeID != "" || r.Email != "")
+}
+
+// String returns the identity as "employee_id <email>", leaving out whichever is unknown, or "unlinked"
+func (r *IdentityRecord) String() string {
+	switch {
+	case !r.Linked():
+		return "unlinked"
+	case r.Email == "":
+		return r.EmployeeID
+	case r.EmployeeID == "":
+		return "<" + r.Email + ">"
+	}
+	return r.EmployeeID + " <" + r.Email + ">"
+}
+
+// identityKey returns the database key for a login's identity record
+func identityKey(login string) []byte {
+	return []byte(identityPrefix + strings.ToLower(login))
+}
+
+// PutIdentity writes a login's identity record, replacing the previous one. A zero Resolved time
+// means the KeyDB's clock. Keys are not touched, so identities can be refreshed without re-collecting.
+func (k *KeyDB) PutIdentity(r *IdentityRecord) error {
+	if r.Resolved.IsZero() {
+		r.Resolved = k.clock.Now()
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return checkSpace(k.update(func(txn *badger.Txn) error {
+		return txn.Set(identityKey(r.Login), data)
+	}))
+}
+
+// Identity returns a login's identity record, or nil if the login has not been looked up
+func (k *KeyDB) Identity(login string) (*IdentityRecord, error) {
+	var r *IdentityRecord
+	err := k.view(func(txn *badger.Txn) error {
+		var err error
+		r, err = getIdentity(txn, login)
+		return err
+	})
+	return r, err
+}
+
+// Identities returns every identity record, by lower-cased login
+func (k *KeyDB) Identities() (map[string]*IdentityRecord, error) {
+	ids := map[string]*IdentityRecord{}
+	err := k.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(identityPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var r IdentityRecord
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &r)
+			}); err != nil {
+				return err
+			}
+			ids[strings.ToLower(r.Login)] = &r
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// getIdentity reads a login's identity record within txn, returning nil if there is none
+func getIdentity(txn *badger.Txn, login string) (*IdentityRecord, error) {
+	item, err := txn.Get(identityKey(login))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r IdentityRecord
+	if err := item.Value(func(val []byte) error { return json.Unmarshal(val, &r) }); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// describeAccount returns login with its corporate identity, if linked, for alerts
+func describeAccount(txn *badger.Txn, login string) string {
+	r, err := getIdentity(txn, login)
+	if err != nil || !r.Linked() {
+		return login
+	}
+	return login + " (" + r.String() + ")"
+}
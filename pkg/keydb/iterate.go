@@ -0,0 +1,124 @@
+package keydb
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// KeyRecord is a stored public key and its metadata
+type KeyRecord struct {
+	Key string
+	Metadata
+}
+
+// UserRecord is a user and all of the keys attributed to them
+type UserRecord struct {
+	// Login is lower-cased; each key's Metadata.User keeps the case it was stored with.
+	Login string
+	// Keys are sorted by key.
+	Keys []KeyRecord
+}
+
+// Range restricts iteration. The zero Range matches every key.
+type Range struct {
+	// KeyPrefix matches keys starting with it, such as "ssh-ed25519 ".
+	KeyPrefix string
+	// SeenAfter and SeenBefore bound the last-seen time (Metadata.Timestamp); zero means unbounded.
+	SeenAfter  time.Time
+	SeenBefore time.Time
+}
+
+// contains reports whether a record's last-seen time falls within the range
+func (r Range) contains(md *Metadata) bool {
+	if !r.SeenAfter.IsZero() && !md.Timestamp.After(r.SeenAfter) {
+		return false
+	}
+	return r.SeenBefore.IsZero() || md.Timestamp.Before(r.SeenBefore)
+}
+
+// ForEachKey calls fn for every stored key. It is ForEachKeyIn with the zero Range.
+func (k *KeyDB) ForEachKey(ctx context.Context, fn func(KeyRecord) error) error {
+	return k.ForEachKeyIn(ctx, Range{}, fn)
+}
+
+// ForEachKeyIn calls fn for every stored key within r, in key order. All calls see one consistent
+// snapshot of the database, unaffected by concurrent writes. Iteration stops at the first error
+// from fn, or when ctx is done, and that error is returned.
+//
+// This and ForEachUser are the supported way to read the whole database: they skip bookkeeping
+// records (skips, blocks, runs) and decode values, so callers need not know the key layout.
+func (k *KeyDB) ForEachKeyIn(ctx context.Context, r Range, fn func(KeyRecord) error) error {
+	return k.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(r.KeyPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := it.Item()
+			if isRecordKey(item.Key()) {
+				continue
+			}
+
+			rec := KeyRecord{Key: string(item.KeyCopy(nil))}
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &rec.Metadata)
+			}); err != nil {
+				return err
+			}
+			if !r.contains(&rec.Metadata) {
+				continue
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEachUser calls fn once per user, in login order, with all of their keys. Users are grouped
+// case-insensitively. Keys are read from one snapshot, as with ForEachKeyIn, and held in memory
+// until every user has been visited.
+func (k *KeyDB) ForEachUser(ctx context.Context, fn func(UserRecord) error) error {
+	users := map[string]*UserRecord{}
+	err := k.ForEachKey(ctx, func(rec KeyRecord) error {
+		login := strings.ToLower(rec.User)
+		u := users[login]
+		if u == nil {
+			u = &UserRecord{Login: login}
+			users[login] = u
+		}
+		u.Keys = append(u.Keys, rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logins := make([]string, 0, len(users))
+	for login := range users {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+
+	for _, login := range logins {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		u := users[login]
+		sort.Slice(u.Keys, func(i, j int) bool { return u.Keys[i].Key < u.Keys[j].Key })
+		if err := fn(*u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,77 +2,539 @@
 package keydb
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
 	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/stats"
 )
 
+// KeyPurpose describes what a user registered a public key on GitHub for
+type KeyPurpose string
+
+const (
+	// PurposeAuth is a key served by the .keys endpoint (SSH authentication)
+	PurposeAuth KeyPurpose = "auth"
+	// PurposeSigning is a key registered only for SSH commit signing
+	PurposeSigning KeyPurpose = "signing"
+	// PurposeBoth is a key registered for both authentication and signing
+	PurposeBoth KeyPurpose = "both"
+)
+
+// Provenance identifies the collector instance and run that wrote a record
+type Provenance struct {
+	Instance string `json:"instance,omitempty"`
+	RunID    string `json:"run_id,omitempty"`
+}
+
 // Metadata stores information about a public key
 type Metadata struct {
-	User      string    `json:"user"`
-	Repo      string    `json:"repo"`
-	Timestamp time.Time `json:"timestamp"`
+	User      string     `json:"user"`
+	Repo      string     `json:"repo"`
+	Timestamp time.Time  `json:"timestamp"`
+	FirstSeen time.Time  `json:"first_seen"`
+	Purpose   KeyPurpose `json:"purpose,omitempty"`
+	Created   *time.Time `json:"created,omitempty"`
+	Source    string     `json:"source,omitempty"`
+	Flags     []string   `json:"flags,omitempty"`
+	LastUsed  *LastUsed  `json:"last_used,omitempty"`
+	// KeysVia is how the key was fetched when its current content was written ("scrape" or "api"), if recorded.
+	KeysVia string `json:"keys_via,omitempty"`
+	// Historical is set when FirstSeen came from an imported dataset (see Backfill).
+	Historical *HistoricalSource `json:"historical,omitempty"`
+	// KeyType and Fingerprint (SHA256) are derived from the key when it is stored.
+	KeyType     string `json:"key_type,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Provenance
+}
+
+// ErrNoSpace is returned when a write fails because the disk is full. Callers should stop writing and shut down.
+var ErrNoSpace = errors.New("no space left for database")
+
+// ErrNotFound is returned by Lookup for keys that are not in the database. It is Badger's ErrKeyNotFound.
+var ErrNotFound = badger.ErrKeyNotFound
+
+// skipPrefix is the key prefix for records explaining why a user was skipped
+const skipPrefix = "skip:"
+
+// SkipRecord stores why and when a user was last skipped by the collector
+type SkipRecord struct {
+	Reason    collect.SkipReason `json:"reason"`
+	Detail    string             `json:"detail,omitempty"`
+	Repo      string             `json:"repo,omitempty"`
+	Timestamp time.Time          `json:"timestamp"`
 }
 
 // KeyDB represents a BadgerDB instance for storing SSH public keys
 type KeyDB struct {
-	db *badger.DB
+	// swap guards db and path, which MigratePath replaces; see view and update
+	swap       sync.RWMutex
+	db         *badger.DB
+	path       string
+	profile    Profile
+	owner      owner
+	provenance Provenance
+	clock      clock.Clock
+	blocklist  *Blocklist
+	counters   stats.Counters
+	// fingerprints are the enabled fingerprint algorithms; nil means the defaults
+	fingerprints []string
+	// readOnly is set by OpenReadOnly; Close then leaves the owner file alone
+	readOnly bool
+	// storeHook and dryRun support tracing; see trace.go
+	storeHook func(StoreEvent)
+	dryRun    bool
+	// detectConflicts is set by SetConflictDetection
+	detectConflicts bool
+	// migrating is held by MigratePath; drops counts DropPrefix calls, which its delta copies miss;
+	// pausing is set while it waits for reads and writes to drain
+	migrating sync.Mutex
+	drops     atomic.Int64
+	pausing   atomic.Pointer[chan struct{}]
 }
 
-// New creates a new KeyDB instance
+// New creates a new KeyDB instance using the balanced profile
 func New(path string) (*KeyDB, error) {
-	opts := badger.DefaultOptions(path)
-	db, err := badger.Open(opts)
+	return NewWithProfile(path, ProfileBalanced)
+}
+
+// NewWithProfile opens a KeyDB with Badger options tuned for the given workload
+func NewWithProfile(path string, profile Profile) (*KeyDB, error) {
+	db, err := openBadger(profile.options(path))
+	if err != nil {
+		return nil, err
+	}
+	o := newOwner(clock.Real.Now())
+	if err := writeOwner(path, o); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("record database owner: %w", err)
+	}
+	k := &KeyDB{db: db, path: path, profile: profile, owner: o, clock: clock.Real}
+	if err := k.buildUserIndex(context.Background()); err != nil {
+		k.Close()
+		return nil, fmt.Errorf("index keys by owner: %w", err)
+	}
+	return k, nil
+}
+
+// OpenReadOnly opens an existing database for lookups only, writing nothing to its directory and
+// logging nothing. Badger keeps writers exclusive, so this fails with ErrLocked while a collector has
+// the database open, and never removes a stale lock.
+func OpenReadOnly(path string) (*KeyDB, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithReadOnly(true).WithLogger(nil))
 	if err != nil {
+		if isLockError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrLocked, err)
+		}
 		return nil, err
 	}
-	return &KeyDB{db: db}, nil
+	return &KeyDB{db: db, path: path, clock: clock.Real, readOnly: true}, nil
+}
+
+// SetProvenance sets the instance and run ID stamped on every subsequent write
+func (k *KeyDB) SetProvenance(p Provenance) {
+	k.provenance = p
+}
+
+// SetClock sets the clock used for writes made without an explicit timestamp
+func (k *KeyDB) SetClock(c clock.Clock) {
+	k.clock = c
+}
+
+// NewRunID returns a random (version 4) UUID identifying a collector run
+func NewRunID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Counts returns a snapshot of this KeyDB's write counters since it was opened: keys_new,
+// keys_written (new or changed), keys_unchanged, keys_rejected, keys_malformed, users_quarantined and, with conflict detection, conflicts. Store may be called concurrently.
+func (k *KeyDB) Counts() map[string]int {
+	return k.counters.Snapshot()
+}
+
+// Path returns the database location, which MigratePath changes
+func (k *KeyDB) Path() string {
+	k.swap.RLock()
+	defer k.swap.RUnlock()
+	return k.path
 }
 
 // Close closes the underlying BadgerDB
 func (k *KeyDB) Close() error {
+	k.swap.Lock()
+	defer k.swap.Unlock()
+
+	if k.readOnly {
+		return k.db.Close()
+	}
+	if err := os.Remove(filepath.Join(k.path, ownerFile)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove %s: %v", ownerFile, err)
+	}
 	return k.db.Close()
 }
 
-// Store adds all public keys from a UserInfo object to the database
+// Store adds all public keys from a UserInfo object to the database. See merge.go for how
+// repeated observations of a key are combined. Keys too large to store are skipped and reported in the returned error; the rest are still stored.
+// A zero timestamp means the user's FetchedAt, or failing that, the KeyDB's clock.
 func (k *KeyDB) Store(userInfo collect.UserInfo, user string, timestamp time.Time) error {
-	metadata := Metadata{
-		User:      user,
-		Repo:      userInfo.Repo,
+	if timestamp.IsZero() {
+		timestamp = userInfo.FetchedAt
+	}
+	if timestamp.IsZero() {
+		timestamp = k.clock.Now()
+	}
+	purposes := keyPurposes(userInfo)
+
+	// Apply size limits up front so one bad key can't abort the whole transaction
+	var rejected []error
+	limited := map[string]string{}
+	truncated := map[string]bool{}
+	parsed := map[string]*parsedKey{}
+	for pubKey := range purposes {
+		key, trunc, err := limitKey(pubKey)
+		if err != nil {
+			rejected = append(rejected, err)
+			continue
+		}
+		pk, err := k.parseKey(key)
+		if errors.Is(err, ErrMalformed) {
+			// Kept so the user's keys stay complete, but flagged rather than stored as a valid key
+			log.Printf("Flagging malformed key for %s: %v: %.40s", user, err, key)
+			pk = &parsedKey{keyType: keyFields(key)[0], malformed: true}
+		} else if err != nil {
+			log.Printf("Skipping unparseable key for %s: %v: %.40s", user, err, key)
+			continue
+		}
+		limited[pubKey] = key
+		truncated[pubKey] = trunc
+		parsed[pubKey] = pk
+	}
+
+	// Store each public key in BadgerDB, tallying outcomes for Counts once committed
+	var added, written, unchanged, malformed, conflicts int64
+	err := checkSpace(k.update(func(txn *badger.Txn) error {
+		for pubKey, key := range limited {
+			purpose := purposes[pubKey]
+			pk := parsed[pubKey]
+			metadata := Metadata{
+				User:        user,
+				Repo:        userInfo.Repo,
+				Timestamp:   timestamp,
+				Purpose:     purpose,
+				Source:      userInfo.Source,
+				KeyType:     pk.keyType,
+				Fingerprint: pk.sha256,
+				Provenance:  k.provenance,
+			}
+			if purpose != PurposeSigning {
+				metadata.KeysVia = userInfo.KeysVia
+			}
+			if created, ok := userInfo.KeyCreatedAt[pubKey]; ok {
+				metadata.Created = &created
+			}
+			if pk.malformed {
+				metadata.Flags = append(metadata.Flags, FlagMalformed)
+				malformed++
+			}
+			if truncated[pubKey] {
+				metadata.Flags = append(metadata.Flags, FlagCommentTruncated)
+			}
+			if len(rejected) > 0 {
+				metadata.Flags = append(metadata.Flags, FlagKeyRejected)
+			}
+			blocked, err := k.isBlocked(txn, key)
+			if err != nil {
+				return err
+			}
+			if blocked {
+				log.Printf("ALERT: blocked key observed on account %s: %.60s", describeAccount(txn, user), key)
+				metadata.Flags = append(metadata.Flags, FlagBlocked)
+			}
+
+			existing, err := getMetadata(txn, []byte(key))
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				added++
+				if err := updateRollup(txn, timestamp, func(r *Rollup) { r.add(key, metadata.Source) }); err != nil {
+					return err
+				}
+			}
+			if !pk.malformed {
+				if err := indexFingerprints(txn, key, pk); err != nil {
+					return err
+				}
+			}
+			conflict, err := k.recordConflict(txn, key, existing, &metadata)
+			if err != nil {
+				return err
+			}
+			if conflict {
+				conflicts++
+			}
+			merged := merge(existing, &metadata)
+			if merged == nil && existing.Fingerprint == "" && !pk.malformed {
+				// Records stored before fingerprints were recorded gain them when seen again
+				refreshed := *existing
+				merged = &refreshed
+			}
+			if merged != nil {
+				merged.KeyType, merged.Fingerprint = pk.keyType, pk.sha256
+			}
+			if k.storeHook != nil {
+				k.storeHook(StoreEvent{User: user, Key: key, Existing: existing, Written: merged})
+			}
+			if merged == nil {
+				unchanged++
+				continue
+			}
+			written++
+
+			// Convert metadata to JSON
+			metadataJSON, err := json.Marshal(merged)
+			if err != nil {
+				return err
+			}
+
+			if err := txn.Set([]byte(key), metadataJSON); err != nil {
+				return err
+			}
+			previous := ""
+			if existing != nil {
+				previous = existing.User
+			}
+			if err := indexUser(txn, key, previous, merged.User); err != nil {
+				return err
+			}
+		}
+
+		// The user is no longer skipped once any of their keys are stored
+		if len(limited) > 0 {
+			if err := txn.Delete(skipKey(user)); err != nil {
+				return err
+			}
+			if err := countUser(txn, user, timestamp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	if err != nil {
+		return err
+	}
+	k.counters.Add("keys_new", added)
+	k.counters.Add("keys_written", written)
+	k.counters.Add("keys_unchanged", unchanged)
+	k.counters.Add("keys_rejected", int64(len(rejected)))
+	k.counters.Add("keys_malformed", malformed)
+	if conflicts > 0 {
+		k.counters.Add("conflicts", conflicts)
+	}
+	return errors.Join(rejected...)
+}
+
+// StoreSkip records why a user was not stored. A zero timestamp means the KeyDB's clock.
+func (k *KeyDB) StoreSkip(skip collect.Skip, timestamp time.Time) error {
+	if timestamp.IsZero() {
+		timestamp = k.clock.Now()
+	}
+	record := SkipRecord{
+		Reason:    skip.Reason,
+		Detail:    skip.Detail,
+		Repo:      skip.Repo,
 		Timestamp: timestamp,
 	}
 
-	// Convert metadata to JSON
-	metadataJSON, err := json.Marshal(metadata)
+	recordJSON, err := json.Marshal(record)
 	if err != nil {
 		return err
 	}
 
-	// Store each public key in BadgerDB
-	return k.db.Update(func(txn *badger.Txn) error {
-		for _, pubKey := range userInfo.PublicKeys {
-			if err := txn.Set([]byte(pubKey), metadataJSON); err != nil {
+	return checkSpace(k.update(func(txn *badger.Txn) error {
+		return txn.Set(skipKey(skip.Username), recordJSON)
+	}))
+}
+
+// Skip returns the most recent skip record for a user, or nil if there is none
+func (k *KeyDB) Skip(user string) (*SkipRecord, error) {
+	var record SkipRecord
+	err := k.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(skipKey(user))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &record)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Skips returns every skip record, by lower-cased login
+func (k *KeyDB) Skips() (map[string]*SkipRecord, error) {
+	skips := map[string]*SkipRecord{}
+	err := k.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(skipPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var r SkipRecord
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &r)
+			}); err != nil {
 				return err
 			}
+			skips[strings.TrimPrefix(string(it.Item().Key()), skipPrefix)] = &r
+		}
+		return nil
+	})
+	return skips, err
+}
+
+// UserKeys returns the stored keys attributed to a user, found through the owner index. Databases
+// whose index has not been built yet, such as an old one opened read-only, are scanned instead.
+func (k *KeyDB) UserKeys(user string) (map[string]*Metadata, error) {
+	var keys map[string]*Metadata
+	indexed := false
+	err := k.view(func(txn *badger.Txn) error {
+		var err error
+		keys, indexed, err = indexedUserKeys(txn, user)
+		return err
+	})
+	if err != nil || indexed {
+		return keys, err
+	}
+	return k.Matching(func(md *Metadata) bool {
+		return strings.EqualFold(md.User, user)
+	})
+}
+
+// Matching returns the stored keys whose metadata satisfies match. This scans the whole database.
+func (k *KeyDB) Matching(match func(*Metadata) bool) (map[string]*Metadata, error) {
+	keys := map[string]*Metadata{}
+	err := k.ForEachKey(context.Background(), func(rec KeyRecord) error {
+		if match(&rec.Metadata) {
+			keys[rec.Key] = &rec.Metadata
 		}
 		return nil
 	})
+	return keys, err
+}
+
+// checkSpace converts disk-full write errors into ErrNoSpace
+func checkSpace(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, syscall.ENOSPC) || strings.Contains(err.Error(), "no space left on device") {
+		return fmt.Errorf("%w: %v", ErrNoSpace, err)
+	}
+	return err
+}
+
+// skipKey returns the database key for a user's skip record
+func skipKey(user string) []byte {
+	return []byte(skipPrefix + strings.ToLower(user))
+}
+
+// recordPrefixes are the key prefixes of bookkeeping records
+var recordPrefixes = []string{skipPrefix, blockPrefix, runPrefix, rollupPrefix, seenUserPrefix, fingerprintPrefix, exposurePrefix, conflictPrefix, cursorPrefix, replicaPrefix, identityPrefix, quarantinePrefix, fleetPrefix, trafficPrefix, userKeyPrefix}
+
+// isRecordKey reports whether a database key holds a bookkeeping record rather than a public key
+func isRecordKey(key []byte) bool {
+	return recordType(key) != RecordKey
+}
+
+// keyPurposes maps each distinct key in userInfo to the purpose it was registered for
+func keyPurposes(userInfo collect.UserInfo) map[string]KeyPurpose {
+	purposes := map[string]KeyPurpose{}
+	for _, pubKey := range userInfo.PublicKeys {
+		purposes[pubKey] = PurposeAuth
+	}
+	for _, pubKey := range userInfo.SigningKeys {
+		if _, ok := purposes[pubKey]; ok {
+			purposes[pubKey] = PurposeBoth
+		} else {
+			purposes[pubKey] = PurposeSigning
+		}
+	}
+	return purposes
+}
+
+// getMetadata reads the stored metadata for key within txn, or nil if there is none
+func getMetadata(txn *badger.Txn, key []byte) (*Metadata, error) {
+	item, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata Metadata
+	if err := item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &metadata)
+	}); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
 }
 
-// Lookup retrieves metadata for a given public key
+// Lookup retrieves metadata for a public key, given as an authorized_keys line or as its SHA256
+// ("SHA256:...") or MD5 ("16:27:ac:...") fingerprint. A key line whose comment differs from the
+// stored one is found by its fingerprint. Keys blocked since they were stored are flagged as blocked.
 func (k *KeyDB) Lookup(pubKey string) (*Metadata, error) {
 	var metadata Metadata
-	err := k.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(pubKey))
+	err := k.view(func(txn *badger.Txn) error {
+		key, err := resolveKey(txn, pubKey)
+		if err != nil {
+			return err
+		}
+		item, err := txn.Get([]byte(key))
 		if err != nil {
 			return err
 		}
 
-		return item.Value(func(val []byte) error {
+		if err := item.Value(func(val []byte) error {
 			return json.Unmarshal(val, &metadata)
-		})
+		}); err != nil {
+			return err
+		}
+
+		blocked, err := k.isBlocked(txn, key)
+		if blocked && !hasFlag(metadata.Flags, FlagBlocked) {
+			metadata.Flags = append(metadata.Flags, FlagBlocked)
+		}
+		return err
 	})
 	if err != nil {
 		return nil, err
@@ -80,16 +542,34 @@ func (k *KeyDB) Lookup(pubKey string) (*Metadata, error) {
 	return &metadata, nil
 }
 
+// resolveKey returns the stored key line for a Lookup query
+func resolveKey(txn *badger.Txn, query string) (string, error) {
+	if fp, ok := normalizeFingerprint(query); ok {
+		return resolveFingerprint(txn, fp)
+	}
+	if _, err := txn.Get([]byte(query)); !errors.Is(err, badger.ErrKeyNotFound) {
+		return query, err
+	}
+	fp, err := Fingerprint(query)
+	if err != nil {
+		return "", badger.ErrKeyNotFound
+	}
+	return resolveFingerprint(txn, fp)
+}
+
 // Count returns the total number of keys in the database
 func (k *KeyDB) Count() (int, error) {
 	keyCount := 0
-	err := k.db.View(func(txn *badger.Txn) error {
+	err := k.view(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false // Keys only
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
 		for it.Rewind(); it.Valid(); it.Next() {
+			if isRecordKey(it.Item().Key()) {
+				continue
+			}
 			keyCount++
 		}
 		return nil
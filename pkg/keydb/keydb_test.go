@@ -0,0 +1,60 @@
+package keydb
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestDB opens a database in a temporary directory, closed when the test ends
+func newTestDB(t *testing.T) *KeyDB {
+	t.Helper()
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testKey returns a distinct, valid ed25519 authorized_keys line for each n
+func testKey(t testing.TB, n int) string {
+	t.Helper()
+	seed := make([]byte, ed25519.SeedSize)
+	binary.BigEndian.PutUint64(seed, uint64(n)+1)
+	pub, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(seed).Public())
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
+
+func TestCheckSpace(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		noSpace bool
+	}{
+		{name: "nil", err: nil},
+		{name: "ENOSPC", err: fmt.Errorf("write vlog: %w", syscall.ENOSPC), noSpace: true},
+		{name: "message only", err: errors.New("sync: no space left on device"), noSpace: true},
+		{name: "other error", err: errors.New("permission denied")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkSpace(tt.err)
+			if errors.Is(got, ErrNoSpace) != tt.noSpace {
+				t.Errorf("checkSpace(%v) = %v, want ErrNoSpace: %v", tt.err, got, tt.noSpace)
+			}
+			if (got == nil) != (tt.err == nil) {
+				t.Errorf("checkSpace(%v) = %v", tt.err, got)
+			}
+		})
+	}
+}
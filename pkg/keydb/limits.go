@@ -0,0 +1,42 @@
+package keydb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxCommentLen is the longest key comment stored; longer comments are truncated
+	maxCommentLen = 256
+	// maxKeyLen is the longest key line accepted, well above a 16384-bit RSA key and well below Badger's 64KB key limit
+	maxKeyLen = 16 << 10
+)
+
+// Metadata flags recording how a user's keys were altered or left incomplete
+const (
+	// FlagCommentTruncated means this key's comment was truncated to maxCommentLen
+	FlagCommentTruncated = "comment_truncated"
+	// FlagKeyRejected means another of the user's keys was rejected, so their stored keys are incomplete
+	FlagKeyRejected = "key_rejected"
+)
+
+// ErrKeyTooLarge is returned (wrapped, once per key) when a key is too long to store
+var ErrKeyTooLarge = errors.New("key too large")
+
+// limitKey truncates an over-long comment and rejects keys that are still too large.
+// It reports whether the comment was truncated.
+func limitKey(pubKey string) (string, bool, error) {
+	truncated := false
+	fields := strings.SplitN(pubKey, " ", 3)
+	if len(fields) == 3 && len(fields[2]) > maxCommentLen {
+		fields[2] = strings.ToValidUTF8(fields[2][:maxCommentLen], "")
+		pubKey = strings.Join(fields, " ")
+		truncated = true
+	}
+
+	if len(pubKey) > maxKeyLen {
+		return "", false, fmt.Errorf("%w: %d bytes (limit %d): %.40s...", ErrKeyTooLarge, len(pubKey), maxKeyLen, pubKey)
+	}
+	return pubKey, truncated, nil
+}
@@ -0,0 +1,84 @@
+package keydb
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+func TestLimitKey(t *testing.T) {
+	const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	tests := []struct {
+		name          string
+		line          string
+		want          string
+		wantTruncated bool
+		wantErr       bool
+	}{
+		{name: "no comment", line: key, want: key},
+		{name: "short comment", line: key + " me@host", want: key + " me@host"},
+		{name: "comment at limit", line: key + " " + strings.Repeat("c", maxCommentLen), want: key + " " + strings.Repeat("c", maxCommentLen)},
+		{name: "long comment", line: key + " " + strings.Repeat("c", 100<<10), want: key + " " + strings.Repeat("c", maxCommentLen), wantTruncated: true},
+		{name: "multibyte comment cut mid-rune", line: key + " " + strings.Repeat("é", maxCommentLen), want: key + " " + strings.Repeat("é", maxCommentLen/2), wantTruncated: true},
+		{name: "100KB blob", line: "ssh-rsa " + strings.Repeat("A", 100<<10), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated, err := limitKey(tt.line)
+			if tt.wantErr {
+				if !errors.Is(err, ErrKeyTooLarge) {
+					t.Fatalf("limitKey error = %v, want ErrKeyTooLarge", err)
+				}
+				if len(err.Error()) > 200 {
+					t.Errorf("error quotes %d bytes of the key", len(err.Error()))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("limitKey: %v", err)
+			}
+			if got != tt.want || truncated != tt.wantTruncated {
+				t.Errorf("limitKey = %.60q... (%d bytes), %v; want %d bytes, %v", got, len(got), truncated, len(tt.want), tt.wantTruncated)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("limitKey returned invalid UTF-8")
+			}
+		})
+	}
+}
+
+func TestStoreOversizedKeyKeepsTheRest(t *testing.T) {
+	db := newTestDB(t)
+	good, long := testKey(t, 1), testKey(t, 2)+" "+strings.Repeat("c", 100<<10)
+	huge := "ssh-rsa " + strings.Repeat("A", 100<<10)
+
+	err := db.Store(collect.UserInfo{Username: "alice", PublicKeys: []string{good, long, huge}}, "alice", time.Time{})
+	if !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("Store error = %v, want ErrKeyTooLarge", err)
+	}
+
+	keys, err := db.UserKeys("alice")
+	if err != nil {
+		t.Fatalf("UserKeys: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("stored %d keys, want the 2 that fit", len(keys))
+	}
+	for key, md := range keys {
+		if !slices.Contains(md.Flags, FlagKeyRejected) {
+			t.Errorf("%.40s: flags %v lack %s", key, md.Flags, FlagKeyRejected)
+		}
+		wantTruncated := strings.HasPrefix(key, testKey(t, 2))
+		if slices.Contains(md.Flags, FlagCommentTruncated) != wantTruncated {
+			t.Errorf("%.40s: flags %v, want %s: %v", key, md.Flags, FlagCommentTruncated, wantTruncated)
+		}
+		if len(key) > maxKeyLen {
+			t.Errorf("stored a %d byte key", len(key))
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package keydb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// ownerFile records which process has the database open, so a lock left by a dead process can be told apart
+// from one held by a live process. It is removed on Close.
+const ownerFile = "pubkey-collector.owner"
+
+// ErrLocked is returned when another live process has the database open
+var ErrLocked = errors.New("database is in use by another process")
+
+// owner identifies the process that has a database open
+type owner struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+	// Migrates is set by KeyDB.AcceptMigrations: the process serves RequestMigration.
+	Migrates bool `json:"migrates,omitempty"`
+}
+
+// openBadger opens a Badger database, removing a lock left behind by a dead process on this host and retrying once
+func openBadger(opts badger.Options) (*badger.DB, error) {
+	db, err := badger.Open(opts)
+	if err == nil || !isLockError(err) {
+		return db, err
+	}
+
+	o, rerr := readOwner(opts.Dir)
+	if rerr != nil || o == nil {
+		return nil, fmt.Errorf("%w: %v", ErrLocked, err)
+	}
+
+	host, _ := os.Hostname()
+	if o.Host != host || processAlive(o.PID) {
+		return nil, fmt.Errorf("%w: %s is held by pid %d on %s since %s", ErrLocked, opts.Dir, o.PID, o.Host, o.Started.Format(time.RFC3339))
+	}
+
+	log.Printf("Removing stale lock on %s left by pid %d (no longer running)", opts.Dir, o.PID)
+	for _, dir := range []string{opts.Dir, opts.ValueDir} {
+		if err := os.Remove(filepath.Join(dir, "LOCK")); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("remove stale lock: %w", err)
+		}
+	}
+	db, err = badger.Open(opts)
+	if err != nil && isLockError(err) {
+		// The lock is held after all, by a process the owner file doesn't know about
+		return nil, fmt.Errorf("%w: %v", ErrLocked, err)
+	}
+	return db, err
+}
+
+// isLockError reports whether err is Badger failing to acquire its directory lock
+func isLockError(err error) bool {
+	return strings.Contains(err.Error(), "Another process is using this Badger database")
+}
+
+// readOwner returns the recorded owner of the database in dir, or nil if there is none
+func readOwner(dir string) (*owner, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ownerFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var o owner
+	if err := json.Unmarshal(b, &o); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// newOwner describes this process, started at now
+func newOwner(now time.Time) owner {
+	host, _ := os.Hostname()
+	return owner{PID: os.Getpid(), Host: host, Started: now}
+}
+
+// writeOwner records o as the owner of the database in dir
+func writeOwner(dir string, o owner) error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ownerFile), b, 0o644)
+}
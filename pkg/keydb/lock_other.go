@@ -0,0 +1,16 @@
+//go:build !unix
+
+package keydb
+
+import "errors"
+
+// processAlive reports whether a process with the given pid exists. Without a way to check, it assumes so,
+// which leaves the lock in place.
+func processAlive(pid int) bool {
+	return true
+}
+
+// signalMigration is unsupported without SIGUSR2
+func signalMigration(pid int) error {
+	return errors.New("migrating a database another process has open needs SIGUSR2, which this platform lacks")
+}
@@ -0,0 +1,135 @@
+package keydb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deadPID returns the pid of a process that has exited
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run child: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestOpenLocked(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a way to tell whether a pid is running")
+	}
+	host, _ := os.Hostname()
+	tests := []struct {
+		name string
+		// owner returns the owner to record, or nil to record none
+		owner   func(t *testing.T) *owner
+		wantMsg string
+	}{
+		{name: "no owner file", owner: func(*testing.T) *owner { return nil }},
+		{name: "live owner", owner: func(*testing.T) *owner {
+			return &owner{PID: os.Getpid(), Host: host, Started: time.Now()}
+		}, wantMsg: fmt.Sprintf("held by pid %d on %s", os.Getpid(), host)},
+		{name: "other host", owner: func(*testing.T) *owner {
+			return &owner{PID: 1, Host: "elsewhere.example.com", Started: time.Now()}
+		}, wantMsg: "held by pid 1 on elsewhere.example.com"},
+		// The owner file names a dead process, but the lock is really held: removing the LOCK file
+		// must not let a second writer in
+		{name: "dead owner", owner: func(t *testing.T) *owner {
+			return &owner{PID: deadPID(t), Host: host, Started: time.Now()}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			held, err := New(dir)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			defer held.Close()
+			os.Remove(filepath.Join(dir, ownerFile))
+			if o := tt.owner(t); o != nil {
+				if err := writeOwner(dir, *o); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db, err := New(dir)
+			if err == nil {
+				db.Close()
+				t.Fatal("opened a database another KeyDB holds")
+			}
+			if !errors.Is(err, ErrLocked) {
+				t.Errorf("New() error = %v, want ErrLocked", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("New() error = %q, want it to mention %q", err, tt.wantMsg)
+			}
+		})
+	}
+}
+
+// TestHelperHoldDB opens the database named by KEYDB_HOLD and waits to be killed
+func TestHelperHoldDB(t *testing.T) {
+	dir := os.Getenv("KEYDB_HOLD")
+	if dir == "" {
+		t.Skip("only run as a child of TestOpenAfterHardExit")
+	}
+	if _, err := New(dir); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	fmt.Println("open")
+	time.Sleep(time.Minute)
+}
+
+func TestOpenAfterHardExit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs SIGKILL")
+	}
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperHoldDB$")
+	cmd.Env = append(os.Environ(), "KEYDB_HOLD="+dir)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, _ := out.Read(buf)
+	if !strings.HasPrefix(string(buf[:n]), "open") {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatalf("child did not open the database: %q", buf[:n])
+	}
+
+	// While the child runs, the database is refused and the child is named
+	if _, err := New(dir); !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), fmt.Sprintf("pid %d", cmd.Process.Pid)) {
+		t.Errorf("New() with the child running: %v, want ErrLocked naming pid %d", err, cmd.Process.Pid)
+	}
+
+	// Dying without Close leaves its owner file and LOCK behind
+	cmd.Process.Kill()
+	cmd.Wait()
+	if o, err := readOwner(dir); err != nil || o == nil || o.PID != cmd.Process.Pid {
+		t.Fatalf("owner after kill = %+v, %v; want the child's", o, err)
+	}
+
+	db, err := New(dir)
+	if err != nil {
+		t.Fatalf("New() after the holder died: %v", err)
+	}
+	defer db.Close()
+	if o, err := readOwner(dir); err != nil || o == nil || o.PID != os.Getpid() {
+		t.Errorf("owner after reopening = %+v, %v; want this process", o, err)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package keydb
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processAlive reports whether a process with the given pid exists on this host
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// signalMigration tells the process pid that a MigrationRequest is waiting
+func signalMigration(pid int) error {
+	return syscall.Kill(pid, syscall.SIGUSR2)
+}
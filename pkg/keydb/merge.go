@@ -0,0 +1,136 @@
+package keydb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// contentHash returns a hash of the fields that define a record's content
+func contentHash(md *Metadata) string {
+	content := struct {
+		User    string     `json:"user"`
+		Repo    string     `json:"repo"`
+		Purpose KeyPurpose `json:"purpose"`
+		Created *time.Time `json:"created"`
+		Source  string     `json:"source"`
+		Flags   []string   `json:"flags"`
+	}{strings.ToLower(md.User), md.Repo, md.Purpose, md.Created, md.Source, md.Flags}
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		// Marshaling plain strings and times cannot fail
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// merge combines an incoming observation of a key with its stored record, if any.
+// It returns the record to write, or nil when storing would not change anything.
+//
+// This is what makes Store idempotent and order-independent for observations of a key:
+//
+//   - Storing the same content with the same timestamp twice changes nothing.
+//   - Storing the same content with a newer timestamp only moves Timestamp (last seen) forward;
+//     an older timestamp only moves FirstSeen back. Neither touches any other field.
+//   - Storing different content (another owner, repo, purpose, source, or flags) replaces the
+//     record only if its timestamp is newer. Equal timestamps are broken by content hash, so
+//     the same set of Store calls converges on the same record in any order.
+//   - FirstSeen is the earliest sighting by the current owner. It is order-independent while a
+//     key has had one owner; once it has moved between owners, it depends on which sightings of
+//     the current owner arrived after the move.
+//
+// Content excludes Provenance and KeysVia, which record the run and transport that wrote the current content, and LastUsed
+// and Historical, which are kept while the key stays with the same owner.
+func merge(existing, incoming *Metadata) *Metadata {
+	if existing == nil {
+		out := *incoming
+		out.FirstSeen = incoming.Timestamp
+		return &out
+	}
+
+	first := existing.FirstSeen
+	if first.IsZero() {
+		first = existing.Timestamp
+	}
+
+	existingHash, incomingHash := contentHash(existing), contentHash(incoming)
+	if existingHash == incomingHash {
+		newFirst, newLast := first, existing.Timestamp
+		if incoming.Timestamp.Before(newFirst) {
+			newFirst = incoming.Timestamp
+		}
+		if incoming.Timestamp.After(newLast) {
+			newLast = incoming.Timestamp
+		}
+		if !existing.FirstSeen.IsZero() && newFirst.Equal(existing.FirstSeen) && newLast.Equal(existing.Timestamp) {
+			return nil
+		}
+		out := *existing
+		out.FirstSeen = newFirst
+		out.Timestamp = newLast
+		return &out
+	}
+
+	// Different content: the newest observation wins
+	if incoming.Timestamp.Before(existing.Timestamp) ||
+		(incoming.Timestamp.Equal(existing.Timestamp) && incomingHash < existingHash) {
+		// A late, older sighting by the same owner still counts toward when they were first seen
+		if !strings.EqualFold(existing.User, incoming.User) || !incoming.Timestamp.Before(first) {
+			return nil
+		}
+		out := *existing
+		out.FirstSeen = incoming.Timestamp
+		return &out
+	}
+
+	out := *incoming
+	out.FirstSeen = incoming.Timestamp
+	if strings.EqualFold(existing.User, incoming.User) {
+		if first.Before(out.FirstSeen) {
+			out.FirstSeen = first
+		}
+		out.LastUsed = existing.LastUsed
+		out.Historical = existing.Historical
+	}
+	return &out
+}
+
+// RemoveDuplicates deletes the records of key lines that collect.DedupeKeys dropped from a user's
+// keys, so re-loading files with duplicates cleans up what earlier loads stored. A line is only
+// removed while user still owns it, and the fingerprint index is repointed by storing the kept line.
+// Removed records are taken out of the rollups. It returns the number of records removed.
+func (k *KeyDB) RemoveDuplicates(user string, lines []string) (int, error) {
+	removed := 0
+	err := checkSpace(k.update(func(txn *badger.Txn) error {
+		for _, line := range lines {
+			md, err := getMetadata(txn, []byte(line))
+			if err != nil {
+				return err
+			}
+			if md == nil || !strings.EqualFold(md.User, user) {
+				continue
+			}
+			if err := txn.Delete([]byte(line)); err != nil {
+				return err
+			}
+			if err := txn.Delete(userKey(md.User, line)); err != nil {
+				return err
+			}
+			if err := uncountKey(txn, line, md); err != nil {
+				return err
+			}
+			removed++
+		}
+		if removed == 0 {
+			return nil
+		}
+		return uncountUser(txn, user)
+	}))
+	return removed, err
+}
@@ -0,0 +1,314 @@
+package keydb
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// randomObservation returns a sighting of one key drawn from a small space, so collisions in
+// content and timestamp are common
+func randomObservation(r *rand.Rand, owners []string, base time.Time) *Metadata {
+	md := &Metadata{
+		User:      owners[r.Intn(len(owners))],
+		Repo:      []string{"", "org/a", "org/b"}[r.Intn(3)],
+		Source:    []string{"github-org", "github-events"}[r.Intn(2)],
+		Timestamp: base.Add(time.Duration(r.Intn(5)) * time.Hour),
+	}
+	if r.Intn(4) == 0 {
+		md.Flags = []string{FlagBlocked}
+	}
+	return md
+}
+
+// fold merges observations in order, as a series of Store calls would
+func fold(obs []*Metadata) *Metadata {
+	var md *Metadata
+	for _, o := range obs {
+		if merged := merge(md, o); merged != nil {
+			md = merged
+		}
+	}
+	return md
+}
+
+func TestMergeOrderIndependent(t *testing.T) {
+	base := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, owners := range [][]string{{"ada"}, {"ada", "grace"}} {
+		t.Run(strings.Join(owners, ","), func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 500; i++ {
+				obs := make([]*Metadata, 1+r.Intn(6))
+				for j := range obs {
+					obs[j] = randomObservation(r, owners, base)
+				}
+				want := fold(obs)
+
+				for p := 0; p < 5; p++ {
+					shuffled := append([]*Metadata(nil), obs...)
+					r.Shuffle(len(shuffled), func(a, b int) { shuffled[a], shuffled[b] = shuffled[b], shuffled[a] })
+					got := fold(shuffled)
+					if len(owners) > 1 {
+						// FirstSeen depends on arrival order once a key changes hands
+						got.FirstSeen = want.FirstSeen
+					}
+					if !reflect.DeepEqual(got, want) {
+						t.Fatalf("observations %s merged to %+v\nbut in order %s merged to %+v", describe(obs), want, describe(shuffled), got)
+					}
+				}
+
+				latest := obs[0].Timestamp
+				earliest := obs[0].Timestamp
+				for _, o := range obs {
+					latest = maxTime(latest, o.Timestamp)
+					if strings.EqualFold(o.User, want.User) && o.Timestamp.Before(earliest) {
+						earliest = o.Timestamp
+					}
+				}
+				if !want.Timestamp.Equal(latest) {
+					t.Fatalf("observations %s merged to Timestamp %s, want the latest, %s", describe(obs), want.Timestamp, latest)
+				}
+				if len(owners) == 1 && !want.FirstSeen.Equal(earliest) {
+					t.Fatalf("observations %s merged to FirstSeen %s, want the earliest, %s", describe(obs), want.FirstSeen, earliest)
+				}
+				// Storing an observation twice in a row is a no-op. While the key has had one owner,
+				// so is storing any earlier observation again.
+				var md *Metadata
+				for _, o := range obs {
+					if merged := merge(md, o); merged != nil {
+						md = merged
+					}
+					if again := merge(md, o); again != nil {
+						t.Fatalf("merging %s twice changed %+v to %+v", describe([]*Metadata{o}), md, again)
+					}
+				}
+				for _, o := range obs {
+					if again := merge(want, o); len(owners) == 1 && again != nil {
+						t.Fatalf("re-merging %s into %+v changed it to %+v", describe([]*Metadata{o}), want, again)
+					}
+				}
+			}
+		})
+	}
+}
+
+// describe summarizes observations for failure messages
+func describe(obs []*Metadata) string {
+	var parts []string
+	for _, o := range obs {
+		parts = append(parts, fmt.Sprintf("{%s %q %s %v %s}", o.User, o.Repo, o.Source, o.Flags, o.Timestamp.Format("15:04")))
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// dumpDB returns every live record in db
+func dumpDB(t *testing.T, db *KeyDB) map[string]string {
+	t.Helper()
+	out := map[string]string{}
+	err := db.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			out[string(it.Item().Key())] = string(val)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	return out
+}
+
+func TestStoreIdempotent(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		user collect.UserInfo
+	}{
+		{name: "keys", user: collect.UserInfo{Username: "ada", Repo: "org/a", Source: "github-org", PublicKeys: []string{testKey(t, 1), testKey(t, 2)}}},
+		{name: "signing", user: collect.UserInfo{Username: "ada", Source: "github-org", PublicKeys: []string{testKey(t, 1)}, SigningKeys: []string{testKey(t, 1), testKey(t, 3)}}},
+		{name: "created", user: collect.UserInfo{Username: "Ada", PublicKeys: []string{testKey(t, 4)}, KeyCreatedAt: map[string]time.Time{testKey(t, 4): at.Add(-time.Hour)}}},
+		{name: "malformed", user: collect.UserInfo{Username: "ada", PublicKeys: []string{"ssh-rsa " + strings.Fields(testKey(t, 5))[1] + " ada"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if err := db.Store(tt.user, tt.user.Username, at); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			want := dumpDB(t, db)
+			for i := 0; i < 3; i++ {
+				if err := db.Store(tt.user, tt.user.Username, at); err != nil {
+					t.Fatalf("Store again: %v", err)
+				}
+			}
+			if got := dumpDB(t, db); !reflect.DeepEqual(got, want) {
+				t.Errorf("storing the same observation again changed the database:\nbefore %v\nafter  %v", want, got)
+			}
+			if n := db.Counts()["keys_written"]; n != len(tt.user.PublicKeys)+len(tt.user.SigningKeys)-overlap(tt.user) {
+				t.Errorf("keys_written = %d after repeated stores, want only the first store's writes", n)
+			}
+		})
+	}
+}
+
+// overlap counts keys listed as both authentication and signing keys, which are stored once
+func overlap(u collect.UserInfo) int {
+	n := 0
+	for _, s := range u.SigningKeys {
+		for _, p := range u.PublicKeys {
+			if s == p {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestStoreOrderIndependent(t *testing.T) {
+	base := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	key := testKey(t, 1)
+	type store struct {
+		user collect.UserInfo
+		at   time.Time
+	}
+	stores := []store{
+		{collect.UserInfo{Username: "ada", Repo: "org/a", Source: "github-org", PublicKeys: []string{key}}, base},
+		{collect.UserInfo{Username: "ada", Repo: "org/b", Source: "github-events", PublicKeys: []string{key}}, base.Add(2 * time.Hour)},
+		{collect.UserInfo{Username: "ada", Repo: "org/a", Source: "github-org", PublicKeys: []string{key}}, base.Add(time.Hour)},
+		{collect.UserInfo{Username: "ada", Repo: "org/b", Source: "github-events", PublicKeys: []string{key}}, base.Add(2 * time.Hour)},
+	}
+
+	var want *Metadata
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		db := newTestDB(t)
+		for _, j := range r.Perm(len(stores)) {
+			if err := db.Store(stores[j].user, stores[j].user.Username, stores[j].at); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+		}
+		got, err := db.Lookup(key)
+		if err != nil {
+			t.Fatalf("Lookup: %v", err)
+		}
+		if got.Repo != "org/b" || !got.Timestamp.Equal(base.Add(2*time.Hour)) || !got.FirstSeen.Equal(base) {
+			t.Errorf("stored %+v, want org/b last seen at +2h and first seen at the start", got)
+		}
+		got.Provenance = Provenance{}
+		if want == nil {
+			want = got
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("order %d stored %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+// dedupeSink stores users the way pubkey-db-load does, deduping each file and removing what earlier loads stored for dropped lines
+type dedupeSink struct {
+	loadSink
+	deduped, removed int
+}
+
+func (s *dedupeSink) Add(ctx context.Context, user *collect.UserInfo) error {
+	dropped, n := collect.DedupeKeys(user)
+	s.deduped += n
+	if err := s.loadSink.Add(ctx, user); err != nil {
+		return err
+	}
+	removed, err := s.db.RemoveDuplicates(user.Username, dropped)
+	s.removed += removed
+	return err
+}
+
+func TestReloadRemovesDuplicates(t *testing.T) {
+	db := newTestDB(t)
+	src := &collect.DirSource{Path: "testdata/duplicates"}
+
+	// Loads from before deduplication stored every distinct line
+	if err := src.Collect(context.Background(), &loadSink{db: db}); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	keys, err := db.UserKeys("ada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("first load stored %d keys, want 3", len(keys))
+	}
+
+	sink := &dedupeSink{loadSink: loadSink{db: db}}
+	if err := src.Collect(context.Background(), sink); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if sink.deduped != 2 || sink.removed != 1 {
+		t.Errorf("reload deduped %d lines and removed %d records, want 2 and 1", sink.deduped, sink.removed)
+	}
+	keys, err = db.UserKeys("ada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for key := range keys {
+		lines = append(lines, strings.Fields(key)[2])
+	}
+	slices.Sort(lines)
+	if want := []string{"ada@desktop", "ada@work"}; !slices.Equal(lines, want) {
+		t.Errorf("after reload, stored comments %q, want %q", lines, want)
+	}
+
+	// The fingerprint index follows the kept line
+	md, err := db.Lookup(ssh.FingerprintSHA256(mustParse(t, testKey(t, 1))))
+	if err != nil || md.User != "ada" {
+		t.Fatalf("Lookup by fingerprint = %+v, %v", md, err)
+	}
+	if _, err := db.Lookup(testKey(t, 1) + " ada@laptop"); err != nil {
+		t.Errorf("Lookup of the removed line by its key: %v", err)
+	}
+
+	// The removed record no longer counts toward the rollups
+	got, err := db.Rollups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.BackfillRollups(context.Background()); err != nil {
+		t.Fatalf("BackfillRollups: %v", err)
+	}
+	want, err := db.Rollups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) || len(got) != 1 || got[0].NewKeys != 2 || got[0].NewUsers != 1 {
+		t.Errorf("rollups after the reload:\ngot  %s\nwant %s, with 2 keys and 1 user", describeRollups(got), describeRollups(want))
+	}
+
+	// Reloading again finds nothing left to remove
+	sink = &dedupeSink{loadSink: loadSink{db: db}}
+	if err := src.Collect(context.Background(), sink); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if sink.removed != 0 {
+		t.Errorf("third load removed %d records, want 0", sink.removed)
+	}
+}
@@ -0,0 +1,339 @@
+package keydb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// migrateFile holds a MigrationRequest in the directory of the database to be moved
+const migrateFile = "pubkey-collector.migrate"
+
+const (
+	// pauseGateWait bounds how long a read or write started while MigratePath is pausing is held
+	// back. Holding it back lets in-flight calls drain; the bound lets a call made from inside
+	// another, such as a ForEachKey callback, proceed rather than wait on itself.
+	pauseGateWait = time.Second
+	// migratePollInterval is how often AwaitMigration checks on a request.
+	migratePollInterval = time.Second
+)
+
+var (
+	// migratePauseWait bounds how long MigratePath waits for in-flight reads and writes to finish
+	// so it can pause them; it gives up, leaving the database where it was, rather than wait longer.
+	// Tests shorten it.
+	migratePauseWait = 30 * time.Second
+	// migrateCopy makes each of MigratePath's copies; tests replace it to fail or lose records partway.
+	migrateCopy = copyDelta
+)
+
+// MigrationInfo describes a database moved by MigratePath
+type MigrationInfo struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Sequence is the last commit copied before the switch.
+	Sequence uint64 `json:"sequence"`
+	// Passes counts the copies made: the full copy, then one per batch of writes made since.
+	Passes int `json:"passes"`
+	// Records counts the entries of each Record type, which matched in both databases at the switch.
+	Records map[string]int `json:"records"`
+	// Paused is how long reads and writes waited for the final delta, check and switch.
+	Paused   time.Duration `json:"paused"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+}
+
+// MigratePath moves the open database to a new directory at dest without closing it. It copies
+// the database from one snapshot while reads and writes continue, then copies the writes made
+// meanwhile. It then holds back new reads and writes until those in flight finish, copies the
+// last writes, checks that both databases hold the same number of records of every type and
+// switches to the new database, closing the old one but leaving its files in place.
+//
+// dest must not exist or be empty. If anything fails before the switch, dest is removed and the
+// KeyDB carries on with its original database, which MigratePath never writes to.
+func (k *KeyDB) MigratePath(dest string) (info *MigrationInfo, err error) {
+	if k.readOnly {
+		return nil, errors.New("database is open read-only")
+	}
+	if !k.migrating.TryLock() {
+		return nil, errors.New("a migration is already in progress")
+	}
+	defer k.migrating.Unlock()
+
+	// Only MigratePath replaces db and path, so they can be read without swap here
+	from, src := k.path, k.db
+	same, err := samePath(from, dest)
+	if err != nil {
+		return nil, err
+	}
+	if same {
+		return nil, fmt.Errorf("%s is the current database location", dest)
+	}
+	if entries, err := os.ReadDir(dest); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", dest)
+	}
+
+	info = &MigrationInfo{From: from, To: dest, Started: k.clock.Now()}
+	next, err := NewWithProfile(dest, k.profile)
+	if err != nil {
+		return nil, err
+	}
+	switched := false
+	defer func() {
+		if switched {
+			return
+		}
+		next.db.Close()
+		os.RemoveAll(dest)
+	}()
+
+	drops := k.drops.Load()
+	if info.Sequence, err = migrateCopy(src, next.db, 0); err != nil {
+		return nil, err
+	}
+	// Catch up with the writes made during the full copy, so the pause only covers the last few
+	seq, err := migrateCopy(src, next.db, info.Sequence)
+	if err != nil {
+		return nil, err
+	}
+	info.Sequence = max(info.Sequence, seq)
+	info.Passes += 2
+
+	paused := time.Now()
+	resume := make(chan struct{})
+	k.pausing.Store(&resume)
+	release := sync.OnceFunc(func() {
+		k.pausing.Store(nil)
+		close(resume)
+	})
+	defer release()
+	for !k.swap.TryLock() {
+		if time.Since(paused) > migratePauseWait {
+			return nil, fmt.Errorf("reads and writes did not pause within %s; %s is unchanged", migratePauseWait, from)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := k.finishMigration(src, next.db, info, drops); err != nil {
+		k.swap.Unlock()
+		return nil, err
+	}
+	k.db, k.path = next.db, dest
+	k.swap.Unlock()
+	release()
+	switched = true
+	info.Paused = time.Since(paused)
+	info.Finished = k.clock.Now()
+
+	if err := writeOwner(dest, k.owner); err != nil {
+		return info, fmt.Errorf("record database owner: %w", err)
+	}
+	if err := src.Close(); err != nil {
+		return info, fmt.Errorf("close %s: %w", from, err)
+	}
+	if err := os.Remove(filepath.Join(from, ownerFile)); err != nil && !os.IsNotExist(err) {
+		return info, fmt.Errorf("remove %s: %w", ownerFile, err)
+	}
+	return info, nil
+}
+
+// finishMigration copies the last writes from src to dst and checks that they hold the same
+// records, while the caller holds swap so that nothing else reads or writes src
+func (k *KeyDB) finishMigration(src, dst *badger.DB, info *MigrationInfo, drops int64) error {
+	seq, err := migrateCopy(src, dst, info.Sequence)
+	if err != nil {
+		return err
+	}
+	info.Sequence = max(info.Sequence, seq)
+	info.Passes++
+	if k.drops.Load() != drops {
+		return errors.New("records were dropped during the copy (rollups were rebuilt); run the migration again")
+	}
+
+	want, err := countRecords(src)
+	if err != nil {
+		return err
+	}
+	got, err := countRecords(dst)
+	if err != nil {
+		return err
+	}
+	if !maps.Equal(want, got) {
+		return fmt.Errorf("record counts differ after copying: %s has %v, the copy has %v", info.From, want, got)
+	}
+	info.Records = want
+	return nil
+}
+
+// countRecords counts the entries in db by Record type
+func countRecords(db *badger.DB) (map[string]int, error) {
+	counts := map[string]int{}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			counts[recordType(it.Item().Key())]++
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// samePath reports whether a and b name the same directory
+func samePath(a, b string) (bool, error) {
+	aa, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	bb, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return aa == bb, nil
+}
+
+// MigrationRequest asks the process that has a database open to move it with MigratePath. It is
+// written to the database directory by RequestMigration and completed there by ServeMigration.
+type MigrationRequest struct {
+	Dest      string    `json:"dest"`
+	Requested time.Time `json:"requested"`
+	// Finished is set once the migration succeeded or failed, with Error if it failed.
+	Finished *time.Time     `json:"finished,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Info     *MigrationInfo `json:"info,omitempty"`
+}
+
+// AcceptMigrations records in the database directory that this process serves MigrationRequests,
+// so that RequestMigration will signal it. The caller must call ServeMigration on that signal.
+func (k *KeyDB) AcceptMigrations() error {
+	k.swap.Lock()
+	defer k.swap.Unlock()
+
+	k.owner.Migrates = true
+	return writeOwner(k.path, k.owner)
+}
+
+// ServeMigration carries out the MigrationRequest in the database directory, if there is one that
+// hasn't finished, and records its outcome there. It returns the request, or nil if there was none.
+func (k *KeyDB) ServeMigration() (*MigrationRequest, error) {
+	k.swap.RLock()
+	dir := k.path
+	k.swap.RUnlock()
+
+	req, err := readMigrationRequest(dir)
+	if err != nil || req == nil || req.Finished != nil {
+		return nil, err
+	}
+	req.Info, err = k.MigratePath(req.Dest)
+	finished := k.clock.Now()
+	req.Finished = &finished
+	if err != nil {
+		req.Error = err.Error()
+	}
+	if werr := writeMigrationRequest(dir, req); werr != nil {
+		return req, errors.Join(err, werr)
+	}
+	return req, err
+}
+
+// RequestMigration asks the live process that has the database in dir open to move it to dest,
+// returning the process's pid for AwaitMigration. The process must be on this host and have called
+// AcceptMigrations, as a running pubkey-collector does.
+func RequestMigration(dir, dest string) (int, error) {
+	o, err := readOwner(dir)
+	if err != nil {
+		return 0, err
+	}
+	host, _ := os.Hostname()
+	switch {
+	case o == nil:
+		return 0, fmt.Errorf("no process has %s open", dir)
+	case o.Host != host:
+		return 0, fmt.Errorf("%s is open on %s; run the migration there", dir, o.Host)
+	case !processAlive(o.PID):
+		return 0, fmt.Errorf("pid %d, which had %s open, is no longer running", o.PID, dir)
+	case !o.Migrates:
+		return 0, fmt.Errorf("pid %d has %s open but doesn't accept migration requests; stop it and migrate offline", o.PID, dir)
+	}
+
+	prev, err := readMigrationRequest(dir)
+	if err != nil {
+		return 0, err
+	}
+	if prev != nil && prev.Finished == nil {
+		return 0, fmt.Errorf("a migration to %s was already requested at %s", prev.Dest, prev.Requested.Format(time.RFC3339))
+	}
+	if err := writeMigrationRequest(dir, &MigrationRequest{Dest: dest, Requested: time.Now()}); err != nil {
+		return 0, err
+	}
+	return o.PID, signalMigration(o.PID)
+}
+
+// AwaitMigration waits for the process pid to finish the migration requested with RequestMigration,
+// returning the finished request, with an error if the migration failed or the process exited first.
+func AwaitMigration(ctx context.Context, dir string, pid int) (*MigrationRequest, error) {
+	t := time.NewTicker(migratePollInterval)
+	defer t.Stop()
+	for {
+		req, err := readMigrationRequest(dir)
+		if err != nil {
+			return nil, err
+		}
+		if req == nil {
+			return nil, fmt.Errorf("the migration request in %s disappeared", dir)
+		}
+		if req.Finished != nil {
+			if req.Error != "" {
+				return req, errors.New(req.Error)
+			}
+			return req, nil
+		}
+		if !processAlive(pid) {
+			return req, fmt.Errorf("pid %d exited before finishing the migration", pid)
+		}
+		select {
+		case <-ctx.Done():
+			return req, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// readMigrationRequest returns the MigrationRequest in dir, or nil if there is none
+func readMigrationRequest(dir string) (*MigrationRequest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, migrateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var req MigrationRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", migrateFile, err)
+	}
+	return &req, nil
+}
+
+// writeMigrationRequest replaces the MigrationRequest in dir, atomically so readers never see part of one
+func writeMigrationRequest(dir string, req *MigrationRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, migrateFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, migrateFile))
+}
@@ -0,0 +1,195 @@
+package keydb
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// storeUser stores testKey(n) for user n
+func storeUser(t testing.TB, db *KeyDB, n int) error {
+	user := fmt.Sprintf("user%d", n)
+	return db.Store(collect.UserInfo{Username: user, PublicKeys: []string{testKey(t, n)}}, user, time.Time{})
+}
+
+// checkUsers fails t unless users 0 to n-1 all have their key in db
+func checkUsers(t *testing.T, db *KeyDB, n int) {
+	t.Helper()
+	for i := range n {
+		md, err := db.Lookup(testKey(t, i))
+		if err != nil || md.User != fmt.Sprintf("user%d", i) {
+			t.Fatalf("Lookup(user%d's key) = %+v, %v", i, md, err)
+		}
+	}
+}
+
+func TestMigratePath(t *testing.T) {
+	db := newTestDB(t)
+	from := db.path
+	const stored = 200
+	for i := range stored {
+		if err := storeUser(t, db, i); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	// Keep writing throughout, as collection would
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var written int
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for written = stored; ; written++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := storeUser(t, db, written); err != nil {
+				t.Errorf("Store during migration: %v", err)
+				return
+			}
+		}
+	}()
+
+	dest := filepath.Join(t.TempDir(), "moved")
+	info, err := db.MigratePath(dest)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("MigratePath: %v", err)
+	}
+	if db.path != dest || info.From != from || info.To != dest || info.Passes < 3 {
+		t.Errorf("after MigratePath the database is at %s, info %+v; want it at %s", db.path, info, dest)
+	}
+	if info.Records[RecordKey] < stored {
+		t.Errorf("copied %d keys, want at least %d", info.Records[RecordKey], stored)
+	}
+	checkUsers(t, db, written)
+	if _, err := os.Stat(filepath.Join(from, ownerFile)); !os.IsNotExist(err) {
+		t.Errorf("the old directory still names an owner: %v", err)
+	}
+	if _, err := db.MigratePath(dest); err == nil {
+		t.Error("migrating to the current location succeeded")
+	}
+}
+
+func TestMigratePathFailure(t *testing.T) {
+	defer func(wait time.Duration) { migratePauseWait = wait }(migratePauseWait)
+	defer func() { migrateCopy = copyDelta }()
+	migratePauseWait = 50 * time.Millisecond
+
+	crash := errors.New("volume unplugged")
+	tests := []struct {
+		name string
+		// copy replaces migrateCopy for pass n of MigratePath, counting from 0
+		copy func(pass int, src, dst *badger.DB, since uint64) (uint64, error)
+		// holdReads keeps a read in flight throughout, so writes can't be paused
+		holdReads bool
+		wantErr   string
+	}{
+		{name: "crash during the full copy", copy: func(pass int, src, dst *badger.DB, since uint64) (uint64, error) {
+			if pass == 0 {
+				return 0, crash
+			}
+			return copyDelta(src, dst, since)
+		}, wantErr: crash.Error()},
+		{name: "crash after the full copy", copy: func(pass int, src, dst *badger.DB, since uint64) (uint64, error) {
+			seq, err := copyDelta(src, dst, since)
+			if pass == 1 {
+				return 0, crash
+			}
+			return seq, err
+		}, wantErr: crash.Error()},
+		{name: "crash during the final copy", copy: func(pass int, src, dst *badger.DB, since uint64) (uint64, error) {
+			if pass == 2 {
+				return 0, crash
+			}
+			return copyDelta(src, dst, since)
+		}, wantErr: crash.Error()},
+		{name: "record counts differ", copy: func(pass int, src, dst *badger.DB, since uint64) (uint64, error) {
+			seq, err := copyDelta(src, dst, since)
+			if err != nil || pass < 2 {
+				return seq, err
+			}
+			// Lose one stored key from the copy
+			return seq, dst.Update(func(txn *badger.Txn) error {
+				it := txn.NewIterator(badger.DefaultIteratorOptions)
+				defer it.Close()
+				for it.Rewind(); it.Valid(); it.Next() {
+					if recordType(it.Item().Key()) == RecordKey {
+						return txn.Delete(it.Item().KeyCopy(nil))
+					}
+				}
+				return errors.New("no key to lose")
+			})
+		}, wantErr: "record counts differ"},
+		{name: "pause timeout", holdReads: true, wantErr: "did not pause"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			from := db.path
+			const stored = 20
+			for i := range stored {
+				if err := storeUser(t, db, i); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+			before, err := countRecords(db.db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			migrateCopy = copyDelta
+			if tt.copy != nil {
+				pass := 0
+				migrateCopy = func(src, dst *badger.DB, since uint64) (uint64, error) {
+					defer func() { pass++ }()
+					return tt.copy(pass, src, dst, since)
+				}
+			}
+			if tt.holdReads {
+				db.swap.RLock()
+			}
+			dest := filepath.Join(t.TempDir(), "moved")
+			_, err = db.MigratePath(dest)
+			if tt.holdReads {
+				db.swap.RUnlock()
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("MigratePath error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+
+			// The original stays authoritative and intact, and the copy is gone
+			if _, err := os.Stat(dest); !os.IsNotExist(err) {
+				t.Errorf("failed migration left %s behind: %v", dest, err)
+			}
+			if db.path != from {
+				t.Errorf("database moved to %s despite the failure", db.path)
+			}
+			after, err := countRecords(db.db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(before, after) {
+				t.Errorf("original records changed from %v to %v", before, after)
+			}
+			checkUsers(t, db, stored)
+			if err := storeUser(t, db, stored); err != nil {
+				t.Fatalf("Store after the failed migration: %v", err)
+			}
+			checkUsers(t, db, stored+1)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package keydb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+)
+
+// Profile names a set of Badger options tuned for one workload.
+//
+// The figures below are medians of three runs of BenchmarkBulkLoad (users with two keys each, stored
+// one at a time as pubkey-db-load does, about 40,000 per run) and BenchmarkLookup (by fingerprint,
+// among 20,000 keys) on a single-CPU Linux VM:
+//
+//	go test ./pkg/keydb -run '^$' -bench . -benchtime 2s -count 3
+//
+// Both data sets fit in every profile's caches, so lookups show per-read overhead rather than cache
+// misses. Runs varied by up to half, so only the larger gaps are meaningful.
+type Profile string
+
+const (
+	// ProfileBalanced is Badger's defaults, suited to the collector's mix of writes and lookups:
+	// 14,000 users/s loaded, 19µs per lookup
+	ProfileBalanced Profile = "balanced"
+	// ProfileBulkLoad favors write throughput: large memtables, more compactors, no compression.
+	// 15,300 users/s loaded, 21µs per lookup
+	ProfileBulkLoad Profile = "bulk-load"
+	// ProfileReadHeavy favors lookups: a large block and index cache. 11,700 users/s loaded, 10µs
+	// per lookup, the fastest and steadiest
+	ProfileReadHeavy Profile = "read-heavy"
+	// ProfileLowMemory keeps memory use small at the cost of throughput: 4,900 users/s loaded, a
+	// third of bulk-load, and 15µs per lookup
+	ProfileLowMemory Profile = "low-memory"
+)
+
+// Profiles lists the supported profiles
+var Profiles = []Profile{ProfileBalanced, ProfileBulkLoad, ProfileReadHeavy, ProfileLowMemory}
+
+// ParseProfile returns the profile with the given name
+func ParseProfile(name string) (Profile, error) {
+	for _, p := range Profiles {
+		if string(p) == name {
+			return p, nil
+		}
+	}
+	names := make([]string, len(Profiles))
+	for i, p := range Profiles {
+		names[i] = string(p)
+	}
+	return "", fmt.Errorf("unknown database profile %q (want one of %s)", name, strings.Join(names, ", "))
+}
+
+// options returns the Badger options for a profile. Metadata values are a few hundred bytes, so every
+// profile keeps them in the LSM tree (Badger's default ValueThreshold) rather than the value log.
+func (p Profile) options(path string) badger.Options {
+	opts := badger.DefaultOptions(path)
+	switch p {
+	case ProfileBulkLoad:
+		return opts.
+			WithMemTableSize(256 << 20).
+			WithNumCompactors(8).
+			WithNumLevelZeroTables(10).
+			WithNumLevelZeroTablesStall(30).
+			WithBlockCacheSize(64 << 20).
+			WithCompression(options.None)
+	case ProfileReadHeavy:
+		return opts.
+			WithMemTableSize(32 << 20).
+			WithNumCompactors(2).
+			WithBlockCacheSize(1 << 30).
+			WithIndexCacheSize(256 << 20).
+			WithCompression(options.Snappy)
+	case ProfileLowMemory:
+		return opts.
+			WithMemTableSize(8 << 20).
+			WithNumMemtables(2).
+			WithNumCompactors(2).
+			WithNumLevelZeroTables(2).
+			WithNumLevelZeroTablesStall(5).
+			WithBlockCacheSize(16 << 20).
+			WithIndexCacheSize(8 << 20).
+			WithCompression(options.ZSTD).
+			WithValueThreshold(1 << 10)
+	default:
+		return opts
+	}
+}
@@ -0,0 +1,82 @@
+package keydb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// benchUsers returns n users with two keys each, as a load of collected JSON would store them
+func benchUsers(b *testing.B, n int) []collect.UserInfo {
+	b.Helper()
+	users := make([]collect.UserInfo, n)
+	for i := range users {
+		login := fmt.Sprintf("user%d", i)
+		users[i] = collect.UserInfo{Username: login, Source: "github-org", PublicKeys: []string{testKey(b, 2*i), testKey(b, 2*i+1)}}
+	}
+	return users
+}
+
+// openProfile opens a database with profile in a temporary directory, closed when the benchmark ends
+func openProfile(b *testing.B, p Profile) *KeyDB {
+	b.Helper()
+	db, err := NewWithProfile(b.TempDir(), p)
+	if err != nil {
+		b.Fatalf("NewWithProfile(%s): %v", p, err)
+	}
+	b.Cleanup(func() { db.Close() })
+	return db
+}
+
+// BenchmarkBulkLoad stores users one at a time, as pubkey-db-load does, under each profile
+func BenchmarkBulkLoad(b *testing.B) {
+	at := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, p := range Profiles {
+		b.Run(string(p), func(b *testing.B) {
+			users := benchUsers(b, b.N)
+			db := openProfile(b, p)
+			b.ResetTimer()
+			for i := range b.N {
+				if err := db.Store(users[i], users[i].Username, at); err != nil {
+					b.Fatalf("Store: %v", err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "users/s")
+		})
+	}
+}
+
+// BenchmarkLookup looks up stored keys by SHA256 fingerprint under each profile
+func BenchmarkLookup(b *testing.B) {
+	const stored = 10000
+	at := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	users := benchUsers(b, stored)
+	var fps []string
+	for _, u := range users {
+		for _, key := range u.PublicKeys {
+			fp, err := Fingerprint(key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			fps = append(fps, fp)
+		}
+	}
+	for _, p := range Profiles {
+		b.Run(string(p), func(b *testing.B) {
+			db := openProfile(b, p)
+			for _, u := range users {
+				if err := db.Store(u, u.Username, at); err != nil {
+					b.Fatalf("Store: %v", err)
+				}
+			}
+			b.ResetTimer()
+			for i := range b.N {
+				if _, err := db.Lookup(fps[i%len(fps)]); err != nil {
+					b.Fatalf("Lookup: %v", err)
+				}
+			}
+		})
+	}
+}
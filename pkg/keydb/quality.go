@@ -0,0 +1,143 @@
+package keydb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// Caveat codes, stable for machine consumers of lookups and reports
+const (
+	// CaveatStale marks keys not seen on GitHub for longer than the stale age.
+	CaveatStale = "stale"
+	// CaveatSingleSource marks keys seen in only one collection, never confirmed by a later fetch.
+	CaveatSingleSource = "single_source"
+	// CaveatSharedKey marks keys that merged data attributed to more than one user.
+	CaveatSharedKey = "shared_key"
+	// CaveatImported marks keys whose history comes from an imported dataset rather than collection.
+	CaveatImported = "imported"
+	// CaveatAccountDeleted marks keys whose owner was no longer found on GitHub after the key was seen.
+	CaveatAccountDeleted = "account_deleted"
+)
+
+// DefaultStaleAfter is how long since a key was last seen before it is CaveatStale, unless configured
+const DefaultStaleAfter = 365 * 24 * time.Hour
+
+// Caveat is a reason not to take an attribution at face value
+type Caveat struct {
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+	// Quality is the most an attribution with this caveat can be trusted, from 0 to 1.
+	Quality float64 `json:"quality"`
+}
+
+// String returns the caveat as "code (detail)"
+func (c Caveat) String() string {
+	return c.Code + " (" + c.Detail + ")"
+}
+
+// Quality returns how far an attribution with caveats can be trusted, from 0 to 1: the lowest Quality
+// of its caveats, or 1 if it has none.
+func Quality(caveats []Caveat) float64 {
+	q := 1.0
+	for _, c := range caveats {
+		q = min(q, c.Quality)
+	}
+	return q
+}
+
+// CaveatCodes returns the codes of caveats, in order
+func CaveatCodes(caveats []Caveat) []string {
+	codes := make([]string, 0, len(caveats))
+	for _, c := range caveats {
+		codes = append(codes, c.Code)
+	}
+	return codes
+}
+
+// Caveats returns what a stored key's record leaves uncertain about its attribution, derived from its
+// provenance and the conflict and skip records around it. Keys last seen longer than staleAfter ago
+// are stale; zero means DefaultStaleAfter. Every tool explaining an attribution should use this, so
+// they all report the same codes.
+func (k *KeyDB) Caveats(md *Metadata, staleAfter time.Duration) ([]Caveat, error) {
+	var caveats []Caveat
+	err := k.view(func(txn *badger.Txn) error {
+		var err error
+		caveats, err = k.caveats(txn, md, staleAfter)
+		return err
+	})
+	return caveats, err
+}
+
+// caveats computes Caveats within txn
+func (k *KeyDB) caveats(txn *badger.Txn, md *Metadata, staleAfter time.Duration) ([]Caveat, error) {
+	if staleAfter == 0 {
+		staleAfter = DefaultStaleAfter
+	}
+	var caveats []Caveat
+
+	if age := k.clock.Now().Sub(md.Timestamp); age > staleAfter {
+		caveats = append(caveats, Caveat{Code: CaveatStale, Quality: 0.5,
+			Detail: fmt.Sprintf("last seen %d days ago, %s", int(age.Hours()/24), md.Timestamp.Format("2006-01-02"))})
+	}
+
+	if md.Historical != nil {
+		h := md.Historical
+		detail := fmt.Sprintf("history from dataset %s at confidence %.2f", h.Dataset, h.Confidence)
+		if h.Source != "" {
+			detail += ", source " + h.Source
+		}
+		caveats = append(caveats, Caveat{Code: CaveatImported, Quality: h.Confidence, Detail: detail})
+	} else if !md.Timestamp.After(md.FirstSeen) {
+		detail := "seen once, " + md.Timestamp.Format("2006-01-02")
+		if md.Source != "" {
+			detail += " from " + md.Source
+		}
+		if md.KeysVia != "" {
+			detail += " via " + md.KeysVia
+		}
+		caveats = append(caveats, Caveat{Code: CaveatSingleSource, Quality: 0.7, Detail: detail})
+	}
+
+	if md.Fingerprint != "" {
+		c, err := getConflict(txn, md.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil && (c.Resolution == nil || c.Resolution.Decision == ResolutionKeepBoth) {
+			var others []string
+			for _, s := range c.Sides {
+				if !strings.EqualFold(s.User, md.User) {
+					others = append(others, s.User)
+				}
+			}
+			cv := Caveat{Code: CaveatSharedKey, Quality: 0.3, Detail: "also attributed to " + strings.Join(others, ", ") + ", unresolved"}
+			if c.Resolution != nil {
+				cv.Quality, cv.Detail = 0.6, "also attributed to "+strings.Join(others, ", ")+", both kept by "+c.Resolution.By
+			}
+			caveats = append(caveats, cv)
+		}
+	}
+
+	item, err := txn.Get(skipKey(md.User))
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		var skip SkipRecord
+		if err := item.Value(func(val []byte) error { return json.Unmarshal(val, &skip) }); err != nil {
+			return nil, err
+		}
+		if skip.Reason == collect.SkipNotFound && skip.Timestamp.After(md.Timestamp) {
+			caveats = append(caveats, Caveat{Code: CaveatAccountDeleted, Quality: 0,
+				Detail: fmt.Sprintf("%s not found on GitHub at %s", md.User, skip.Timestamp.Format("2006-01-02"))})
+		}
+	}
+	return caveats, nil
+}
@@ -0,0 +1,109 @@
+package keydb
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+func TestCaveats(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	key := testKey(t, 1)
+	day := 24 * time.Hour
+	// store records sightings of key by user at each age before now
+	store := func(t *testing.T, db *KeyDB, user string, ages ...time.Duration) {
+		t.Helper()
+		for _, age := range ages {
+			if err := db.Store(collect.UserInfo{Username: user, Source: "github-org", PublicKeys: []string{key}}, user, now.Add(-age)); err != nil {
+				t.Fatalf("Store(%s): %v", user, err)
+			}
+		}
+	}
+	resolve := func(t *testing.T, db *KeyDB, r Resolution) {
+		t.Helper()
+		fp, err := Fingerprint(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.ResolveConflict(fp, r); err != nil {
+			t.Fatalf("ResolveConflict: %v", err)
+		}
+	}
+	skip := func(t *testing.T, db *KeyDB, age time.Duration) {
+		t.Helper()
+		if err := db.StoreSkip(collect.Skip{Username: "ada", Reason: collect.SkipNotFound}, now.Add(-age)); err != nil {
+			t.Fatalf("StoreSkip: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		staleAfter  time.Duration
+		setup       func(t *testing.T, db *KeyDB)
+		want        []string
+		wantQuality float64
+	}{
+		{name: "confirmed and recent", setup: func(t *testing.T, db *KeyDB) { store(t, db, "ada", 2*day, day) }, wantQuality: 1},
+		{name: "stale", setup: func(t *testing.T, db *KeyDB) { store(t, db, "ada", 400*day, 399*day) },
+			want: []string{CaveatStale}, wantQuality: 0.5},
+		{name: "stale sooner", staleAfter: 30 * day, setup: func(t *testing.T, db *KeyDB) { store(t, db, "ada", 40*day, 39*day) },
+			want: []string{CaveatStale}, wantQuality: 0.5},
+		{name: "seen once", setup: func(t *testing.T, db *KeyDB) { store(t, db, "ada", time.Hour) },
+			want: []string{CaveatSingleSource}, wantQuality: 0.7},
+		{name: "stale and seen once", setup: func(t *testing.T, db *KeyDB) { store(t, db, "ada", 400*day) },
+			want: []string{CaveatStale, CaveatSingleSource}, wantQuality: 0.5},
+		{name: "imported", setup: func(t *testing.T, db *KeyDB) {
+			if _, err := db.Backfill([]Sighting{{Login: "ada", Key: key, ObservedAt: now.Add(-day), Source: "ghtorrent-2014"}}, "ghtorrent", 0.4); err != nil {
+				t.Fatalf("Backfill: %v", err)
+			}
+		}, want: []string{CaveatImported}, wantQuality: 0.4},
+		{name: "shared key", setup: func(t *testing.T, db *KeyDB) {
+			store(t, db, "grace", 3*day)
+			store(t, db, "ada", 2*day, day)
+		}, want: []string{CaveatSharedKey}, wantQuality: 0.3},
+		{name: "shared key, both kept", setup: func(t *testing.T, db *KeyDB) {
+			store(t, db, "grace", 3*day)
+			store(t, db, "ada", 2*day, day)
+			resolve(t, db, Resolution{Decision: ResolutionKeepBoth, By: "security"})
+		}, want: []string{CaveatSharedKey}, wantQuality: 0.6},
+		{name: "shared key, owner accepted", setup: func(t *testing.T, db *KeyDB) {
+			store(t, db, "grace", 3*day)
+			store(t, db, "ada", 2*day, day)
+			resolve(t, db, Resolution{Decision: ResolutionAccept, Login: "ada", By: "security"})
+		}, wantQuality: 1},
+		{name: "account deleted", setup: func(t *testing.T, db *KeyDB) {
+			store(t, db, "ada", 2*day, day)
+			skip(t, db, time.Hour)
+		}, want: []string{CaveatAccountDeleted}, wantQuality: 0},
+		{name: "account missing before the key was seen", setup: func(t *testing.T, db *KeyDB) {
+			skip(t, db, 3*day)
+			store(t, db, "ada", 2*day, day)
+		}, wantQuality: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			db.SetClock(clock.Fixed(now))
+			db.SetConflictDetection(true)
+			tt.setup(t, db)
+
+			md, err := db.Lookup(key)
+			if err != nil {
+				t.Fatalf("Lookup: %v", err)
+			}
+			caveats, err := db.Caveats(md, tt.staleAfter)
+			if err != nil {
+				t.Fatalf("Caveats: %v", err)
+			}
+			if got := CaveatCodes(caveats); !slices.Equal(got, tt.want) {
+				t.Errorf("Caveats() = %v, want codes %v", caveats, tt.want)
+			}
+			if got := Quality(caveats); got != tt.wantQuality {
+				t.Errorf("Quality() = %v, want %v", got, tt.wantQuality)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package keydb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// quarantinePrefix is the key prefix for quarantined batches, keyed by batch ID
+const quarantinePrefix = "quarantine:"
+
+// Decisions on a QuarantineBatch
+const (
+	// QuarantinePending batches await review.
+	QuarantinePending = "pending"
+	// QuarantineDiscarded batches were judged corrupt; their keys stay unattributed.
+	QuarantineDiscarded = "discarded"
+	// QuarantineApplied batches were judged genuine and stored as ordinary observations.
+	QuarantineApplied = "applied"
+)
+
+// QuarantineBatch is one keys body served identically to several users, held back from attribution
+type QuarantineBatch struct {
+	Batch    string    `json:"batch"`
+	Detected time.Time `json:"detected"`
+	Keys     []string  `json:"keys"`
+	// Users are the observations of the body, in the order they were quarantined.
+	Users []QuarantinedUser `json:"users"`
+	// Status is QuarantinePending until the batch is reviewed.
+	Status     string     `json:"status"`
+	ReviewedBy string     `json:"reviewed_by,omitempty"`
+	Reviewed   *time.Time `json:"reviewed,omitempty"`
+	Provenance
+}
+
+// QuarantinedUser is one user the batch's keys were served for
+type QuarantinedUser struct {
+	Login     string    `json:"login"`
+	Repo      string    `json:"repo,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+	// Withdrawn is set for users whose keys were stored before the batch was detected and have since
+	// been removed from the database.
+	Withdrawn bool `json:"withdrawn,omitempty"`
+}
+
+// Quarantine holds back a user marked by collect.Quarantine instead of storing their keys, adding
+// them to the batch for its keys body. Users of the batch stored earlier in its window, before the
+// threshold was reached, have those keys withdrawn, unless they already held them before the window.
+// The first time a batch is seen it raises an alert.
+func (k *KeyDB) Quarantine(user collect.UserInfo) error {
+	q := user.Quarantine
+	if q == nil {
+		return fmt.Errorf("%s is not marked for quarantine", user.Username)
+	}
+	var alert bool
+	var withdrawn []string
+	err := checkSpace(k.update(func(txn *badger.Txn) error {
+		b, err := getQuarantine(txn, q.Batch)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			alert = true
+			b = &QuarantineBatch{Batch: q.Batch, Detected: k.clock.Now(), Keys: user.PublicKeys, Status: QuarantinePending, Provenance: k.provenance}
+		}
+		has := map[string]bool{}
+		for _, u := range b.Users {
+			has[strings.ToLower(u.Login)] = true
+		}
+		if !has[strings.ToLower(user.Username)] {
+			b.Users = append(b.Users, QuarantinedUser{Login: user.Username, Repo: user.Repo, Source: user.Source, FetchedAt: user.FetchedAt})
+			has[strings.ToLower(user.Username)] = true
+			if b.Status != QuarantinePending {
+				// A reviewed body served to someone new needs another look
+				alert = true
+				b.Status, b.ReviewedBy, b.Reviewed = QuarantinePending, "", nil
+			}
+		}
+
+		// Users reaching the threshold earlier were stored as usual; take their keys back
+		for _, login := range q.Users {
+			if has[login] {
+				continue
+			}
+			md, err := k.withdraw(txn, login, user.PublicKeys, q.Since)
+			if err != nil {
+				return err
+			}
+			u := QuarantinedUser{Login: login, FetchedAt: q.Since}
+			if md != nil {
+				u = QuarantinedUser{Login: md.User, Repo: md.Repo, Source: md.Source, FetchedAt: md.Timestamp, Withdrawn: true}
+				withdrawn = append(withdrawn, login)
+			}
+			b.Users = append(b.Users, u)
+			has[login] = true
+		}
+		return putQuarantine(txn, b)
+	}))
+	if err != nil {
+		return err
+	}
+	k.counters.Inc("users_quarantined")
+	if alert {
+		log.Printf("ALERT: GitHub served identical keys for %d users (%s); quarantined batch %s for review with pubkey-db -quarantine", len(q.Users), strings.Join(q.Users, ", "), q.Batch)
+	}
+	if len(withdrawn) > 0 {
+		log.Printf("Withdrew keys stored for %s into quarantine batch %s", strings.Join(withdrawn, ", "), q.Batch)
+	}
+	return nil
+}
+
+// withdraw deletes login's records of keys first seen at or after since, along with their fingerprint
+// entries and rollup counts, returning the last one deleted, or nil if there were none
+func (k *KeyDB) withdraw(txn *badger.Txn, login string, keys []string, since time.Time) (*Metadata, error) {
+	var last *Metadata
+	for _, key := range keys {
+		fp, err := Fingerprint(key)
+		if err != nil {
+			continue
+		}
+		stored, err := resolveFingerprint(txn, fp)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		md, err := getMetadata(txn, []byte(stored))
+		if err != nil {
+			return nil, err
+		}
+		if md == nil || !strings.EqualFold(md.User, login) || md.FirstSeen.Before(since) {
+			continue
+		}
+		if err := txn.Delete([]byte(stored)); err != nil {
+			return nil, err
+		}
+		if err := txn.Delete(userKey(md.User, stored)); err != nil {
+			return nil, err
+		}
+		if err := unindexFingerprints(txn, stored); err != nil {
+			return nil, err
+		}
+		if err := uncountKey(txn, stored, md); err != nil {
+			return nil, err
+		}
+		last = md
+	}
+	if last == nil {
+		return nil, nil
+	}
+	return last, uncountUser(txn, last.User)
+}
+
+// QuarantineBatches returns every quarantined batch, most recently detected first
+func (k *KeyDB) QuarantineBatches() ([]*QuarantineBatch, error) {
+	var batches []*QuarantineBatch
+	err := k.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(quarantinePrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var b QuarantineBatch
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &b)
+			}); err != nil {
+				return err
+			}
+			batches = append(batches, &b)
+		}
+		return nil
+	})
+	sort.Slice(batches, func(i, j int) bool { return batches[i].Detected.After(batches[j].Detected) })
+	return batches, err
+}
+
+// ReviewQuarantine settles a pending batch. Applying it stores each user's observation as Store would
+// have; discarding it leaves the keys unattributed. The batch is kept, with the decision, for audit.
+func (k *KeyDB) ReviewQuarantine(batch, decision, by string) error {
+	if decision != QuarantineApplied && decision != QuarantineDiscarded {
+		return fmt.Errorf("unknown decision %q: want %s or %s", decision, QuarantineApplied, QuarantineDiscarded)
+	}
+	var b *QuarantineBatch
+	if err := k.view(func(txn *badger.Txn) error {
+		var err error
+		b, err = getQuarantine(txn, batch)
+		return err
+	}); err != nil {
+		return err
+	}
+	if b == nil {
+		return fmt.Errorf("no quarantined batch %s", batch)
+	}
+	if b.Status != QuarantinePending {
+		return fmt.Errorf("batch %s was already %s", batch, b.Status)
+	}
+
+	if decision == QuarantineApplied {
+		for _, u := range b.Users {
+			info := collect.UserInfo{Username: u.Login, PublicKeys: b.Keys, Repo: u.Repo, Source: u.Source, FetchedAt: u.FetchedAt}
+			if err := k.Store(info, u.Login, u.FetchedAt); err != nil {
+				return fmt.Errorf("apply %s: %w", u.Login, err)
+			}
+		}
+	}
+
+	now := k.clock.Now()
+	b.Status, b.ReviewedBy, b.Reviewed = decision, by, &now
+	return checkSpace(k.update(func(txn *badger.Txn) error {
+		return putQuarantine(txn, b)
+	}))
+}
+
+// getQuarantine reads a batch within txn, returning nil if there is none
+func getQuarantine(txn *badger.Txn, batch string) (*QuarantineBatch, error) {
+	item, err := txn.Get([]byte(quarantinePrefix + batch))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var b QuarantineBatch
+	if err := item.Value(func(val []byte) error { return json.Unmarshal(val, &b) }); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// putQuarantine writes a batch within txn
+func putQuarantine(txn *badger.Txn, b *QuarantineBatch) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(quarantinePrefix+b.Batch), data)
+}
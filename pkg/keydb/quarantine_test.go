@@ -0,0 +1,94 @@
+package keydb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+func TestQuarantineWithdraw(t *testing.T) {
+	day := func(d, h int) time.Time { return time.Date(2026, 1, d, h, 0, 0, 0, time.UTC) }
+	shared := []string{testKey(t, 10), testKey(t, 11)}
+	type store struct {
+		user string
+		keys []string
+		at   time.Time
+	}
+	tests := []struct {
+		name string
+		// stores come before linus is stored with the shared keys on day 5 and ken is quarantined with them
+		stores    []store
+		wantKeys  int
+		wantUsers int
+	}{
+		{name: "withdrawn user had no other keys", stores: []store{
+			{"ada", []string{testKey(t, 1)}, day(1, 12)},
+		}, wantKeys: 1, wantUsers: 1},
+		{name: "withdrawn user keeps older keys", stores: []store{
+			{"ada", []string{testKey(t, 1)}, day(1, 12)},
+			{"linus", []string{testKey(t, 2)}, day(2, 12)},
+		}, wantKeys: 2, wantUsers: 2},
+		{name: "withdrawn user first seen the same day", stores: []store{
+			{"ada", []string{testKey(t, 1)}, day(5, 8)},
+		}, wantKeys: 1, wantUsers: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if err := db.SetFingerprints([]string{"sha512"}); err != nil {
+				t.Fatal(err)
+			}
+			stores := append(tt.stores, store{"linus", shared, day(5, 10)})
+			for _, s := range stores {
+				if err := db.Store(collect.UserInfo{Username: s.user, Source: "github-events", PublicKeys: s.keys}, s.user, s.at); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+			q := &collect.Quarantine{Batch: "sha256:0123456789ab", Users: []string{"ken", "linus"}, Since: day(5, 9)}
+			if err := db.Quarantine(collect.UserInfo{Username: "ken", PublicKeys: shared, FetchedAt: day(5, 11), Quarantine: q}); err != nil {
+				t.Fatalf("Quarantine: %v", err)
+			}
+			if err := db.ReviewQuarantine(q.Batch, QuarantineDiscarded, "tester"); err != nil {
+				t.Fatalf("ReviewQuarantine: %v", err)
+			}
+
+			// Only the remaining keys are indexed, under SHA256, MD5 and SHA512
+			if n := countPrefix(t, db, fingerprintPrefix); n != 3*tt.wantKeys {
+				t.Errorf("%d fingerprint entries after the discard, want %d", n, 3*tt.wantKeys)
+			}
+			for _, key := range shared {
+				if md, err := db.Lookup(key); !errors.Is(err, badger.ErrKeyNotFound) {
+					t.Errorf("Lookup of a withdrawn key = %+v, %v; want not found", md, err)
+				}
+			}
+
+			got, err := db.Rollups()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.BackfillRollups(context.Background()); err != nil {
+				t.Fatalf("BackfillRollups: %v", err)
+			}
+			want, err := db.Rollups()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("rollups after the discard differ from a backfill:\ngot  %s\nwant %s", describeRollups(got), describeRollups(want))
+			}
+			points, err := db.Timeseries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last := points[len(points)-1]; last.Keys != tt.wantKeys || last.Users != tt.wantUsers {
+				t.Errorf("final totals = %d keys, %d users; want %d keys, %d users", last.Keys, last.Users, tt.wantKeys, tt.wantUsers)
+			}
+		})
+	}
+}
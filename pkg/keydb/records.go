@@ -0,0 +1,104 @@
+package keydb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// RecordSchema is the version of the Record layout written by DumpRecords. It changes whenever a
+// stored value changes incompatibly, so archives say which reader they need.
+const RecordSchema = 1
+
+// RecordKey is the Record type of a stored public key
+const RecordKey = "key"
+
+// Record is one database entry, independent of Badger's on-disk format, for archiving
+type Record struct {
+	// Type is RecordKey or the kind of bookkeeping record, such as "skip", "run" or "fp".
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	// Value holds JSON values as they are stored; Text holds the plain-text ones, such as index entries.
+	Value json.RawMessage `json:"value,omitempty"`
+	Text  string          `json:"text,omitempty"`
+}
+
+// recordType returns the Record type of a database key: its bookkeeping prefix without the colon,
+// or RecordKey
+func recordType(key []byte) string {
+	for _, prefix := range recordPrefixes {
+		if strings.HasPrefix(string(key), prefix) {
+			return strings.TrimSuffix(prefix, ":")
+		}
+	}
+	return RecordKey
+}
+
+// DumpRecords calls fn for every entry in the database, bookkeeping records and indexes included, in
+// key order from one consistent snapshot. It stops at the first error from fn, or when ctx is done.
+func (k *KeyDB) DumpRecords(ctx context.Context, fn func(Record) error) error {
+	return k.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := it.Item()
+			rec := Record{Type: recordType(item.Key()), Key: string(item.KeyCopy(nil))}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if json.Valid(val) {
+				rec.Value = val
+			} else {
+				rec.Text = string(val)
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadRecords writes records as DumpRecords produced them, replacing entries with the same keys.
+// A record whose type doesn't match its key is rejected before anything is written.
+func (k *KeyDB) LoadRecords(recs []Record) error {
+	for _, rec := range recs {
+		if t := recordType([]byte(rec.Key)); t != rec.Type {
+			return fmt.Errorf("record %q has type %q, want %q", rec.Key, rec.Type, t)
+		}
+	}
+	if k.dryRun {
+		return nil
+	}
+
+	k.enter()
+	defer k.swap.RUnlock()
+	wb := k.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, rec := range recs {
+		val := []byte(rec.Value)
+		if rec.Value == nil {
+			val = []byte(rec.Text)
+		}
+		if err := wb.Set([]byte(rec.Key), val); err != nil {
+			return checkSpace(err)
+		}
+		// Archives from before the owner index existed don't carry its entries
+		var md Metadata
+		if rec.Type != RecordKey || json.Unmarshal(val, &md) != nil {
+			continue
+		}
+		if err := wb.Set(userKey(md.User, rec.Key), nil); err != nil {
+			return checkSpace(err)
+		}
+	}
+	return checkSpace(wb.Flush())
+}
@@ -0,0 +1,114 @@
+package keydb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// replicaPrefix is the key prefix for records describing a database cloned from another
+const replicaPrefix = "replica:"
+
+// replicaKey holds a clone's ReplicaInfo
+const replicaKey = replicaPrefix + "source"
+
+// ReplicaInfo describes where a cloned database came from. The clone holds exactly what the source
+// held when its commit sequence was Sequence: every write committed at or before Sequence, and none after.
+type ReplicaInfo struct {
+	Source   string    `json:"source"`
+	Sequence uint64    `json:"sequence"`
+	Cloned   time.Time `json:"cloned"`
+}
+
+// CloneSnapshot copies the database to a new database at dest while writes continue, using Badger's
+// backup stream from one read snapshot, and records the snapshot's sequence in the clone. dest must
+// not exist or be empty; it is removed again if cloning fails.
+func (k *KeyDB) CloneSnapshot(dest string) (info *ReplicaInfo, err error) {
+	if entries, err := os.ReadDir(dest); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", dest)
+	}
+	clone, err := NewWithProfile(dest, ProfileBulkLoad)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := clone.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.RemoveAll(dest)
+		}
+	}()
+
+	k.enter()
+	defer k.swap.RUnlock()
+	started := k.clock.Now()
+	seq, err := copyDelta(k.db, clone.db, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	info = &ReplicaInfo{Source: k.path, Sequence: seq, Cloned: started}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSpace(clone.update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(replicaKey), data)
+	})); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// copyDelta copies every write to src committed after sequence since into dst, from one read
+// snapshot, returning the sequence of the last write copied, or 0 if there were none
+func copyDelta(src, dst *badger.DB, since uint64) (uint64, error) {
+	pr, pw := io.Pipe()
+	var seq uint64
+	done := make(chan error, 1)
+	go func() {
+		// Each of a stream's goroutines reads from its own snapshot, so one keeps the copy consistent
+		stream := src.NewStream()
+		stream.LogPrefix = "keydb.copyDelta"
+		stream.NumGo = 1
+		stream.SinceTs = since
+		var err error
+		seq, err = stream.Backup(pw, since)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	lerr := dst.Load(pr, 256)
+	// Unblock the backup if loading stopped early
+	pr.CloseWithError(errors.New("copy stopped loading"))
+	if err := errors.Join(<-done, lerr); err != nil {
+		return 0, checkSpace(err)
+	}
+	return seq, nil
+}
+
+// Replica returns where the database was cloned from, or nil if it is not a clone
+func (k *KeyDB) Replica() (*ReplicaInfo, error) {
+	var info ReplicaInfo
+	err := k.view(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(replicaKey))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &info)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
@@ -0,0 +1,124 @@
+package keydb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+func TestCloneSnapshotUnderConcurrentWrites(t *testing.T) {
+	const writers, perWriter = 4, 1000
+
+	// Flushed tables give Badger key ranges to stream from separate goroutines, which is what
+	// could split a clone across several snapshots
+	dir := t.TempDir()
+	db, err := New(dir)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for i := 0; i < 10000; i++ {
+		user := fmt.Sprintf("old%d", i)
+		if err := db.Store(collect.UserInfo{Username: user, PublicKeys: []string{testKey(t, writers*perWriter+i)}}, user, time.Time{}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if db, err = New(dir); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	base := db.db.MaxVersion()
+
+	// Each writer stores a user per commit, in order, so any consistent snapshot holds a prefix of
+	// each writer's users
+	keys := make([][]string, writers)
+	for w := range keys {
+		for i := 0; i < perWriter; i++ {
+			keys[w] = append(keys[w], testKey(t, w*perWriter+i))
+		}
+	}
+	var stored atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, key := range keys[w] {
+				user := fmt.Sprintf("writer%d-%d", w, i)
+				err := db.Store(collect.UserInfo{Username: user, PublicKeys: []string{key}}, user, time.Time{})
+				// Writers touch shared bookkeeping records, so their commits can conflict
+				for errors.Is(err, badger.ErrConflict) {
+					err = db.Store(collect.UserInfo{Username: user, PublicKeys: []string{key}}, user, time.Time{})
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				stored.Add(1)
+			}
+		}()
+	}
+	for stored.Load() < writers*perWriter/4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	dest := filepath.Join(t.TempDir(), "clone")
+	info, err := db.CloneSnapshot(dest)
+	if err != nil {
+		t.Fatalf("CloneSnapshot: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Store: %v", err)
+	}
+
+	clone, err := New(dest)
+	if err != nil {
+		t.Fatalf("open clone: %v", err)
+	}
+	defer clone.Close()
+
+	total := 0
+	for w := range keys {
+		present := 0
+		for i, key := range keys[w] {
+			_, err := clone.Lookup(key)
+			switch {
+			case err == nil:
+				if present != i {
+					t.Fatalf("clone has writer%d-%d but not writer%d-%d: not a single snapshot", w, i, w, present)
+				}
+				present++
+			case !errors.Is(err, badger.ErrKeyNotFound):
+				t.Fatalf("Lookup writer%d-%d: %v", w, i, err)
+			}
+		}
+		total += present
+	}
+	// Every Store is one commit, so a clone at Sequence holds exactly the users committed by then
+	if got := db.db.MaxVersion() - base; got != writers*perWriter {
+		t.Fatalf("writers made %d commits, want one per user (%d)", got, writers*perWriter)
+	}
+	if want := int(info.Sequence - base); total != want {
+		t.Errorf("clone holds %d users, want the %d committed by its sequence %d", total, want, info.Sequence)
+	}
+	if total < writers*perWriter/4 {
+		t.Errorf("clone holds %d users, want at least the %d stored before cloning", total, writers*perWriter/4)
+	}
+
+	r, err := clone.Replica()
+	if err != nil || r == nil || r.Sequence != info.Sequence {
+		t.Errorf("Replica() = %+v, %v; want sequence %d", r, err, info.Sequence)
+	}
+}
@@ -0,0 +1,256 @@
+package keydb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// rollupPrefix is the key prefix for daily rollups of newly seen keys and users
+const rollupPrefix = "rollup:"
+
+// seenUserPrefix is the key prefix for markers of users already counted in a rollup
+const seenUserPrefix = "user:"
+
+// rollupDate is the layout of rollup dates (UTC days)
+const rollupDate = "2006-01-02"
+
+// Rollup counts the keys and users first seen on one day. Keys that move to another owner are not
+// subtracted from their previous owner's count.
+type Rollup struct {
+	Date        string         `json:"date"`
+	NewKeys     int            `json:"new_keys"`
+	NewUsers    int            `json:"new_users"`
+	BySource    map[string]int `json:"by_source,omitempty"`
+	ByAlgorithm map[string]int `json:"by_algorithm,omitempty"`
+}
+
+// Point is the running total of distinct keys and users with at least one key at the end of a day
+type Point struct {
+	Date  string
+	Keys  int
+	Users int
+}
+
+// add counts a newly seen key
+func (r *Rollup) add(key, source string) {
+	if r.BySource == nil {
+		r.BySource = map[string]int{}
+		r.ByAlgorithm = map[string]int{}
+	}
+	r.NewKeys++
+	r.BySource[source]++
+	r.ByAlgorithm[algorithm(key)]++
+}
+
+// remove uncounts a key counted by add
+func (r *Rollup) remove(key, source string) {
+	r.NewKeys--
+	uncount(r.BySource, source)
+	uncount(r.ByAlgorithm, algorithm(key))
+}
+
+// uncount decrements m[k], dropping it once nothing is counted
+func uncount(m map[string]int, k string) {
+	if m[k] > 1 {
+		m[k]--
+		return
+	}
+	delete(m, k)
+}
+
+// algorithm returns the key type of an authorized_keys line, such as "ssh-ed25519"
+func algorithm(key string) string {
+	if f := keyFields(key); len(f) > 0 {
+		return f[0]
+	}
+	return ""
+}
+
+// rollupKey returns the database key for the rollup of the day containing t
+func rollupKey(t time.Time) []byte {
+	return []byte(rollupPrefix + t.UTC().Format(rollupDate))
+}
+
+// updateRollup applies fn to the rollup of the day containing t within txn, deleting the rollup if
+// it no longer counts anything
+func updateRollup(txn *badger.Txn, t time.Time, fn func(*Rollup)) error {
+	r := Rollup{Date: t.UTC().Format(rollupDate)}
+	item, err := txn.Get(rollupKey(t))
+	switch {
+	case err == nil:
+		if err := item.Value(func(val []byte) error { return json.Unmarshal(val, &r) }); err != nil {
+			return err
+		}
+	case !errors.Is(err, badger.ErrKeyNotFound):
+		return err
+	}
+
+	fn(&r)
+	if r.NewKeys == 0 && r.NewUsers == 0 {
+		return txn.Delete(rollupKey(t))
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return txn.Set(rollupKey(t), data)
+}
+
+// countUser counts user in the rollup for t unless they have been counted before
+func countUser(txn *badger.Txn, user string, t time.Time) error {
+	marker := []byte(seenUserPrefix + strings.ToLower(user))
+	_, err := txn.Get(marker)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	if err := txn.Set(marker, []byte(t.UTC().Format(rollupDate))); err != nil {
+		return err
+	}
+	return updateRollup(txn, t, func(r *Rollup) { r.NewUsers++ })
+}
+
+// uncountKey takes a removed key out of the rollup for the day it was first seen
+func uncountKey(txn *badger.Txn, key string, md *Metadata) error {
+	first := md.FirstSeen
+	if first.IsZero() {
+		first = md.Timestamp
+	}
+	return updateRollup(txn, first, func(r *Rollup) { r.remove(key, md.Source) })
+}
+
+// uncountUser takes user out of the rollup they were counted in once they have no keys left, so
+// they are counted again if keys are stored for them later
+func uncountUser(txn *badger.Txn, user string) error {
+	keys, indexed, err := indexedUserKeys(txn, user)
+	if err != nil || !indexed || len(keys) > 0 {
+		return err
+	}
+	marker := []byte(seenUserPrefix + strings.ToLower(user))
+	item, err := txn.Get(marker)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	day, err := time.Parse(rollupDate, string(val))
+	if err != nil {
+		return err
+	}
+	if err := txn.Delete(marker); err != nil {
+		return err
+	}
+	return updateRollup(txn, day, func(r *Rollup) { r.NewUsers-- })
+}
+
+// Rollups returns the daily rollups, oldest first
+func (k *KeyDB) Rollups() ([]*Rollup, error) {
+	var rollups []*Rollup
+	err := k.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(rollupPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// Keys sort by date
+		for it.Rewind(); it.Valid(); it.Next() {
+			var r Rollup
+			if err := it.Item().Value(func(val []byte) error { return json.Unmarshal(val, &r) }); err != nil {
+				return err
+			}
+			rollups = append(rollups, &r)
+		}
+		return nil
+	})
+	return rollups, err
+}
+
+// Timeseries returns running totals of distinct keys and users for each day with a rollup.
+// Keys removed as duplicates or withdrawn into quarantine are subtracted from the day they were first
+// seen, so totals do not only grow.
+func (k *KeyDB) Timeseries() ([]Point, error) {
+	rollups, err := k.Rollups()
+	if err != nil {
+		return nil, err
+	}
+	points := make([]Point, 0, len(rollups))
+	var keys, users int
+	for _, r := range rollups {
+		keys += r.NewKeys
+		users += r.NewUsers
+		points = append(points, Point{Date: r.Date, Keys: keys, Users: users})
+	}
+	return points, nil
+}
+
+// BackfillRollups recomputes every rollup from the stored keys' first-seen times, replacing the
+// incrementally maintained ones, and returns the number of days. Store counts keys on the day they are
+// first stored, so rollups drift from first-seen when older observations arrive later; this corrects that.
+func (k *KeyDB) BackfillRollups(ctx context.Context) (int, error) {
+	rollups := map[string]*Rollup{}
+	userFirst := map[string]time.Time{}
+	rollupFor := func(t time.Time) *Rollup {
+		day := t.UTC().Format(rollupDate)
+		if rollups[day] == nil {
+			rollups[day] = &Rollup{Date: day}
+		}
+		return rollups[day]
+	}
+
+	err := k.ForEachKey(ctx, func(rec KeyRecord) error {
+		first := rec.FirstSeen
+		if first.IsZero() {
+			first = rec.Timestamp
+		}
+		rollupFor(first).add(rec.Key, rec.Source)
+		login := strings.ToLower(rec.User)
+		if t, ok := userFirst[login]; !ok || first.Before(t) {
+			userFirst[login] = first
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, first := range userFirst {
+		rollupFor(first).NewUsers++
+	}
+
+	k.enter()
+	defer k.swap.RUnlock()
+	// User markers stay, so users whose keys have all moved to another owner aren't counted again
+	k.drops.Add(1)
+	if err := k.db.DropPrefix([]byte(rollupPrefix)); err != nil {
+		return 0, err
+	}
+
+	wb := k.db.NewWriteBatch()
+	defer wb.Cancel()
+	for day, r := range rollups {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return 0, err
+		}
+		if err := wb.Set([]byte(rollupPrefix+day), data); err != nil {
+			return 0, err
+		}
+	}
+	for login, first := range userFirst {
+		if err := wb.Set([]byte(seenUserPrefix+login), []byte(first.UTC().Format(rollupDate))); err != nil {
+			return 0, err
+		}
+	}
+	return len(rollups), checkSpace(wb.Flush())
+}
@@ -0,0 +1,152 @@
+package keydb
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// ecdsaKey returns a new ecdsa-sha2-nistp256 authorized_keys line
+func ecdsaKey(t *testing.T) string {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
+
+// scanRollups computes rollups the slow way, from every stored key's first-seen time
+func scanRollups(t *testing.T, db *KeyDB) []*Rollup {
+	t.Helper()
+	byDay := map[string]*Rollup{}
+	userFirst := map[string]time.Time{}
+	err := db.ForEachKey(context.Background(), func(rec KeyRecord) error {
+		day := rec.FirstSeen.UTC().Format(rollupDate)
+		r := byDay[day]
+		if r == nil {
+			r = &Rollup{Date: day, BySource: map[string]int{}, ByAlgorithm: map[string]int{}}
+			byDay[day] = r
+		}
+		r.NewKeys++
+		r.BySource[rec.Source]++
+		r.ByAlgorithm[strings.Fields(rec.Key)[0]]++
+		login := strings.ToLower(rec.User)
+		if first, ok := userFirst[login]; !ok || rec.FirstSeen.Before(first) {
+			userFirst[login] = rec.FirstSeen
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, first := range userFirst {
+		day := first.UTC().Format(rollupDate)
+		if byDay[day] == nil {
+			byDay[day] = &Rollup{Date: day}
+		}
+		byDay[day].NewUsers++
+	}
+
+	var out []*Rollup
+	for _, r := range byDay {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Date < out[j].Date })
+	return out
+}
+
+func TestRollupsMatchScan(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 15, 0, 0, 0, time.UTC) }
+	ada1, ada2, grace1, linus1 := testKey(t, 1), ecdsaKey(t), testKey(t, 2), ecdsaKey(t)
+	type store struct {
+		user   string
+		source string
+		keys   []string
+		at     time.Time
+	}
+	tests := []struct {
+		name   string
+		stores []store
+		// drifts is set when observations arrive out of order, so only a backfill matches the scan
+		drifts bool
+	}{
+		{name: "in order", stores: []store{
+			{"ada", "github-org", []string{ada1}, day(1)},
+			{"grace", "github-events", []string{grace1}, day(1)},
+			{"ada", "github-org", []string{ada1, ada2}, day(3)},
+			{"Ada", "github-org", []string{ada1, ada2}, day(4)},
+			{"linus", "github-users", []string{linus1}, day(4)},
+		}},
+		{name: "older observations arrive later", drifts: true, stores: []store{
+			{"ada", "github-org", []string{ada1, ada2}, day(5)},
+			{"linus", "github-users", []string{linus1}, day(6)},
+			{"ada", "github-org", []string{ada1}, day(2)},
+			{"grace", "github-events", []string{grace1}, day(3)},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			for _, s := range tt.stores {
+				if err := db.Store(collect.UserInfo{Username: s.user, Source: s.source, PublicKeys: s.keys}, s.user, s.at); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+			want := scanRollups(t, db)
+
+			got, err := db.Rollups()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matches := reflect.DeepEqual(got, want); matches == tt.drifts {
+				t.Errorf("incremental rollups match the scan: %v, want %v\ngot  %s\nwant %s", matches, !tt.drifts, describeRollups(got), describeRollups(want))
+			}
+
+			days, err := db.BackfillRollups(context.Background())
+			if err != nil {
+				t.Fatalf("BackfillRollups: %v", err)
+			}
+			got, err = db.Rollups()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if days != len(want) || !reflect.DeepEqual(got, want) {
+				t.Errorf("backfilled %d days:\ngot  %s\nwant %s", days, describeRollups(got), describeRollups(want))
+			}
+
+			points, err := db.Timeseries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := points[len(points)-1]
+			if last.Keys != 4 || last.Users != 3 {
+				t.Errorf("final totals = %d keys, %d users; want 4 keys, 3 users", last.Keys, last.Users)
+			}
+		})
+	}
+}
+
+// describeRollups formats rollups for failure messages
+func describeRollups(rs []*Rollup) string {
+	var parts []string
+	for _, r := range rs {
+		parts = append(parts, fmt.Sprintf("%s: %d keys %v %v, %d users", r.Date, r.NewKeys, r.BySource, r.ByAlgorithm, r.NewUsers))
+	}
+	return strings.Join(parts, "; ")
+}
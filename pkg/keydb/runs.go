@@ -0,0 +1,169 @@
+package keydb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// runPrefix is the key prefix for run records
+const runPrefix = "run:"
+
+// maxRuns is how many run records are retained; older runs are pruned by PutRun
+const maxRuns = 1000
+
+// MaxRunErrors is how many error messages a run record keeps
+const MaxRunErrors = 20
+
+// RunRecord summarizes one invocation of a collector or loader
+type RunRecord struct {
+	ID       string     `json:"id"`
+	Instance string     `json:"instance"`
+	Mode     string     `json:"mode"`
+	ArgsHash string     `json:"args_hash"`
+	Start    time.Time  `json:"start"`
+	End      *time.Time `json:"end,omitempty"`
+	// Counts are named tallies such as users stored and skipped.
+	Counts map[string]int `json:"counts,omitempty"`
+	// Errors are the first errors the run encountered; the "errors" count has the total.
+	Errors []string `json:"errors,omitempty"`
+	// APIRemainingStart and APIRemainingEnd are the GitHub core rate limit remaining, when known.
+	APIRemainingStart int `json:"api_remaining_start,omitempty"`
+	APIRemainingEnd   int `json:"api_remaining_end,omitempty"`
+	// Config is the run's effective flag values (see RunConfig). Runs recorded before it was added have none.
+	Config map[string]string `json:"config,omitempty"`
+	// Gap is set when a stream run started long enough after the last poll that events were missed.
+	Gap *StreamGap `json:"gap,omitempty"`
+}
+
+// StreamGap describes a coverage gap in the event stream and the backfill run to make up for it
+type StreamGap struct {
+	// Since is the last poll before the gap, and Detected when this run found it.
+	Since    time.Time `json:"since"`
+	Detected time.Time `json:"detected"`
+	// Watchlist and Members are how many watchlist users and org members were refreshed.
+	Watchlist int `json:"watchlist"`
+	Members   int `json:"members"`
+	// Deferred are org members left unrefreshed by the backfill budget.
+	Deferred int `json:"deferred"`
+	// Org is the organization backfilled, if any; Enumeration describes how completely it was listed.
+	Org         string `json:"org,omitempty"`
+	Enumeration string `json:"enumeration,omitempty"`
+	// Error is why the backfill stopped early, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// AddError counts an error the run encountered, keeping its message if there is room
+func (r *RunRecord) AddError(err error) {
+	if r.Counts == nil {
+		r.Counts = map[string]int{}
+	}
+	r.Counts["errors"]++
+	if len(r.Errors) < MaxRunErrors {
+		r.Errors = append(r.Errors, err.Error())
+	}
+}
+
+// HashArgs identifies a command line for a run record without storing it, since arguments may name private orgs or files
+func HashArgs(args []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(args, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// secretFlagWords mark flags whose values RunConfig redacts
+var secretFlagWords = []string{"token", "secret", "password"}
+
+// RunConfig returns the effective value of every flag in fs, defaults included, for a run record.
+// Values of flags that may hold secrets are replaced with "REDACTED" when set. Unlike HashArgs, this
+// keeps org names and file paths in the clear: they are needed to interpret what the run collected.
+func RunConfig(fs *flag.FlagSet) map[string]string {
+	config := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		for _, word := range secretFlagWords {
+			if v != "" && strings.Contains(f.Name, word) {
+				v = "REDACTED"
+			}
+		}
+		config[f.Name] = v
+	})
+	return config
+}
+
+// PutRun writes a run record, replacing any earlier version of it, and prunes the oldest runs beyond the retention limit
+func (k *KeyDB) PutRun(r *RunRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := checkSpace(k.update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(runPrefix+r.ID), data)
+	})); err != nil {
+		return err
+	}
+
+	runs, err := k.Runs()
+	if err != nil || len(runs) <= maxRuns {
+		return err
+	}
+	return checkSpace(k.update(func(txn *badger.Txn) error {
+		for _, old := range runs[maxRuns:] {
+			if err := txn.Delete([]byte(runPrefix + old.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// Run returns the run record with the given ID, or nil if there is none
+func (k *KeyDB) Run(id string) (*RunRecord, error) {
+	var r RunRecord
+	err := k.view(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(runPrefix + id))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &r)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Runs returns all retained run records, newest first
+func (k *KeyDB) Runs() ([]*RunRecord, error) {
+	var runs []*RunRecord
+	err := k.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(runPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var r RunRecord
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &r)
+			}); err != nil {
+				return err
+			}
+			runs = append(runs, &r)
+		}
+		return nil
+	})
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Start.After(runs[j].Start) })
+	return runs, err
+}
@@ -0,0 +1,130 @@
+package keydb
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// spillRetryInterval is the minimum time between attempts to write spilled observations
+const spillRetryInterval = 5 * time.Second
+
+// pendingStore is an observation that failed to store and is waiting to be retried
+type pendingStore struct {
+	info     collect.UserInfo
+	user     string
+	at       time.Time
+	failedAt time.Time
+}
+
+// Spill absorbs short periods when the database can't be written, such as a filesystem snapshot.
+// Observations that fail to store are held in memory and retried for up to a window. Because Store
+// is idempotent, a retried observation lands exactly once however many attempts it takes.
+type Spill struct {
+	db     *KeyDB
+	max    int
+	window time.Duration
+	// store is db.Store; tests replace it to simulate failing writes
+	store func(info collect.UserInfo, user string, timestamp time.Time) error
+
+	mu        sync.Mutex
+	pending   []pendingStore
+	lastRetry time.Time
+	dropped   int
+}
+
+// NewSpill returns a Spill holding at most max observations for up to window each. With max below 1
+// nothing is held: Store returns every failed write's error.
+func NewSpill(db *KeyDB, max int, window time.Duration) *Spill {
+	return &Spill{db: db, max: max, window: window, store: db.Store}
+}
+
+// Store stores an observation as KeyDB.Store does, holding it for retry if the write fails.
+// Rejected keys and ErrNoSpace are returned rather than held: retrying won't fix them.
+func (s *Spill) Store(info collect.UserInfo, user string, timestamp time.Time) error {
+	if timestamp.IsZero() {
+		timestamp = info.FetchedAt
+	}
+	if timestamp.IsZero() {
+		timestamp = s.db.clock.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.lastRetry) >= spillRetryInterval {
+		if err := s.retry(); err != nil {
+			return err
+		}
+	}
+
+	// Keep observations in order while earlier ones are still waiting
+	if len(s.pending) > 0 {
+		s.hold(pendingStore{info: info, user: user, at: timestamp, failedAt: time.Now()})
+		return nil
+	}
+
+	err := s.store(info, user, timestamp)
+	if !retryable(err) || s.max < 1 {
+		return err
+	}
+	log.Printf("Store for %s failed, holding for retry: %v", user, err)
+	s.hold(pendingStore{info: info, user: user, at: timestamp, failedAt: time.Now()})
+	return nil
+}
+
+// Flush retries the held observations now, returning how many are still pending
+func (s *Spill) Flush() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.retry()
+	return len(s.pending), err
+}
+
+// Dropped returns how many observations were given up on
+func (s *Spill) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// hold queues an observation, dropping the oldest if the buffer is full
+func (s *Spill) hold(p pendingStore) {
+	if len(s.pending) >= s.max {
+		log.Printf("ALERT: store retry buffer full (%d); dropping observation of %s", s.max, s.pending[0].user)
+		s.pending = s.pending[1:]
+		s.dropped++
+	}
+	s.pending = append(s.pending, p)
+}
+
+// retry attempts the held observations in order, stopping at the first that still fails.
+// ErrNoSpace is returned, with the observation still held.
+func (s *Spill) retry() error {
+	s.lastRetry = time.Now()
+	for len(s.pending) > 0 {
+		p := s.pending[0]
+		err := s.store(p.info, p.user, p.at)
+		if errors.Is(err, ErrNoSpace) {
+			return err
+		}
+		if retryable(err) {
+			if time.Since(p.failedAt) < s.window {
+				return nil
+			}
+			log.Printf("ALERT: giving up on storing %s after %s: %v", p.user, s.window, err)
+			s.dropped++
+		} else if err != nil {
+			log.Printf("Store for %s failed on retry: %v", p.user, err)
+		}
+		s.pending = s.pending[1:]
+	}
+	return nil
+}
+
+// retryable reports whether a Store error may succeed if retried
+func retryable(err error) bool {
+	return err != nil && !errors.Is(err, ErrNoSpace) && !errors.Is(err, ErrKeyTooLarge)
+}
@@ -0,0 +1,126 @@
+package keydb
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// flakyStore stands in for KeyDB.Store, failing with err while it is set and recording the users it stored
+type flakyStore struct {
+	err    error
+	stored []string
+}
+
+func (f *flakyStore) store(_ collect.UserInfo, user string, _ time.Time) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.stored = append(f.stored, user)
+	return nil
+}
+
+func TestSpill(t *testing.T) {
+	errDown := errors.New("database is being snapshotted")
+	tests := []struct {
+		name   string
+		max    int
+		window time.Duration
+		// fail is the error Store returns until the flush
+		fail       error
+		users      []string
+		wantErrs   int
+		wantStored []string
+		wantDrop   int
+	}{
+		{name: "held observations land in order", max: 10, window: time.Hour, fail: errDown,
+			users: []string{"ada", "grace", "linus"}, wantStored: []string{"ada", "grace", "linus"}},
+		{name: "full buffer drops the oldest", max: 2, window: time.Hour, fail: errDown,
+			users: []string{"ada", "grace", "linus"}, wantStored: []string{"grace", "linus"}, wantDrop: 1},
+		{name: "no buffer returns failures", max: 0, window: time.Hour, fail: errDown,
+			users: []string{"ada", "grace"}, wantErrs: 2},
+		{name: "expired observations are given up on", max: 10, window: 0, fail: errDown,
+			users: []string{"ada", "grace"}, wantDrop: 2},
+		{name: "oversized keys are not retried", max: 10, window: time.Hour, fail: fmt.Errorf("%w: 20000 bytes", ErrKeyTooLarge),
+			users: []string{"ada", "grace"}, wantErrs: 2},
+		{name: "a full disk is not retried", max: 10, window: time.Hour, fail: ErrNoSpace,
+			users: []string{"ada", "grace"}, wantErrs: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &flakyStore{err: tt.fail}
+			s := NewSpill(newTestDB(t), tt.max, tt.window)
+			s.store = f.store
+
+			errs := 0
+			for _, u := range tt.users {
+				if err := s.Store(collect.UserInfo{Username: u}, u, time.Time{}); err != nil {
+					if !errors.Is(err, tt.fail) {
+						t.Errorf("Store(%s) error = %v, want %v", u, err, tt.fail)
+					}
+					errs++
+				}
+			}
+			if errs != tt.wantErrs {
+				t.Errorf("Store returned %d errors, want %d", errs, tt.wantErrs)
+			}
+
+			// Expired observations are dropped on the next attempt, while writes still fail
+			if tt.window == 0 {
+				if n, err := s.Flush(); n != 0 || err != nil {
+					t.Errorf("Flush() = %d, %v; want 0 pending", n, err)
+				}
+			}
+			f.err = nil
+			if n, err := s.Flush(); n != 0 || err != nil {
+				t.Errorf("Flush() = %d, %v; want 0 pending", n, err)
+			}
+			if !slices.Equal(f.stored, tt.wantStored) {
+				t.Errorf("stored %q, want %q", f.stored, tt.wantStored)
+			}
+			if got := s.Dropped(); got != tt.wantDrop {
+				t.Errorf("Dropped() = %d, want %d", got, tt.wantDrop)
+			}
+		})
+	}
+}
+
+func TestSpillFlushKeepsHeldOnNoSpace(t *testing.T) {
+	f := &flakyStore{err: errors.New("database is being snapshotted")}
+	s := NewSpill(newTestDB(t), 10, time.Hour)
+	s.store = f.store
+	for _, u := range []string{"ada", "grace"} {
+		if err := s.Store(collect.UserInfo{Username: u}, u, time.Time{}); err != nil {
+			t.Fatalf("Store(%s): %v", u, err)
+		}
+	}
+
+	f.err = ErrNoSpace
+	if n, err := s.Flush(); n != 2 || !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("Flush() on a full disk = %d, %v; want 2 pending, ErrNoSpace", n, err)
+	}
+
+	f.err = nil
+	if n, err := s.Flush(); n != 0 || err != nil {
+		t.Fatalf("Flush() = %d, %v; want 0 pending", n, err)
+	}
+	if want := []string{"ada", "grace"}; !slices.Equal(f.stored, want) {
+		t.Errorf("stored %q, want %q", f.stored, want)
+	}
+}
+
+func TestSpillStoresThroughKeyDB(t *testing.T) {
+	db := newTestDB(t)
+	s := NewSpill(db, 10, time.Hour)
+	if err := s.Store(collect.UserInfo{Username: "ada", PublicKeys: []string{testKey(t, 1)}}, "ada", time.Time{}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	keys, err := db.UserKeys("ada")
+	if err != nil || len(keys) != 1 {
+		t.Errorf("UserKeys(ada) = %d keys, %v; want 1", len(keys), err)
+	}
+}
@@ -0,0 +1,63 @@
+package keydb
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// StoreEvent describes one key Store considered, for tracing a collection
+type StoreEvent struct {
+	User string
+	Key  string
+	// Existing is the stored record before this observation, or nil for a new key.
+	Existing *Metadata
+	// Written is the record Store wrote, or would write in a dry run; nil if the key was unchanged.
+	Written *Metadata
+}
+
+// SetStoreHook sets a function called for every key Store considers, before its transaction
+// commits. A nil fn disables the hook.
+func (k *KeyDB) SetStoreHook(fn func(StoreEvent)) {
+	k.storeHook = fn
+}
+
+// SetDryRun makes every write, including skip and run records, run in a transaction that is
+// discarded instead of committed, so the database is never changed.
+func (k *KeyDB) SetDryRun(dry bool) {
+	k.dryRun = dry
+}
+
+// enter read-locks swap for a read or write, first waiting, up to pauseGateWait, for MigratePath
+// if it is pausing them
+func (k *KeyDB) enter() {
+	if resume := k.pausing.Load(); resume != nil {
+		t := time.NewTimer(pauseGateWait)
+		defer t.Stop()
+		select {
+		case <-*resume:
+		case <-t.C:
+		}
+	}
+	k.swap.RLock()
+}
+
+// view runs fn in a read-only transaction
+func (k *KeyDB) view(fn func(txn *badger.Txn) error) error {
+	k.enter()
+	defer k.swap.RUnlock()
+	return k.db.View(fn)
+}
+
+// update runs fn in a read-write transaction, committing it unless this is a dry run
+func (k *KeyDB) update(fn func(txn *badger.Txn) error) error {
+	k.enter()
+	defer k.swap.RUnlock()
+
+	if !k.dryRun {
+		return k.db.Update(fn)
+	}
+	txn := k.db.NewTransaction(true)
+	defer txn.Discard()
+	return fn(txn)
+}
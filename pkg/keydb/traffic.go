@@ -0,0 +1,144 @@
+package keydb
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tstromberg/pubkey-collector/pkg/traffic"
+)
+
+// trafficPrefix is the key prefix for the log of outbound requests. Each save adds a chunk under its
+// hour and instance, so a save writes only its own requests however busy the hour has been.
+const trafficPrefix = "traffic:"
+
+// trafficHourFormat is the hour in a traffic record's key, which sorts records by time
+const trafficHourFormat = "2006-01-02T15"
+
+// TrafficLog is the outbound requests one collector instance made in one hour
+type TrafficLog struct {
+	Hour     time.Time `json:"hour"`
+	Instance string    `json:"instance"`
+	// Dropped counts requests made but not recorded, because the collector's buffer overflowed
+	// before it was saved.
+	Dropped  int               `json:"dropped,omitempty"`
+	Requests []traffic.Request `json:"requests"`
+}
+
+// trafficKey returns the prefix of an instance's traffic log chunks for the hour starting at hour
+func trafficKey(hour time.Time, instance string) []byte {
+	return []byte(trafficPrefix + hour.UTC().Format(trafficHourFormat) + "/" + instance)
+}
+
+// trafficChunkKey returns the key of chunk n of an instance's traffic log for an hour
+func trafficChunkKey(hour time.Time, instance string, n int) []byte {
+	return fmt.Appendf(trafficKey(hour, instance), "/%08d", n)
+}
+
+// nextTrafficChunk returns the number of the chunk after the last one of an instance's traffic log
+// for an hour
+func nextTrafficChunk(txn *badger.Txn, hour time.Time, instance string) (int, error) {
+	prefix := append(trafficKey(hour, instance), '/')
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = true
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	it.Seek(append(slices.Clone(prefix), 0xff))
+	if !it.Valid() {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(string(it.Item().Key()[len(prefix):]))
+	if err != nil {
+		return 0, fmt.Errorf("traffic log chunk %q: %w", it.Item().Key(), err)
+	}
+	return n + 1, nil
+}
+
+// AppendTraffic adds requests to the traffic logs of the instance set with SetProvenance, counting
+// dropped requests in the current hour, and deletes the logs of every instance for hours that ended
+// before retainSince. The requests are written as new chunks; earlier ones are not read or rewritten.
+func (k *KeyDB) AppendTraffic(reqs []traffic.Request, dropped int, retainSince time.Time) error {
+	instance := k.provenance.Instance
+	byHour := map[time.Time][]traffic.Request{}
+	for _, r := range reqs {
+		hour := r.Time.UTC().Truncate(time.Hour)
+		byHour[hour] = append(byHour[hour], r)
+	}
+	now := k.clock.Now().UTC().Truncate(time.Hour)
+	if dropped > 0 && byHour[now] == nil {
+		byHour[now] = []traffic.Request{}
+	}
+
+	return checkSpace(k.update(func(txn *badger.Txn) error {
+		for hour, rs := range byHour {
+			n, err := nextTrafficChunk(txn, hour, instance)
+			if err != nil {
+				return err
+			}
+			l := TrafficLog{Hour: hour, Instance: instance, Requests: rs}
+			if hour.Equal(now) {
+				l.Dropped = dropped
+			}
+			data, err := json.Marshal(l)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(trafficChunkKey(hour, instance, n), data); err != nil {
+				return err
+			}
+		}
+
+		cutoff := string(trafficKey(retainSince.UTC().Truncate(time.Hour), ""))
+		var stale [][]byte
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(trafficPrefix)
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid() && string(it.Item().Key()) < cutoff; it.Next() {
+			stale = append(stale, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+		for _, key := range stale {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// TrafficLogs returns the traffic logs of every instance for hours ending after since, oldest first,
+// each merged from the chunks its saves wrote
+func (k *KeyDB) TrafficLogs(since time.Time) ([]TrafficLog, error) {
+	var logs []TrafficLog
+	// index finds the log of an hour and instance; chunks of one instance can sort between another's
+	index := map[string]int{}
+	err := k.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(trafficPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(trafficKey(since.UTC().Truncate(time.Hour), "")); it.Valid(); it.Next() {
+			var chunk TrafficLog
+			if err := it.Item().Value(func(val []byte) error { return json.Unmarshal(val, &chunk) }); err != nil {
+				return err
+			}
+			id := string(trafficKey(chunk.Hour, chunk.Instance))
+			i, ok := index[id]
+			if !ok {
+				index[id] = len(logs)
+				logs = append(logs, chunk)
+				continue
+			}
+			logs[i].Dropped += chunk.Dropped
+			logs[i].Requests = append(logs[i].Requests, chunk.Requests...)
+		}
+		return nil
+	})
+	return logs, err
+}
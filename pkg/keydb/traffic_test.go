@@ -0,0 +1,130 @@
+package keydb
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
+	"github.com/tstromberg/pubkey-collector/pkg/traffic"
+)
+
+// trafficSave is one call to AppendTraffic by an instance
+type trafficSave struct {
+	instance string
+	// times are when each saved request was sent, as offsets from the test's now
+	times   []time.Duration
+	dropped int
+}
+
+func TestAppendTraffic(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	hour := now.Truncate(time.Hour)
+	tests := []struct {
+		name   string
+		saves  []trafficSave
+		retain time.Duration
+		// want maps instance and hour offset to the requests and dropped count of each merged log
+		want map[string][2]int
+		// wantChunks is how many records the logs are stored in
+		wantChunks int
+	}{
+		{name: "one save", saves: []trafficSave{{instance: "a", times: []time.Duration{-time.Minute, -2 * time.Minute}}},
+			want: map[string][2]int{"a 0s": {2, 0}}, wantChunks: 1},
+		{name: "saves of an hour are merged", saves: []trafficSave{
+			{instance: "a", times: []time.Duration{-20 * time.Minute}},
+			{instance: "a", times: []time.Duration{-10 * time.Minute, -5 * time.Minute}},
+			{instance: "a", dropped: 3},
+		}, want: map[string][2]int{"a 0s": {3, 3}}, wantChunks: 3},
+		{name: "a save spanning hours", saves: []trafficSave{{instance: "a", times: []time.Duration{-time.Hour, -time.Minute}}},
+			want: map[string][2]int{"a -1h0m0s": {1, 0}, "a 0s": {1, 0}}, wantChunks: 2},
+		{name: "instances kept apart", saves: []trafficSave{
+			{instance: "a", times: []time.Duration{-time.Minute}},
+			{instance: "a-b", times: []time.Duration{-time.Minute}},
+			{instance: "a", times: []time.Duration{-time.Minute}},
+		}, want: map[string][2]int{"a 0s": {2, 0}, "a-b 0s": {1, 0}}, wantChunks: 3},
+		{name: "hours before retention are pruned", retain: 2 * time.Hour, saves: []trafficSave{
+			{instance: "a", times: []time.Duration{-5 * time.Hour, -3 * time.Hour}},
+			{instance: "b", times: []time.Duration{-4 * time.Hour}},
+			{instance: "a", times: []time.Duration{-2 * time.Hour, -time.Minute}},
+		}, want: map[string][2]int{"a -2h0m0s": {1, 0}, "a 0s": {1, 0}}, wantChunks: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			db.SetClock(clock.Fixed(now))
+			retainSince := time.Time{}
+			if tt.retain > 0 {
+				retainSince = now.Add(-tt.retain)
+			}
+			for _, s := range tt.saves {
+				db.SetProvenance(Provenance{Instance: s.instance})
+				var reqs []traffic.Request
+				for _, d := range s.times {
+					reqs = append(reqs, traffic.Request{Time: now.Add(d), Host: "github.com", Class: ":user.keys", Status: 200})
+				}
+				if err := db.AppendTraffic(reqs, s.dropped, retainSince); err != nil {
+					t.Fatalf("AppendTraffic: %v", err)
+				}
+			}
+
+			logs, err := db.TrafficLogs(time.Time{})
+			if err != nil {
+				t.Fatalf("TrafficLogs: %v", err)
+			}
+			got := map[string][2]int{}
+			var hours []time.Time
+			for _, l := range logs {
+				got[fmt.Sprintf("%s %s", l.Instance, l.Hour.Sub(hour))] = [2]int{len(l.Requests), l.Dropped}
+				hours = append(hours, l.Hour)
+				for _, r := range l.Requests {
+					if !r.Time.Truncate(time.Hour).Equal(l.Hour) {
+						t.Errorf("log of %s holds a request sent at %s", l.Hour, r.Time)
+					}
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) || len(logs) != len(tt.want) {
+				t.Errorf("TrafficLogs() = %v, want %v", got, tt.want)
+			}
+			if !slices.IsSortedFunc(hours, func(a, b time.Time) int { return a.Compare(b) }) {
+				t.Errorf("TrafficLogs() hours %v are not oldest first", hours)
+			}
+			if n := countPrefix(t, db, trafficPrefix); n != tt.wantChunks {
+				t.Errorf("logs stored in %d chunks, want %d", n, tt.wantChunks)
+			}
+
+			recent, err := db.TrafficLogs(hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range recent {
+				if l.Hour.Before(hour) {
+					t.Errorf("TrafficLogs(%s) returned the log of %s", hour, l.Hour)
+				}
+			}
+		})
+	}
+}
+
+// countPrefix returns how many records in db have prefix
+func countPrefix(t *testing.T, db *KeyDB, prefix string) int {
+	t.Helper()
+	n := 0
+	err := db.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,66 @@
+package keydb
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// LastUsed records when a key was last used to authenticate, and where that was learned.
+// Most records have none: a missing LastUsed means unknown, not never used.
+type LastUsed struct {
+	At     time.Time `json:"at"`
+	Source string    `json:"source"`
+}
+
+// RecordKeyUsage sets LastUsed on stored keys whose fingerprint appears in usage (keyed as by
+// collect.NormalizeFingerprint) and whose owner matches. Recorded times only move forward.
+// It returns the number of keys updated.
+func (k *KeyDB) RecordKeyUsage(usage map[string]collect.KeyUsage, source string) (int, error) {
+	records, err := k.Matching(func(*Metadata) bool { return true })
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	err = checkSpace(k.update(func(txn *badger.Txn) error {
+		for key, md := range records {
+			u, ok := keyUsage(usage, key)
+			if !ok || !strings.EqualFold(u.Login, md.User) {
+				continue
+			}
+			if md.LastUsed != nil && !u.At.After(md.LastUsed.At) {
+				continue
+			}
+			md.LastUsed = &LastUsed{At: u.At, Source: source}
+			mdJSON, err := json.Marshal(md)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set([]byte(key), mdJSON); err != nil {
+				return err
+			}
+			updated++
+		}
+		return nil
+	}))
+	return updated, err
+}
+
+// keyUsage finds the usage for an authorized_keys line by its SHA256 or MD5 fingerprint
+func keyUsage(usage map[string]collect.KeyUsage, key string) (collect.KeyUsage, bool) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return collect.KeyUsage{}, false
+	}
+	if u, ok := usage[ssh.FingerprintSHA256(pk)]; ok {
+		return u, true
+	}
+	u, ok := usage["MD5:"+strings.ReplaceAll(ssh.FingerprintLegacyMD5(pk), ":", "")]
+	return u, ok
+}
@@ -0,0 +1,103 @@
+package keydb
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// userKeyPrefix is the key prefix for the index from owners to their stored keys. Entries are
+// userKeyPrefix + lower-cased login + "\x00" + key line, with an empty value.
+const userKeyPrefix = "ukey:"
+
+// userIndexMarker is present once every stored key has been indexed by owner. Databases written
+// before the index existed gain it the next time they are opened for writing.
+const userIndexMarker = userKeyPrefix
+
+// userKey returns the index entry pointing login at key
+func userKey(login, key string) []byte {
+	return []byte(userKeyPrefix + strings.ToLower(login) + "\x00" + key)
+}
+
+// indexUser points the owner index at key for user, removing the previous owner's entry if the key
+// has moved. It writes only if something changed.
+func indexUser(txn *badger.Txn, key, previous, user string) error {
+	if previous != "" && !strings.EqualFold(previous, user) {
+		if err := txn.Delete(userKey(previous, key)); err != nil {
+			return err
+		}
+	}
+	entry := userKey(user, key)
+	if _, err := txn.Get(entry); !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	return txn.Set(entry, nil)
+}
+
+// indexedUserKeys returns user's keys found through the owner index, and false if the index has not
+// been built. Entries left behind by keys that have since moved are ignored.
+func indexedUserKeys(txn *badger.Txn, user string) (map[string]*Metadata, bool, error) {
+	if _, err := txn.Get([]byte(userIndexMarker)); errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	prefix := userKey(user, "")
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	keys := map[string]*Metadata{}
+	for it.Rewind(); it.Valid(); it.Next() {
+		key := string(it.Item().Key()[len(prefix):])
+		md, err := getMetadata(txn, []byte(key))
+		if err != nil {
+			return nil, true, err
+		}
+		if md != nil && strings.EqualFold(md.User, user) {
+			keys[key] = md
+		}
+	}
+	return keys, true, nil
+}
+
+// buildUserIndex indexes every stored key by owner, if that has not been done yet
+func (k *KeyDB) buildUserIndex(ctx context.Context) error {
+	built := false
+	err := k.view(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(userIndexMarker))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		built = err == nil
+		return err
+	})
+	if err != nil || built {
+		return err
+	}
+
+	var entries [][]byte
+	err = k.ForEachKey(ctx, func(rec KeyRecord) error {
+		entries = append(entries, userKey(rec.User, rec.Key))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	k.enter()
+	defer k.swap.RUnlock()
+	wb := k.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, e := range append(entries, []byte(userIndexMarker)) {
+		if err := wb.Set(e, nil); err != nil {
+			return err
+		}
+	}
+	return checkSpace(wb.Flush())
+}
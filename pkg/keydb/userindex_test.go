@@ -0,0 +1,107 @@
+package keydb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+func TestUserKeys(t *testing.T) {
+	db := newTestDB(t)
+	at := time.Date(2026, 2, 1, 12, 0, 0, 0, time.UTC)
+	store := func(user string, at time.Time, keys ...string) {
+		t.Helper()
+		if err := db.Store(collect.UserInfo{Username: user, PublicKeys: keys}, user, at); err != nil {
+			t.Fatalf("Store(%s): %v", user, err)
+		}
+	}
+	store("Ada", at, testKey(t, 1), testKey(t, 2))
+	store("grace", at, testKey(t, 3))
+	// Key 2 moves to grace, and a late, older sighting by Ada doesn't move it back
+	store("grace", at.Add(time.Hour), testKey(t, 2))
+	store("ada", at.Add(-time.Hour), testKey(t, 2))
+	if _, err := db.RemoveDuplicates("grace", []string{testKey(t, 3)}); err != nil {
+		t.Fatalf("RemoveDuplicates: %v", err)
+	}
+
+	tests := []struct {
+		user string
+		want []string
+	}{
+		{user: "ada", want: []string{testKey(t, 1)}},
+		{user: "ADA", want: []string{testKey(t, 1)}},
+		{user: "grace", want: []string{testKey(t, 2)}},
+		{user: "linus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			keys, err := db.UserKeys(tt.user)
+			if err != nil {
+				t.Fatalf("UserKeys: %v", err)
+			}
+			if len(keys) != len(tt.want) {
+				t.Errorf("UserKeys(%s) returned %d keys, want %d", tt.user, len(keys), len(tt.want))
+			}
+			for _, key := range tt.want {
+				if keys[key] == nil {
+					t.Errorf("UserKeys(%s) is missing %.40s", tt.user, key)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildUserIndex(t *testing.T) {
+	dir := t.TempDir()
+	db, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Store(collect.UserInfo{Username: "ada", PublicKeys: []string{testKey(t, 1), testKey(t, 2)}}, "ada", time.Time{}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	// Drop the index, as in a database written before it existed
+	if err := db.db.DropPrefix([]byte(userKeyPrefix)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only opens can't build the index, so they scan
+	ro, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatalf("OpenReadOnly: %v", err)
+	}
+	if keys, err := ro.UserKeys("ada"); err != nil || len(keys) != 2 {
+		t.Errorf("read-only UserKeys(ada) = %d keys, %v; want 2", len(keys), err)
+	}
+	ro.Close()
+
+	db, err = New(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	err = db.view(func(txn *badger.Txn) error {
+		keys, indexed, err := indexedUserKeys(txn, "ada")
+		if !indexed || len(keys) != 2 {
+			t.Errorf("index after reopening has %d keys for ada (built: %v), want 2", len(keys), indexed)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.Count()
+	if err != nil || n != 2 {
+		t.Errorf("Count() = %d, %v; want 2 keys, the index not counted", n, err)
+	}
+	if err := db.buildUserIndex(context.Background()); err != nil {
+		t.Errorf("building again: %v", err)
+	}
+}
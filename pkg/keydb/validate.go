@@ -0,0 +1,112 @@
+package keydb
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+// FlagMalformed marks a key whose base64 decodes but whose blob is not a valid public key of its declared type
+const FlagMalformed = "malformed"
+
+// minRSABits is the smallest RSA modulus considered sane; GitHub has rejected smaller keys since 2021
+const minRSABits = 1024
+
+// minStrongRSABits is the smallest RSA modulus not reported by Weakness, as NIST has required since 2013
+const minStrongRSABits = 2048
+
+// ErrMalformed is returned (wrapped) by ValidateKey for keys whose decoded blob is invalid
+var ErrMalformed = errors.New("malformed key")
+
+// ValidateKey checks the wire format inside an authorized_keys line: the blob must parse with no
+// trailing bytes, its type must match the declared type, and RSA moduli and exponents must be sane.
+// Lines that aren't a type followed by base64 return a plain error; keys that decode but fail these
+// checks, typically from hand editing, return an error wrapping ErrMalformed.
+func ValidateKey(line string) (ssh.PublicKey, error) {
+	fields := keyFields(line)
+	if len(fields) < 2 {
+		return nil, errors.New("not a key: want type and base64 blob")
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("not a key: %w", err)
+	}
+
+	// ParsePublicKey checks lengths, trailing bytes and ed25519 key size
+	pk, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if pk.Type() != fields[0] {
+		return nil, fmt.Errorf("%w: declared %s but blob is %s", ErrMalformed, fields[0], pk.Type())
+	}
+	if ck, ok := pk.(ssh.CryptoPublicKey); ok {
+		if rk, ok := ck.CryptoPublicKey().(*rsa.PublicKey); ok {
+			if rk.N.Sign() <= 0 || rk.N.Bit(0) == 0 || rk.N.BitLen() < minRSABits {
+				return nil, fmt.Errorf("%w: implausible %d-bit RSA modulus", ErrMalformed, rk.N.BitLen())
+			}
+		}
+	}
+	return pk, nil
+}
+
+// keyFields splits an authorized_keys line on spaces and tabs only, as OpenSSH and ssh.ParseAuthorizedKey
+// do, so that a key accepted here is found again by its fingerprint
+func keyFields(line string) []string {
+	return strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' })
+}
+
+// Weakness returns why a valid key should no longer authorize access, such as "1024-bit RSA", or ""
+// if it isn't known to be weak. OpenSSH disabled DSA keys by default in 7.0.
+func Weakness(pk ssh.PublicKey) string {
+	if pk.Type() == ssh.KeyAlgoDSA {
+		return "DSA"
+	}
+	if ck, ok := pk.(ssh.CryptoPublicKey); ok {
+		if rk, ok := ck.CryptoPublicKey().(*rsa.PublicKey); ok && rk.N.BitLen() < minStrongRSABits {
+			return fmt.Sprintf("%d-bit RSA", rk.N.BitLen())
+		}
+	}
+	return ""
+}
+
+// FlagMalformedKeys re-validates every stored key, flagging the malformed ones that aren't flagged
+// yet, and returns how many it flagged. Keys stored before validation was added may need it.
+func (k *KeyDB) FlagMalformedKeys(ctx context.Context) (int, error) {
+	var bad []KeyRecord
+	err := k.ForEachKey(ctx, func(rec KeyRecord) error {
+		if _, err := ValidateKey(rec.Key); errors.Is(err, ErrMalformed) && !hasFlag(rec.Flags, FlagMalformed) {
+			bad = append(bad, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = checkSpace(k.update(func(txn *badger.Txn) error {
+		for _, rec := range bad {
+			rec.Flags = append(rec.Flags, FlagMalformed)
+			data, err := json.Marshal(rec.Metadata)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set([]byte(rec.Key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	if err != nil {
+		return 0, err
+	}
+	k.counters.Add("keys_malformed", int64(len(bad)))
+	return len(bad), nil
+}
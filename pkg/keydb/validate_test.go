@@ -0,0 +1,164 @@
+package keydb
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+)
+
+// rsaBlob returns an ssh-rsa wire-format blob with the given exponent and modulus
+func rsaBlob(e, n *big.Int) []byte {
+	return ssh.Marshal(struct {
+		Name string
+		E    *big.Int
+		N    *big.Int
+	}{ssh.KeyAlgoRSA, e, n})
+}
+
+// keyLine returns an authorized_keys line declaring keyType for blob
+func keyLine(keyType string, blob []byte) string {
+	return keyType + " " + base64.StdEncoding.EncodeToString(blob)
+}
+
+func TestValidateKey(t *testing.T) {
+	edBlob, err := base64.StdEncoding.DecodeString(strings.Fields(testKey(t, 1))[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := big.NewInt(int64(rsaKey.E))
+	evenN := new(big.Int).Lsh(rsaKey.N, 1)
+	smallN := new(big.Int).Rsh(rsaKey.N, 600)
+	smallN.SetBit(smallN, 0, 1)
+
+	tests := []struct {
+		name          string
+		line          string
+		wantMalformed bool
+		wantErr       bool
+	}{
+		{name: "ed25519", line: testKey(t, 1) + " ada@example.com"},
+		{name: "rsa", line: keyLine(ssh.KeyAlgoRSA, rsaBlob(e, rsaKey.N))},
+		{name: "ecdsa", line: ecdsaKey(t)},
+		{name: "declared type differs from blob", line: keyLine(ssh.KeyAlgoRSA, edBlob), wantMalformed: true},
+		{name: "truncated blob", line: keyLine(ssh.KeyAlgoED25519, edBlob[:len(edBlob)-4]), wantMalformed: true},
+		{name: "trailing bytes", line: keyLine(ssh.KeyAlgoED25519, append(append([]byte{}, edBlob...), 0, 0)), wantMalformed: true},
+		{name: "short ed25519 key", line: keyLine(ssh.KeyAlgoED25519, ssh.Marshal(struct {
+			Name string
+			Key  []byte
+		}{ssh.KeyAlgoED25519, make([]byte, ed25519.PublicKeySize-1)})), wantMalformed: true},
+		{name: "even rsa modulus", line: keyLine(ssh.KeyAlgoRSA, rsaBlob(e, evenN)), wantMalformed: true},
+		{name: "small rsa modulus", line: keyLine(ssh.KeyAlgoRSA, rsaBlob(e, smallN)), wantMalformed: true},
+		{name: "rsa exponent of one", line: keyLine(ssh.KeyAlgoRSA, rsaBlob(big.NewInt(1), rsaKey.N)), wantMalformed: true},
+		{name: "not base64", line: "ssh-ed25519 not!base64", wantErr: true},
+		{name: "type only", line: "ssh-ed25519", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pk, err := ValidateKey(tt.line)
+			if malformed := errors.Is(err, ErrMalformed); malformed != tt.wantMalformed {
+				t.Fatalf("ValidateKey error = %v, want malformed: %v", err, tt.wantMalformed)
+			}
+			if (err != nil) != (tt.wantMalformed || tt.wantErr) {
+				t.Fatalf("ValidateKey error = %v, want error: %v", err, tt.wantMalformed || tt.wantErr)
+			}
+			if err == nil && pk.Type() != keyFields(tt.line)[0] {
+				t.Errorf("parsed a %s, want %s", pk.Type(), keyFields(tt.line)[0])
+			}
+		})
+	}
+}
+
+func TestWeakness(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strong, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{name: "ed25519", line: testKey(t, 1)},
+		{name: "ecdsa", line: ecdsaKey(t)},
+		{name: "1024-bit rsa", line: keyLine(ssh.KeyAlgoRSA, rsaBlob(big.NewInt(int64(small.E)), small.N)), want: "1024-bit RSA"},
+		{name: "2048-bit rsa", line: keyLine(ssh.KeyAlgoRSA, rsaBlob(big.NewInt(int64(strong.E)), strong.N))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pk, err := ValidateKey(tt.line)
+			if err != nil {
+				t.Fatalf("ValidateKey: %v", err)
+			}
+			if got := Weakness(pk); got != tt.want {
+				t.Errorf("Weakness() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlagMalformedKeys(t *testing.T) {
+	db := newTestDB(t)
+	malformed := "ssh-rsa " + strings.Fields(testKey(t, 2))[1]
+	if err := db.Store(collect.UserInfo{Username: "ada", PublicKeys: []string{testKey(t, 1), malformed}}, "ada", time.Time{}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if got := db.Counts()["keys_malformed"]; got != 1 {
+		t.Errorf("Store counted %d malformed keys, want 1", got)
+	}
+
+	// A record written before validation existed carries no flag
+	legacy := "ssh-ed25519 " + strings.Fields(ecdsaKey(t))[1]
+	err := db.update(func(txn *badger.Txn) error {
+		data, err := json.Marshal(Metadata{User: "grace", Timestamp: time.Now(), Purpose: PurposeAuth})
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(legacy), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int{1, 0} {
+		n, err := db.FlagMalformedKeys(context.Background())
+		if err != nil {
+			t.Fatalf("FlagMalformedKeys: %v", err)
+		}
+		if n != want {
+			t.Errorf("pass %d flagged %d keys, want %d", i+1, n, want)
+		}
+	}
+	for key, want := range map[string]bool{testKey(t, 1): false, malformed: true, legacy: true} {
+		md, err := db.Lookup(key)
+		if err != nil {
+			t.Fatalf("Lookup(%.40s): %v", key, err)
+		}
+		if got := hasFlag(md.Flags, FlagMalformed); got != want {
+			t.Errorf("%.40s: flags %v, want malformed: %v", key, md.Flags, want)
+		}
+	}
+	if got := db.Counts()["keys_malformed"]; got != 2 {
+		t.Errorf("keys_malformed = %d, want 2", got)
+	}
+}
@@ -0,0 +1,328 @@
+// Package lists loads line-oriented list files, such as blocklists, from a local path or an HTTPS URL
+// and keeps them current. Entries are the lines with blank lines and # comments removed.
+//
+// Remote lists are refreshed with ETag-conditional requests, can be required to carry an Ed25519
+// signature, and are cached on disk so that a collector starting while the server is unreachable
+// uses the last good copy. Content that fails to fetch, verify or validate never replaces the
+// current entries.
+package lists
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxListSize bounds how much of a remote list or signature is read
+const maxListSize = 16 << 20
+
+// Options configure how a list is loaded
+type Options struct {
+	// CacheDir holds the last good copy of remote lists. Empty disables the cache.
+	CacheDir string
+	// PublicKey, if set, must have signed remote content. The signature is fetched from the list URL
+	// with ".sig" appended, as base64.
+	PublicKey ed25519.PublicKey
+	// Validate, if set, rejects malformed entries before they replace the current ones.
+	Validate func(entries []string) error
+	// Client fetches remote lists; nil means a client with a 30 second timeout.
+	Client *http.Client
+}
+
+// List is a list loaded from a file or URL. It is safe for concurrent use.
+type List struct {
+	src  string
+	opts Options
+
+	mu       sync.RWMutex
+	entries  []string
+	version  string
+	etag     string
+	onChange []func(entries []string)
+}
+
+// cached is a remote list as saved in the cache directory
+type cached struct {
+	Source  string    `json:"source"`
+	ETag    string    `json:"etag,omitempty"`
+	Fetched time.Time `json:"fetched"`
+	Content []byte    `json:"content"`
+}
+
+// Open loads the list at src, a file path or https:// URL. If a remote list cannot be fetched, the
+// cached copy is used instead; Open fails only if neither is usable.
+func Open(src string, opts Options) (*List, error) {
+	if strings.HasPrefix(src, "http://") {
+		return nil, fmt.Errorf("list %s must be fetched over https", src)
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	l := &List{src: src, opts: opts}
+
+	_, err := l.Refresh(context.Background())
+	if err == nil || !l.remote() {
+		return l, err
+	}
+	c, cerr := l.readCache()
+	if cerr != nil {
+		return nil, fmt.Errorf("%w (and no cached copy: %v)", err, cerr)
+	}
+	if serr := l.set(c.Content, c.ETag); serr != nil {
+		return nil, fmt.Errorf("%w (and cached copy unusable: %v)", err, serr)
+	}
+	log.Printf("Fetching list %s failed, using the copy cached %s (version %s): %v", src, c.Fetched.Format(time.RFC3339), l.Version(), err)
+	return l, nil
+}
+
+// Entries returns the current entries.
+func (l *List) Entries() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.entries
+}
+
+// Version identifies the current content: "sha256:" and the start of its hash.
+func (l *List) Version() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.version
+}
+
+// Source returns the path or URL the list is loaded from.
+func (l *List) Source() string {
+	return l.src
+}
+
+// OnChange calls fn with the current entries, and again with the new entries whenever they change.
+func (l *List) OnChange(fn func(entries []string)) {
+	l.mu.Lock()
+	l.onChange = append(l.onChange, fn)
+	entries := l.entries
+	l.mu.Unlock()
+	fn(entries)
+}
+
+// Refresh re-reads the list, reporting whether its content changed. On error the current entries are kept.
+func (l *List) Refresh(ctx context.Context) (bool, error) {
+	if !l.remote() {
+		content, err := os.ReadFile(l.src)
+		if err != nil {
+			return false, err
+		}
+		return l.update(content, "")
+	}
+
+	l.mu.RLock()
+	etag := l.etag
+	l.mu.RUnlock()
+	content, newTag, err := l.fetch(ctx, l.src, etag)
+	if err != nil || content == nil {
+		return false, err
+	}
+	if l.opts.PublicKey != nil {
+		sig, _, err := l.fetch(ctx, l.src+".sig", "")
+		if err != nil {
+			return false, fmt.Errorf("fetch signature: %w", err)
+		}
+		if err := verify(l.opts.PublicKey, content, sig); err != nil {
+			return false, err
+		}
+	}
+	changed, err := l.update(content, newTag)
+	if err != nil {
+		return false, err
+	}
+	if err := l.writeCache(content, newTag); err != nil {
+		log.Printf("Failed to cache list %s: %v", l.src, err)
+	}
+	return changed, nil
+}
+
+// Watch refreshes the list every interval until ctx is done, logging version changes and failures.
+func (l *List) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		changed, err := l.Refresh(ctx)
+		switch {
+		case err != nil:
+			log.Printf("Keeping list %s version %s; refresh failed: %v", l.src, l.Version(), err)
+		case changed:
+			log.Printf("List %s is now version %s (%d entries)", l.src, l.Version(), len(l.Entries()))
+		}
+	}
+}
+
+// remote reports whether the list is loaded from a URL
+func (l *List) remote() bool {
+	return strings.HasPrefix(l.src, "https://")
+}
+
+// update replaces the entries with content unless it is unchanged or invalid, reporting whether it changed
+func (l *List) update(content []byte, etag string) (bool, error) {
+	if version(content) == l.Version() {
+		l.mu.Lock()
+		l.etag = etag
+		l.mu.Unlock()
+		return false, nil
+	}
+	return true, l.set(content, etag)
+}
+
+// set parses and validates content, then makes it current and notifies OnChange functions
+func (l *List) set(content []byte, etag string) error {
+	entries, err := parse(content)
+	if err != nil {
+		return err
+	}
+	if l.opts.Validate != nil {
+		if err := l.opts.Validate(entries); err != nil {
+			return fmt.Errorf("list %s: %w", l.src, err)
+		}
+	}
+
+	l.mu.Lock()
+	l.entries, l.version, l.etag = entries, version(content), etag
+	fns := append([]func([]string){}, l.onChange...)
+	l.mu.Unlock()
+	for _, fn := range fns {
+		fn(entries)
+	}
+	return nil
+}
+
+// fetch GETs url, returning nil content if the server reports it unchanged since etag
+func (l *List) fetch(ctx context.Context, url, etag string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := l.opts.Client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, nil
+	case http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("fetch %s: status %d", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) > maxListSize {
+		return nil, "", fmt.Errorf("fetch %s: larger than %d bytes", url, maxListSize)
+	}
+	return body, resp.Header.Get("ETag"), nil
+}
+
+// verify checks a base64 Ed25519 signature of content
+func verify(pub ed25519.PublicKey, content, sig []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	if !ed25519.Verify(pub, content, raw) {
+		return errors.New("signature does not match the list's public key")
+	}
+	return nil
+}
+
+// cachePath returns where the remote list is cached
+func (l *List) cachePath() string {
+	sum := sha256.Sum256([]byte(l.src))
+	return filepath.Join(l.opts.CacheDir, fmt.Sprintf("%x.json", sum[:8]))
+}
+
+// readCache returns the cached copy of the remote list
+func (l *List) readCache() (*cached, error) {
+	if l.opts.CacheDir == "" {
+		return nil, errors.New("caching is disabled")
+	}
+	data, err := os.ReadFile(l.cachePath())
+	if err != nil {
+		return nil, err
+	}
+	c := &cached{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if c.Source != l.src {
+		return nil, fmt.Errorf("cache %s holds %s", l.cachePath(), c.Source)
+	}
+	return c, nil
+}
+
+// writeCache atomically replaces the cached copy of the remote list
+func (l *List) writeCache(content []byte, etag string) error {
+	if l.opts.CacheDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(cached{Source: l.src, ETag: etag, Fetched: time.Now(), Content: content})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.opts.CacheDir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(l.opts.CacheDir, ".list-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.cachePath())
+}
+
+// parse returns the entries of list content
+func parse(content []byte) ([]string, error) {
+	var entries []string
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, s.Err()
+}
+
+// version returns the version string of list content
+func version(content []byte) string {
+	sum := sha256.Sum256(content)
+	return fmt.Sprintf("sha256:%x", sum[:6])
+}
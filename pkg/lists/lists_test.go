@@ -0,0 +1,226 @@
+package lists
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// listServer serves one list and its signature, counting conditional requests answered 304
+type listServer struct {
+	mu      sync.Mutex
+	content string
+	status  int
+	sig     string
+	notMod  int
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	if r.URL.Path == "/list.sig" {
+		fmt.Fprint(w, s.sig)
+		return
+	}
+	etag := `"` + version([]byte(s.content)) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		s.notMod++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	fmt.Fprint(w, s.content)
+}
+
+// set changes what the server returns; status 0 serves content normally
+func (s *listServer) set(content string, status int, sig string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.content, s.status, s.sig = content, status, sig
+}
+
+// newListServer starts an HTTPS server for s, returning the list URL and a client trusting it
+func newListServer(t *testing.T, s *listServer) (string, *http.Client) {
+	t.Helper()
+	ts := httptest.NewTLSServer(s)
+	t.Cleanup(ts.Close)
+	return ts.URL + "/list", ts.Client()
+}
+
+// sign returns the base64 Ed25519 signature of content
+func sign(key ed25519.PrivateKey, content string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(content)))
+}
+
+// noBad rejects entries containing "bad"
+func noBad(entries []string) error {
+	for _, e := range entries {
+		if strings.Contains(e, "bad") {
+			return fmt.Errorf("malformed entry %q", e)
+		}
+	}
+	return nil
+}
+
+func TestOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "blocked.txt")
+	if err := os.WriteFile(path, []byte("# blocked keys\n\nalpha\n  beta  # leaked\n#gamma\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		src     string
+		opts    Options
+		want    []string
+		wantErr bool
+	}{
+		{name: "entries", src: path, want: []string{"alpha", "beta  # leaked"}},
+		{name: "missing file", src: filepath.Join(dir, "none.txt"), wantErr: true},
+		{name: "plain http", src: "http://example.com/list", wantErr: true},
+		{name: "validation", src: path, opts: Options{Validate: func([]string) error { return errors.New("no") }}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := Open(tt.src, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open error = %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil && !slices.Equal(l.Entries(), tt.want) {
+				t.Errorf("Entries() = %q, want %q", l.Entries(), tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenRemote(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const good = "alpha\nbeta\n"
+
+	tests := []struct {
+		name string
+		// cached is served, and so cached, before the list is opened again with what the server has now
+		cached  string
+		content string
+		status  int
+		sig     string
+		signed  bool
+		want    []string
+		wantErr bool
+	}{
+		{name: "fetched", content: good, want: []string{"alpha", "beta"}},
+		{name: "signed", content: good, sig: sign(priv, good), signed: true, want: []string{"alpha", "beta"}},
+		{name: "signed by another key", content: good, sig: sign(otherKey, good), signed: true, wantErr: true},
+		{name: "signature not base64", content: good, sig: "!!", signed: true, wantErr: true},
+		{name: "malformed content", content: "alpha\nbad\n", wantErr: true},
+		{name: "server down", status: http.StatusBadGateway, wantErr: true},
+		{name: "server down, cached copy", cached: good, status: http.StatusBadGateway, want: []string{"alpha", "beta"}},
+		{name: "malformed content, cached copy", cached: good, content: "bad\n", want: []string{"alpha", "beta"}},
+		{name: "bad signature, cached copy", cached: good, content: "gamma\n", sig: sign(otherKey, "gamma\n"), signed: true,
+			want: []string{"alpha", "beta"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &listServer{}
+			url, client := newListServer(t, s)
+			opts := Options{CacheDir: t.TempDir(), Validate: noBad, Client: client}
+			if tt.signed {
+				opts.PublicKey = pub
+			}
+			if tt.cached != "" {
+				s.set(tt.cached, 0, sign(priv, tt.cached))
+				if _, err := Open(url, opts); err != nil {
+					t.Fatalf("Open to fill the cache: %v", err)
+				}
+			}
+
+			s.set(tt.content, tt.status, tt.sig)
+			l, err := Open(url, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open error = %v, want error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !slices.Equal(l.Entries(), tt.want) {
+				t.Errorf("Entries() = %q, want %q", l.Entries(), tt.want)
+			}
+			if want := version([]byte(good)); l.Version() != want {
+				t.Errorf("Version() = %s, want %s", l.Version(), want)
+			}
+		})
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	s := &listServer{content: "alpha\n"}
+	url, client := newListServer(t, s)
+	l, err := Open(url, Options{Validate: noBad, Client: client})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	var changes [][]string
+	l.OnChange(func(entries []string) { changes = append(changes, entries) })
+
+	// Each step changes what the server returns, then refreshes; the entries carry over between steps
+	steps := []struct {
+		name        string
+		content     string
+		status      int
+		wantChanged bool
+		wantErr     bool
+		want        []string
+		// wantNotMod counts the 304 responses so far
+		wantNotMod int
+	}{
+		{name: "unchanged", content: "alpha\n", want: []string{"alpha"}, wantNotMod: 1},
+		{name: "new entries", content: "alpha\nbeta\n", wantChanged: true, want: []string{"alpha", "beta"}, wantNotMod: 1},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true, want: []string{"alpha", "beta"}, wantNotMod: 1},
+		{name: "malformed content", content: "alpha\nbad\n", wantErr: true, want: []string{"alpha", "beta"}, wantNotMod: 1},
+		{name: "recovered", content: "alpha\nbeta\n", want: []string{"alpha", "beta"}, wantNotMod: 2},
+		{name: "comments only differ", content: "# v2\nalpha\nbeta\n", wantChanged: true, want: []string{"alpha", "beta"}, wantNotMod: 2},
+		{name: "emptied", content: "# nothing blocked\n", wantChanged: true, wantNotMod: 2},
+	}
+	for _, st := range steps {
+		s.set(st.content, st.status, "")
+		changed, err := l.Refresh(context.Background())
+		if (err != nil) != st.wantErr {
+			t.Fatalf("%s: Refresh error = %v, want error: %v", st.name, err, st.wantErr)
+		}
+		if changed != st.wantChanged {
+			t.Errorf("%s: Refresh changed = %v, want %v", st.name, changed, st.wantChanged)
+		}
+		if !slices.Equal(l.Entries(), st.want) {
+			t.Errorf("%s: Entries() = %q, want %q", st.name, l.Entries(), st.want)
+		}
+		if s.notMod != st.wantNotMod {
+			t.Errorf("%s: server has answered %d requests with 304, want %d", st.name, s.notMod, st.wantNotMod)
+		}
+	}
+	// The initial entries, then one call per change
+	if len(changes) != 4 {
+		t.Errorf("OnChange called %d times, want 4: %q", len(changes), changes)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package ratebudget
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// lockFile is unsupported without flock, so coordination is never available
+func lockFile(f *os.File, timeout time.Duration) error {
+	return errors.ErrUnsupported
+}
+
+// unlockFile releases the lock taken by lockFile
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,293 @@
+// Package ratebudget divides one GitHub token's core API quota between processes on a host that share
+// it, such as an org mirror and a stream collector. Each process registers as a consumer in a shared
+// lease file and takes one request at a time from it; the file is updated under an exclusive lock, with
+// the quota refreshed from GitHub's rate limit headers.
+//
+// Each active consumer is entitled to an equal share of the quota for the current reset window. A
+// consumer may use more than its share only while enough quota remains to cover what the others have
+// not yet used of theirs, and those reservations shrink as the window runs out, so quota left by an
+// idle consumer is handed to busy ones late in the window. Consumers that stop making requests drop
+// out after a few minutes.
+//
+// Coordination is best effort: if the lease file cannot be locked, read or written, a process logs it
+// once and carries on as if it had the quota to itself.
+package ratebudget
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// consumerTTL is how long a consumer stays registered after its last request
+	consumerTTL = 3 * time.Minute
+	// pollInterval is how often a consumer over its allocation rechecks the lease file
+	pollInterval = 5 * time.Second
+	// lockTimeout is how long to wait for another process to release the lease file
+	lockTimeout = time.Second
+	// probeTimeout is how long a request sent to learn the quota may go unanswered before another is allowed
+	probeTimeout = 30 * time.Second
+	// probeWait is how often consumers waiting on such a request recheck the lease file
+	probeWait = 200 * time.Millisecond
+)
+
+// state is the contents of the lease file
+type state struct {
+	// Reset ends the current window; zero means no window is known yet
+	Reset time.Time `json:"reset"`
+	// WindowStart is when this file first saw the window
+	WindowStart time.Time `json:"window_start"`
+	// Quota is the remaining quota when the window was first seen
+	Quota int `json:"quota"`
+	// Remaining is Quota less the requests granted since, or lower if GitHub reports less
+	Remaining int `json:"remaining"`
+	// Probe is when the single request allowed while no window is known was granted
+	Probe     time.Time            `json:"probe,omitempty"`
+	Consumers map[string]*consumer `json:"consumers"`
+}
+
+// consumer is one registered process
+type consumer struct {
+	Seen time.Time `json:"seen"`
+	// Used is the requests granted to the consumer in the current window
+	Used int `json:"used"`
+}
+
+// Budget is one process's registration in a lease file. It is safe for concurrent use.
+type Budget struct {
+	path string
+	id   string
+	// mu serializes this process's updates; the file lock serializes processes
+	mu       sync.Mutex
+	degraded bool
+}
+
+// Open registers consumer id in the lease file at path, creating it if needed. It fails if the file
+// cannot be locked and updated, in which case the caller should run uncoordinated.
+func Open(path, id string) (*Budget, error) {
+	b := &Budget{path: path, id: id}
+	err := b.update(func(s *state, now time.Time) {})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close unregisters the consumer, releasing its share to the others.
+func (b *Budget) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.updateLocked(func(s *state, now time.Time) {
+		delete(s.Consumers, b.id)
+	})
+}
+
+// Acquire waits until the consumer may make one core API request, or ctx is done. If the lease file
+// becomes unusable it returns nil at once, leaving GitHub's own limit to apply.
+func (b *Budget) Acquire(ctx context.Context) error {
+	for {
+		var granted bool
+		var wait time.Duration
+		err := b.update(func(s *state, now time.Time) {
+			granted, wait = s.take(b.id, now)
+		})
+		if err != nil {
+			b.degrade(err)
+			return nil
+		}
+		if granted {
+			return nil
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Observe updates the shared quota from a GitHub API response's rate limit headers, which may be
+// missing if the request failed. Responses for other rate limit resources, such as search, are ignored.
+func (b *Budget) Observe(h http.Header) {
+	if r := h.Get("X-RateLimit-Resource"); r != "" && r != "core" {
+		return
+	}
+	remaining, err1 := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	resetUnix, err2 := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	reset := time.Unix(resetUnix, 0)
+
+	err := b.update(func(s *state, now time.Time) {
+		s.Probe = time.Time{}
+		if err1 != nil || err2 != nil {
+			return
+		}
+		if !reset.Equal(s.Reset) {
+			if reset.Before(s.Reset) {
+				// A response from the previous window arriving late
+				return
+			}
+			s.Reset, s.WindowStart, s.Quota, s.Remaining = reset, now, remaining, remaining
+			for _, c := range s.Consumers {
+				c.Used = 0
+			}
+			return
+		}
+		s.Remaining = min(s.Remaining, remaining)
+	})
+	if err != nil {
+		b.degrade(err)
+	}
+}
+
+// take grants consumer id one request if its allocation allows, or returns how long to wait before
+// asking again.
+func (s *state) take(id string, now time.Time) (bool, time.Duration) {
+	me := s.Consumers[id]
+	if s.Reset.IsZero() || !now.Before(s.Reset) {
+		// No current window: let one request through at a time until a response starts one
+		if now.Sub(s.Probe) < probeTimeout {
+			return false, probeWait
+		}
+		s.Probe = now
+		return true, 0
+	}
+
+	share := float64(s.Quota) / float64(len(s.Consumers))
+	left := 1.0
+	if window := s.Reset.Sub(s.WindowStart); window > 0 {
+		left = min(float64(s.Reset.Sub(now))/float64(window), 1)
+	}
+	reserved := 0.0
+	for cid, c := range s.Consumers {
+		if cid != id {
+			reserved += max(share-float64(c.Used), 0) * left
+		}
+	}
+
+	if float64(s.Remaining-1) >= math.Ceil(reserved) {
+		s.Remaining--
+		me.Used++
+		return true, 0
+	}
+	return false, min(pollInterval, s.Reset.Sub(now)+time.Second)
+}
+
+// update applies fn to the lease file under its lock, after registering this consumer and dropping
+// those that have gone quiet.
+func (b *Budget) update(fn func(s *state, now time.Time)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.updateLocked(func(s *state, now time.Time) {
+		for id, c := range s.Consumers {
+			if now.Sub(c.Seen) > consumerTTL {
+				delete(s.Consumers, id)
+			}
+		}
+		if s.Consumers[b.id] == nil {
+			s.Consumers[b.id] = &consumer{}
+		}
+		s.Consumers[b.id].Seen = now
+		fn(s, now)
+	})
+}
+
+// updateLocked is update without registration; b.mu must be held.
+func (b *Budget) updateLocked(fn func(s *state, now time.Time)) error {
+	lock, err := os.OpenFile(b.path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock, lockTimeout); err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	s := &state{}
+	data, err := os.ReadFile(b.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	case json.Unmarshal(data, s) != nil:
+		// Start over rather than stop coordinating; GitHub's headers restore the quota.
+		log.Printf("Rate budget %s is corrupt; resetting it", b.path)
+		s = &state{}
+	}
+	if s.Consumers == nil {
+		s.Consumers = map[string]*consumer{}
+	}
+	fn(s, time.Now())
+
+	data, err = json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), ".ratebudget-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
+
+// degrade logs, once, that coordination has stopped working
+func (b *Budget) degrade(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.degraded {
+		log.Printf("Rate budget %s unavailable, continuing without coordination: %v", b.path, err)
+		b.degraded = true
+	}
+}
+
+// Transport returns an http.RoundTripper that takes each core API request from b and feeds responses
+// back to it. base defaults to http.DefaultTransport.
+func (b *Budget) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{budget: b, base: base}
+}
+
+// transport is the RoundTripper returned by Budget.Transport
+type transport struct {
+	budget *Budget
+	base   http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Checking the rate limit is free, and search has its own quota
+	if req.URL.Path != "/rate_limit" && !strings.HasPrefix(req.URL.Path, "/search/") {
+		if err := t.budget.Acquire(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.budget.Observe(http.Header{})
+		return nil, err
+	}
+	t.budget.Observe(resp.Header)
+	return resp, nil
+}
@@ -0,0 +1,286 @@
+package ratebudget
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openBudget registers id in the lease file at path, skipping the test where files can't be locked
+func openBudget(t *testing.T, path, id string) *Budget {
+	t.Helper()
+	b, err := Open(path, id)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("lease files need flock")
+	}
+	if err != nil {
+		t.Fatalf("Open(%s): %v", id, err)
+	}
+	return b
+}
+
+// rateHeaders returns the core rate limit headers of a response with remaining requests left until reset
+func rateHeaders(remaining int, reset time.Time) http.Header {
+	h := http.Header{}
+	h.Set("X-RateLimit-Resource", "core")
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	return h
+}
+
+// acquireAll takes requests from b until ctx is done, returning how many were granted
+func acquireAll(ctx context.Context, b *Budget) int {
+	n := 0
+	for b.Acquire(ctx) == nil {
+		n++
+	}
+	return n
+}
+
+// readState reads the lease file at path
+func readState(t *testing.T, path string) *state {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &state{}
+	if err := json.Unmarshal(data, s); err != nil {
+		t.Fatalf("lease file: %v", err)
+	}
+	return s
+}
+
+func TestTake(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		state state
+		want  bool
+	}{
+		{name: "first probe", state: state{}, want: true},
+		{name: "probe already in flight", state: state{Probe: now.Add(-time.Second)}},
+		{name: "unanswered probe times out", state: state{Probe: now.Add(-probeTimeout)}, want: true},
+		{name: "window over", state: state{Reset: now, WindowStart: now.Add(-time.Hour), Quota: 100, Remaining: 100}, want: true},
+		{name: "within share", state: state{Reset: now.Add(time.Hour), WindowStart: now, Quota: 10, Remaining: 6,
+			Consumers: map[string]*consumer{"other": {Seen: now}}}, want: true},
+		{name: "others' reservations", state: state{Reset: now.Add(time.Hour), WindowStart: now, Quota: 10, Remaining: 5,
+			Consumers: map[string]*consumer{"other": {Seen: now}}}},
+		{name: "reservation shrinks late in the window", state: state{Reset: now.Add(time.Minute), WindowStart: now.Add(-59 * time.Minute), Quota: 10, Remaining: 5,
+			Consumers: map[string]*consumer{"other": {Seen: now}}}, want: true},
+		{name: "others used their share", state: state{Reset: now.Add(time.Hour), WindowStart: now, Quota: 10, Remaining: 1,
+			Consumers: map[string]*consumer{"other": {Seen: now, Used: 5}}}, want: true},
+		{name: "quota exhausted", state: state{Reset: now.Add(time.Hour), WindowStart: now, Quota: 10, Remaining: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.state
+			if s.Consumers == nil {
+				s.Consumers = map[string]*consumer{}
+			}
+			me := &consumer{Seen: now, Used: 5}
+			s.Consumers["me"] = me
+			remaining, used := s.Remaining, me.Used
+
+			granted, wait := s.take("me", now)
+			if granted != tt.want {
+				t.Fatalf("take() granted %v, want %v", granted, tt.want)
+			}
+			if !granted && wait <= 0 {
+				t.Errorf("refused with a wait of %s", wait)
+			}
+			if granted && !s.Reset.IsZero() && now.Before(s.Reset) && (s.Remaining != remaining-1 || me.Used != used+1) {
+				t.Errorf("granted with remaining %d, used %d; want %d, %d", s.Remaining, me.Used, remaining-1, used+1)
+			}
+		})
+	}
+}
+
+func TestConsumersShareQuota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budget.json")
+	ids := []string{"mirror", "stream", "backfill"}
+	var budgets []*Budget
+	for _, id := range ids {
+		budgets = append(budgets, openBudget(t, path, id))
+	}
+	budgets[0].Observe(rateHeaders(30, time.Now().Add(time.Hour)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	granted := make([]int, len(budgets))
+	var wg sync.WaitGroup
+	for i, b := range budgets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			granted[i] = acquireAll(ctx, b)
+		}()
+	}
+	wg.Wait()
+
+	for i, n := range granted {
+		if n != 10 {
+			t.Errorf("%s was granted %d requests, want its share of 10", ids[i], n)
+		}
+	}
+	if s := readState(t, path); s.Remaining != 0 {
+		t.Errorf("lease file has %d requests remaining, want 0", s.Remaining)
+	}
+}
+
+// TestHelperConsumer is a consumer process for TestProcessesShareQuota; it does nothing on its own
+func TestHelperConsumer(t *testing.T) {
+	path, id := os.Getenv("RATEBUDGET_LEASE"), os.Getenv("RATEBUDGET_ID")
+	if path == "" {
+		t.Skip("run by TestProcessesShareQuota")
+	}
+	b, err := Open(path, id)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	fmt.Printf("granted=%d\n", acquireAll(ctx, b))
+}
+
+func TestProcessesShareQuota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budget.json")
+	ids := []string{"mirror", "stream", "backfill", "report"}
+	// Register everyone before the window starts so each is entitled to a quarter
+	for _, id := range ids {
+		openBudget(t, path, id)
+	}
+	openBudget(t, path, ids[0]).Observe(rateHeaders(40, time.Now().Add(time.Hour)))
+
+	granted := make([]int, len(ids))
+	errs := make([]error, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestHelperConsumer$")
+			cmd.Env = append(os.Environ(), "RATEBUDGET_LEASE="+path, "RATEBUDGET_ID="+id)
+			out, err := cmd.Output()
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w: %s", id, err, out)
+				return
+			}
+			for _, line := range strings.Fields(string(out)) {
+				if n, ok := strings.CutPrefix(line, "granted="); ok {
+					granted[i], errs[i] = strconv.Atoi(n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for i, n := range granted {
+		if errs[i] != nil {
+			t.Fatalf("consumer process: %v", errs[i])
+		}
+		if n != 10 {
+			t.Errorf("%s was granted %d requests, want its share of 10", ids[i], n)
+		}
+		total += n
+	}
+	if total > 40 {
+		t.Errorf("processes were granted %d requests in total, more than the quota of 40", total)
+	}
+}
+
+func TestExpiredConsumerReleasesReservation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budget.json")
+	b := openBudget(t, path, "stream")
+	b.Observe(rateHeaders(10, time.Now().Add(time.Hour)))
+
+	// A consumer that registered, then stopped making requests without closing
+	s := readState(t, path)
+	s.Consumers["mirror"] = &consumer{Seen: time.Now().Add(-consumerTTL - time.Minute)}
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if n := acquireAll(ctx, b); n != 10 {
+		t.Errorf("granted %d requests, want the whole quota of 10", n)
+	}
+	if s := readState(t, path); s.Consumers["mirror"] != nil {
+		t.Errorf("expired consumer is still registered: %+v", s.Consumers["mirror"])
+	}
+}
+
+func TestCloseReleasesShare(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budget.json")
+	stream, mirror := openBudget(t, path, "stream"), openBudget(t, path, "mirror")
+	stream.Observe(rateHeaders(10, time.Now().Add(time.Hour)))
+	if err := mirror.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if n := acquireAll(ctx, stream); n != 10 {
+		t.Errorf("granted %d requests, want the whole quota of 10", n)
+	}
+}
+
+func TestCorruptLeaseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budget.json")
+	if err := os.WriteFile(path, []byte(`{"reset": "not a time", "consumers": {`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	b := openBudget(t, path, "stream")
+	if s := readState(t, path); s.Consumers["stream"] == nil || !s.Reset.IsZero() {
+		t.Errorf("lease file after reset = %+v, want only the new registration", s)
+	}
+
+	// With no window known, one probe request goes through until a response starts one
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := b.Acquire(ctx); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	b.Observe(rateHeaders(3, time.Now().Add(time.Hour)))
+	if n := acquireAll(ctx, b); n != 3 {
+		t.Errorf("granted %d requests after the reset, want 3", n)
+	}
+}
+
+func TestUnusableLeaseFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "budget.json")
+	b := openBudget(t, path, "stream")
+	b.Observe(rateHeaders(0, time.Now().Add(time.Hour)))
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Coordination is lost, so requests go ahead and GitHub's own limit applies
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	for i := range 3 {
+		if err := b.Acquire(ctx); err != nil {
+			t.Fatalf("Acquire %d without a lease file: %v", i, err)
+		}
+	}
+	if _, err := Open(path, "mirror"); err == nil {
+		t.Error("Open succeeded without a directory for the lease file")
+	}
+}
@@ -0,0 +1,177 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// DefaultMinPopulation is the fewest users any aggregate may describe, unless configured
+const DefaultMinPopulation = 10
+
+// ageRounding is the granularity of reported key ages, so a percentile doesn't give away one user's
+// exact first-seen date
+const ageRounding = 30 * 24 * time.Hour
+
+// otherBucket names the bucket that small buckets are merged into
+const otherBucket = "other"
+
+// AggregateFilter narrows the population an aggregate report describes. It deliberately has no way
+// to name a key, fingerprint or user: only populations can be selected.
+type AggregateFilter struct {
+	// KeyType limits the report to keys of this type, such as "ssh-ed25519".
+	KeyType string `json:"key_type,omitempty"`
+	// SeenAfter and SeenBefore bound when keys were last seen on GitHub; nil means unbounded. They
+	// are truncated to whole UTC days, so windows a moment apart can't be compared to single out
+	// the users seen in between.
+	SeenAfter  *time.Time `json:"seen_after,omitempty"`
+	SeenBefore *time.Time `json:"seen_before,omitempty"`
+}
+
+// AggregateBucket is a count of distinct users
+type AggregateBucket struct {
+	Name  string `json:"name"`
+	Users int    `json:"users"`
+}
+
+// AggregateReport is statistics about a population of users that are safe to share outside the
+// team: every number in it describes at least MinPopulation users.
+type AggregateReport struct {
+	Generated     time.Time       `json:"generated"`
+	MinPopulation int             `json:"min_population"`
+	Filter        AggregateFilter `json:"filter"`
+	// Withheld is set when the filtered population is smaller than MinPopulation; nothing else is reported.
+	Withheld bool `json:"withheld,omitempty"`
+	Users    int  `json:"users,omitempty"`
+	// Algorithms counts users with at least one key of each type. Types held by fewer than
+	// MinPopulation users are merged into "other", along with the next smallest types if needed to
+	// make "other" big enough.
+	Algorithms []AggregateBucket `json:"algorithms,omitempty"`
+	// KeyAgeDays are percentiles ("p10" to "p90") of how long ago each user's oldest key was first
+	// seen, or created if GitHub said, rounded to 30 days. Each user counts once.
+	KeyAgeDays map[string]int `json:"key_age_days,omitempty"`
+}
+
+// Aggregates computes the statistics of an AggregateReport for the users with keys matching f, as of
+// now. minPopulation is the smallest number of users a reported number may describe; zero means
+// DefaultMinPopulation, and values below 2 are refused since they would describe individuals.
+//
+// Thresholds are enforced here, for every consumer, rather than left to callers to apply: buckets
+// and percentiles are computed from distinct users, then withheld or merged before anything is
+// returned.
+func Aggregates(ctx context.Context, db *keydb.KeyDB, f AggregateFilter, minPopulation int, now time.Time) (*AggregateReport, error) {
+	if minPopulation == 0 {
+		minPopulation = DefaultMinPopulation
+	}
+	if minPopulation < 2 {
+		return nil, fmt.Errorf("minimum population %d would describe individual users", minPopulation)
+	}
+
+	f.SeenAfter, f.SeenBefore = truncateDay(f.SeenAfter), truncateDay(f.SeenBefore)
+	var r keydb.Range
+	if f.SeenAfter != nil {
+		r.SeenAfter = *f.SeenAfter
+	}
+	if f.SeenBefore != nil {
+		r.SeenBefore = *f.SeenBefore
+	}
+	if f.KeyType != "" {
+		r.KeyPrefix = f.KeyType + " "
+	}
+	types := map[string]map[string]bool{}
+	oldest := map[string]time.Time{}
+	err := db.ForEachKeyIn(ctx, r, func(rec keydb.KeyRecord) error {
+		login := strings.ToLower(rec.User)
+		kt := rec.KeyType
+		if kt == "" {
+			kt, _, _ = strings.Cut(rec.Key, " ")
+		}
+		if types[kt] == nil {
+			types[kt] = map[string]bool{}
+		}
+		types[kt][login] = true
+
+		seen := rec.FirstSeen
+		if rec.Created != nil && rec.Created.Before(seen) {
+			seen = *rec.Created
+		}
+		if t, ok := oldest[login]; !ok || seen.Before(t) {
+			oldest[login] = seen
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &AggregateReport{Generated: now, MinPopulation: minPopulation, Filter: f}
+	if len(oldest) < minPopulation {
+		rep.Withheld = true
+		return rep, nil
+	}
+	rep.Users = len(oldest)
+	rep.Algorithms = thresholdBuckets(types, minPopulation)
+
+	ages := make([]time.Duration, 0, len(oldest))
+	for _, t := range oldest {
+		ages = append(ages, now.Sub(t))
+	}
+	sort.Slice(ages, func(i, j int) bool { return ages[i] < ages[j] })
+	rep.KeyAgeDays = map[string]int{}
+	for _, p := range []int{10, 25, 50, 75, 90} {
+		age := ages[(len(ages)-1)*p/100].Round(ageRounding)
+		rep.KeyAgeDays[fmt.Sprintf("p%d", p)] = int(age.Hours() / 24)
+	}
+	return rep, nil
+}
+
+// thresholdBuckets turns sets of users by bucket name into counts, merging buckets of fewer than minUsers
+// users into otherBucket. While that is still too small, the smallest reported bucket is merged in
+// too, so a small bucket can't be recovered by subtracting the others from the total either.
+func thresholdBuckets(sets map[string]map[string]bool, minUsers int) []AggregateBucket {
+	var names []string
+	other := map[string]bool{}
+	for name, users := range sets {
+		if len(users) >= minUsers && name != otherBucket {
+			names = append(names, name)
+			continue
+		}
+		for u := range users {
+			other[u] = true
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(sets[names[i]]) != len(sets[names[j]]) {
+			return len(sets[names[i]]) > len(sets[names[j]])
+		}
+		return names[i] < names[j]
+	})
+	for len(other) > 0 && len(other) < minUsers && len(names) > 0 {
+		for u := range sets[names[len(names)-1]] {
+			other[u] = true
+		}
+		names = names[:len(names)-1]
+	}
+
+	out := make([]AggregateBucket, 0, len(names)+1)
+	for _, name := range names {
+		out = append(out, AggregateBucket{Name: name, Users: len(sets[name])})
+	}
+	if len(other) >= minUsers {
+		out = append(out, AggregateBucket{Name: otherBucket, Users: len(other)})
+	}
+	return out
+}
+
+// truncateDay returns a copy of t truncated to the start of its UTC day, or nil if t is nil
+func truncateDay(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	day := t.UTC().Truncate(24 * time.Hour)
+	return &day
+}
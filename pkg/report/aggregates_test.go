@@ -0,0 +1,174 @@
+package report
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// edKey returns a distinct ed25519 authorized_keys line for each n
+func edKey(t *testing.T, n int) string {
+	t.Helper()
+	seed := make([]byte, ed25519.SeedSize)
+	binary.BigEndian.PutUint64(seed, uint64(n)+1)
+	pub, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(seed).Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
+
+// ecKey returns a new ECDSA authorized_keys line on curve
+func ecKey(t *testing.T, curve elliptic.Curve) string {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
+
+// newPopulationDB stores twelve users, user i first and last seen (i+1)*30 days before now, each with
+// an ed25519 key. Users 0-2 also have a nistp256 key and users 3-4 a nistp384 key.
+func newPopulationDB(t *testing.T, now time.Time) *keydb.KeyDB {
+	t.Helper()
+	db, err := keydb.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for i := range 12 {
+		login := fmt.Sprintf("user%02d", i)
+		keys := []string{edKey(t, i)}
+		switch {
+		case i < 3:
+			keys = append(keys, ecKey(t, elliptic.P256()))
+		case i < 5:
+			keys = append(keys, ecKey(t, elliptic.P384()))
+		}
+		at := now.Add(-time.Duration(i+1) * 30 * 24 * time.Hour)
+		if err := db.Store(collect.UserInfo{Username: login, PublicKeys: keys}, login, at); err != nil {
+			t.Fatalf("Store(%s): %v", login, err)
+		}
+	}
+	return db
+}
+
+func TestThresholdBuckets(t *testing.T) {
+	users := func(names ...string) map[string]bool {
+		set := map[string]bool{}
+		for _, n := range names {
+			set[n] = true
+		}
+		return set
+	}
+	tests := []struct {
+		name string
+		sets map[string]map[string]bool
+		min  int
+		want []AggregateBucket
+	}{
+		{name: "all large enough, largest first", min: 2,
+			sets: map[string]map[string]bool{"rsa": users("a", "b"), "ed25519": users("a", "c", "d")},
+			want: []AggregateBucket{{"ed25519", 3}, {"rsa", 2}}},
+		{name: "small buckets merge", min: 2,
+			sets: map[string]map[string]bool{"ed25519": users("a", "b", "c"), "dsa": users("d"), "ecdsa": users("e")},
+			want: []AggregateBucket{{"ed25519", 3}, {"other", 2}}},
+		{name: "merged users count once", min: 2,
+			sets: map[string]map[string]bool{"ed25519": users("a", "b", "c"), "dsa": users("d"), "ecdsa": users("d", "e")},
+			want: []AggregateBucket{{"ed25519", 3}, {"other", 2}}},
+		{name: "smallest reported bucket joins a small other", min: 3,
+			sets: map[string]map[string]bool{"ed25519": users("a", "b", "c", "d"), "rsa": users("e", "f", "g"), "dsa": users("h")},
+			want: []AggregateBucket{{"ed25519", 4}, {"other", 4}}},
+		{name: "ties broken by name", min: 2,
+			sets: map[string]map[string]bool{"rsa": users("a", "b"), "ecdsa": users("c", "d"), "dsa": users("e")},
+			want: []AggregateBucket{{"ecdsa", 2}, {"other", 3}}},
+		{name: "nothing large enough", min: 5,
+			sets: map[string]map[string]bool{"rsa": users("a", "b"), "dsa": users("c")},
+			want: []AggregateBucket{}},
+		{name: "a type named other is merged", min: 1,
+			sets: map[string]map[string]bool{"other": users("a"), "rsa": users("b")},
+			want: []AggregateBucket{{"rsa", 1}, {"other", 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := thresholdBuckets(tt.sets, tt.min); !slices.Equal(got, tt.want) {
+				t.Errorf("thresholdBuckets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregates(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	db := newPopulationDB(t, now)
+	after := now.Add(-100 * 24 * time.Hour)
+	afterDay := time.Date(2025, 11, 21, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name           string
+		filter         AggregateFilter
+		min            int
+		wantErr        bool
+		wantWithheld   bool
+		wantUsers      int
+		wantAlgorithms []AggregateBucket
+		wantAges       map[string]int
+		wantAfter      *time.Time
+	}{
+		{name: "default minimum", wantUsers: 12, wantAlgorithms: []AggregateBucket{{"other", 12}},
+			wantAges: map[string]int{"p10": 60, "p25": 90, "p50": 180, "p75": 270, "p90": 300}},
+		{name: "small types merged", min: 3, wantUsers: 12,
+			wantAlgorithms: []AggregateBucket{{"ssh-ed25519", 12}, {"other", 5}},
+			wantAges:       map[string]int{"p10": 60, "p25": 90, "p50": 180, "p75": 270, "p90": 300}},
+		{name: "one key type", filter: AggregateFilter{KeyType: "ecdsa-sha2-nistp256"}, min: 3, wantUsers: 3,
+			wantAlgorithms: []AggregateBucket{{"ecdsa-sha2-nistp256", 3}},
+			wantAges:       map[string]int{"p10": 30, "p25": 30, "p50": 60, "p75": 60, "p90": 60}},
+		{name: "too few users", filter: AggregateFilter{KeyType: "ecdsa-sha2-nistp384"}, min: 3, wantWithheld: true},
+		{name: "recent window", filter: AggregateFilter{SeenAfter: &after}, min: 3, wantUsers: 3, wantAfter: &afterDay,
+			wantAlgorithms: []AggregateBucket{{"ecdsa-sha2-nistp256", 3}, {"ssh-ed25519", 3}},
+			wantAges:       map[string]int{"p10": 30, "p25": 30, "p50": 60, "p75": 60, "p90": 60}},
+		{name: "individuals", min: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rep, err := Aggregates(context.Background(), db, tt.filter, tt.min, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Aggregates error = %v, want error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if rep.Withheld != tt.wantWithheld || rep.Users != tt.wantUsers {
+				t.Errorf("withheld %v, %d users; want %v, %d", rep.Withheld, rep.Users, tt.wantWithheld, tt.wantUsers)
+			}
+			if !slices.Equal(rep.Algorithms, tt.wantAlgorithms) {
+				t.Errorf("Algorithms = %v, want %v", rep.Algorithms, tt.wantAlgorithms)
+			}
+			if !maps.Equal(rep.KeyAgeDays, tt.wantAges) {
+				t.Errorf("KeyAgeDays = %v, want %v", rep.KeyAgeDays, tt.wantAges)
+			}
+			if tt.wantAfter != nil && (rep.Filter.SeenAfter == nil || !rep.Filter.SeenAfter.Equal(*tt.wantAfter)) {
+				t.Errorf("Filter.SeenAfter = %v, want it truncated to %s", rep.Filter.SeenAfter, tt.wantAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// Severities of AttentionItems, most urgent first
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+	SeverityInfo     = "info"
+)
+
+// severityRank orders severities for sorting; unknown severities sort last
+var severityRank = map[string]int{SeverityCritical: 0, SeverityWarning: 1, SeverityInfo: 2}
+
+// maxRemedyUsers bounds how many logins a remedy command lists
+const maxRemedyUsers = 100
+
+// AttentionItem is one open problem that needs an operator to act
+type AttentionItem struct {
+	Severity string `json:"severity"`
+	// Kind is the name of the provider that found the item.
+	Kind string `json:"kind"`
+	// Subject identifies the item within its kind, such as a fingerprint or batch ID.
+	Subject string `json:"subject"`
+	Detail  string `json:"detail"`
+	// Since is when the item was opened, for its age.
+	Since time.Time `json:"since"`
+	// Remedy is the command to run, with alternatives in braces where a human has to choose.
+	Remedy string `json:"remedy"`
+}
+
+// AttentionEnv is what providers are given to find items
+type AttentionEnv struct {
+	DB *keydb.KeyDB
+	// DBPath is the database location, for remedy commands.
+	DBPath string
+	Now    time.Time
+}
+
+// AttentionProvider finds the open items of one kind. Subsystems register one with
+// RegisterAttention, from an init function, so their items appear in Attention.
+type AttentionProvider interface {
+	// Name returns the kind of item the provider finds, recorded as AttentionItem.Kind.
+	Name() string
+	// Attention returns the provider's open items; none means nothing needs attention.
+	Attention(ctx context.Context, env AttentionEnv) ([]AttentionItem, error)
+}
+
+var (
+	attentionMu        sync.Mutex
+	attentionProviders = map[string]AttentionProvider{}
+)
+
+// RegisterAttention adds a provider to Attention. It panics if a provider with the same name is
+// already registered.
+func RegisterAttention(p AttentionProvider) {
+	attentionMu.Lock()
+	defer attentionMu.Unlock()
+
+	if _, dup := attentionProviders[p.Name()]; dup {
+		panic(fmt.Sprintf("report: attention provider %q registered twice", p.Name()))
+	}
+	attentionProviders[p.Name()] = p
+}
+
+// AttentionProviders returns the names of all registered providers in sorted order.
+func AttentionProviders() []string {
+	attentionMu.Lock()
+	defer attentionMu.Unlock()
+
+	names := make([]string, 0, len(attentionProviders))
+	for name := range attentionProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Attention collects the open items of every registered provider, most severe first and oldest
+// first within a severity. An empty result means all clear. A provider that fails is reported as a
+// critical item of its own, so a broken check never reads as all clear.
+func Attention(ctx context.Context, env AttentionEnv) []AttentionItem {
+	var items []AttentionItem
+	for _, name := range AttentionProviders() {
+		attentionMu.Lock()
+		p := attentionProviders[name]
+		attentionMu.Unlock()
+
+		found, err := p.Attention(ctx, env)
+		if err != nil {
+			items = append(items, AttentionItem{Severity: SeverityCritical, Kind: name, Subject: "check failed",
+				Detail: err.Error(), Since: env.Now, Remedy: "pubkey-report -db " + shellQuote(env.DBPath) + " -attention"})
+			continue
+		}
+		for _, it := range found {
+			if it.Kind == "" {
+				it.Kind = name
+			}
+			items = append(items, it)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		ri, ok := severityRank[items[i].Severity]
+		if !ok {
+			ri = len(severityRank)
+		}
+		rj, ok := severityRank[items[j].Severity]
+		if !ok {
+			rj = len(severityRank)
+		}
+		if ri != rj {
+			return ri < rj
+		}
+		return items[i].Since.Before(items[j].Since)
+	})
+	return items
+}
+
+// shellSafe matches words that need no quoting in a shell command
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote returns s quoted for a POSIX shell if it needs to be
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// attentionFunc adapts a function to AttentionProvider
+type attentionFunc struct {
+	name string
+	fn   func(ctx context.Context, env AttentionEnv) ([]AttentionItem, error)
+}
+
+// Name returns the provider's kind.
+func (a attentionFunc) Name() string { return a.name }
+
+// Attention calls the function.
+func (a attentionFunc) Attention(ctx context.Context, env AttentionEnv) ([]AttentionItem, error) {
+	return a.fn(ctx, env)
+}
+
+func init() {
+	RegisterAttention(attentionFunc{"conflict", conflictAttention})
+	RegisterAttention(attentionFunc{"quarantine", quarantineAttention})
+	RegisterAttention(attentionFunc{"blocked_key", blockedKeyAttention})
+	RegisterAttention(attentionFunc{"fetch_failed", fetchFailedAttention})
+	RegisterAttention(attentionFunc{"stream_gap", streamGapAttention})
+	RegisterAttention(attentionFunc{"run_errors", runErrorsAttention})
+}
+
+// conflictAttention reports unresolved ownership conflicts
+func conflictAttention(_ context.Context, env AttentionEnv) ([]AttentionItem, error) {
+	conflicts, err := env.DB.Conflicts()
+	if err != nil {
+		return nil, err
+	}
+	var items []AttentionItem
+	for _, c := range conflicts {
+		if c.Resolution != nil {
+			continue
+		}
+		var users []string
+		for _, s := range c.Sides {
+			users = append(users, s.User)
+		}
+		items = append(items, AttentionItem{
+			Severity: SeverityWarning,
+			Subject:  c.Fingerprint,
+			Detail:   "key attributed to " + strings.Join(users, " and "),
+			Since:    c.Detected,
+			Remedy:   fmt.Sprintf("pubkey-db -db %s -resolve-conflict %s {-accept %s | -keep-both -note NOTE}", shellQuote(env.DBPath), c.Fingerprint, strings.Join(users, " | -accept ")),
+		})
+	}
+	return items, nil
+}
+
+// quarantineAttention reports quarantined batches awaiting review
+func quarantineAttention(_ context.Context, env AttentionEnv) ([]AttentionItem, error) {
+	batches, err := env.DB.QuarantineBatches()
+	if err != nil {
+		return nil, err
+	}
+	var items []AttentionItem
+	for _, b := range batches {
+		if b.Status != keydb.QuarantinePending {
+			continue
+		}
+		items = append(items, AttentionItem{
+			Severity: SeverityWarning,
+			Subject:  b.Batch,
+			Detail:   fmt.Sprintf("%d keys served identically to %d users", len(b.Keys), len(b.Users)),
+			Since:    b.Detected,
+			Remedy:   fmt.Sprintf("pubkey-db -db %s {-quarantine-apply | -quarantine-discard} %s", shellQuote(env.DBPath), b.Batch),
+		})
+	}
+	return items, nil
+}
+
+// blockedKeyAttention reports blocked keys that users still publish
+func blockedKeyAttention(ctx context.Context, env AttentionEnv) ([]AttentionItem, error) {
+	var items []AttentionItem
+	err := env.DB.ForEachKey(ctx, func(rec keydb.KeyRecord) error {
+		for _, f := range rec.Flags {
+			if f != keydb.FlagBlocked {
+				continue
+			}
+			items = append(items, AttentionItem{
+				Severity: SeverityCritical,
+				Subject:  rec.Fingerprint,
+				Detail:   fmt.Sprintf("blocked key published by %s, last seen %s", rec.User, rec.Timestamp.Format("2006-01-02")),
+				Since:    rec.FirstSeen,
+				Remedy:   fmt.Sprintf("pubkey-db -db %s -why %s", shellQuote(env.DBPath), rec.User),
+			})
+		}
+		return nil
+	})
+	return items, err
+}
+
+// fetchFailedAttention reports the backlog of users whose last key fetch failed, as one item
+func fetchFailedAttention(_ context.Context, env AttentionEnv) ([]AttentionItem, error) {
+	skips, err := env.DB.Skips()
+	if err != nil {
+		return nil, err
+	}
+	var logins []string
+	var oldest time.Time
+	for login, s := range skips {
+		if s.Reason != collect.SkipFetchFailed {
+			continue
+		}
+		logins = append(logins, login)
+		if oldest.IsZero() || s.Timestamp.Before(oldest) {
+			oldest = s.Timestamp
+		}
+	}
+	if len(logins) == 0 {
+		return nil, nil
+	}
+	sort.Strings(logins)
+	detail := fmt.Sprintf("%d users whose last key fetch failed", len(logins))
+	if len(logins) > maxRemedyUsers {
+		detail += fmt.Sprintf("; the command retries the first %d", maxRemedyUsers)
+		logins = logins[:maxRemedyUsers]
+	}
+	return []AttentionItem{{
+		Severity: SeverityWarning,
+		Subject:  "backlog",
+		Detail:   detail,
+		Since:    oldest,
+		Remedy:   fmt.Sprintf("pubkey-collector -db %s -record-skips -users %s", shellQuote(env.DBPath), strings.Join(logins, ",")),
+	}}, nil
+}
+
+// latestRuns returns the most recent run of each instance and mode
+func latestRuns(db *keydb.KeyDB) ([]*keydb.RunRecord, error) {
+	runs, err := db.Runs()
+	if err != nil {
+		return nil, err
+	}
+	latest := map[string]*keydb.RunRecord{}
+	for _, r := range runs {
+		k := r.Instance + "\x00" + r.Mode
+		if l := latest[k]; l == nil || r.Start.After(l.Start) {
+			latest[k] = r
+		}
+	}
+	out := make([]*keydb.RunRecord, 0, len(latest))
+	for _, r := range latest {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out, nil
+}
+
+// streamGapAttention reports stream coverage gaps whose backfill, in the latest stream run of an
+// instance, stopped early or left org members unrefreshed
+func streamGapAttention(_ context.Context, env AttentionEnv) ([]AttentionItem, error) {
+	runs, err := latestRuns(env.DB)
+	if err != nil {
+		return nil, err
+	}
+	var items []AttentionItem
+	for _, r := range runs {
+		g := r.Gap
+		if g == nil || (g.Error == "" && g.Deferred == 0) {
+			continue
+		}
+		item := AttentionItem{
+			Severity: SeverityWarning,
+			Subject:  r.ID,
+			Since:    g.Detected,
+			Remedy:   fmt.Sprintf("pubkey-db -db %s -run %s", shellQuote(env.DBPath), r.ID),
+		}
+		item.Detail = fmt.Sprintf("events since %s were missed and the backfill was incomplete", g.Since.Format("2006-01-02 15:04"))
+		if g.Error != "" {
+			item.Detail += ": " + g.Error
+		}
+		if g.Deferred > 0 && g.Org != "" {
+			item.Detail += fmt.Sprintf("; %d members of %s were not refreshed", g.Deferred, g.Org)
+			item.Remedy = fmt.Sprintf("pubkey-collector -db %s -record-skips -org %s", shellQuote(env.DBPath), g.Org)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// runErrorsAttention reports instances whose latest run of a mode recorded errors
+func runErrorsAttention(_ context.Context, env AttentionEnv) ([]AttentionItem, error) {
+	runs, err := latestRuns(env.DB)
+	if err != nil {
+		return nil, err
+	}
+	var items []AttentionItem
+	for _, r := range runs {
+		n := r.Counts["errors"]
+		if n == 0 {
+			continue
+		}
+		detail := fmt.Sprintf("latest %s run of %s had %d errors", r.Mode, orUnknown(r.Instance), n)
+		if len(r.Errors) > 0 {
+			detail += ", first: " + r.Errors[0]
+		}
+		items = append(items, AttentionItem{
+			Severity: SeverityInfo,
+			Subject:  r.ID,
+			Detail:   detail,
+			Since:    r.Start,
+			Remedy:   fmt.Sprintf("pubkey-db -db %s -run %s", shellQuote(env.DBPath), r.ID),
+		})
+	}
+	return items, nil
+}
+
+// orUnknown returns s, or "unknown instance" if it is empty
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown instance"
+	}
+	return s
+}
@@ -0,0 +1,104 @@
+package report
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// fakeProvider reports whatever items and error a test gives it
+type fakeProvider struct {
+	mu    sync.Mutex
+	items []AttentionItem
+	err   error
+}
+
+func (f *fakeProvider) Name() string { return "report_test_fake" }
+
+func (f *fakeProvider) Attention(context.Context, AttentionEnv) ([]AttentionItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.items, f.err
+}
+
+func (f *fakeProvider) set(items []AttentionItem, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items, f.err = items, err
+}
+
+// fake is registered once for the package, as subsystems register theirs, and left quiet between tests
+var fake = &fakeProvider{}
+
+func init() {
+	RegisterAttention(fake)
+}
+
+func TestRegisterAttention(t *testing.T) {
+	if !slices.Contains(AttentionProviders(), fake.Name()) {
+		t.Errorf("AttentionProviders() = %v, missing %q", AttentionProviders(), fake.Name())
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a provider name twice did not panic")
+		}
+	}()
+	RegisterAttention(&fakeProvider{})
+}
+
+func TestAttention(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	db, err := keydb.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+	env := AttentionEnv{DB: db, DBPath: "/var/lib/pubkeys db", Now: now}
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	tests := []struct {
+		name  string
+		items []AttentionItem
+		err   error
+		// want are the Kind/Subject pairs of the items, in order
+		want       []string
+		wantRemedy string
+	}{
+		{name: "all clear"},
+		{name: "sorted by severity then age", items: []AttentionItem{
+			{Severity: SeverityInfo, Subject: "old info", Since: ago(72 * time.Hour)},
+			{Severity: SeverityWarning, Subject: "new warning", Since: ago(time.Hour)},
+			{Severity: SeverityCritical, Subject: "critical", Since: ago(time.Minute)},
+			{Severity: SeverityWarning, Subject: "old warning", Since: ago(48 * time.Hour)},
+			{Severity: "unknown", Subject: "unranked", Since: ago(100 * time.Hour)},
+		}, want: []string{"report_test_fake/critical", "report_test_fake/old warning", "report_test_fake/new warning",
+			"report_test_fake/old info", "report_test_fake/unranked"}},
+		{name: "provider sets its own kind", items: []AttentionItem{{Severity: SeverityWarning, Kind: "drift", Subject: "schema"}},
+			want: []string{"drift/schema"}},
+		{name: "failing provider is critical", err: errors.New("index unreadable"),
+			want: []string{"report_test_fake/check failed"}, wantRemedy: "pubkey-report -db '/var/lib/pubkeys db' -attention"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.set(tt.items, tt.err)
+			defer fake.set(nil, nil)
+
+			var got []string
+			items := Attention(context.Background(), env)
+			for _, it := range items {
+				got = append(got, it.Kind+"/"+it.Subject)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("Attention() = %q, want %q", got, tt.want)
+			}
+			if tt.err != nil && (items[0].Severity != SeverityCritical || items[0].Detail != tt.err.Error() || items[0].Remedy != tt.wantRemedy) {
+				t.Errorf("failed check = %+v, want a critical item with the error and remedy %q", items[0], tt.wantRemedy)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package report
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// Caveats describes how the retained runs' configuration limits what the database can say, such as
+// which collection modes ran and which users they filtered out, for report headers. Absences in a
+// report should be read with these in mind. A clone made with KeyDB.CloneSnapshot is reported as of
+// the source sequence it was cloned at.
+func Caveats(db *keydb.KeyDB) ([]string, error) {
+	var caveats []string
+	replica, err := db.Replica()
+	if err != nil {
+		return nil, err
+	}
+	if replica != nil {
+		caveats = append(caveats, fmt.Sprintf("as of sequence %d of %s, cloned %s: later writes to it are not included", replica.Sequence, replica.Source, replica.Cloned.Format("2006-01-02 15:04:05")))
+	}
+
+	runs, err := db.Runs()
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return append(caveats, "no runs recorded: collection settings are unknown"), nil
+	}
+
+	modes := map[string]bool{}
+	unknown, noSkips, noSigning, collectors := 0, 0, 0, 0
+	for _, r := range runs {
+		for _, m := range strings.Split(r.Mode, ",") {
+			if m != "" {
+				modes[m] = true
+			}
+		}
+		if r.Config == nil {
+			unknown++
+			continue
+		}
+		if r.Mode == "load" || r.Mode == "fleet" {
+			continue
+		}
+		collectors++
+		if r.Config["record-skips"] != "true" {
+			noSkips++
+		}
+		if r.Config["signing-keys"] != "true" {
+			noSigning++
+		}
+	}
+
+	names := make([]string, 0, len(modes))
+	for m := range modes {
+		names = append(names, m)
+	}
+	sort.Strings(names)
+	caveats = append(caveats, fmt.Sprintf("collected by: %s (%d runs retained)", strings.Join(names, ", "), len(runs)))
+	if modes["stream"] {
+		caveats = append(caveats, `events actors with logins ending in "bot" are filtered out and never stored`)
+	}
+	if noSkips > 0 {
+		caveats = append(caveats, fmt.Sprintf("%d of %d collector runs did not record skips: users without keys may be absent without explanation", noSkips, collectors))
+	}
+	if noSigning > 0 {
+		caveats = append(caveats, fmt.Sprintf("%d of %d collector runs did not collect signing keys", noSigning, collectors))
+	}
+	if unknown > 0 {
+		caveats = append(caveats, fmt.Sprintf("%d runs predate configuration recording; their filters are unknown", unknown))
+	}
+	return caveats, nil
+}
@@ -0,0 +1,132 @@
+// Package report computes summaries over a pubkey-collector database.
+package report
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// maxEventPages bounds API usage when listing org events; GitHub serves at most 300 events (10 pages).
+const maxEventPages = 10
+
+// CoverageReport describes what fraction of an organization's recent pushers have keys in the database.
+type CoverageReport struct {
+	Org   string    `json:"org"`
+	Since time.Time `json:"since"`
+	// Committers are the logins that pushed to the org's repositories since Since.
+	Committers []string `json:"committers"`
+	// Uncovered are the committers with no keys in the database.
+	Uncovered []string `json:"uncovered"`
+	// Unknown are the committers without keys whose last fetch failed, so whether they have keys is unknown.
+	Unknown []string `json:"unknown,omitempty"`
+	// Unlinked are the committers not linked to a corporate identity (see package identity): either
+	// no directory knows them or they have not been looked up. Empty if no identities are recorded.
+	Unlinked []string `json:"unlinked,omitempty"`
+	// Percent is the share of committers with at least one key, among those whose keys are known.
+	Percent float64 `json:"percent"`
+	// Runs are the collector runs that wrote the covered committers' keys (see pubkey-db -run).
+	Runs []string `json:"runs,omitempty"`
+}
+
+// Coverage enumerates the users who pushed to org's repositories since the given time and
+// reports how many of them have at least one key in db.
+//
+// Committers come from the org's public events feed, which GitHub limits to 300 events and 90 days.
+func Coverage(ctx context.Context, client *github.Client, db *keydb.KeyDB, org string, since time.Time) (*CoverageReport, error) {
+	committers, err := recentPushers(ctx, client, org, since)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the set of users with keys in one pass
+	haveKeys := map[string]bool{}
+	userRuns := map[string][]string{}
+	err = db.ForEachKey(ctx, func(rec keydb.KeyRecord) error {
+		login := strings.ToLower(rec.User)
+		haveKeys[login] = true
+		if rec.RunID != "" {
+			userRuns[login] = append(userRuns[login], rec.RunID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := db.Identities()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &CoverageReport{Org: org, Since: since, Committers: committers}
+	runs := map[string]bool{}
+	for _, login := range committers {
+		if len(ids) > 0 && !ids[strings.ToLower(login)].Linked() {
+			r.Unlinked = append(r.Unlinked, login)
+		}
+		if !haveKeys[strings.ToLower(login)] {
+			skip, err := db.Skip(login)
+			if err != nil {
+				return nil, err
+			}
+			if skip != nil && skip.Reason == collect.SkipFetchFailed {
+				r.Unknown = append(r.Unknown, login)
+				continue
+			}
+			r.Uncovered = append(r.Uncovered, login)
+		}
+		for _, id := range userRuns[strings.ToLower(login)] {
+			runs[id] = true
+		}
+	}
+	for id := range runs {
+		r.Runs = append(r.Runs, id)
+	}
+	sort.Strings(r.Runs)
+	if known := len(committers) - len(r.Unknown); known > 0 {
+		r.Percent = 100 * float64(known-len(r.Uncovered)) / float64(known)
+	}
+	return r, nil
+}
+
+// recentPushers returns the sorted, distinct actors of push events in org since the given time.
+func recentPushers(ctx context.Context, client *github.Client, org string, since time.Time) ([]string, error) {
+	seen := map[string]bool{}
+	opts := &github.ListOptions{PerPage: 30}
+
+	for page := 0; page < maxEventPages; page++ {
+		events, resp, err := client.Activity.ListEventsForOrganization(ctx, org, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list org events: %w", err)
+		}
+
+		for _, e := range events {
+			if e.GetType() != "PushEvent" || e.GetCreatedAt().Before(since) {
+				continue
+			}
+			if login := e.GetActor().GetLogin(); login != "" {
+				seen[login] = true
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	logins := make([]string, 0, len(seen))
+	for login := range seen {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	return logins, nil
+}
@@ -0,0 +1,100 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// ExposureReport lists the users who could push to a repository and the keys they could push with.
+type ExposureReport struct {
+	Repo string `json:"repo"`
+	// Collected is when the repository's exposure was last collected.
+	Collected time.Time `json:"collected"`
+	// Limitations are the populations that could not be listed, so the report covers only the rest.
+	Limitations []string      `json:"limitations,omitempty"`
+	Users       []ExposedUser `json:"users"`
+}
+
+// ExposedUser is one user who could push to the repository.
+type ExposedUser struct {
+	Login string   `json:"login"`
+	Roles []string `json:"roles"`
+	// Identity is the user's corporate identity, or nil if they have not been looked up.
+	Identity *keydb.IdentityRecord `json:"identity,omitempty"`
+	// Keys are the user's stored keys, oldest first. Users with none are still listed.
+	Keys []ExposedKey `json:"keys,omitempty"`
+}
+
+// ExposedKey is a stored key belonging to an exposed user.
+type ExposedKey struct {
+	Fingerprint string `json:"fingerprint"`
+	KeyType     string `json:"key_type"`
+	// Purpose is what the user registered the key for; empty for keys stored before it was recorded.
+	Purpose keydb.KeyPurpose `json:"purpose,omitempty"`
+	// Age is measured from when the key was added to GitHub, or when it was first seen if that is unknown.
+	Age   time.Duration `json:"age"`
+	Flags []string      `json:"flags,omitempty"`
+	// Caveats are what the key's record leaves uncertain about its attribution; see KeyDB.Caveats.
+	Caveats []keydb.Caveat `json:"caveats,omitempty"`
+}
+
+// Exposure reports the users recorded by pubkey-collector -exposure for repo, with their stored keys.
+// Keys last seen longer than staleAfter ago are caveated as stale. It makes no network requests.
+func Exposure(ctx context.Context, db *keydb.KeyDB, repo string, now time.Time, staleAfter time.Duration) (*ExposureReport, error) {
+	rec, err := db.Exposure(repo)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, fmt.Errorf("no exposure recorded for %s; run pubkey-collector -exposure %s first", repo, repo)
+	}
+
+	exposed := map[string]bool{}
+	for login := range rec.Roles {
+		exposed[strings.ToLower(login)] = true
+	}
+	keys := map[string][]ExposedKey{}
+	err = db.ForEachKey(ctx, func(k keydb.KeyRecord) error {
+		login := strings.ToLower(k.User)
+		if !exposed[login] {
+			return nil
+		}
+		added := k.FirstSeen
+		if k.Created != nil {
+			added = *k.Created
+		}
+		fp := k.Fingerprint
+		if fp == "" {
+			// Keys stored before fingerprints were recorded
+			fp, _ = keydb.Fingerprint(k.Key)
+		}
+		caveats, err := db.Caveats(&k.Metadata, staleAfter)
+		if err != nil {
+			return err
+		}
+		keys[login] = append(keys[login], ExposedKey{Fingerprint: fp, KeyType: k.KeyType, Purpose: k.Purpose, Age: now.Sub(added), Flags: k.Flags, Caveats: caveats})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := db.Identities()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ExposureReport{Repo: rec.Repo, Collected: rec.Timestamp, Limitations: rec.Limitations}
+	for login, roles := range rec.Roles {
+		ks := keys[strings.ToLower(login)]
+		sort.Slice(ks, func(i, j int) bool { return ks[i].Age > ks[j].Age })
+		r.Users = append(r.Users, ExposedUser{Login: login, Roles: roles, Keys: ks, Identity: ids[strings.ToLower(login)]})
+	}
+	sort.Slice(r.Users, func(i, j int) bool { return r.Users[i].Login < r.Users[j].Login })
+	return r, nil
+}
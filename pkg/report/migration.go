@@ -0,0 +1,163 @@
+package report
+
+import (
+	"errors"
+	"sort"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// How a local account's keys map to GitHub users, in a MigrationReport
+const (
+	// MappingClean accounts have only keys attributed to one GitHub user.
+	MappingClean = "clean"
+	// MappingPartial accounts have keys attributed to one GitHub user and keys unknown to GitHub.
+	MappingPartial = "partial"
+	// MappingShared accounts have keys attributed to more than one GitHub user.
+	MappingShared = "shared"
+	// MappingUnknown accounts have no key attributed to a GitHub user.
+	MappingUnknown = "unknown"
+)
+
+// AccountMapping is how one local account on one host maps to GitHub users
+type AccountMapping struct {
+	Host    string `json:"host"`
+	Account string `json:"account"`
+	// Status is one of the Mapping constants.
+	Status      string   `json:"status"`
+	GitHubUsers []string `json:"github_users,omitempty"`
+	Keys        int      `json:"keys"`
+	UnknownKeys int      `json:"unknown_keys"`
+}
+
+// RiskyFleetKey is a fleet key that should stop authorizing access wherever it still does
+type RiskyFleetKey struct {
+	keydb.FleetKey
+	// GitHubUser is who the key is attributed to, if anyone.
+	GitHubUser string `json:"github_user,omitempty"`
+	// Reasons are "blocked", "malformed" or a keydb.Weakness, such as "DSA".
+	Reasons []string `json:"reasons"`
+}
+
+// MigrationReport cross-references the keys imported from a fleet's authorized_keys files with the
+// keys attributed to GitHub users, for planning a move to GitHub-sourced keys
+type MigrationReport struct {
+	Hosts int `json:"hosts"`
+	// Accounts are sorted by host and account.
+	Accounts []AccountMapping `json:"accounts"`
+	// Unknown are the fleet keys not attributed to any GitHub user.
+	Unknown []keydb.FleetKey `json:"unknown,omitempty"`
+	// Risky are the fleet keys that are blocked, malformed or weak, whether or not GitHub knows them.
+	Risky []RiskyFleetKey `json:"risky,omitempty"`
+	// Statuses counts Accounts by Status.
+	Statuses map[string]int `json:"statuses"`
+}
+
+// Migration builds a MigrationReport from the fleet keys imported into db (see KeyDB.PutFleetHost).
+// Keys are matched by SHA256 fingerprint, so a fleet key's options and comment don't matter.
+// Blocked keys are those blocked in db or on the blocklist set with KeyDB.SetBlocklist.
+func Migration(db *keydb.KeyDB) (*MigrationReport, error) {
+	keys, err := db.FleetKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &MigrationReport{Statuses: map[string]int{}}
+	hosts := map[string]bool{}
+	// known caches Lookup by fingerprint, nil for keys not in db
+	known := map[string]*keydb.Metadata{}
+	var m *AccountMapping
+	users := map[string]bool{}
+	finish := func() {
+		if m == nil {
+			return
+		}
+		for u := range users {
+			m.GitHubUsers = append(m.GitHubUsers, u)
+		}
+		sort.Strings(m.GitHubUsers)
+		switch {
+		case len(m.GitHubUsers) > 1:
+			m.Status = MappingShared
+		case len(m.GitHubUsers) == 0:
+			m.Status = MappingUnknown
+		case m.UnknownKeys > 0:
+			m.Status = MappingPartial
+		default:
+			m.Status = MappingClean
+		}
+		r.Statuses[m.Status]++
+		r.Accounts = append(r.Accounts, *m)
+	}
+
+	for _, fk := range keys {
+		hosts[fk.Host] = true
+		if m == nil || m.Host != fk.Host || m.Account != fk.Account {
+			finish()
+			m = &AccountMapping{Host: fk.Host, Account: fk.Account}
+			users = map[string]bool{}
+		}
+		m.Keys++
+
+		md, ok := known[fk.Fingerprint]
+		if !ok {
+			md, err = db.Lookup(fk.Fingerprint)
+			if errors.Is(err, keydb.ErrNotFound) {
+				md, err = nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			known[fk.Fingerprint] = md
+		}
+		var owner string
+		var flags []string
+		if md != nil {
+			owner, flags = md.User, md.Flags
+		}
+		if owner == "" {
+			m.UnknownKeys++
+			r.Unknown = append(r.Unknown, fk)
+		} else {
+			users[owner] = true
+		}
+
+		reasons, err := fleetKeyRisks(db, fk, flags)
+		if err != nil {
+			return nil, err
+		}
+		if len(reasons) > 0 {
+			r.Risky = append(r.Risky, RiskyFleetKey{FleetKey: fk, GitHubUser: owner, Reasons: reasons})
+		}
+	}
+	finish()
+	r.Hosts = len(hosts)
+	return r, nil
+}
+
+// fleetKeyRisks returns why fk should stop authorizing access, given the flags of its stored record
+func fleetKeyRisks(db *keydb.KeyDB, fk keydb.FleetKey, flags []string) ([]string, error) {
+	var reasons []string
+	blocked, err := db.IsBlocked(fk.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range flags {
+		blocked = blocked || f == keydb.FlagBlocked
+	}
+	if blocked {
+		reasons = append(reasons, keydb.FlagBlocked)
+	}
+	if fk.Malformed {
+		reasons = append(reasons, keydb.FlagMalformed)
+	}
+	// Parsed without ValidateKey's checks, which reject the smallest RSA keys as malformed
+	if pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fk.Key)); err == nil {
+		if w := keydb.Weakness(pk); w != "" {
+			reasons = append(reasons, w)
+		}
+	}
+	return reasons, nil
+}
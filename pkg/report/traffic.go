@@ -0,0 +1,158 @@
+package report
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/traffic"
+)
+
+// TrafficHour is the requests made to one host in one hour
+type TrafficHour struct {
+	Hour     time.Time `json:"hour"`
+	Host     string    `json:"host"`
+	Requests int       `json:"requests"`
+	// Statuses counts requests by response: "2xx" to "5xx", or "error" for no response.
+	Statuses map[string]int `json:"statuses"`
+}
+
+// TrafficHost totals the requests made to one host
+type TrafficHost struct {
+	Host     string `json:"host"`
+	Requests int    `json:"requests"`
+	// ActiveHours counts the hours with at least one request.
+	ActiveHours int `json:"active_hours"`
+	// PeakHour is the hour with the most requests, PeakHourRequests; PeakMinute is the most
+	// requests in any one minute.
+	PeakHour         time.Time `json:"peak_hour"`
+	PeakHourRequests int       `json:"peak_hour_requests"`
+	PeakMinute       int       `json:"peak_minute"`
+	// Classes counts requests by endpoint class (see traffic.Class).
+	Classes  map[string]int `json:"classes"`
+	Statuses map[string]int `json:"statuses"`
+}
+
+// TrafficRun is a collector run during a traffic report's period and the ceiling it ran under
+type TrafficRun struct {
+	ID       string    `json:"id"`
+	Instance string    `json:"instance"`
+	Start    time.Time `json:"start"`
+	// Ceiling is the most requests the run could make in an hour.
+	Ceiling int `json:"ceiling"`
+}
+
+// TrafficReport summarizes the outbound requests persisted by collectors (see
+// keydb.KeyDB.AppendTraffic), as evidence of how hard they have used GitHub
+type TrafficReport struct {
+	// From and To are the first and last hours with requests.
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Hours are sorted by hour, then host.
+	Hours []TrafficHour `json:"hours"`
+	// Hosts are sorted by most requests first.
+	Hosts []TrafficHost `json:"hosts"`
+	// Dropped counts requests made but not recorded.
+	Dropped int `json:"dropped,omitempty"`
+	// Runs are those that ran during the period and recorded their ceiling, oldest first.
+	Runs []TrafficRun `json:"runs,omitempty"`
+}
+
+// Traffic builds a TrafficReport from the requests persisted for hours ending after since.
+func Traffic(db *keydb.KeyDB, since time.Time) (*TrafficReport, error) {
+	logs, err := db.TrafficLogs(since)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &TrafficReport{}
+	hours := map[string]*TrafficHour{}
+	hosts := map[string]*TrafficHost{}
+	minutes := map[string]int{}
+	for _, l := range logs {
+		r.Dropped += l.Dropped
+		for _, req := range l.Requests {
+			hour := req.Time.UTC().Truncate(time.Hour)
+			if r.From.IsZero() || hour.Before(r.From) {
+				r.From = hour
+			}
+			if hour.After(r.To) {
+				r.To = hour
+			}
+			status := statusClass(req.Status)
+
+			hk := hour.Format(time.RFC3339) + " " + req.Host
+			h := hours[hk]
+			if h == nil {
+				h = &TrafficHour{Hour: hour, Host: req.Host, Statuses: map[string]int{}}
+				hours[hk] = h
+			}
+			h.Requests++
+			h.Statuses[status]++
+
+			t := hosts[req.Host]
+			if t == nil {
+				t = &TrafficHost{Host: req.Host, Classes: map[string]int{}, Statuses: map[string]int{}}
+				hosts[req.Host] = t
+			}
+			t.Requests++
+			t.Classes[req.Class]++
+			t.Statuses[status]++
+
+			mk := req.Time.UTC().Truncate(time.Minute).Format(time.RFC3339) + " " + req.Host
+			minutes[mk]++
+			t.PeakMinute = max(t.PeakMinute, minutes[mk])
+		}
+	}
+
+	for _, h := range hours {
+		r.Hours = append(r.Hours, *h)
+		t := hosts[h.Host]
+		t.ActiveHours++
+		if h.Requests > t.PeakHourRequests || (h.Requests == t.PeakHourRequests && h.Hour.Before(t.PeakHour)) {
+			t.PeakHour, t.PeakHourRequests = h.Hour, h.Requests
+		}
+	}
+	sort.Slice(r.Hours, func(i, j int) bool {
+		if !r.Hours[i].Hour.Equal(r.Hours[j].Hour) {
+			return r.Hours[i].Hour.Before(r.Hours[j].Hour)
+		}
+		return r.Hours[i].Host < r.Hours[j].Host
+	})
+	for _, t := range hosts {
+		r.Hosts = append(r.Hosts, *t)
+	}
+	sort.Slice(r.Hosts, func(i, j int) bool {
+		if r.Hosts[i].Requests != r.Hosts[j].Requests {
+			return r.Hosts[i].Requests > r.Hosts[j].Requests
+		}
+		return r.Hosts[i].Host < r.Hosts[j].Host
+	})
+
+	runs, err := db.Runs()
+	if err != nil {
+		return nil, err
+	}
+	for _, run := range runs {
+		v, ok := run.Config[traffic.CeilingFlag]
+		if !ok || (run.End != nil && run.End.Before(since)) {
+			continue
+		}
+		ceiling, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		r.Runs = append(r.Runs, TrafficRun{ID: run.ID, Instance: run.Instance, Start: run.Start, Ceiling: ceiling})
+	}
+	sort.Slice(r.Runs, func(i, j int) bool { return r.Runs[i].Start.Before(r.Runs[j].Start) })
+	return r, nil
+}
+
+// statusClass returns the TrafficHour.Statuses key for an HTTP status
+func statusClass(status int) string {
+	if status < 100 {
+		return "error"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
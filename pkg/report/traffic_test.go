@@ -0,0 +1,131 @@
+package report
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/clock"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+	"github.com/tstromberg/pubkey-collector/pkg/traffic"
+)
+
+func TestTraffic(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	at := func(hour, min, sec int) time.Time { return time.Date(2026, 3, 1, hour, min, sec, 0, time.UTC) }
+	db, err := keydb.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+	db.SetClock(clock.Fixed(now))
+
+	saves := []struct {
+		instance string
+		reqs     []traffic.Request
+		dropped  int
+	}{
+		{instance: "a", reqs: []traffic.Request{
+			{Time: at(10, 5, 0), Host: "github.com", Class: ":user.keys", Status: 200},
+			{Time: at(10, 5, 30), Host: "github.com", Class: ":user.keys", Status: 200},
+			{Time: at(10, 6, 0), Host: "github.com", Class: ":user.keys", Status: 404},
+			{Time: at(11, 0, 0), Host: "api.github.com", Class: "events", Status: 200},
+			{Time: at(11, 0, 10), Host: "api.github.com", Class: "events", Status: 429},
+		}},
+		{instance: "b", reqs: []traffic.Request{
+			{Time: at(11, 0, 20), Host: "api.github.com", Class: "orgs/:org/members"},
+			{Time: at(11, 10, 0), Host: "github.com", Class: ":user.keys", Status: 200},
+		}, dropped: 2},
+		{instance: "a", reqs: []traffic.Request{
+			{Time: at(11, 0, 40), Host: "api.github.com", Class: "events", Status: 200},
+			{Time: at(11, 1, 0), Host: "api.github.com", Class: "events", Status: 200},
+		}},
+	}
+	for _, s := range saves {
+		db.SetProvenance(keydb.Provenance{Instance: s.instance})
+		if err := db.AppendTraffic(s.reqs, s.dropped, time.Time{}); err != nil {
+			t.Fatalf("AppendTraffic: %v", err)
+		}
+	}
+
+	ended := at(9, 30, 0)
+	runs := []*keydb.RunRecord{
+		{ID: "old", Instance: "a", Start: at(9, 0, 0), End: &ended, Config: map[string]string{traffic.CeilingFlag: "7200"}},
+		{ID: "capped", Instance: "b", Start: at(10, 0, 0), Config: map[string]string{traffic.CeilingFlag: "100"}},
+		{ID: "uncapped", Instance: "c", Start: at(10, 30, 0), Config: map[string]string{"workers": "4"}},
+	}
+	for _, r := range runs {
+		if err := db.PutRun(r); err != nil {
+			t.Fatalf("PutRun: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		since     time.Time
+		wantFrom  time.Time
+		wantHours []TrafficHour
+		wantHosts []TrafficHost
+		wantRuns  []string
+	}{
+		{name: "everything", wantFrom: at(10, 0, 0),
+			wantHours: []TrafficHour{
+				{Hour: at(10, 0, 0), Host: "github.com", Requests: 3, Statuses: map[string]int{"2xx": 2, "4xx": 1}},
+				{Hour: at(11, 0, 0), Host: "api.github.com", Requests: 5, Statuses: map[string]int{"2xx": 3, "4xx": 1, "error": 1}},
+				{Hour: at(11, 0, 0), Host: "github.com", Requests: 1, Statuses: map[string]int{"2xx": 1}},
+			},
+			wantHosts: []TrafficHost{
+				{Host: "api.github.com", Requests: 5, ActiveHours: 1, PeakHour: at(11, 0, 0), PeakHourRequests: 5, PeakMinute: 4,
+					Classes: map[string]int{"events": 4, "orgs/:org/members": 1}, Statuses: map[string]int{"2xx": 3, "4xx": 1, "error": 1}},
+				{Host: "github.com", Requests: 4, ActiveHours: 2, PeakHour: at(10, 0, 0), PeakHourRequests: 3, PeakMinute: 2,
+					Classes: map[string]int{":user.keys": 4}, Statuses: map[string]int{"2xx": 3, "4xx": 1}},
+			},
+			wantRuns: []string{"old", "capped"}},
+		{name: "since an hour", since: at(11, 20, 0), wantFrom: at(11, 0, 0),
+			wantHours: []TrafficHour{
+				{Hour: at(11, 0, 0), Host: "api.github.com", Requests: 5, Statuses: map[string]int{"2xx": 3, "4xx": 1, "error": 1}},
+				{Hour: at(11, 0, 0), Host: "github.com", Requests: 1, Statuses: map[string]int{"2xx": 1}},
+			},
+			wantHosts: []TrafficHost{
+				{Host: "api.github.com", Requests: 5, ActiveHours: 1, PeakHour: at(11, 0, 0), PeakHourRequests: 5, PeakMinute: 4,
+					Classes: map[string]int{"events": 4, "orgs/:org/members": 1}, Statuses: map[string]int{"2xx": 3, "4xx": 1, "error": 1}},
+				{Host: "github.com", Requests: 1, ActiveHours: 1, PeakHour: at(11, 0, 0), PeakHourRequests: 1, PeakMinute: 1,
+					Classes: map[string]int{":user.keys": 1}, Statuses: map[string]int{"2xx": 1}},
+			},
+			wantRuns: []string{"capped"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rep, err := Traffic(db, tt.since)
+			if err != nil {
+				t.Fatalf("Traffic: %v", err)
+			}
+			if !rep.From.Equal(tt.wantFrom) || !rep.To.Equal(at(11, 0, 0)) || rep.Dropped != 2 {
+				t.Errorf("From %s, To %s, %d dropped; want %s, %s, 2", rep.From, rep.To, rep.Dropped, tt.wantFrom, at(11, 0, 0))
+			}
+			if !slices.EqualFunc(rep.Hours, tt.wantHours, func(a, b TrafficHour) bool {
+				return a.Hour.Equal(b.Hour) && a.Host == b.Host && a.Requests == b.Requests && maps.Equal(a.Statuses, b.Statuses)
+			}) {
+				t.Errorf("Hours = %+v, want %+v", rep.Hours, tt.wantHours)
+			}
+			if !slices.EqualFunc(rep.Hosts, tt.wantHosts, func(a, b TrafficHost) bool {
+				return a.Host == b.Host && a.Requests == b.Requests && a.ActiveHours == b.ActiveHours && a.PeakHour.Equal(b.PeakHour) &&
+					a.PeakHourRequests == b.PeakHourRequests && a.PeakMinute == b.PeakMinute &&
+					maps.Equal(a.Classes, b.Classes) && maps.Equal(a.Statuses, b.Statuses)
+			}) {
+				t.Errorf("Hosts = %+v, want %+v", rep.Hosts, tt.wantHosts)
+			}
+			var ids []string
+			for _, r := range rep.Runs {
+				ids = append(ids, r.ID)
+			}
+			if !slices.Equal(ids, tt.wantRuns) {
+				t.Errorf("Runs = %q, want %q", ids, tt.wantRuns)
+			}
+			if len(rep.Runs) > 0 && rep.Runs[len(rep.Runs)-1].Ceiling != 100 {
+				t.Errorf("run capped has ceiling %d, want 100", rep.Runs[len(rep.Runs)-1].Ceiling)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+// Package simulate is a fake GitHub for rehearsing collection at scale without touching GitHub. A
+// Server answers the requests the collector makes, for the org members listing, .keys, the keys and
+// signing keys APIs and the rate limit, from a generated population of users, with configurable
+// latency, server errors and API rate limiting.
+//
+// Everything the Server returns is derived from the profile's seed and the request, including which
+// requests fail and how long they take, so a run with the same profile and seed sees the same GitHub
+// however its requests are interleaved. Only the rate limit, which follows the wall clock, varies.
+package simulate
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Profile describes the simulated GitHub and its population
+type Profile struct {
+	Name string
+	// Org is the organization whose members are the population.
+	Org     string
+	Members int
+	// EmptyRate is the share of members without keys; the rest have 1 to MaxKeys.
+	EmptyRate float64
+	MaxKeys   int
+	// NotFoundRate is the share of members whose account is gone by the time their keys are fetched.
+	NotFoundRate float64
+	// ErrorRate is the share of per-user requests answered with a 502, as GitHub does under load.
+	ErrorRate float64
+	// ListErrorRate is the same for org listing requests. The collector doesn't retry these, so any
+	// failure ends the run; it is zero in the predefined profiles.
+	ListErrorRate float64
+	// Latency is log-normal with this median and 99th percentile.
+	LatencyMedian time.Duration
+	LatencyP99    time.Duration
+	// RateLimit is how many API requests are allowed per RateWindow; zero means unlimited. .keys
+	// requests, like GitHub's, are not counted.
+	RateLimit  int
+	RateWindow time.Duration
+	Seed       int64
+}
+
+// Profiles are the predefined simulations: "ci" finishes in seconds for automated soak runs, "large"
+// rehearses a 60,000 member org and takes a while.
+var Profiles = map[string]Profile{
+	"ci": {
+		Name: "ci", Org: "sim-ci", Members: 500, EmptyRate: 0.3, MaxKeys: 4, NotFoundRate: 0.01,
+		ErrorRate: 0.02, LatencyMedian: 2 * time.Millisecond, LatencyP99: 20 * time.Millisecond,
+		RateLimit: 5000, RateWindow: time.Hour, Seed: 1,
+	},
+	"large": {
+		Name: "large", Org: "sim-large", Members: 60000, EmptyRate: 0.3, MaxKeys: 6, NotFoundRate: 0.005,
+		ErrorRate: 0.005, LatencyMedian: 80 * time.Millisecond, LatencyP99: 1500 * time.Millisecond,
+		RateLimit: 5000, RateWindow: time.Hour, Seed: 1,
+	},
+}
+
+// ProfileNames returns the names of the predefined profiles, sorted
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for n := range Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Server is a simulated GitHub, used as the http.RoundTripper of the collector's clients
+type Server struct {
+	p Profile
+
+	mu       sync.Mutex
+	attempts map[string]int
+	window   time.Time
+	used     int
+	stats    map[string]int
+}
+
+// NewServer returns a Server for p
+func NewServer(p Profile) *Server {
+	if p.RateWindow == 0 {
+		p.RateWindow = time.Hour
+	}
+	return &Server{p: p, attempts: map[string]int{}, stats: map[string]int{}}
+}
+
+// Login returns the login of member i
+func (s *Server) Login(i int) string {
+	return fmt.Sprintf("sim-%s-%06d", s.p.Name, i)
+}
+
+// Keys returns the authorized_keys lines GitHub serves for login, generated from the seed
+func (s *Server) Keys(login string) []string {
+	if s.unit("empty", login) < s.p.EmptyRate {
+		return nil
+	}
+	n := 1 + int(s.unit("nkeys", login)*float64(max(s.p.MaxKeys, 1)))
+	var keys []string
+	for i := 0; i < n; i++ {
+		seed := sha256.Sum256([]byte(fmt.Sprintf("%d/key/%s/%d", s.p.Seed, login, i)))
+		pub, err := ssh.NewPublicKey(ed25519.NewKeyFromSeed(seed[:]).Public())
+		if err != nil {
+			continue
+		}
+		keys = append(keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))))
+	}
+	return keys
+}
+
+// Stats returns the requests served, by endpoint, and the faults injected
+func (s *Server) Stats() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]int, len(s.stats))
+	for k, v := range s.stats {
+		out[k] = v
+	}
+	return out
+}
+
+// RoundTrip answers req as GitHub would, after the simulated latency
+func (s *Server) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	endpoint, route := s.route(req)
+	key := req.Method + " " + req.URL.String()
+	s.mu.Lock()
+	attempt := s.attempts[key]
+	s.attempts[key]++
+	s.stats["requests_"+endpoint]++
+	s.mu.Unlock()
+
+	if err := sleep(req.Context(), s.latency(key, attempt)); err != nil {
+		return nil, err
+	}
+
+	h := http.Header{}
+	h.Set("Server", "GitHub.com")
+	if req.URL.Host != "github.com" && endpoint != "rate_limit" {
+		if limited := s.takeAPI(h); limited {
+			s.count("rate_limited")
+			return respond(req, http.StatusForbidden, h, `{"message":"API rate limit exceeded (simulated)"}`), nil
+		}
+	}
+	rate := s.p.ErrorRate
+	if endpoint == "org" || endpoint == "org_members" {
+		rate = s.p.ListErrorRate
+	}
+	if s.unit("error", key, strconv.Itoa(attempt)) < rate {
+		s.count("errors_injected")
+		return respond(req, http.StatusBadGateway, h, "simulated server error"), nil
+	}
+	if route == nil {
+		return respond(req, http.StatusNotFound, h, `{"message":"Not Found"}`), nil
+	}
+	status, body := route(h)
+	return respond(req, status, h, body), nil
+}
+
+// route returns the endpoint name for stats and the handler for req, or a nil handler for a 404
+func (s *Server) route(req *http.Request) (string, func(http.Header) (int, string)) {
+	path := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if req.URL.Host == "github.com" {
+		login, ok := strings.CutSuffix(path, ".keys")
+		if !ok || strings.Contains(login, "/") {
+			return "other", nil
+		}
+		return "keys_scrape", func(http.Header) (int, string) {
+			if !s.exists(login) {
+				return http.StatusNotFound, "Not Found"
+			}
+			return http.StatusOK, strings.Join(append(s.Keys(login), ""), "\n")
+		}
+	}
+
+	switch {
+	case path == "rate_limit":
+		return "rate_limit", s.rateLimit
+	case len(parts) == 2 && parts[0] == "orgs" && parts[1] == s.p.Org:
+		return "org", func(h http.Header) (int, string) {
+			return jsonBody(h, map[string]any{"login": s.p.Org, "plan": map[string]int{"filled_seats": s.p.Members}})
+		}
+	case len(parts) == 3 && parts[0] == "orgs" && parts[1] == s.p.Org && parts[2] == "members":
+		return "org_members", func(h http.Header) (int, string) { return s.members(req, h) }
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "keys":
+		return "keys_api", func(h http.Header) (int, string) {
+			if !s.exists(parts[1]) {
+				return http.StatusNotFound, `{"message":"Not Found"}`
+			}
+			var keys []map[string]any
+			for i, k := range s.Keys(parts[1]) {
+				keys = append(keys, map[string]any{"id": i + 1, "key": k})
+			}
+			return jsonBody(h, keys)
+		}
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "ssh_signing_keys":
+		return "signing_keys", func(h http.Header) (int, string) { return jsonBody(h, []any{}) }
+	}
+	return "other", nil
+}
+
+// members serves one page of the org members listing, with GitHub's Link header
+func (s *Server) members(req *http.Request, h http.Header) (int, string) {
+	q := req.URL.Query()
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	if perPage <= 0 || perPage > 100 {
+		perPage = 30
+	}
+	page, _ := strconv.Atoi(q.Get("page"))
+	page = max(page, 1)
+
+	var logins []map[string]string
+	for i := (page - 1) * perPage; i < min(page*perPage, s.p.Members); i++ {
+		logins = append(logins, map[string]string{"login": s.Login(i)})
+	}
+	if page*perPage < s.p.Members {
+		next := *req.URL
+		q.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = q.Encode()
+		h.Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	}
+	if logins == nil {
+		logins = []map[string]string{}
+	}
+	return jsonBody(h, logins)
+}
+
+// rateLimit serves the rate limit status, which GitHub doesn't count against the limit
+func (s *Server) rateLimit(h http.Header) (int, string) {
+	s.mu.Lock()
+	limit, remaining, reset := s.quota(time.Now())
+	s.mu.Unlock()
+	core := map[string]int64{"limit": int64(limit), "remaining": int64(remaining), "reset": reset.Unix()}
+	return jsonBody(h, map[string]any{"resources": map[string]any{"core": core}, "rate": core})
+}
+
+// takeAPI counts an API request against the limit and sets the rate limit headers, reporting
+// whether the request is over the limit
+func (s *Server) takeAPI(h http.Header) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limit, remaining, reset := s.quota(time.Now())
+	if s.p.RateLimit > 0 && remaining == 0 {
+		h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+		h.Set("X-RateLimit-Remaining", "0")
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		return true
+	}
+	s.used++
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(max(remaining-1, 0)))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	return false
+}
+
+// quota returns the limit, remaining requests and reset time of the current window, starting a new
+// window if the last one is over; s.mu must be held
+func (s *Server) quota(now time.Time) (int, int, time.Time) {
+	if s.window.IsZero() || now.Sub(s.window) >= s.p.RateWindow {
+		s.window, s.used = now, 0
+	}
+	reset := s.window.Add(s.p.RateWindow)
+	if s.p.RateLimit <= 0 {
+		return math.MaxInt32, math.MaxInt32, reset
+	}
+	return s.p.RateLimit, max(s.p.RateLimit-s.used, 0), reset
+}
+
+// exists reports whether login is a member whose account still exists
+func (s *Server) exists(login string) bool {
+	prefix := fmt.Sprintf("sim-%s-", s.p.Name)
+	n, err := strconv.Atoi(strings.TrimPrefix(login, prefix))
+	if !strings.HasPrefix(login, prefix) || err != nil || n < 0 || n >= s.p.Members {
+		return false
+	}
+	return s.unit("gone", login) >= s.p.NotFoundRate
+}
+
+// latency returns how long the given attempt at a request takes
+func (s *Server) latency(key string, attempt int) time.Duration {
+	if s.p.LatencyMedian <= 0 {
+		return 0
+	}
+	// Box-Muller from two seeded uniforms; 2.326 is the standard normal's 99th percentile
+	u1 := max(s.unit("lat1", key, strconv.Itoa(attempt)), 1e-12)
+	u2 := s.unit("lat2", key, strconv.Itoa(attempt))
+	z := math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2)
+	sigma := 0.0
+	if s.p.LatencyP99 > s.p.LatencyMedian {
+		sigma = math.Log(float64(s.p.LatencyP99)/float64(s.p.LatencyMedian)) / 2.326
+	}
+	return time.Duration(float64(s.p.LatencyMedian) * math.Exp(sigma*z))
+}
+
+// unit returns a number in [0, 1) determined by the seed and parts
+func (s *Server) unit(parts ...string) float64 {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d/%s", s.p.Seed, strings.Join(parts, "/"))))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+func (s *Server) count(name string) {
+	s.mu.Lock()
+	s.stats[name]++
+	s.mu.Unlock()
+}
+
+// jsonBody encodes v as a JSON response body
+func jsonBody(h http.Header, v any) (int, string) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	return http.StatusOK, string(data)
+}
+
+// respond builds a response to req
+func respond(req *http.Request, status int, h http.Header, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader([]byte(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// sleep waits for d, returning early with ctx's error if ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
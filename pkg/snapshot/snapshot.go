@@ -0,0 +1,175 @@
+// Package snapshot produces canonical, hash-verified documents of an organization's members and keys.
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/tstromberg/pubkey-collector/pkg/collect"
+	"github.com/tstromberg/pubkey-collector/pkg/keydb"
+)
+
+// Snapshot is the state of an organization's members and their keys at one point in time.
+type Snapshot struct {
+	Org     string    `json:"org"`
+	TakenAt time.Time `json:"taken_at"`
+	// Enumeration is how complete the member list was, when collected live.
+	Enumeration *collect.Enumeration `json:"enumeration,omitempty"`
+	// Provenance identifies the collector run that produced the data.
+	Provenance keydb.Provenance `json:"provenance"`
+	// SourceRuns are the collector runs that wrote the keys, when the snapshot was taken from a database.
+	SourceRuns []string `json:"source_runs,omitempty"`
+	// Members are sorted by login.
+	Members []Member `json:"members"`
+}
+
+// Member is one organization member and their keys.
+type Member struct {
+	Login string `json:"login"`
+	// Keys are sorted by key.
+	Keys []Key `json:"keys"`
+}
+
+// Key is a public key published by a member.
+type Key struct {
+	Key         string   `json:"key"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Flags       []string `json:"flags,omitempty"`
+}
+
+// File is the serialized form of a snapshot: the canonical JSON of Snapshot and its SHA-256.
+type File struct {
+	Snapshot Snapshot `json:"snapshot"`
+	SHA256   string   `json:"sha256"`
+}
+
+// New builds a snapshot in canonical order. keys maps each login to its keys' flags.
+func New(org string, takenAt time.Time, prov keydb.Provenance, e *collect.Enumeration, keys map[string]map[string][]string) *Snapshot {
+	s := &Snapshot{Org: org, TakenAt: takenAt.UTC(), Enumeration: e, Provenance: prov, Members: []Member{}}
+	for login, userKeys := range keys {
+		m := Member{Login: login, Keys: []Key{}}
+		for key, flags := range userKeys {
+			fp, _ := keydb.Fingerprint(key)
+			m.Keys = append(m.Keys, Key{Key: key, Fingerprint: fp, Flags: flags})
+		}
+		sort.Slice(m.Keys, func(i, j int) bool { return m.Keys[i].Key < m.Keys[j].Key })
+		s.Members = append(s.Members, m)
+	}
+	sort.Slice(s.Members, func(i, j int) bool { return s.Members[i].Login < s.Members[j].Login })
+	return s
+}
+
+// Hash returns the hex SHA-256 of the snapshot's canonical JSON.
+func (s *Snapshot) Hash() (string, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Write serializes the snapshot with its content hash.
+func (s *Snapshot) Write(w io.Writer) error {
+	hash, err := s.Hash()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(File{Snapshot: *s, SHA256: hash})
+}
+
+// Read parses a snapshot file and verifies its content hash.
+func Read(r io.Reader) (*Snapshot, error) {
+	var f File
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+	hash, err := f.Snapshot.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if hash != f.SHA256 {
+		return nil, fmt.Errorf("content hash mismatch: file says %s, content is %s", f.SHA256, hash)
+	}
+	return &f.Snapshot, nil
+}
+
+// Change is a difference between two snapshots.
+type Change struct {
+	// Kind is one of "member-added", "member-removed", "key-added" or "key-removed".
+	Kind  string `json:"kind"`
+	Login string `json:"login"`
+	Key   string `json:"key,omitempty"`
+}
+
+// Diff returns the member and key changes from a to b, ordered by login.
+func Diff(a, b *Snapshot) []Change {
+	before := index(a)
+	after := index(b)
+
+	logins := map[string]bool{}
+	for login := range before {
+		logins[login] = true
+	}
+	for login := range after {
+		logins[login] = true
+	}
+	sorted := make([]string, 0, len(logins))
+	for login := range logins {
+		sorted = append(sorted, login)
+	}
+	sort.Strings(sorted)
+
+	var changes []Change
+	for _, login := range sorted {
+		oldKeys, wasMember := before[login]
+		newKeys, isMember := after[login]
+		switch {
+		case !wasMember:
+			changes = append(changes, Change{Kind: "member-added", Login: login})
+		case !isMember:
+			changes = append(changes, Change{Kind: "member-removed", Login: login})
+		}
+		for _, k := range sortedKeys(newKeys) {
+			if !oldKeys[k] {
+				changes = append(changes, Change{Kind: "key-added", Login: login, Key: k})
+			}
+		}
+		for _, k := range sortedKeys(oldKeys) {
+			if !newKeys[k] {
+				changes = append(changes, Change{Kind: "key-removed", Login: login, Key: k})
+			}
+		}
+	}
+	return changes
+}
+
+// index maps each member login in s to the set of their keys.
+func index(s *Snapshot) map[string]map[string]bool {
+	idx := map[string]map[string]bool{}
+	for _, m := range s.Members {
+		keys := map[string]bool{}
+		for _, k := range m.Keys {
+			keys[k.Key] = true
+		}
+		idx[m.Login] = keys
+	}
+	return idx
+}
+
+// sortedKeys returns the members of a key set in sorted order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,67 @@
+// Package stats provides named counters that are safe to update from many goroutines, such as the
+// fetch workers, and to snapshot for run summaries while they are being updated.
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Counters is a set of named counters. The zero value is ready to use.
+type Counters struct {
+	mu sync.RWMutex
+	m  map[string]*atomic.Int64
+}
+
+// Add adds n to the named counter, creating it if needed.
+func (c *Counters) Add(name string, n int64) {
+	c.counter(name).Add(n)
+}
+
+// Inc adds one to the named counter.
+func (c *Counters) Inc(name string) {
+	c.Add(name, 1)
+}
+
+// Get returns the current value of the named counter, or 0 if it has never been added to.
+func (c *Counters) Get(name string) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if v := c.m[name]; v != nil {
+		return v.Load()
+	}
+	return 0
+}
+
+// Snapshot returns a copy of every counter. Each value is read atomically; counters updated while
+// the snapshot is taken may or may not include those updates.
+func (c *Counters) Snapshot() map[string]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make(map[string]int, len(c.m))
+	for name, v := range c.m {
+		out[name] = int(v.Load())
+	}
+	return out
+}
+
+// counter returns the named counter, creating it on first use.
+func (c *Counters) counter(name string) *atomic.Int64 {
+	c.mu.RLock()
+	v := c.m[name]
+	c.mu.RUnlock()
+	if v != nil {
+		return v
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = map[string]*atomic.Int64{}
+	}
+	if v = c.m[name]; v == nil {
+		v = &atomic.Int64{}
+		c.m[name] = v
+	}
+	return v
+}
@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCountersConcurrent(t *testing.T) {
+	tests := []struct {
+		goroutines int
+		names      int
+		adds       int
+	}{
+		{goroutines: 1, names: 1, adds: 1000},
+		{goroutines: 64, names: 1, adds: 1000},
+		{goroutines: 64, names: 16, adds: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d goroutines, %d names", tt.goroutines, tt.names), func(t *testing.T) {
+			var c Counters
+			var wg sync.WaitGroup
+			stop := make(chan struct{})
+			snapshots := make(chan struct{})
+			// Snapshots taken while counting must never go backwards
+			go func() {
+				defer close(snapshots)
+				last := map[string]int{}
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					for name, v := range c.Snapshot() {
+						if v < last[name] {
+							t.Errorf("%s went from %d to %d", name, last[name], v)
+						}
+						last[name] = v
+					}
+				}
+			}()
+			for g := 0; g < tt.goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < tt.adds; i++ {
+						name := fmt.Sprintf("counter_%d", (g+i)%tt.names)
+						if i%2 == 0 {
+							c.Inc(name)
+						} else {
+							c.Add(name, 2)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(stop)
+			<-snapshots
+
+			total := 0
+			snap := c.Snapshot()
+			for name, v := range snap {
+				if got := c.Get(name); int(got) != v {
+					t.Errorf("Get(%s) = %d, snapshot has %d", name, got, v)
+				}
+				total += v
+			}
+			if len(snap) != tt.names {
+				t.Errorf("snapshot has %d counters, want %d", len(snap), tt.names)
+			}
+			if want := tt.goroutines * tt.adds * 3 / 2; total != want {
+				t.Errorf("counters total %d, want %d", total, want)
+			}
+		})
+	}
+}
+
+func TestCountersZero(t *testing.T) {
+	var c Counters
+	if got := c.Get("missing"); got != 0 {
+		t.Errorf("Get on an empty set = %d, want 0", got)
+	}
+	if snap := c.Snapshot(); len(snap) != 0 {
+		t.Errorf("Snapshot of an empty set = %v, want none", snap)
+	}
+	c.Add("keys", 0)
+	if snap := c.Snapshot(); len(snap) != 1 || snap["keys"] != 0 {
+		t.Errorf("Snapshot after adding 0 = %v, want keys: 0", snap)
+	}
+}
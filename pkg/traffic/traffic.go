@@ -0,0 +1,235 @@
+// Package traffic records every outbound HTTP request a process makes and holds them under a hard
+// ceiling per hour, whatever pacing each source asks for, so that the collector's load on GitHub is
+// bounded and can be shown. Wrap every client's transport with the same Recorder.
+package traffic
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CeilingFlag is the pubkey-collector flag setting the ceiling, as recorded in run configurations.
+	CeilingFlag = "max-requests-per-hour"
+	// DefaultCeiling is the ceiling unless configured: two requests a second on average.
+	DefaultCeiling = 7200
+	// ceilingWindow is the period the ceiling applies to.
+	ceilingWindow = time.Hour
+)
+
+// Request is one outbound HTTP request
+type Request struct {
+	// Time is when the request was sent.
+	Time time.Time `json:"time"`
+	Host string    `json:"host"`
+	// Class is the endpoint with user, org and repository names replaced; see Class.
+	Class string `json:"class"`
+	// Status is the HTTP status, or 0 if no response was received.
+	Status int `json:"status"`
+}
+
+// Recorder keeps the most recent requests in a ring buffer and enforces the ceiling. It is safe
+// for concurrent use.
+type Recorder struct {
+	mu sync.Mutex
+	// ring holds up to its capacity of requests; next is where the next one goes
+	ring []Request
+	next int
+	full bool
+	// unsaved counts the newest requests not yet returned by Unsaved; dropped counts those
+	// overwritten before they were
+	unsaved int
+	dropped int
+	// grants holds the send times of the last ceiling requests, oldest at grant, so no more than
+	// ceiling are let through in any window (ceilingWindow but in tests)
+	ceiling int
+	window  time.Duration
+	grants  []time.Time
+	grant   int
+	held    bool
+}
+
+// NewRecorder returns a Recorder remembering the last capacity requests and letting at most
+// perHour requests through in any hour; perHour 0 means no ceiling.
+func NewRecorder(capacity, perHour int) *Recorder {
+	return &Recorder{ring: make([]Request, 0, max(capacity, 1)), ceiling: perHour, window: ceilingWindow}
+}
+
+// Ceiling returns the most requests let through in any hour, or 0 for no ceiling.
+func (r *Recorder) Ceiling() int {
+	return r.ceiling
+}
+
+// Transport returns an http.RoundTripper that waits for the ceiling to allow each request and
+// records it. base defaults to http.DefaultTransport.
+func (r *Recorder) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{recorder: r, base: base}
+}
+
+// transport is the RoundTripper returned by Recorder.Transport
+type transport struct {
+	recorder *Recorder
+	base     http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sent, err := t.recorder.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+	t.recorder.add(Request{Time: sent, Host: req.URL.Host, Class: Class(req.URL), Status: status})
+	return resp, err
+}
+
+// acquire waits until the ceiling lets one more request through, or ctx is done, returning when
+// the request was let through
+func (r *Recorder) acquire(ctx context.Context) (time.Time, error) {
+	if r.ceiling <= 0 {
+		return time.Now(), nil
+	}
+	for {
+		r.mu.Lock()
+		now := time.Now()
+		if len(r.grants) < r.ceiling {
+			r.grants = append(r.grants, now)
+			r.held = false
+			r.mu.Unlock()
+			return now, nil
+		}
+		wait := r.grants[r.grant].Add(r.window).Sub(now)
+		if wait <= 0 {
+			r.grants[r.grant] = now
+			r.grant = (r.grant + 1) % r.ceiling
+			r.held = false
+			r.mu.Unlock()
+			return now, nil
+		}
+		if !r.held {
+			log.Printf("Request ceiling of %d per hour reached; holding requests for %s", r.ceiling, wait.Round(time.Second))
+			r.held = true
+		}
+		r.mu.Unlock()
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return time.Time{}, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// add records a request, overwriting the oldest once the ring is full
+func (r *Recorder) add(req Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		r.ring = append(r.ring, req)
+		r.full = len(r.ring) == cap(r.ring)
+	} else {
+		r.ring[r.next] = req
+	}
+	r.next = (r.next + 1) % cap(r.ring)
+	if r.unsaved == cap(r.ring) {
+		r.dropped++
+	} else {
+		r.unsaved++
+	}
+}
+
+// Requests returns the requests in the ring buffer, oldest first.
+func (r *Recorder) Requests() []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastLocked(len(r.ring))
+}
+
+// Unsaved returns the requests recorded since the last call, oldest first, for persisting them,
+// and how many more were overwritten before they could be returned.
+func (r *Recorder) Unsaved() ([]Request, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reqs, dropped := r.lastLocked(r.unsaved), r.dropped
+	r.unsaved, r.dropped = 0, 0
+	return reqs, dropped
+}
+
+// lastLocked returns the newest n requests, oldest first; r.mu must be held
+func (r *Recorder) lastLocked(n int) []Request {
+	out := make([]Request, 0, n)
+	start := r.next - n
+	if start < 0 {
+		start += len(r.ring)
+	}
+	for i := 0; i < n; i++ {
+		out = append(out, r.ring[(start+i)%len(r.ring)])
+	}
+	return out
+}
+
+// Class names the endpoint of a request URL with user, org and repository names and numeric IDs
+// replaced, so requests can be counted by what they ask for without recording who they ask about:
+// "users/:user/keys" for https://api.github.com/users/alice/keys and ":user.keys" for
+// https://github.com/alice.keys. The paths of hosts other than GitHub's are not recorded.
+func Class(u *url.URL) string {
+	path := strings.Trim(u.Path, "/")
+	if u.Host == "github.com" && strings.HasSuffix(path, ".keys") && !strings.Contains(path, "/") {
+		return ":user.keys"
+	}
+	if u.Host != "api.github.com" {
+		return ":path"
+	}
+
+	parts := strings.Split(path, "/")
+	for i := 0; i < len(parts); i++ {
+		if names, ok := namedBy[parts[i]]; ok {
+			for _, name := range names {
+				if i+1 < len(parts) {
+					i++
+					parts[i] = name
+				}
+			}
+			continue
+		}
+		if isNumeric(parts[i]) {
+			parts[i] = ":id"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// namedBy maps API path segments to the placeholders for the names that follow them
+var namedBy = map[string][]string{
+	"users": {":user"},
+	"orgs":  {":org"},
+	"teams": {":team"},
+	"repos": {":owner", ":repo"},
+}
+
+// isNumeric reports whether s is all digits
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,231 @@
+package traffic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// statusTransport answers every request with status, without sending it
+type statusTransport int
+
+func (s statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: int(s), Body: http.NoBody, Request: req}, nil
+}
+
+// get sends a GET for rawURL through rt
+func get(ctx context.Context, rt http.RoundTripper, rawURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestClass(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://github.com/alice.keys", want: ":user.keys"},
+		{url: "https://github.com/alice/repo.keys", want: ":path"},
+		{url: "https://github.com/alice", want: ":path"},
+		{url: "https://api.github.com/users/alice/keys", want: "users/:user/keys"},
+		{url: "https://api.github.com/users/alice/ssh_signing_keys?per_page=100", want: "users/:user/ssh_signing_keys"},
+		{url: "https://api.github.com/orgs/acme/members", want: "orgs/:org/members"},
+		{url: "https://api.github.com/orgs/acme/teams/infra/members", want: "orgs/:org/teams/:team/members"},
+		{url: "https://api.github.com/repos/acme/widget/commits", want: "repos/:owner/:repo/commits"},
+		{url: "https://api.github.com/user/keys/12345", want: "user/keys/:id"},
+		{url: "https://api.github.com/events", want: "events"},
+		{url: "https://api.github.com/rate_limit", want: "rate_limit"},
+		{url: "https://api.github.com/users", want: "users"},
+		{url: "https://lists.example.com/blocked/alice.txt", want: ":path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Class(u); got != tt.want {
+				t.Errorf("Class(%s) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+// host returns the host request n of a test is sent to, so it can be told apart once recorded
+func host(n int) string {
+	return fmt.Sprintf("h%d.example.com", n)
+}
+
+// hosts returns host(n) for each n from first up to but not including end
+func hosts(first, end int) []string {
+	var out []string
+	for n := first; n < end; n++ {
+		out = append(out, host(n))
+	}
+	return out
+}
+
+func TestRecorderRing(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		// batches are how many requests are made before each call to Unsaved
+		batches     []int
+		wantUnsaved []int
+		wantDropped []int
+		// wantKept is the first and end request numbers still in the ring at the end
+		wantKept [2]int
+	}{
+		{name: "under capacity", capacity: 4, batches: []int{3}, wantUnsaved: []int{3}, wantDropped: []int{0}, wantKept: [2]int{0, 3}},
+		{name: "exactly full", capacity: 3, batches: []int{3}, wantUnsaved: []int{3}, wantDropped: []int{0}, wantKept: [2]int{0, 3}},
+		{name: "wrapped before a save", capacity: 3, batches: []int{5}, wantUnsaved: []int{3}, wantDropped: []int{2}, wantKept: [2]int{2, 5}},
+		{name: "saved, then wrapped", capacity: 3, batches: []int{2, 2, 7}, wantUnsaved: []int{2, 2, 3}, wantDropped: []int{0, 0, 4},
+			wantKept: [2]int{8, 11}},
+		{name: "nothing new", capacity: 3, batches: []int{2, 0}, wantUnsaved: []int{2, 0}, wantDropped: []int{0, 0}, wantKept: [2]int{0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRecorder(tt.capacity, 0)
+			rt := r.Transport(statusTransport(http.StatusOK))
+			n := 0
+			for i, batch := range tt.batches {
+				for range batch {
+					if err := get(context.Background(), rt, "https://"+host(n)+"/"); err != nil {
+						t.Fatal(err)
+					}
+					n++
+				}
+				reqs, dropped := r.Unsaved()
+				var got []string
+				for _, req := range reqs {
+					got = append(got, req.Host)
+				}
+				// The newest requests are returned, oldest first
+				if want := hosts(n-tt.wantUnsaved[i], n); !slices.Equal(got, want) || dropped != tt.wantDropped[i] {
+					t.Errorf("save %d: Unsaved() = %q, %d dropped; want %q, %d", i, got, dropped, want, tt.wantDropped[i])
+				}
+			}
+			var kept []string
+			for _, req := range r.Requests() {
+				kept = append(kept, req.Host)
+			}
+			if want := hosts(tt.wantKept[0], tt.wantKept[1]); !slices.Equal(kept, want) {
+				t.Errorf("Requests() = %q, want %q", kept, want)
+			}
+		})
+	}
+}
+
+func TestRecorderStatus(t *testing.T) {
+	r := NewRecorder(10, 0)
+	if err := get(context.Background(), r.Transport(statusTransport(http.StatusTooManyRequests)), "https://api.github.com/events"); err != nil {
+		t.Fatal(err)
+	}
+	failing := r.Transport(roundTripFunc(func(*http.Request) (*http.Response, error) { return nil, errors.New("connection refused") }))
+	if err := get(context.Background(), failing, "https://github.com/alice.keys"); err == nil {
+		t.Fatal("request through a failing transport succeeded")
+	}
+	want := []Request{{Host: "api.github.com", Class: "events", Status: http.StatusTooManyRequests}, {Host: "github.com", Class: ":user.keys"}}
+	got := r.Requests()
+	for i := range got {
+		got[i].Time = time.Time{}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Requests() = %+v, want %+v", got, want)
+	}
+}
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestCeiling(t *testing.T) {
+	const window = 200 * time.Millisecond
+	tests := []struct {
+		name             string
+		ceiling, callers int
+		perCaller        int
+	}{
+		{name: "one caller", ceiling: 4, callers: 1, perCaller: 10},
+		{name: "concurrent callers", ceiling: 5, callers: 8, perCaller: 3},
+		{name: "no ceiling", callers: 8, perCaller: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total := tt.callers * tt.perCaller
+			r := NewRecorder(total, tt.ceiling)
+			r.window = window
+			rt := r.Transport(statusTransport(http.StatusOK))
+
+			start := time.Now()
+			var wg sync.WaitGroup
+			for c := range tt.callers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range tt.perCaller {
+						if err := get(context.Background(), rt, fmt.Sprintf("https://example.com/%d/%d", c, i)); err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			elapsed := time.Since(start)
+
+			var sent []time.Time
+			for _, req := range r.Requests() {
+				sent = append(sent, req.Time)
+			}
+			if len(sent) != total {
+				t.Fatalf("recorded %d requests, want %d", len(sent), total)
+			}
+			if tt.ceiling == 0 {
+				if elapsed > window {
+					t.Errorf("%d requests without a ceiling took %s", total, elapsed)
+				}
+				return
+			}
+			// However the callers interleave, no window holds more than the ceiling
+			slices.SortFunc(sent, func(a, b time.Time) int { return a.Compare(b) })
+			for i := 0; i+tt.ceiling < len(sent); i++ {
+				if d := sent[i+tt.ceiling].Sub(sent[i]); d < window {
+					t.Fatalf("requests %d to %d were sent within %s, inside the %s window", i, i+tt.ceiling, d, window)
+				}
+			}
+			if want := time.Duration((total-1)/tt.ceiling) * window; elapsed < want {
+				t.Errorf("%d requests under a ceiling of %d took %s, want at least %s", total, tt.ceiling, elapsed, want)
+			}
+		})
+	}
+}
+
+func TestCeilingCancel(t *testing.T) {
+	r := NewRecorder(10, 1)
+	rt := r.Transport(statusTransport(http.StatusOK))
+	if err := get(context.Background(), rt, "https://example.com/first"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := get(ctx, rt, "https://example.com/held"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("request beyond the ceiling = %v, want it held until the context expired", err)
+	}
+	if n := len(r.Requests()); n != 1 {
+		t.Errorf("recorded %d requests, want only the one let through", n)
+	}
+}